@@ -0,0 +1,286 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// capturedPacket is a packet read from a capture file
+type capturedPacket struct {
+	Time     int64  // Time of capture, in nanoseconds since the epoch
+	LinkType uint32 // Link-layer header type of Data
+	Data     []byte
+	Flags    uint32 // Flags of pcapng packets, zero if unknown
+	Comment  string // Comment of pcapng packets
+}
+
+// Direction bits of the pcapng packet flags
+const (
+	captureInbound  = 1
+	captureOutbound = 2
+)
+
+// captureReader reads packets from pcap and pcapng files
+type captureReader struct {
+	r     *bufio.Reader
+	ng    bool
+	order binary.ByteOrder
+
+	// pcap
+	linkType uint32
+	nano     bool
+
+	// pcapng
+	ifaces   []captureInterface
+	userAppl string // The application that wrote the current section
+}
+
+// captureInterface describes an interface of a pcapng section
+type captureInterface struct {
+	linkType uint32
+	tsresol  byte
+}
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapHeaderLen  = 24
+	pcapRecordLen  = 16
+	pcapMaxPacket  = 1 << 18
+	pcapngMaxBlock = 1 << 24
+
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngSimplePacket   = 0x00000003
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptFlags    = 2
+	pcapngOptUserAppl = 4
+	pcapngOptTSResol  = 9
+)
+
+var (
+	errCaptureFormat = errors.New("not a pcap or pcapng file")
+	errCaptureBlock  = errors.New("malformed pcapng block")
+	errCaptureRecord = errors.New("malformed pcap record")
+)
+
+// newCaptureReader creates a reader for the pcap or pcapng file r
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	c := &captureReader{r: bufio.NewReader(r)}
+	magic, err := c.r.Peek(4)
+	if err != nil {
+		return nil, errCaptureFormat
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		c.ng = true
+		return c, nil
+	}
+	var h [pcapHeaderLen]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return nil, errCaptureFormat
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(h[0:4]) {
+		case pcapMagic:
+			c.order = order
+		case pcapMagicNano:
+			c.order, c.nano = order, true
+		}
+		if c.order != nil {
+			// The upper bits of the link type carry FCS information
+			c.linkType = c.order.Uint32(h[20:24]) & 0x0fffffff
+			return c, nil
+		}
+	}
+	return nil, errCaptureFormat
+}
+
+// UserAppl returns the application that wrote the current pcapng section, if known
+func (c *captureReader) UserAppl() string {
+	return c.userAppl
+}
+
+// Next returns the next packet, or io.EOF at the end of the file
+func (c *captureReader) Next() (*capturedPacket, error) {
+	if c.ng {
+		return c.nextBlock()
+	}
+	var h [pcapRecordLen]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errCaptureRecord
+		}
+		return nil, err
+	}
+	sec, frac := int64(c.order.Uint32(h[0:4])), int64(c.order.Uint32(h[4:8]))
+	n := c.order.Uint32(h[8:12])
+	if n > pcapMaxPacket {
+		return nil, errCaptureRecord
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return nil, errCaptureRecord
+	}
+	if !c.nano {
+		frac *= 1e3
+	}
+	return &capturedPacket{Time: sec*1e9 + frac, LinkType: c.linkType, Data: p}, nil
+}
+
+// nextBlock reads pcapng blocks up to and including the next packet block
+func (c *captureReader) nextBlock() (*capturedPacket, error) {
+	for {
+		typ, body, err := c.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case pcapngSectionHeader:
+			if len(body) < 16 {
+				return nil, errCaptureBlock
+			}
+			c.ifaces, c.userAppl = nil, ""
+			c.walkOptions(body[16:], func(code uint16, v []byte) {
+				if code == pcapngOptUserAppl {
+					c.userAppl = string(v)
+				}
+			})
+		case pcapngInterface:
+			if len(body) < 8 {
+				return nil, errCaptureBlock
+			}
+			iface := captureInterface{linkType: uint32(c.order.Uint16(body[0:2])), tsresol: 6}
+			c.walkOptions(body[8:], func(code uint16, v []byte) {
+				if code == pcapngOptTSResol && len(v) == 1 {
+					iface.tsresol = v[0]
+				}
+			})
+			c.ifaces = append(c.ifaces, iface)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, errCaptureBlock
+			}
+			id, n := c.order.Uint32(body[0:4]), int(c.order.Uint32(body[12:16]))
+			if int(id) >= len(c.ifaces) || n > len(body)-20 {
+				return nil, errCaptureBlock
+			}
+			ts := uint64(c.order.Uint32(body[4:8]))<<32 | uint64(c.order.Uint32(body[8:12]))
+			pkt := &capturedPacket{
+				Time:     captureTime(ts, c.ifaces[id].tsresol),
+				LinkType: c.ifaces[id].linkType,
+				Data:     body[20 : 20+n],
+			}
+			if k := 20 + (n+3)/4*4; k <= len(body) {
+				c.walkOptions(body[k:], func(code uint16, v []byte) {
+					switch {
+					case code == pcapngOptComment:
+						pkt.Comment = string(v)
+					case code == pcapngOptFlags && len(v) == 4:
+						pkt.Flags = c.order.Uint32(v)
+					}
+				})
+			}
+			return pkt, nil
+		case pcapngSimplePacket:
+			if len(body) < 4 || len(c.ifaces) == 0 {
+				return nil, errCaptureBlock
+			}
+			n := int(c.order.Uint32(body[0:4]))
+			if n > len(body)-4 {
+				n = len(body) - 4
+			}
+			return &capturedPacket{LinkType: c.ifaces[0].linkType, Data: body[4 : 4+n]}, nil
+		}
+	}
+}
+
+// readBlock reads a pcapng block and returns its type and body, without the trailing length.
+// The byte order is set by every section header block.
+func (c *captureReader) readBlock() (typ uint32, body []byte, err error) {
+	var h [8]byte
+	if _, err = io.ReadFull(c.r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errCaptureBlock
+		}
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(h[0:4]) == pcapngSectionHeader {
+		magic, err := c.r.Peek(4)
+		if err != nil {
+			return 0, nil, errCaptureBlock
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+			c.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+			c.order = binary.BigEndian
+		default:
+			return 0, nil, errCaptureBlock
+		}
+	}
+	if c.order == nil {
+		return 0, nil, errCaptureBlock
+	}
+	typ, n := c.order.Uint32(h[0:4]), c.order.Uint32(h[4:8])
+	if n < 12 || n%4 != 0 || n > pcapngMaxBlock {
+		return 0, nil, errCaptureBlock
+	}
+	body = make([]byte, n-8)
+	if _, err = io.ReadFull(c.r, body); err != nil {
+		return 0, nil, errCaptureBlock
+	}
+	if c.order.Uint32(body[len(body)-4:]) != n {
+		return 0, nil, errCaptureBlock
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// walkOptions calls f for each pcapng option in p
+func (c *captureReader) walkOptions(p []byte, f func(code uint16, v []byte)) {
+	for len(p) >= 4 {
+		code, n := c.order.Uint16(p[0:2]), int(c.order.Uint16(p[2:4]))
+		if code == pcapngOptEnd || 4+n > len(p) {
+			return
+		}
+		f(code, p[4:4+n])
+		k := 4 + (n+3)/4*4
+		if k > len(p) {
+			return
+		}
+		p = p[k:]
+	}
+}
+
+// captureTime converts the pcapng timestamp ts of resolution tsresol to nanoseconds
+func captureTime(ts uint64, tsresol byte) int64 {
+	if tsresol&0x80 != 0 {
+		// Resolution of 2^-k seconds
+		k := uint(tsresol & 0x7f)
+		if k > 63 {
+			return 0
+		}
+		sec, frac := ts>>k, ts&(1<<k-1)
+		for ; k > 32; k-- {
+			frac >>= 1
+		}
+		return int64(sec*1e9 + frac*1e9>>k)
+	}
+	// Resolution of 10^-tsresol seconds
+	for ; tsresol < 9; tsresol++ {
+		ts *= 10
+	}
+	for ; tsresol > 9; tsresol-- {
+		ts /= 10
+	}
+	return int64(ts)
+}
@@ -0,0 +1,335 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"github.com/petar/GoDCCP/dccp"
+	"github.com/petar/GoDCCP/dccp/ccid3"
+)
+
+// Packet is the decoding of a captured UDP datagram that carries a DCCP packet
+type Packet struct {
+	Index      int    // Position of the packet in the capture, starting from 1
+	Time       int64  // Time of capture, in nanoseconds since the epoch
+	Source     string // Source IP address and UDP port
+	Dest       string // Destination IP address and UDP port
+	Direction  string `json:",omitempty"` // "in" or "out", if recorded in the capture
+	Comment    string `json:",omitempty"`
+	SourceFlow string `json:",omitempty"` // Source label of the Mux flow, if framed
+	SinkFlow   string `json:",omitempty"` // Sink label of the Mux flow, if framed
+
+	Summary string       `json:",omitempty"` // One-line description of the header
+	Header  *dccp.Header `json:",omitempty"` // The header, whose options are listed in Options
+	Options []*Option    `json:",omitempty"`
+	Error   string       `json:",omitempty"` // Checksum or parse error
+}
+
+// Option is a decoded DCCP option
+type Option struct {
+	Type      byte
+	Name      string
+	Mandatory bool        `json:",omitempty"`
+	Value     interface{} `json:",omitempty"` // The decoded option, or nil if unknown or malformed
+	Data      []byte      `json:",omitempty"` // The raw option data, if Value is nil
+}
+
+// Link-layer header types, see http://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeSLL      = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	protoUDP       = 17
+	udpHeaderLen   = 8
+	muxFramingLen  = 2 * dccp.LabelLen
+)
+
+var (
+	errNotUDP     = errors.New("not a UDP packet")
+	errLinkType   = errors.New("unsupported link type")
+	errTruncated  = errors.New("truncated packet")
+	errFragment   = errors.New("IP fragment")
+	errMuxControl = errors.New("mux control packet")
+)
+
+// decodePacket decodes the captured packet pkt. If framed is set, the UDP payload is expected
+// to start with the Mux framing. port, if not zero, is the UDP port of the DCCP traffic. It
+// returns errNotUDP if pkt is not a UDP packet of the DCCP traffic. Errors in the DCCP packet
+// itself are recorded in the Error field of the returned Packet.
+func decodePacket(pkt *capturedPacket, framed bool, port int) (*Packet, error) {
+	ip, err := stripLink(pkt.LinkType, pkt.Data)
+	if err != nil {
+		return nil, err
+	}
+	srcIP, dstIP, payload, err := stripIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < udpHeaderLen {
+		return nil, errTruncated
+	}
+	srcPort, dstPort := int(binary.BigEndian.Uint16(payload[0:2])), int(binary.BigEndian.Uint16(payload[2:4]))
+	if port != 0 && srcPort != port && dstPort != port {
+		return nil, errNotUDP
+	}
+	n := int(binary.BigEndian.Uint16(payload[4:6]))
+	if n < udpHeaderLen || n > len(payload) {
+		return nil, errTruncated
+	}
+	p := &Packet{
+		Time:    pkt.Time,
+		Source:  (&net.UDPAddr{IP: srcIP, Port: srcPort}).String(),
+		Dest:    (&net.UDPAddr{IP: dstIP, Port: dstPort}).String(),
+		Comment: pkt.Comment,
+	}
+	switch pkt.Flags & 3 {
+	case captureInbound:
+		p.Direction = "in"
+	case captureOutbound:
+		p.Direction = "out"
+	}
+	cargo := payload[udpHeaderLen:n]
+	if framed {
+		cargo, err = p.stripMux(cargo)
+		if err == errMuxControl {
+			p.Summary = "Mux control packet"
+			return p, nil
+		}
+		if err != nil {
+			p.Error = err.Error()
+			return p, nil
+		}
+	}
+	p.decodeDCCP(cargo)
+	return p, nil
+}
+
+// stripLink returns the IP packet inside the link-layer frame p
+func stripLink(linkType uint32, p []byte) ([]byte, error) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return p, nil
+	case linkTypeNull, linkTypeLoop:
+		if len(p) < 4 {
+			return nil, errTruncated
+		}
+		return p[4:], nil
+	case linkTypeEthernet:
+		if len(p) < 14 {
+			return nil, errTruncated
+		}
+		k := 12
+		for {
+			switch binary.BigEndian.Uint16(p[k : k+2]) {
+			case etherTypeVLAN, etherTypeQinQ:
+				k += 4
+				if len(p) < k+2 {
+					return nil, errTruncated
+				}
+				continue
+			case etherTypeIPv4, etherTypeIPv6:
+				return p[k+2:], nil
+			}
+			return nil, errNotUDP
+		}
+	case linkTypeSLL:
+		if len(p) < 16 {
+			return nil, errTruncated
+		}
+		return ipEtherType(binary.BigEndian.Uint16(p[14:16]), p[16:])
+	case linkTypeSLL2:
+		if len(p) < 20 {
+			return nil, errTruncated
+		}
+		return ipEtherType(binary.BigEndian.Uint16(p[0:2]), p[20:])
+	}
+	return nil, errLinkType
+}
+
+func ipEtherType(etherType uint16, p []byte) ([]byte, error) {
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil, errNotUDP
+	}
+	return p, nil
+}
+
+// stripIP returns the addresses and the UDP datagram of the IP packet p
+func stripIP(p []byte) (srcIP, dstIP net.IP, payload []byte, err error) {
+	if len(p) < 1 {
+		return nil, nil, nil, errTruncated
+	}
+	switch p[0] >> 4 {
+	case 4:
+		if len(p) < 20 {
+			return nil, nil, nil, errTruncated
+		}
+		hl, n := int(p[0]&0x0f)*4, int(binary.BigEndian.Uint16(p[2:4]))
+		if hl < 20 || n < hl || n > len(p) {
+			return nil, nil, nil, errTruncated
+		}
+		if p[9] != protoUDP {
+			return nil, nil, nil, errNotUDP
+		}
+		// More Fragments flag or non-zero Fragment Offset
+		if binary.BigEndian.Uint16(p[6:8])&0x3fff != 0 {
+			return nil, nil, nil, errFragment
+		}
+		return net.IP(p[12:16]), net.IP(p[16:20]), p[hl:n], nil
+	case 6:
+		if len(p) < 40 {
+			return nil, nil, nil, errTruncated
+		}
+		n := 40 + int(binary.BigEndian.Uint16(p[4:6]))
+		if n > len(p) {
+			return nil, nil, nil, errTruncated
+		}
+		next, k := p[6], 40
+		for next != protoUDP {
+			switch next {
+			case 0, 43, 60: // Hop-by-Hop, Routing and Destination Options headers
+				if n < k+8 {
+					return nil, nil, nil, errTruncated
+				}
+				next, k = p[k], k+(int(p[k+1])+1)*8
+			case 44:
+				return nil, nil, nil, errFragment
+			default:
+				return nil, nil, nil, errNotUDP
+			}
+			if k > n {
+				return nil, nil, nil, errTruncated
+			}
+		}
+		return net.IP(p[8:24]), net.IP(p[24:40]), p[k:n], nil
+	}
+	return nil, nil, nil, errNotUDP
+}
+
+// stripMux records the flow labels of the Mux framing of cargo, and returns the DCCP packet
+// that it carries
+func (p *Packet) stripMux(cargo []byte) ([]byte, error) {
+	if len(cargo) < muxFramingLen {
+		return nil, errTruncated
+	}
+	source, _, _ := dccp.ReadLabel(cargo)
+	sink, _, _ := dccp.ReadLabel(cargo[dccp.LabelLen:])
+	p.SourceFlow, p.SinkFlow = source.String(), sink.String()
+	if source == nil {
+		return nil, errMuxControl
+	}
+	return cargo[muxFramingLen:], nil
+}
+
+// decodeDCCP reads the DCCP packet q, whose checksum is computed over zero labels, as the Mux
+// does, and records its header and options or the error
+func (p *Packet) decodeDCCP(q []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.Header, p.Summary, p.Options = nil, "", nil
+			p.Error = fmt.Sprintf("parse panic (%v)", r)
+		}
+	}()
+	h, err := dccp.ReadHeader(q, dccp.LabelZero.Bytes(), dccp.LabelZero.Bytes(), dccp.AnyProto, false)
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	p.Header, p.Summary = h, h.String()
+	for _, opt := range h.Options {
+		p.Options = append(p.Options, decodeOption(opt))
+	}
+	h.Options = nil
+}
+
+var optionNames = map[byte]string{
+	dccp.OptionPadding:         "Padding",
+	dccp.OptionMandatory:       "Mandatory",
+	dccp.OptionSlowReceiver:    "SlowReceiver",
+	dccp.OptionChangeL:         "ChangeL",
+	dccp.OptionConfirmL:        "ConfirmL",
+	dccp.OptionChangeR:         "ChangeR",
+	dccp.OptionConfirmR:        "ConfirmR",
+	dccp.OptionInitCookie:      "InitCookie",
+	dccp.OptionNDPCount:        "NDPCount",
+	dccp.OptionAckVectorNonce0: "AckVectorNonce0",
+	dccp.OptionAckVectorNonce1: "AckVectorNonce1",
+	dccp.OptionDataDropped:     "DataDropped",
+	dccp.OptionTimestamp:       "Timestamp",
+	dccp.OptionTimestampEcho:   "TimestampEcho",
+	dccp.OptionElapsedTime:     "ElapsedTime",
+	dccp.OptionDataChecksum:    "DataChecksum",
+
+	ccid3.OptionLossEventRate:   "LossEventRate",
+	ccid3.OptionLossIntervals:   "LossIntervals",
+	ccid3.OptionReceiveRate:     "ReceiveRate",
+	ccid3.OptionLossDigest:      "LossDigest",
+	ccid3.OptionRoundtripReport: "RoundtripReport",
+}
+
+// decodeOption decodes the generic DCCP options and the options of CCID3
+func decodeOption(opt *dccp.Option) *Option {
+	r := &Option{Type: opt.Type, Name: optionNames[opt.Type], Mandatory: opt.Mandatory}
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("Option%d", opt.Type)
+	}
+	// The decoders return typed nil pointers on malformed options
+	switch opt.Type {
+	case dccp.OptionAckVectorNonce0, dccp.OptionAckVectorNonce1:
+		if v := dccp.DecodeAckVectorOption(opt); v != nil {
+			r.Value = v
+		}
+	case dccp.OptionTimestamp:
+		if v := dccp.DecodeTimestampOption(opt); v != nil {
+			r.Value = v
+		}
+	case dccp.OptionTimestampEcho:
+		if v := dccp.DecodeTimestampEchoOption(opt); v != nil {
+			r.Value = v
+		}
+	case dccp.OptionElapsedTime:
+		if v := dccp.DecodeElapsedTimeOption(opt); v != nil {
+			r.Value = v
+		}
+	case ccid3.OptionLossEventRate:
+		if v := ccid3.DecodeLossEventRateOption(opt); v != nil {
+			r.Value = v
+		}
+	case ccid3.OptionLossIntervals:
+		if v := ccid3.DecodeLossIntervalsOption(opt); v != nil {
+			r.Value = v
+		}
+	case ccid3.OptionReceiveRate:
+		if v := ccid3.DecodeReceiveRateOption(opt); v != nil {
+			r.Value = v
+		}
+	case ccid3.OptionLossDigest:
+		if v := ccid3.DecodeLossDigestOption(opt); v != nil {
+			r.Value = v
+		}
+	case ccid3.OptionRoundtripReport:
+		if v := ccid3.DecodeRoundtripReportOption(opt); v != nil {
+			r.Value = v
+		}
+	}
+	if r.Value == nil {
+		r.Data = opt.Data
+	}
+	return r
+}
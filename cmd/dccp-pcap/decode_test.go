@@ -0,0 +1,212 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+	"github.com/petar/GoDCCP/dccp/ccid3"
+)
+
+func encodeOptions(t *testing.T, opts ...ccid3.UnencodedOption) []*dccp.Option {
+	var r []*dccp.Option
+	for _, u := range opts {
+		opt, err := u.Encode()
+		if err != nil {
+			t.Fatalf("encode (%s)", err)
+		}
+		r = append(r, opt)
+	}
+	return r
+}
+
+func writeHeader(t *testing.T, h *dccp.Header) []byte {
+	p, err := h.Write(dccp.LabelZero.Bytes(), dccp.LabelZero.Bytes(), dccp.AnyProto, false)
+	if err != nil {
+		t.Fatalf("write header (%s)", err)
+	}
+	return p
+}
+
+func frameMux(source, sink *dccp.Label, cargo []byte) []byte {
+	p := make([]byte, muxFramingLen+len(cargo))
+	source.Write(p)
+	sink.Write(p[dccp.LabelLen:])
+	copy(p[muxFramingLen:], cargo)
+	return p
+}
+
+func readPackets(t *testing.T, capture []byte, framed bool) (*captureReader, []*Packet) {
+	c, err := newCaptureReader(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("capture (%s)", err)
+	}
+	var r []*Packet
+	for {
+		pkt, err := c.Next()
+		if err != nil {
+			break
+		}
+		if p, err := decodePacket(pkt, framed, 0); err == nil {
+			r = append(r, p)
+		}
+	}
+	return c, r
+}
+
+// TestDecodeCaptureLink decodes the capture of a CaptureLink, and checks that the CCID3
+// options are decoded and that corrupted packets are reported
+func TestDecodeCaptureLink(t *testing.T) {
+	env := dccp.NewEnv(nil)
+	var w bytes.Buffer
+	p, q := dccp.NewChanPipe()
+	env.Go(func() {
+		buf := make([]byte, q.GetMTU())
+		for {
+			if _, _, err := q.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}, "drain")
+	l, err := dccp.NewCaptureLink(env, dccp.NoLogging, p, &w, nil, true)
+	if err != nil {
+		t.Fatalf("capture link (%s)", err)
+	}
+
+	intervals := &ccid3.LossIntervalsOption{
+		SkipLength: 1,
+		LossIntervals: []*ccid3.LossInterval{
+			&ccid3.LossInterval{LosslessLength: 20, LossLength: 2, DataLength: 22, ECNNonceEcho: true},
+			&ccid3.LossInterval{LosslessLength: 100, LossLength: 1, DataLength: 101},
+		},
+	}
+	h := &dccp.Header{
+		SourcePort: 1,
+		DestPort:   2,
+		Type:       dccp.DataAck,
+		X:          true,
+		SeqNo:      100,
+		AckNo:      50,
+		Options: encodeOptions(t,
+			&ccid3.LossEventRateOption{RateInv: 40},
+			intervals,
+			&ccid3.ReceiveRateOption{Rate: 12000},
+		),
+		Data: []byte("data"),
+	}
+	source, sink := dccp.ChooseLabel(), dccp.ChooseLabel()
+	good := writeHeader(t, h)
+	l.WriteTo(frameMux(source, sink, good), nil)
+	bad := append([]byte{}, good...)
+	bad[len(bad)-1] ^= 1
+	l.WriteTo(frameMux(source, sink, bad), nil)
+
+	c, packets := readPackets(t, w.Bytes(), false)
+	if c.UserAppl() != dccp.CaptureApplication {
+		t.Errorf("user application %q", c.UserAppl())
+	}
+	if len(packets) != 2 {
+		t.Fatalf("decoded %d packets, expecting 2", len(packets))
+	}
+	p0 := packets[0]
+	if p0.Error != "" || p0.Header == nil || p0.Header.SeqNo != 100 || p0.Direction != "out" {
+		t.Fatalf("packet 0: %+v", p0)
+	}
+	if p0.Source != "10.0.0.1:6511" || p0.Dest != "10.0.0.2:6511" {
+		t.Errorf("packet 0: from %s to %s", p0.Source, p0.Dest)
+	}
+	expect := []interface{}{
+		&ccid3.LossEventRateOption{RateInv: 40},
+		intervals,
+		&ccid3.ReceiveRateOption{Rate: 12000},
+	}
+	if len(p0.Options) != len(expect) {
+		t.Fatalf("packet 0: %d options, expecting %d", len(p0.Options), len(expect))
+	}
+	for i, opt := range p0.Options {
+		if !reflect.DeepEqual(opt.Value, expect[i]) {
+			t.Errorf("option %s: %+v, expecting %+v", opt.Name, opt.Value, expect[i])
+		}
+	}
+	if packets[1].Error != dccp.ErrChecksum.Error() {
+		t.Errorf("packet 1: error %q, expecting checksum error", packets[1].Error)
+	}
+	l.Close()
+	q.Close()
+}
+
+// pcapUDP returns an Ethernet frame with an IPv4 UDP datagram that carries payload
+func pcapUDP(payload []byte) []byte {
+	p := make([]byte, 14+20+8+len(payload))
+	binary.BigEndian.PutUint16(p[12:14], etherTypeIPv4)
+	ip := p[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	ip[8], ip[9] = 64, protoUDP
+	copy(ip[12:16], net.IPv4(192, 168, 0, 1).To4())
+	copy(ip[16:20], net.IPv4(192, 168, 0, 2).To4())
+	u := ip[20:]
+	binary.BigEndian.PutUint16(u[0:2], 4000)
+	binary.BigEndian.PutUint16(u[2:4], 5000)
+	binary.BigEndian.PutUint16(u[4:6], uint16(8+len(payload)))
+	copy(u[8:], payload)
+	return p
+}
+
+// TestDecodePcap decodes a classic big-endian pcap capture of Ethernet frames, whose UDP
+// payloads carry the Mux framing
+func TestDecodePcap(t *testing.T) {
+	var w bytes.Buffer
+	hdr := make([]byte, pcapHeaderLen)
+	binary.BigEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.BigEndian.PutUint16(hdr[4:6], 2)
+	binary.BigEndian.PutUint16(hdr[6:8], 4)
+	binary.BigEndian.PutUint32(hdr[16:20], 65535)
+	binary.BigEndian.PutUint32(hdr[20:24], linkTypeEthernet)
+	w.Write(hdr)
+	record := func(sec, usec uint32, p []byte) {
+		r := make([]byte, pcapRecordLen)
+		binary.BigEndian.PutUint32(r[0:4], sec)
+		binary.BigEndian.PutUint32(r[4:8], usec)
+		binary.BigEndian.PutUint32(r[8:12], uint32(len(p)))
+		binary.BigEndian.PutUint32(r[12:16], uint32(len(p)))
+		w.Write(r)
+		w.Write(p)
+	}
+
+	source, sink := dccp.ChooseLabel(), dccp.ChooseLabel()
+	h := &dccp.Header{SourcePort: 1, DestPort: 2, Type: dccp.Request, X: true, SeqNo: 7, ServiceCode: 3}
+	record(10, 5, pcapUDP(frameMux(source, sink, writeHeader(t, h))))
+	arp := make([]byte, 42)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+	record(11, 0, arp)
+	record(12, 0, pcapUDP(frameMux(nil, sink, []byte("cookie"))))
+	record(13, 0, pcapUDP([]byte("short")))
+
+	_, packets := readPackets(t, w.Bytes(), true)
+	if len(packets) != 3 {
+		t.Fatalf("decoded %d packets, expecting 3", len(packets))
+	}
+	p0 := packets[0]
+	if p0.Error != "" || p0.Header == nil || p0.Header.SeqNo != 7 || p0.Header.ServiceCode != 3 {
+		t.Fatalf("packet 0: %+v", p0)
+	}
+	if p0.Time != 10e9+5e3 || p0.Source != "192.168.0.1:4000" || p0.Dest != "192.168.0.2:5000" {
+		t.Errorf("packet 0: at %d from %s to %s", p0.Time, p0.Source, p0.Dest)
+	}
+	if p0.SourceFlow != source.String() || p0.SinkFlow != sink.String() {
+		t.Errorf("packet 0: flow %s > %s", p0.SourceFlow, p0.SinkFlow)
+	}
+	if packets[1].Summary != "Mux control packet" || packets[1].Error != "" {
+		t.Errorf("packet 1: %+v", packets[1])
+	}
+	if packets[2].Error != errTruncated.Error() {
+		t.Errorf("packet 2: error %q, expecting truncated packet", packets[2].Error)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+// dccp-pcap decodes the DCCP packets in pcap and pcapng captures with the parser of this
+// project. It strips the link, IP and UDP headers and the Mux framing of every packet, reads
+// the DCCP header with dccp.ReadHeader, and prints it along with its decoded options, or the
+// checksum or parse error of the packet. Captures written by dccp.CaptureLink carry no Mux
+// framing, which is detected automatically. Packets other than UDP are skipped. Packets whose
+// link, IP, UDP or Mux framing cannot be decoded are reported on standard error by index.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+var (
+	flagJSON *bool   = flag.Bool("json", false, "Print one JSON object per packet")
+	flagMux  *string = flag.String("mux", "auto", "Mux framing of UDP payloads: auto, yes, no")
+	flagPort *int    = flag.Int("port", 0, "UDP port of the DCCP traffic, or 0 for all UDP packets")
+)
+
+func usage() {
+	fmt.Printf("%s [optional_flags] capture_file\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+
+	nonflags := flag.Args()
+	if len(nonflags) == 0 {
+		usage()
+	}
+	if *flagMux != "auto" && *flagMux != "yes" && *flagMux != "no" {
+		usage()
+	}
+
+	f, err := os.Open(nonflags[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening capture (%s)\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	c, err := newCaptureReader(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading capture (%s)\n", err)
+		os.Exit(1)
+	}
+
+	var w packetWriter
+	if *flagJSON {
+		w = json.NewEncoder(os.Stdout)
+	} else {
+		w = textWriter{os.Stdout}
+	}
+	var index, decoded, failed, skipped int
+	for {
+		pkt, err := c.Next()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Terminated unexpectedly (%s).\n", err)
+			}
+			break
+		}
+		index++
+		framed := *flagMux == "yes" || (*flagMux == "auto" && c.UserAppl() != dccp.CaptureApplication)
+		p, err := decodePacket(pkt, framed, *flagPort)
+		if err == errNotUDP {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Packet #%d not decoded (%s)\n", index, err)
+			skipped++
+			continue
+		}
+		p.Index = index
+		decoded++
+		if p.Error != "" {
+			failed++
+		}
+		if err = w.Encode(p); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output (%s)\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Read %d packets, decoded %d, with %d errors, %d not decoded.\n", index, decoded, failed, skipped)
+}
+
+// packetWriter prints decoded packets
+type packetWriter interface {
+	Encode(v interface{}) error
+}
+
+// textWriter prints decoded packets in human-readable form
+type textWriter struct {
+	w io.Writer
+}
+
+func (t textWriter) Encode(v interface{}) error {
+	p := v.(*Packet)
+	fmt.Fprintf(t.w, "#%d %s %s > %s", p.Index,
+		time.Unix(0, p.Time).UTC().Format("15:04:05.000000000"), p.Source, p.Dest)
+	if p.Direction != "" {
+		fmt.Fprintf(t.w, " %s", p.Direction)
+	}
+	if p.Comment != "" {
+		fmt.Fprintf(t.w, " [%s]", p.Comment)
+	}
+	fmt.Fprintln(t.w)
+	if p.SourceFlow != "" {
+		fmt.Fprintf(t.w, "\tflow %s > %s\n", p.SourceFlow, p.SinkFlow)
+	}
+	if p.Summary != "" {
+		fmt.Fprintf(t.w, "\t%s\n", p.Summary)
+	}
+	for _, opt := range p.Options {
+		fmt.Fprintf(t.w, "\t%s", opt.Name)
+		if opt.Mandatory {
+			fmt.Fprintf(t.w, " (mandatory)")
+		}
+		if opt.Value != nil {
+			value, _ := json.Marshal(opt.Value)
+			fmt.Fprintf(t.w, " %s", value)
+		} else if len(opt.Data) > 0 {
+			fmt.Fprintf(t.w, " % x", opt.Data)
+		}
+		fmt.Fprintln(t.w)
+	}
+	if p.Error != "" {
+		fmt.Fprintf(t.w, "\terror: %s\n", p.Error)
+	}
+	_, err := fmt.Fprintln(t.w)
+	return err
+}
@@ -0,0 +1,165 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+// AckVectorOption, Section 11.4
+// The Ack Vector is a run-length encoded history of the packets received by the HC-Receiver.
+// Cells are listed in reverse order of sequence number, starting from the Acknowledgement
+// Number of the packet carrying the option.
+type AckVectorOption struct {
+	Nonce byte // ECN Nonce Echo, 0 or 1, which selects option type 38 or 39
+	Cells []AckVectorCell
+}
+
+// AckVectorCell describes a run of RunLength+1 consecutive packets that share the same State
+type AckVectorCell struct {
+	State     byte // One of AckVectorReceived, AckVectorECNMarked or AckVectorNotReceived
+	RunLength byte // A 6-bit number
+}
+
+// The three Ack Vector packet states, Section 11.4
+const (
+	AckVectorReceived    = 0
+	AckVectorECNMarked   = 1
+	AckVectorNotReceived = 3
+)
+
+const maxAckVectorRunLength = 0x3f
+
+func (opt *AckVectorOption) Encode() (*Option, error) {
+	if len(opt.Cells) > 255-2 {
+		return nil, ErrOverflow
+	}
+	d := make([]byte, len(opt.Cells))
+	for i, cell := range opt.Cells {
+		if cell.State == 2 || cell.State > AckVectorNotReceived || cell.RunLength > maxAckVectorRunLength {
+			return nil, ErrOverflow
+		}
+		d[i] = cell.State<<6 | cell.RunLength
+	}
+	t := byte(OptionAckVectorNonce0)
+	if opt.Nonce != 0 {
+		t = OptionAckVectorNonce1
+	}
+	return &Option{
+		Type:      t,
+		Data:      d,
+		Mandatory: false,
+	}, nil
+}
+
+func DecodeAckVectorOption(opt *Option) *AckVectorOption {
+	if opt.Type != OptionAckVectorNonce0 && opt.Type != OptionAckVectorNonce1 {
+		return nil
+	}
+	r := &AckVectorOption{Cells: make([]AckVectorCell, len(opt.Data))}
+	if opt.Type == OptionAckVectorNonce1 {
+		r.Nonce = 1
+	}
+	for i, b := range opt.Data {
+		r.Cells[i] = AckVectorCell{State: b >> 6, RunLength: b & maxAckVectorRunLength}
+		// State 2 is reserved and receivers must not send it
+		if r.Cells[i].State == 2 {
+			return nil
+		}
+	}
+	return r
+}
+
+// FindAckVectorOption returns the first Ack Vector among opts, or nil if there is none
+func FindAckVectorOption(opts []*Option) *AckVectorOption {
+	for _, opt := range opts {
+		if av := DecodeAckVectorOption(opt); av != nil {
+			return av
+		}
+	}
+	return nil
+}
+
+// Walk calls f for every sequence number covered by the Ack Vector, starting with ackno
+// and proceeding backwards, along with the state of the respective packet.
+func (opt *AckVectorOption) Walk(ackno int64, f func(seqno int64, state byte)) {
+	seqno := ackno
+	for _, cell := range opt.Cells {
+		for i := 0; i <= int(cell.RunLength); i++ {
+			f(seqno, cell.State)
+			seqno = SeqNoAdd(seqno, -1)
+		}
+	}
+}
+
+const (
+	// ackVectorMaxCells is the maximum number of cells in the Ack Vectors sent by Conn,
+	// which keeps the option within the room reserved by maxDataOptionSize
+	ackVectorMaxCells = 16
+
+	// ackVectorWindow is the number of most recent sequence numbers remembered by
+	// ackVectorRecorder, which is the most that ackVectorMaxCells cells can describe
+	ackVectorWindow = ackVectorMaxCells * (maxAckVectorRunLength + 1)
+)
+
+// ackVectorRecorder remembers which of the recently sent sequence numbers of the other side
+// have been received, and produces the Ack Vectors that Conn places on its Ack and DataAck
+// packets. Its methods are called under the Conn lock.
+type ackVectorRecorder struct {
+	started bool
+	low     int64 // Lowest sequence number that can be described, i.e. the first one recorded
+	high    int64 // Greatest sequence number recorded
+	recv    [ackVectorWindow]bool
+}
+
+// Init resets the ackVectorRecorder for new use
+func (r *ackVectorRecorder) Init() {
+	*r = ackVectorRecorder{}
+}
+
+// OnRead records the arrival of the packet with sequence number seqno. It is called for
+// every packet that becomes acknowledgeable.
+func (r *ackVectorRecorder) OnRead(seqno int64) {
+	if !r.started {
+		r.started, r.low, r.high = true, seqno, seqno
+		r.recv[seqno%ackVectorWindow] = true
+		return
+	}
+	d := SeqNoDiff(seqno, r.high)
+	switch {
+	case d > 0:
+		// Forget the state of the sequence numbers that fall out of the window
+		for i := int64(1); i < d && i <= ackVectorWindow; i++ {
+			r.recv[SeqNoAdd(r.high, i)%ackVectorWindow] = false
+		}
+		r.high = seqno
+		r.recv[seqno%ackVectorWindow] = true
+	case d > -ackVectorWindow && SeqNoDiff(seqno, r.low) >= 0:
+		r.recv[seqno%ackVectorWindow] = true
+	}
+}
+
+// Option returns the Ack Vector for a packet acknowledging ackno, or nil if ackno is not
+// among the recorded sequence numbers. The vector extends backwards from ackno as far as
+// ackVectorMaxCells cells reach, but not below the first recorded sequence number.
+func (r *ackVectorRecorder) Option(ackno int64) *AckVectorOption {
+	if !r.started || SeqNoDiff(r.high, ackno) != 0 {
+		return nil
+	}
+	n := min64(SeqNoDiff(r.high, r.low)+1, ackVectorWindow)
+	av := &AckVectorOption{}
+	for i := int64(0); i < n; i++ {
+		state := byte(AckVectorNotReceived)
+		if r.recv[SeqNoAdd(ackno, -i)%ackVectorWindow] {
+			state = AckVectorReceived
+		}
+		k := len(av.Cells) - 1
+		if k >= 0 && av.Cells[k].State == state && av.Cells[k].RunLength < maxAckVectorRunLength {
+			av.Cells[k].RunLength++
+			continue
+		}
+		if k+1 == ackVectorMaxCells {
+			break
+		}
+		av.Cells = append(av.Cells, AckVectorCell{State: state})
+	}
+	return av
+}
@@ -6,6 +6,7 @@ package dccp
 
 import (
 	"errors"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -86,3 +87,11 @@ func (addr *Addr) Write(p []byte) (n int, err error) {
 	EncodeUint16(addr.Port, p[0:2])
 	return n + 2, nil
 }
+
+// addrKey returns a string that identifies the link address addr, for use as a map key
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + "/" + addr.String()
+}
@@ -0,0 +1,336 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// CaptureLink is a Link that records all traffic of an underlying Link in pcapng format, so
+// that it can be inspected with Wireshark, or decoded offline with cmd/dccp-pcap. It is meant
+// to sit between a Mux and its link. CaptureLink implements Link.
+//
+// Every datagram that is sent or received successfully is written as an IP/UDP packet with
+// synthesized IP and UDP headers, whose UDP payload is the DCCP packet carried by the Mux.
+// The Mux framing (the source and sink labels of the flow) is stripped, so that the payload
+// can be decoded by the DCCP-over-UDP dissector of Wireshark (RFC 6773). Packets that do not
+// belong to a flow, such as cookie challenges, are written whole.
+//
+// UDP addresses are written as they are. Other addresses are mapped to addresses in
+// 10.0.0.0/8, and are given the port CapturePort. Note that the Mux computes the DCCP
+// checksums over zero labels rather than IP addresses, so Wireshark reports them as incorrect
+// unless DCCP checksum validation is turned off.
+type CaptureLink struct {
+	env      *Env
+	amb      *Amb
+	link     Link
+	local    net.Addr
+	comments bool
+
+	Mutex
+	w     io.Writer
+	ipID  uint16
+	names map[string]string // Names of flows, keyed by the string form of their local label
+}
+
+const (
+	// CapturePort is the UDP port of captured endpoints whose addresses are not UDP
+	// addresses. It is the port assigned to DCCP-UDP encapsulation by RFC 6773.
+	CapturePort = 6511
+
+	// CaptureApplication is written in the section header of captures, so that decoders
+	// can tell that the Mux framing has been stripped from their packets
+	CaptureApplication = "GoDCCP CaptureLink"
+)
+
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptUserAppl    = 4
+	pcapngOptTSResol     = 9
+	pcapngOptFlags       = 2
+	pcapngFlagInbound    = 1
+	pcapngFlagOutbound   = 2
+	pcapLinkTypeRaw      = 101
+	captureIPv4HeaderLen = 20
+	captureIPv6HeaderLen = 40
+	captureUDPHeaderLen  = 8
+	captureProtoUDP      = 17
+	captureTTL           = 64
+)
+
+// NewCaptureLink creates a CaptureLink on top of link, which writes its capture to w. local is
+// the address of link, which is used as the address of this endpoint in the capture; it can be
+// nil. If comments is set, every packet of a flow is annotated with its labels and with the
+// name of its connection, if one was given with Name or NameConn. The pcapng headers are written
+// to w immediately.
+func NewCaptureLink(env *Env, amb *Amb, link Link, w io.Writer, local net.Addr, comments bool) (*CaptureLink, error) {
+	l := &CaptureLink{
+		env:      env,
+		amb:      amb.Refine("capture"),
+		link:     link,
+		local:    local,
+		comments: comments,
+		w:        w,
+		names:    make(map[string]string),
+	}
+	var p []byte
+	p = appendUint32(p, pcapngByteOrderMagic)
+	p = appendUint16(p, 1) // Major version
+	p = appendUint16(p, 0) // Minor version
+	p = appendUint32(p, 0xffffffff)
+	p = appendUint32(p, 0xffffffff) // Unknown section length
+	p = appendPcapngOption(p, pcapngOptUserAppl, []byte(CaptureApplication))
+	p = appendPcapngOption(p, pcapngOptEnd, nil)
+	if err := l.writeBlock(pcapngSectionHeader, p); err != nil {
+		return nil, err
+	}
+	p = p[:0]
+	p = appendUint16(p, pcapLinkTypeRaw)
+	p = appendUint16(p, 0)
+	p = appendUint32(p, 0)                                 // No snapshot length limit
+	p = appendPcapngOption(p, pcapngOptTSResol, []byte{9}) // Nanoseconds
+	p = appendPcapngOption(p, pcapngOptEnd, nil)
+	if err := l.writeBlock(pcapngInterface, p); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Name sets the name under which the flow with local label local is annotated
+func (l *CaptureLink) Name(local Bytes, name string) {
+	l.Lock()
+	defer l.Unlock()
+	l.names[string(local.Bytes())] = name
+}
+
+// NameConn annotates the flow of c with the labels of the Amb of c
+func (l *CaptureLink) NameConn(c *Conn) {
+	l.Name(c.LocalLabel(), strings.Join(c.Amb().Labels(), "/"))
+}
+
+// GetMTU implements Link.GetMTU
+func (l *CaptureLink) GetMTU() int {
+	return l.link.GetMTU()
+}
+
+// SetReadDeadline implements Link.SetReadDeadline
+func (l *CaptureLink) SetReadDeadline(t time.Time) error {
+	return l.link.SetReadDeadline(t)
+}
+
+// Close implements Link.Close. It does not close the writer of the capture.
+func (l *CaptureLink) Close() error {
+	return l.link.Close()
+}
+
+// ReadFrom implements Link.ReadFrom
+func (l *CaptureLink) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = l.link.ReadFrom(buf)
+	if err != nil {
+		return n, addr, err
+	}
+	l.capture(buf[:n], addr, l.local, false)
+	return n, addr, nil
+}
+
+// WriteTo implements Link.WriteTo
+func (l *CaptureLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
+	n, err = l.link.WriteTo(buf, addr)
+	if err != nil {
+		return n, err
+	}
+	l.capture(buf, l.local, addr, true)
+	return n, nil
+}
+
+// capture writes the packet p, which was sent from src to dst, to the capture
+func (l *CaptureLink) capture(p []byte, src, dst net.Addr, outbound bool) {
+	payload, comment := p, ""
+	if msg, cargo, err := readMuxHeader(p); err == nil && msg.Source != nil {
+		payload = cargo
+		if l.comments {
+			comment = l.flowComment(msg, outbound)
+		}
+	} else if l.comments {
+		comment = "mux control"
+	}
+
+	// Nil addresses are given host number 1 at this endpoint and 2 at the remote
+	var srcHost, dstHost byte = 1, 2
+	if !outbound {
+		srcHost, dstHost = 2, 1
+	}
+	srcIP, srcPort := captureEndpoint(src, srcHost)
+	dstIP, dstPort := captureEndpoint(dst, dstHost)
+	if len(srcIP) != len(dstIP) {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.ipID++
+	pkt := captureUDPPacket(srcIP, dstIP, srcPort, dstPort, l.ipID, payload)
+
+	var b []byte
+	now := l.env.Now()
+	b = appendUint32(b, 0) // Interface ID
+	b = appendUint32(b, uint32(uint64(now)>>32))
+	b = appendUint32(b, uint32(uint64(now)))
+	b = appendUint32(b, uint32(len(pkt)))
+	b = appendUint32(b, uint32(len(pkt)))
+	b = append(b, pkt...)
+	b = appendPcapngPadding(b)
+	flags := make([]byte, 4)
+	if outbound {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+	} else {
+		binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+	}
+	b = appendPcapngOption(b, pcapngOptFlags, flags)
+	if comment != "" {
+		b = appendPcapngOption(b, pcapngOptComment, []byte(comment))
+	}
+	b = appendPcapngOption(b, pcapngOptEnd, nil)
+	if err := l.writeBlock(pcapngEnhancedPacket, b); err != nil {
+		l.amb.E(EventWarn, fmt.Sprintf("Capture write (%s)", err))
+	}
+}
+
+// flowComment returns the annotation of a packet of the flow of msg
+func (l *CaptureLink) flowComment(msg *muxMsg, outbound bool) string {
+	local := msg.Sink
+	if outbound {
+		local = msg.Source
+	}
+	l.Lock()
+	name := l.names[string(local.Bytes())]
+	l.Unlock()
+	comment := fmt.Sprintf("source=%s sink=%s", msg.Source, msg.Sink)
+	if name != "" {
+		comment = name + " " + comment
+	}
+	return comment
+}
+
+// writeBlock writes a pcapng block of type typ and body body. The caller must hold the lock
+// of l, unless l is not shared yet.
+func (l *CaptureLink) writeBlock(typ uint32, body []byte) error {
+	n := uint32(12 + len(body))
+	var p []byte
+	p = appendUint32(p, typ)
+	p = appendUint32(p, n)
+	p = append(p, body...)
+	p = appendUint32(p, n)
+	_, err := l.w.Write(p)
+	return err
+}
+
+// captureEndpoint returns the IP address and port under which addr appears in a capture.
+// A nil address is given the address 10.0.0.host.
+func captureEndpoint(addr net.Addr, host byte) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case nil:
+		return net.IPv4(10, 0, 0, host).To4(), CapturePort
+	case *net.UDPAddr:
+		if ip4 := a.IP.To4(); ip4 != nil {
+			return ip4, uint16(a.Port)
+		}
+		if ip := a.IP.To16(); ip != nil {
+			return ip, uint16(a.Port)
+		}
+		return net.IPv4(10, 0, 0, host).To4(), uint16(a.Port)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(addr.Network() + " " + addr.String()))
+	s := h.Sum32()
+	return net.IPv4(10, byte(s>>16), byte(s>>8), byte(s)).To4(), CapturePort
+}
+
+// captureUDPPacket returns an IPv4 or IPv6 packet, depending on the length of the addresses,
+// which carries payload in a UDP datagram
+func captureUDPPacket(srcIP, dstIP net.IP, srcPort, dstPort, id uint16, payload []byte) []byte {
+	udpLen := captureUDPHeaderLen + len(payload)
+	var p []byte
+	if len(srcIP) == net.IPv4len {
+		p = make([]byte, captureIPv4HeaderLen+udpLen)
+		p[0] = 0x45 // Version 4, header of 5 words
+		binary.BigEndian.PutUint16(p[2:4], uint16(len(p)))
+		binary.BigEndian.PutUint16(p[4:6], id)
+		p[8] = captureTTL
+		p[9] = captureProtoUDP
+		copy(p[12:16], srcIP)
+		copy(p[16:20], dstIP)
+		csumUint16ToBytes(csumDone(csumSum(p[:captureIPv4HeaderLen])), p[10:12])
+	} else {
+		p = make([]byte, captureIPv6HeaderLen+udpLen)
+		p[0] = 0x60 // Version 6
+		binary.BigEndian.PutUint16(p[4:6], uint16(udpLen))
+		p[6] = captureProtoUDP
+		p[7] = captureTTL
+		copy(p[8:24], srcIP)
+		copy(p[24:40], dstIP)
+	}
+	u := p[len(p)-udpLen:]
+	binary.BigEndian.PutUint16(u[0:2], srcPort)
+	binary.BigEndian.PutUint16(u[2:4], dstPort)
+	binary.BigEndian.PutUint16(u[4:6], uint16(udpLen))
+	copy(u[captureUDPHeaderLen:], payload)
+	sum := csumDone(csumAdd(csumPseudoIP(srcIP, dstIP, captureProtoUDP, udpLen), captureSum(u)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	csumUint16ToBytes(sum, u[6:8])
+	return p
+}
+
+// captureSum returns the one's complement sum of buf as in RFC 1071, which pads a trailing
+// odd byte with a zero byte. UDP packets may have odd length, and csumSum, which is kept as it
+// is for DCCP checksums (see TODO), leaves their last byte out.
+func captureSum(buf []byte) uint16 {
+	var sum uint16
+	for len(buf) >= 2 {
+		sum = csumAdd(sum, csumBytesToUint16(buf))
+		buf = buf[2:]
+	}
+	if len(buf) == 1 {
+		sum = csumAdd(sum, uint16(buf[0])<<8)
+	}
+	return sum
+}
+
+func appendUint16(p []byte, u uint16) []byte {
+	return append(p, byte(u), byte(u>>8))
+}
+
+func appendUint32(p []byte, u uint32) []byte {
+	return append(p, byte(u), byte(u>>8), byte(u>>16), byte(u>>24))
+}
+
+// appendPcapngPadding pads p to a multiple of 4 bytes
+func appendPcapngPadding(p []byte) []byte {
+	for len(p)%4 != 0 {
+		p = append(p, 0)
+	}
+	return p
+}
+
+// appendPcapngOption appends a pcapng option with the given code and value to p
+func appendPcapngOption(p []byte, code uint16, value []byte) []byte {
+	p = appendUint16(p, code)
+	p = appendUint16(p, uint16(len(value)))
+	p = append(p, value...)
+	return appendPcapngPadding(p)
+}
@@ -0,0 +1,155 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+type capturedBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func readCapture(t *testing.T, p []byte) []capturedBlock {
+	var blocks []capturedBlock
+	for len(p) > 0 {
+		if len(p) < 12 {
+			t.Fatalf("short block")
+		}
+		typ, n := binary.LittleEndian.Uint32(p[0:4]), int(binary.LittleEndian.Uint32(p[4:8]))
+		if n%4 != 0 || n > len(p) || binary.LittleEndian.Uint32(p[n-4:n]) != uint32(n) {
+			t.Fatalf("bad block length %d", n)
+		}
+		blocks = append(blocks, capturedBlock{typ, p[8 : n-4]})
+		p = p[n:]
+	}
+	return blocks
+}
+
+func readCaptureOptions(p []byte) map[uint16][]byte {
+	opts := make(map[uint16][]byte)
+	for len(p) >= 4 {
+		code, n := binary.LittleEndian.Uint16(p[0:2]), int(binary.LittleEndian.Uint16(p[2:4]))
+		if code == pcapngOptEnd {
+			break
+		}
+		opts[code] = p[4 : 4+n]
+		p = p[4+(n+3)/4*4:]
+	}
+	return opts
+}
+
+// TestCaptureLink checks that sent and received packets are captured as UDP packets with valid
+// checksums, which carry the DCCP packet without the Mux framing
+func TestCaptureLink(t *testing.T) {
+	env := NewEnv(nil)
+	var w bytes.Buffer
+	p, q := NewChanPipe()
+	local := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 4000}
+	remote := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5000}
+	l, err := NewCaptureLink(env, NoLogging, p, &w, local, true)
+	if err != nil {
+		t.Fatalf("capture (%s)", err)
+	}
+	env.Go(func() {
+		buf := make([]byte, q.GetMTU())
+		for {
+			if _, _, err := q.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}, "drain")
+	source, sink := ChooseLabel(), ChooseLabel()
+	l.Name(source, "client")
+
+	cargo := []byte("dccp packet")
+	framed := make([]byte, muxMsgFootprint+len(cargo))
+	(&muxMsg{source, sink}).Write(framed)
+	copy(framed[muxMsgFootprint:], cargo)
+	if _, err := l.WriteTo(framed, remote); err != nil {
+		t.Fatalf("write (%s)", err)
+	}
+	reply := make([]byte, len(framed))
+	copy(reply, framed)
+	(&muxMsg{sink, source}).Write(reply)
+	env.Go(func() { q.WriteTo(reply, remote) }, "reply")
+	buf := make([]byte, l.GetMTU())
+	if _, _, err := l.ReadFrom(buf); err != nil {
+		t.Fatalf("read (%s)", err)
+	}
+	l.WriteTo([]byte("odd"), nil)
+
+	blocks := readCapture(t, w.Bytes())
+	if len(blocks) != 5 || blocks[0].typ != pcapngSectionHeader || blocks[1].typ != pcapngInterface {
+		t.Fatalf("unexpected blocks %v", blocks)
+	}
+	if a := readCaptureOptions(blocks[0].body[16:])[pcapngOptUserAppl]; string(a) != CaptureApplication {
+		t.Errorf("user application %q", a)
+	}
+	if lt := binary.LittleEndian.Uint16(blocks[1].body[0:2]); lt != pcapLinkTypeRaw {
+		t.Errorf("link type %d", lt)
+	}
+	for i, c := range []struct {
+		flags    uint32
+		src, dst string
+		payload  string
+		comment  string
+	}{
+		{pcapngFlagOutbound, "192.168.1.1:4000", "192.168.1.2:5000", "dccp packet", "client source="},
+		{pcapngFlagInbound, "192.168.1.2:5000", "192.168.1.1:4000", "dccp packet", "client source="},
+		{pcapngFlagOutbound, "192.168.1.1:4000", "10.0.0.2:6511", "odd", "mux control"},
+	} {
+		b := blocks[2+i]
+		if b.typ != pcapngEnhancedPacket {
+			t.Fatalf("block type %d", b.typ)
+		}
+		n := int(binary.LittleEndian.Uint32(b.body[12:16]))
+		pkt := b.body[20 : 20+n]
+		opts := readCaptureOptions(b.body[20+(n+3)/4*4:])
+		if f := binary.LittleEndian.Uint32(opts[pcapngOptFlags]); f != c.flags {
+			t.Errorf("packet %d: flags %d, expecting %d", i, f, c.flags)
+		}
+		if !strings.HasPrefix(string(opts[pcapngOptComment]), c.comment) {
+			t.Errorf("packet %d: comment %q", i, opts[pcapngOptComment])
+		}
+		if pkt[0] != 0x45 || pkt[9] != captureProtoUDP || int(binary.BigEndian.Uint16(pkt[2:4])) != n {
+			t.Errorf("packet %d: bad IP header", i)
+		}
+		if csumSum(pkt[:captureIPv4HeaderLen]) != 0xffff {
+			t.Errorf("packet %d: bad IP checksum", i)
+		}
+		u := pkt[captureIPv4HeaderLen:]
+		src := &net.UDPAddr{IP: net.IP(pkt[12:16]), Port: int(binary.BigEndian.Uint16(u[0:2]))}
+		dst := &net.UDPAddr{IP: net.IP(pkt[16:20]), Port: int(binary.BigEndian.Uint16(u[2:4]))}
+		if src.String() != c.src || dst.String() != c.dst {
+			t.Errorf("packet %d: from %s to %s, expecting from %s to %s", i, src, dst, c.src, c.dst)
+		}
+		if csumAdd(csumPseudoIP(pkt[12:16], pkt[16:20], captureProtoUDP, len(u)), captureSum(u)) != 0xffff {
+			t.Errorf("packet %d: bad UDP checksum", i)
+		}
+		if string(u[captureUDPHeaderLen:]) != c.payload {
+			t.Errorf("packet %d: payload %q, expecting %q", i, u[captureUDPHeaderLen:], c.payload)
+		}
+	}
+	l.Close()
+	q.Close()
+}
+
+// TestCaptureSum checks captureSum against the example of RFC 1071, with and without a
+// trailing odd byte
+func TestCaptureSum(t *testing.T) {
+	p := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7, 0x01}
+	if sum := captureSum(p[:8]); sum != 0xddf2 {
+		t.Errorf("sum %04x, expecting ddf2", sum)
+	}
+	if sum := captureSum(p); sum != 0xdef2 {
+		t.Errorf("sum %04x, expecting def2", sum)
+	}
+}
@@ -4,6 +4,8 @@
 
 package dccp
 
+import "math"
+
 // Regarding options and Half-Connection CCIDs (from Section 10.3):
 //
 // Any packet may contain information meant for either half-connection,
@@ -82,6 +84,18 @@ type SenderCongestionControl interface {
 	Close()
 }
 
+// LossEventRater is an optional interface, which a SenderCongestionControl implements if it
+// maintains an estimate of the loss event rate experienced by the connection.
+type LossEventRater interface {
+
+	// LossEventRateInv returns the inverse of the current loss event rate, or
+	// UnknownLossEventRateInv if no loss has been observed yet.
+	LossEventRateInv() uint32
+}
+
+// UnknownLossEventRateInv is the inverse loss event rate that signifies 'no loss'
+const UnknownLossEventRateInv = math.MaxUint32
+
 // ReceiverCongestionControl specifies the interface for the congestion control logic of a DCCP
 // receiver (aka Half-Connection Receiver CCID)
 type ReceiverCongestionControl interface {
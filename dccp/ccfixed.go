@@ -19,28 +19,21 @@ func (CCFixed) NewReceiver(env *Env, amb *Amb) ReceiverCongestionControl {
 // ---> Fixed-rate HC-Sender Congestion Control
 
 type fixedRateSenderControl struct {
-	env         *Env
+	env    *Env
 	Mutex
-	every       int64 // Strobe every every nanoseconds
-	strobeRead  chan int
-	strobeWrite chan int
+	every  int64 // Strobe every every nanoseconds
+	strobe chan int
+	done   chan int // Closed by Close
+	closed bool
 }
 
 func newFixedRateSenderControl(env *Env, every int64) *fixedRateSenderControl {
-	strobe := make(chan int)
-	return &fixedRateSenderControl{env: env, every: every, strobeRead: strobe, strobeWrite: strobe}
+	return &fixedRateSenderControl{env: env, every: every, strobe: make(chan int), done: make(chan int)}
 }
 
 func (scc *fixedRateSenderControl) Open() {
 	scc.env.Go(func() {
-		for {
-			scc.Lock()
-			if scc.strobeWrite == nil {
-				scc.Unlock()
-				break
-			}
-			scc.strobeWrite <- 1
-			scc.Unlock()
+		for Send(scc.env, scc.strobe, 1, scc.done) {
 			scc.env.Sleep(scc.every)
 		}
 	}, "fixedRateSenderControl")
@@ -63,7 +56,7 @@ func (scc *fixedRateSenderControl) OnRead(fb *FeedbackHeader) error { return nil
 func (scc *fixedRateSenderControl) OnIdle(now int64) error { return nil }
 
 func (scc *fixedRateSenderControl) Strobe() {
-	<-scc.strobeRead
+	Select(scc.env, -1, scc.strobe, scc.done)
 }
 
 func (scc *fixedRateSenderControl) SetHeartbeat(interval int64) {
@@ -72,9 +65,9 @@ func (scc *fixedRateSenderControl) SetHeartbeat(interval int64) {
 func (scc *fixedRateSenderControl) Close() {
 	scc.Lock()
 	defer scc.Unlock()
-	if scc.strobeWrite != nil {
-		close(scc.strobeWrite)
-		scc.strobeWrite = nil
+	if !scc.closed {
+		close(scc.done)
+		scc.closed = true
 	}
 }
 
@@ -5,6 +5,7 @@
 package ccid3
 
 import (
+	"math"
 	"github.com/petar/GoDCCP/dccp"
 )
 
@@ -61,10 +62,18 @@ func (r *receiverRateCalculator) Flush(rtt int64, timeWrite int64) *ReceiveRateO
 }
 
 // Given data volume in bytes and time duration in nanoseconds, rate returns the
-// corresponding rate in bytes per second
+// corresponding rate in bytes per second. A zero duration, which is possible under
+// synthetic time, is treated as the shortest measurable one.
 func rate(nbytes int, nsec int64) uint32 {
-	if nbytes < 0 || nsec <= 0 {
+	if nbytes < 0 || nsec < 0 {
 		panic("receive rate, negative bytes or time")
 	}
-	return uint32((int64(nbytes)*1e9)/nsec)
+	if nsec == 0 {
+		nsec = 1
+	}
+	r := (int64(nbytes) * 1e9) / nsec
+	if r > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(r)
 }
@@ -168,6 +168,23 @@ func readReceiveRate(fb *dccp.FeedbackHeader) (xrecv uint32, err error) {
 	return receiverRateCalculator.Rate, nil
 }
 
+// LossReport implements dccp.LossReporter. It recovers the received and lost packets from the
+// loss intervals reported in fb.
+func (s *sender) LossReport(fb *dccp.FeedbackHeader) (received, lost []dccp.SeqNoRange, ok bool) {
+	return lossReport(fb)
+}
+
+// LossEventRateInv implements dccp.LossEventRater. It returns the inverse loss event rate
+// computed from the most recent feedback.
+func (s *sender) LossEventRateInv() uint32 {
+	s.Lock()
+	defer s.Unlock()
+	if !s.open {
+		return UnknownLossEventRateInv
+	}
+	return s.senderLossTracker.lastRateInv
+}
+
 // Strobe blocks until a new packet can be sent without violating the congestion control
 // rate limit. If the CC is not active, Strobe MUST return immediately.
 func (s *sender) Strobe() {
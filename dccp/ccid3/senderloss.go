@@ -73,20 +73,56 @@ func (t *senderLossTracker) OnRead(fb *dccp.FeedbackHeader) (LossFeedback, error
 	t.lastRateInv = rateInv
 	t.amb.E(dccp.EventMatch, fmt.Sprintf("Loss rate inv = %0.4g", 1 / float64(rateInv)))
 
-	// XXX: Must use circular arithmetic here
-	t.lastAckNo = max64(t.lastAckNo, fb.AckNo)
+	if dccp.SeqNoDiff(fb.AckNo, t.lastAckNo) > 0 {
+		t.lastAckNo = fb.AckNo
+	}
 
 	return r, nil
 }
 
+// lossReport returns the sequence numbers that the loss intervals in fb prove were received
+// and lost. The first packet of the lossy part of every interval was lost, while the other
+// packets of the lossy part may have been received. The lossless parts of all but the most
+// recent interval were received. The most recent interval may be unfinished, and its lossless
+// part may contain losses that the receiver has not detected yet. Nothing is known about the
+// packets before the oldest interval, nor about those in the skip region.
+//
+// Since this implementation does not use ECN, we assume that no packets are ECN-marked. The
+// first packet of a lossy part could otherwise have been marked, rather than lost.
+func lossReport(fb *dccp.FeedbackHeader) (received, lost []dccp.SeqNoRange, ok bool) {
+	if fb.Type != dccp.Ack && fb.Type != dccp.DataAck {
+		return nil, nil, false
+	}
+	var lossIntervals *LossIntervalsOption
+	for _, opt := range fb.Options {
+		if lossIntervals = DecodeLossIntervalsOption(opt); lossIntervals != nil {
+			break
+		}
+	}
+	if lossIntervals == nil {
+		return nil, nil, false
+	}
+	details := recoverIntervalDetails(fb.AckNo, lossIntervals.SkipLength, lossIntervals.LossIntervals)
+	for i, d := range details {
+		if d.LossLength > 0 {
+			lost = append(lost, dccp.SeqNoRange{From: d.StartSeqNo, To: d.StartSeqNo})
+		}
+		if i > 0 && d.LosslessLength > 0 {
+			from := dccp.SeqNoAdd(d.StartSeqNo, int64(d.LossLength))
+			received = append(received, dccp.SeqNoRange{From: from, To: dccp.SeqNoAdd(from, int64(d.LosslessLength)-1)})
+		}
+	}
+	return received, lost, true
+}
+
 // recoverIntervalDetails returns a slice containing the estimated details of the loss intervals
 func recoverIntervalDetails(ackno int64, skip byte, lis []*LossInterval) []*LossIntervalDetail {
 	r := make([]*LossIntervalDetail, len(lis))
-	var head int64 = ackno + 1 - int64(skip)
+	head := dccp.SeqNoAdd(ackno, 1-int64(skip))
 	for i, li := range lis {
 		r[i] = &LossIntervalDetail{}
 		r[i].LossInterval = *li
-		head -= int64(li.SeqLen())
+		head = dccp.SeqNoAdd(head, -int64(li.SeqLen()))
 		r[i].StartSeqNo = head
 		// TODO: StartTime, StartRTT, Unfinished are not recovered (but also not used)
 	}
@@ -95,12 +131,11 @@ func recoverIntervalDetails(ackno int64, skip byte, lis []*LossInterval) []*Loss
 
 // calcNewLossCount calculates the number of new loss intervals reported in this feedback packet,
 // since the last packet (identified by lastAckNo)
-// XXX: Must use circular arithmetic here
 func calcNewLossCount(details []*LossIntervalDetail, lastAckNo int64) byte {
 	// If lastAckNo is zero (no acks have been received), this function works correctly
 	var r byte
 	for _, d := range details {
-		if d.StartSeqNo <= lastAckNo {
+		if dccp.SeqNoDiff(d.StartSeqNo, lastAckNo) <= 0 {
 			break
 		}
 		r++
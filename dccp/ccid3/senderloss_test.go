@@ -0,0 +1,85 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package ccid3
+
+import (
+	"reflect"
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+func lossIntervalsFeedback(t *testing.T, ackno int64, opt *LossIntervalsOption) *dccp.FeedbackHeader {
+	encoded, err := opt.Encode()
+	if err != nil {
+		t.Fatalf("encoding option (%s)", err)
+	}
+	return &dccp.FeedbackHeader{Type: dccp.Ack, X: true, AckNo: ackno, Options: []*dccp.Option{encoded}}
+}
+
+func TestLossReport(t *testing.T) {
+	opt := &LossIntervalsOption{
+		SkipLength: 2,
+		LossIntervals: []*LossInterval{
+			&LossInterval{LosslessLength: 10, LossLength: 3, DataLength: 13},
+			&LossInterval{LosslessLength: 20, LossLength: 2, DataLength: 22},
+		},
+	}
+	for _, ackno := range []int64{100, 5} {
+		// The intervals start at ackno-14 and ackno-36. With ackno 5, they precede the
+		// wrap-around of sequence numbers.
+		at := func(d int64) int64 { return dccp.SeqNoAdd(ackno, d) }
+		received, lost, ok := lossReport(lossIntervalsFeedback(t, ackno, opt))
+		if !ok {
+			t.Fatalf("ackno %d: no loss report", ackno)
+		}
+		expectLost := []dccp.SeqNoRange{{From: at(-14), To: at(-14)}, {From: at(-36), To: at(-36)}}
+		if !reflect.DeepEqual(lost, expectLost) {
+			t.Errorf("ackno %d: lost %v, expecting %v", ackno, lost, expectLost)
+		}
+		// The lossless part of the most recent interval, the rest of the lossy parts, the
+		// skip region and the packets before the oldest interval are not reported
+		expectReceived := []dccp.SeqNoRange{{From: at(-34), To: at(-15)}}
+		if !reflect.DeepEqual(received, expectReceived) {
+			t.Errorf("ackno %d: received %v, expecting %v", ackno, received, expectReceived)
+		}
+		if ackno == 5 && (!lost[0].Contains(at(-14)) || lost[0].Contains(0) || !received[0].Contains(dccp.SeqNoAdd(0, -15))) {
+			t.Errorf("ackno %d: ranges do not wrap around", ackno)
+		}
+	}
+
+	// Feedback without loss intervals carries no loss report
+	if _, _, ok := lossReport(&dccp.FeedbackHeader{Type: dccp.Ack, X: true, AckNo: 100}); ok {
+		t.Errorf("loss report without loss intervals option")
+	}
+	fb := lossIntervalsFeedback(t, 100, opt)
+	fb.Type = dccp.Sync
+	if _, _, ok := lossReport(fb); ok {
+		t.Errorf("loss report on a Sync")
+	}
+}
+
+func TestCalcNewLossCount(t *testing.T) {
+	opt := &LossIntervalsOption{
+		LossIntervals: []*LossInterval{
+			&LossInterval{LosslessLength: 10, LossLength: 3, DataLength: 13},
+			&LossInterval{LosslessLength: 20, LossLength: 2, DataLength: 22},
+		},
+	}
+	// The intervals start at 2 and at 2^48-20, across the wrap-around
+	details := recoverIntervalDetails(14, opt.SkipLength, opt.LossIntervals)
+	for _, c := range []struct {
+		lastAckNo int64
+		count     byte
+	}{
+		{dccp.SeqNoAdd(0, -30), 2},
+		{dccp.SeqNoAdd(0, -20), 1},
+		{1, 1},
+		{2, 0},
+	} {
+		if n := calcNewLossCount(details, c.lastAckNo); n != c.count {
+			t.Errorf("last ackno %d: %d new losses, expecting %d", c.lastAckNo, n, c.count)
+		}
+	}
+}
@@ -179,10 +179,12 @@ func (t *senderRateCalculator) updateLimits(now int64, timerLimit uint32) uint32
 	return t.recalculate(now)
 }
 
-// minRate returns the unconditionally minimal sending rate in bytes per second
+// minRate returns the unconditionally minimal sending rate in bytes per second, which is one
+// segment per X_MAX_BACKOFF_INTERVAL. It is rounded up, since the strober converts rates to
+// whole packets per 64 sec and would otherwise divide by zero (see senderStrober.SetRate).
 func minRate(ss uint32) uint32 {
 	//fmt.Printf("minRate, ss=%d\n", ss)
-	return uint32((1e9 * int64(ss)) / X_MAX_BACKOFF_INTERVAL)
+	return uint32((1e9 * int64(ss) + X_MAX_BACKOFF_INTERVAL - 1) / X_MAX_BACKOFF_INTERVAL)
 }
 
 // thruEq returns the allowed sending rate, in bytes per second, according to the TCP
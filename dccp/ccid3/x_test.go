@@ -0,0 +1,27 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package ccid3
+
+import (
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// TestMinRate checks that the minimal sending rate is no less than one segment per 64 sec, so
+// that the strober can be set to it
+func TestMinRate(t *testing.T) {
+	var s senderStrober
+	for _, ss := range []uint32{1, 63, 1000, 1500, FixedSegmentSize} {
+		x := minRate(ss)
+		if BytesPerSecondToPacketsPer64Sec(x, ss) < 1 {
+			t.Errorf("min rate %d B/s is below one segment of %d bytes per 64 sec", x, ss)
+			continue
+		}
+		s.Init(dccp.NewEnv(nil), dccp.NoLogging, x, ss)
+		if s.interval <= 0 || s.interval > 64e9 {
+			t.Errorf("strobe interval %d at min rate, segment size %d", s.interval, ss)
+		}
+	}
+}
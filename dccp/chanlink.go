@@ -9,16 +9,40 @@ import (
 	"time"
 )
 
-// ChanLink treats one side of a channel as an incoming packet link
+// ChanLink treats one side of a channel as an incoming packet link. Every packet carries
+// the address passed to WriteTo, which is returned by ReadFrom on the other side. A pair
+// of ChanLinks thus connects exactly two endpoints, which typically ignore the addresses,
+// while a router in the middle of several pairs can use them to forward packets (see the
+// VirtualNet of the sandbox).
+//
+// Closing a ChanLink ends its outgoing direction: blocked and future writes fail, and reads
+// on the other side return ErrIO. The channels themselves are never closed, so that Close
+// does not race with writes in progress.
+//
+// The ChanLinks of NewChanPipeEnv wait through an Env, so that the goroutines of a
+// synthetic Env can read and write them (see Runtime).
 type ChanLink struct {
 	Mutex
-	in, out chan []byte
+	env            *Env
+	in, out        chan chanPacket
+	done, peerDone chan int // Closed when this side and the other side are closed, respectively
+}
+
+type chanPacket struct {
+	p    []byte
+	addr net.Addr
 }
 
 func NewChanPipe() (p, q *ChanLink) {
-	c0 := make(chan []byte)
-	c1 := make(chan []byte)
-	return &ChanLink{in: c0, out: c1}, &ChanLink{in: c1, out: c0}
+	return NewChanPipeEnv(nil)
+}
+
+// NewChanPipeEnv creates a pair of ChanLinks, like NewChanPipe, whose reads and writes wait
+// through env
+func NewChanPipeEnv(env *Env) (p, q *ChanLink) {
+	c0, c1 := make(chan chanPacket), make(chan chanPacket)
+	d0, d1 := make(chan int), make(chan int)
+	return &ChanLink{env: env, in: c0, out: c1, done: d0, peerDone: d1}, &ChanLink{env: env, in: c1, out: c0, done: d1, peerDone: d0}
 }
 
 func (l *ChanLink) GetMTU() int {
@@ -40,15 +64,15 @@ func (l *ChanLink) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
 		return 0, nil, ErrBad
 	}
 
-	p, ok := <-in
-	if !ok {
+	i, pkt, _, _ := Select(l.env, -1, in, l.peerDone)
+	if i != 0 {
 		return 0, nil, ErrIO
 	}
-	n = copy(buf, p)
-	if n != len(p) {
+	n = copy(buf, pkt.p)
+	if n != len(pkt.p) {
 		panic("insufficient buf len")
 	}
-	return len(p), nil, nil
+	return n, pkt.addr, nil
 }
 
 func (l *ChanLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
@@ -61,7 +85,9 @@ func (l *ChanLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
 
 	p := make([]byte, len(buf))
 	copy(p, buf)
-	out <- p
+	if !Send(l.env, out, chanPacket{p, addr}, l.done) {
+		return 0, ErrBad
+	}
 	return len(buf), nil
 }
 
@@ -70,7 +96,7 @@ func (l *ChanLink) Close() error {
 	defer l.Unlock()
 
 	if l.out != nil {
-		close(l.out)
+		close(l.done)
 		l.out = nil
 	}
 	return nil
@@ -21,11 +21,15 @@ type Conn struct {
 	readAppLk      Mutex
 	readApp        chan []byte  // readLoop() sends application data to Read()
 	writeDataLk    Mutex
-	writeData      chan []byte  // Write() sends application data to writeLoop()
+	writeData      chan *appData // Write() sends application data to writeLoop()
+	writeDone      chan int     // Closed when Write is no longer accepted
 	writeNonDataLk Mutex
 	writeNonData   chan *writeHeader // inject() sends wire-format non-Data packets (higher priority) to writeLoop()
 
 	writeTime      monotoneTime
+	delivery       deliveryTracker // Protected by the Conn lock
+	ackVector      ackVectorRecorder // Protected by the Conn lock
+	ackVectorFeat  ackVectorFeature  // Protected by the Conn lock
 }
 
 // Joiner returns a Joiner instance that can wait until all goroutines
@@ -48,10 +52,14 @@ func newConn(env *Env, amb *Amb, hc HeaderConn, scc SenderCongestionControl, rcc
 		rcc:          rcc,
 		ccidOpen:     false,
 		readApp:      make(chan []byte, 5),
-		writeData:    make(chan []byte),
+		writeData:    make(chan *appData),
+		writeDone:    make(chan int),
 		writeNonData: make(chan *writeHeader, 5),
 	}
 	c.writeTime.Init(env)
+	c.delivery.Init(env, amb)
+	c.ackVector.Init()
+	c.ackVectorFeat.Init()
 
 	c.Lock()
 	// Currently, CCID is not negotiated, rather both sides use the same
@@ -79,7 +87,7 @@ func NewConnServer(env *Env, amb *Amb, hc HeaderConn,
 	c.gotoLISTEN()
 	c.Unlock()
 
-	c.env.Go(func() { c.writeLoop(c.writeNonData, c.writeData) }, "ConnServer·writLoop")
+	c.env.Go(func() { c.writeLoop(c.writeNonData, c.writeData, c.writeDone) }, "ConnServer·writLoop")
 	c.env.Go(func() { c.readLoop() }, "ConnServer·readLoop")
 	c.env.Go(func() { c.idleLoop() }, "ConnServer·idleLoop")
 	return c
@@ -94,7 +102,7 @@ func NewConnClient(env *Env, amb *Amb, hc HeaderConn,
 	c.gotoREQUEST(serviceCode)
 	c.Unlock()
 
-	c.env.Go(func() { c.writeLoop(c.writeNonData, c.writeData) }, "ConnClient·writeLoop")
+	c.env.Go(func() { c.writeLoop(c.writeNonData, c.writeData, c.writeDone) }, "ConnClient·writeLoop")
 	c.env.Go(func() { c.readLoop() }, "ConnClient·readLoop")
 	c.env.Go(func() { c.idleLoop() }, "ConnClient·idleLoop")
 	return c
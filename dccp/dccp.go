@@ -14,13 +14,44 @@ type Stack struct {
 
 // NewStack creates a new connection-handling object.
 func NewStack(link Link, ccid CCID) *Stack {
+	return NewStackConfig(link, ccid, MuxConfig{})
+}
+
+// NewStackConfig creates a new connection-handling object, whose Mux observes the admission
+// limits in config. Unless config provides a Reject function, connection requests beyond the
+// limits are answered with a Reset with code ResetTooBusy.
+func NewStackConfig(link Link, ccid CCID, config MuxConfig) *Stack {
+	if config.Reject == nil {
+		config.Reject = rejectTooBusy
+	}
 	return &Stack{
-		mux:  NewMux(link),
+		mux:  NewMuxConfig(config, link),
 		link: link,
 		ccid: ccid,
 	}
 }
 
+// rejectTooBusy returns the wire format of a Reset with code ResetTooBusy in response to the
+// DCCP Request in p, or nil if p is not a Request. Since there is no connection state, the
+// sequence and acknowledgement numbers are chosen as in Section 8.3.1.
+func rejectTooBusy(p []byte) []byte {
+	h, err := ReadHeader(p, LabelZero.Bytes(), LabelZero.Bytes(), AnyProto, false)
+	if err != nil || h.Type != Request {
+		return nil
+	}
+	r := &Header{}
+	r.InitResetHeader(ResetTooBusy)
+	if h.HasAckNo() {
+		r.SeqNo = h.AckNo + 1
+	}
+	r.AckNo = h.SeqNo
+	q, err := r.Write(LabelZero.Bytes(), LabelZero.Bytes(), AnyProto, false)
+	if err != nil {
+		return nil
+	}
+	return q
+}
+
 // Dial initiates a new connection to the specified Link-layer address.
 func (s *Stack) Dial(addr net.Addr, serviceCode uint32) (c SegmentConn, err error) {
 	bc, err := s.mux.Dial(addr)
@@ -0,0 +1,193 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import "fmt"
+
+// Delivery reports the fate of an application message that was written with WriteTracked.
+//
+// Message IDs are returned by WriteTracked rather than by Write, since Write must keep
+// returning only an error for Conn to implement SegmentConn (see TODO). Reports are read with
+// ReadDelivery, rather than received from a channel, since it waits through the Env (see
+// Recv), which a plain receive in the goroutine of a sandbox Env would not.
+type Delivery struct {
+	ID    int64 // The message ID returned by WriteTracked
+	SeqNo int64 // The sequence number of the DCCP packet that carried the message
+	Lost  bool  // True if the message was deemed lost, false if it was acknowledged
+	// Unknown is true if the fate of the message could not be established before the
+	// packet that carried it fell behind the Ack window. Lost is false in this case.
+	Unknown bool
+}
+
+// SeqNoRange is an inclusive range of sequence numbers
+type SeqNoRange struct {
+	From, To int64
+}
+
+// Contains returns true if seqno is in the range, in circular sequence space
+func (r SeqNoRange) Contains(seqno int64) bool {
+	return SeqNoDiff(seqno, r.From) >= 0 && SeqNoDiff(r.To, seqno) >= 0
+}
+
+// LossReporter is an optional interface, which a SenderCongestionControl implements if it
+// can tell which of the sent packets the HC-Receiver has received or lost. Conn uses it to
+// produce delivery reports, when feedback packets carry no Ack Vector.
+type LossReporter interface {
+
+	// LossReport inspects the feedback header fb. If fb carries loss information, LossReport
+	// returns the ranges of sequence numbers that the feedback proves were received and
+	// lost. The fate of packets in neither range is unknown. If fb carries no loss
+	// information, ok is false.
+	LossReport(fb *FeedbackHeader) (received, lost []SeqNoRange, ok bool)
+}
+
+// deliveryDupAck is the number of packets that must be received after a packet that the
+// Ack Vector reports as not received, before the packet is deemed lost, as in Section 7.2
+// of RFC 5348
+const deliveryDupAck = 3
+
+// deliveryBufferLen is the number of delivery reports that can be pending before the
+// application reads them, after which further reports are dropped
+const deliveryBufferLen = 64
+
+// deliveryTracker remembers the sequence numbers of tracked messages until they are
+// acknowledged or deemed lost. Its methods, except Read and Close, are called under the Conn lock.
+type deliveryTracker struct {
+	env     *Env
+	amb     *Amb
+	lastID  int64
+	pending map[int64]int64 // Sequence number mapped to message ID
+
+	reportLk Mutex
+	report   chan Delivery // Delivery reports waiting for the application
+	closed   bool
+}
+
+// Init resets the deliveryTracker for new use
+func (t *deliveryTracker) Init(env *Env, amb *Amb) {
+	t.env = env
+	t.amb = amb
+	t.lastID = 0
+	t.pending = make(map[int64]int64)
+	t.report = make(chan Delivery, deliveryBufferLen)
+	t.closed = false
+}
+
+// ChooseID returns a new message ID. IDs are positive and increasing.
+func (t *deliveryTracker) ChooseID() int64 {
+	t.lastID++
+	return t.lastID
+}
+
+// OnWrite is called when the message id is sent in the packet with sequence number seqno
+func (t *deliveryTracker) OnWrite(seqno, id int64) {
+	t.pending[seqno] = id
+}
+
+// OnRead is called with every feedback header received. lr is the loss reporter of the
+// sender congestion control, if one is available. awl is the low end of the Ack window;
+// the fate of pending packets below it can no longer be learned, and it is reported unknown.
+func (t *deliveryTracker) OnRead(fb *FeedbackHeader, lr LossReporter, awl int64) {
+	if len(t.pending) == 0 {
+		return
+	}
+	if fb.Type == Ack || fb.Type == DataAck {
+		t.onAck(fb, lr)
+	}
+	for seqno, id := range t.pending {
+		if SeqNoDiff(seqno, awl) < 0 {
+			t.resolve(seqno, id, Delivery{Unknown: true})
+		}
+	}
+}
+
+func (t *deliveryTracker) onAck(fb *FeedbackHeader, lr LossReporter) {
+	// The packet with sequence number AckNo has certainly been received
+	if id, ok := t.pending[fb.AckNo]; ok {
+		t.resolve(fb.AckNo, id, Delivery{})
+	}
+
+	// Prefer the Ack Vector, which describes the state of each individual packet. A packet
+	// that has not been received yet may still be in flight, unless enough later packets
+	// have overtaken it.
+	if av := FindAckVectorOption(fb.Options); av != nil {
+		var later int
+		av.Walk(fb.AckNo, func(seqno int64, state byte) {
+			if state != AckVectorNotReceived {
+				later++
+			}
+			id, ok := t.pending[seqno]
+			switch {
+			case !ok:
+			case state != AckVectorNotReceived:
+				t.resolve(seqno, id, Delivery{})
+			case later >= deliveryDupAck:
+				t.resolve(seqno, id, Delivery{Lost: true})
+			}
+		})
+		return
+	}
+
+	// Otherwise, use the loss report of the congestion control
+	if lr == nil {
+		return
+	}
+	received, lost, ok := lr.LossReport(fb)
+	if !ok {
+		return
+	}
+	for seqno, id := range t.pending {
+		switch {
+		case inSeqNoRanges(lost, seqno):
+			t.resolve(seqno, id, Delivery{Lost: true})
+		case inSeqNoRanges(received, seqno):
+			t.resolve(seqno, id, Delivery{})
+		}
+	}
+}
+
+func inSeqNoRanges(ranges []SeqNoRange, seqno int64) bool {
+	for _, r := range ranges {
+		if r.Contains(seqno) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve reports the fate of message id, carried by packet seqno, as given by the Lost and
+// Unknown fields of d
+func (t *deliveryTracker) resolve(seqno, id int64, d Delivery) {
+	delete(t.pending, seqno)
+	d.ID, d.SeqNo = id, seqno
+	// Reports are dropped silently once the tracker is closed, and with a warning if the
+	// queue is full
+	t.reportLk.Lock()
+	defer t.reportLk.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.report <- d:
+	default:
+		t.amb.E(EventWarn, fmt.Sprintf("Slow delivery reader, ID=%d", id))
+	}
+}
+
+// Read blocks until the next delivery report is available. It returns false once the
+// tracker is closed and all reports have been read.
+func (t *deliveryTracker) Read() (d Delivery, ok bool) {
+	return Recv(t.env, t.report)
+}
+
+// Close closes the delivery report queue. It MUST be idempotent.
+func (t *deliveryTracker) Close() {
+	t.reportLk.Lock()
+	defer t.reportLk.Unlock()
+	if !t.closed {
+		close(t.report)
+		t.closed = true
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"testing"
+)
+
+type fixedLossReporter struct {
+	received, lost []SeqNoRange
+}
+
+func (x *fixedLossReporter) LossReport(fb *FeedbackHeader) ([]SeqNoRange, []SeqNoRange, bool) {
+	return x.received, x.lost, true
+}
+
+func readDeliveries(t *deliveryTracker) map[int64]bool {
+	r := make(map[int64]bool)
+	for {
+		select {
+		case d := <-t.report:
+			r[d.ID] = d.Lost
+		default:
+			return r
+		}
+	}
+	panic("unreach")
+}
+
+func TestDeliveryAckVector(t *testing.T) {
+	var dt deliveryTracker
+	dt.Init(NewEnv(nil), NoLogging)
+	for seqno := int64(10); seqno < 17; seqno++ {
+		dt.OnWrite(seqno, dt.ChooseID())
+	}
+	// 16 received, 15 not received, 14 and 13 received, 12 not received, 11 and 10 received
+	avopt, err := (&AckVectorOption{Cells: []AckVectorCell{
+		{AckVectorReceived, 0},
+		{AckVectorNotReceived, 0},
+		{AckVectorReceived, 1},
+		{AckVectorNotReceived, 0},
+		{AckVectorReceived, 1},
+	}}).Encode()
+	if err != nil {
+		t.Fatalf("ack vector encode: %s", err)
+	}
+	if av := DecodeAckVectorOption(avopt); av == nil || len(av.Cells) != 5 {
+		t.Fatalf("ack vector decode")
+	}
+	dt.OnRead(&FeedbackHeader{Type: Ack, X: true, AckNo: 16, Options: []*Option{avopt}}, nil, 0)
+	r := readDeliveries(&dt)
+	// 15 may still be in flight, while 12 has been overtaken by three packets
+	if _, ok := r[6]; ok || len(r) != 6 {
+		t.Fatalf("expecting 6 reports and message 6 pending, got %v", r)
+	}
+	for id, lost := range r {
+		if lost != (id == 3) {
+			t.Errorf("message %d: lost=%v", id, lost)
+		}
+	}
+}
+
+func TestAckVectorRecorder(t *testing.T) {
+	var r ackVectorRecorder
+	r.Init()
+	if r.Option(5) != nil {
+		t.Errorf("ack vector before any packet")
+	}
+	// Start just before the sequence numbers wrap around
+	first := int64(seqNoMask - 4)
+	for i := int64(0); i < 12; i++ {
+		if i != 3 && i != 7 {
+			r.OnRead(SeqNoAdd(first, i))
+		}
+	}
+	// A late packet arrives
+	r.OnRead(SeqNoAdd(first, 3))
+	last := SeqNoAdd(first, 11)
+	if r.Option(SeqNoAdd(last, -1)) != nil {
+		t.Errorf("ack vector for a packet other than the greatest received")
+	}
+	av := r.Option(last)
+	expect := []AckVectorCell{
+		{AckVectorReceived, 3},
+		{AckVectorNotReceived, 0},
+		{AckVectorReceived, 6},
+	}
+	if av == nil || len(av.Cells) != len(expect) {
+		t.Fatalf("ack vector %v, expecting %v", av, expect)
+	}
+	for i, cell := range av.Cells {
+		if cell != expect[i] {
+			t.Errorf("cell %d is %v, expecting %v", i, cell, expect[i])
+		}
+	}
+	var n int64
+	av.Walk(last, func(seqno int64, state byte) {
+		if seqno != SeqNoAdd(last, -n) || seqno < 0 || seqno > seqNoMask {
+			t.Errorf("walk visits %d at step %d", seqno, n)
+		}
+		n++
+	})
+	if n != 12 {
+		t.Errorf("walk visits %d sequence numbers, expecting 12", n)
+	}
+
+	// The vector is limited to ackVectorMaxCells cells
+	r.Init()
+	for i := int64(0); i < 100; i += 2 {
+		r.OnRead(i)
+	}
+	if av = r.Option(98); av == nil || len(av.Cells) != ackVectorMaxCells {
+		t.Errorf("ack vector %v, expecting %d cells", av, ackVectorMaxCells)
+	}
+}
+
+func TestDeliveryLossReport(t *testing.T) {
+	var dt deliveryTracker
+	dt.Init(NewEnv(nil), NoLogging)
+	for seqno := int64(10); seqno < 20; seqno++ {
+		dt.OnWrite(seqno, seqno)
+	}
+	lr := &fixedLossReporter{received: []SeqNoRange{{14, 16}}, lost: []SeqNoRange{{12, 12}}}
+	dt.OnRead(&FeedbackHeader{Type: Ack, X: true, AckNo: 18}, lr, 0)
+	r := readDeliveries(&dt)
+	for seqno := int64(10); seqno < 20; seqno++ {
+		lost, ok := r[seqno]
+		switch {
+		case seqno == 12:
+			if !ok || !lost {
+				t.Errorf("message %d should be lost", seqno)
+			}
+		case seqno >= 14 && seqno <= 16 || seqno == 18:
+			if !ok || lost {
+				t.Errorf("message %d should be received", seqno)
+			}
+		case ok:
+			t.Errorf("message %d should be pending", seqno)
+		}
+	}
+
+	// The fate of packets that fall behind the Ack window is unknown
+	dt.OnRead(&FeedbackHeader{Type: Sync, X: true}, nil, 12)
+	select {
+	case d := <-dt.report:
+		if d.ID != 10 && d.ID != 11 || d.Lost || !d.Unknown {
+			t.Errorf("expecting message 10 or 11 unknown, got %v", d)
+		}
+	default:
+		t.Errorf("expecting a report")
+	}
+	if r = readDeliveries(&dt); len(r) != 1 {
+		t.Errorf("expecting one more report, got %v", r)
+	}
+	dt.Close()
+	dt.Close()
+}
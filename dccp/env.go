@@ -5,6 +5,9 @@
 package dccp
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
 	"sync"
 	"time"
 	"github.com/petar/GoGauge/filter"
@@ -13,28 +16,120 @@ import (
 // Env encapsulates the runtime environment of a DCCP endpoint.  It includes a pluggable
 // time interface, in order to allow for use of real as well as synthetic (accelerated) time
 // (for testing purposes), as well as a amb interface.
+//
+// All protocol randomness (initial sequence numbers, labels, jitter) is drawn from the
+// random source of the Env. It is crypto/rand, unless the Env is created with a seed for
+// testing (see NewEnvRuntime).
 type Env struct {
 	guzzle  Guzzle
 	filter  *filter.Filter
 	gojoin  *GoJoin
+	rt      Runtime // nil in real time
+
+	offerLk sync.Mutex
+	offers  map[uintptr][]*offer // Values offered by Send on unbuffered channels, see Send
 
 	sync.Mutex
 	timeZero int64 // Time when execution started
 	timeLast int64 // Time of last log message
+	rand     *rand.Rand
+}
+
+// Runtime is the time interface of an Env that does not run in real time, such as the
+// synthetic time of the sandbox. The goroutines of such an Env are the goroutine that
+// creates it and those started with Go. The Runtime lets them sleep with Sleep, and wait
+// with Wait for the channel operations of Recv, Select and Send and the Joiners of the Env.
+type Runtime interface {
+	Now() int64
+	Sleep(ns int64)
+
+	// Go runs f in a new goroutine of the Env
+	Go(f func())
+
+	// Wait blocks until try returns true, or until timeout nanoseconds pass if timeout is not
+	// negative. try performs a channel operation without blocking and reports whether it
+	// succeeded. It is called by Wait, and then again whenever another goroutine of the Env
+	// may have made it succeed. Wait returns false on timeout.
+	Wait(try func() bool, timeout int64) bool
 }
 
+// NewEnv creates an Env that runs in real time and draws its randomness from crypto/rand,
+// since labels and initial sequence numbers must not be predictable (RFC 4340, Section 7.2)
 func NewEnv(guzzle Guzzle) *Env {
-	now := time.Now().UnixNano()
+	return newEnv(guzzle, nil, rand.New(cryptoSource{}))
+}
+
+// NewEnvRuntime creates an Env whose time is kept by rt, or real time if rt is nil, and
+// whose random source is seeded with seed, so that runs can be reproduced. It is meant for
+// testing, such as in the sandbox, since seeded randomness is predictable.
+func NewEnvRuntime(guzzle Guzzle, rt Runtime, seed int64) *Env {
+	return newEnv(guzzle, rt, rand.New(rand.NewSource(seed)))
+}
+
+func newEnv(guzzle Guzzle, rt Runtime, src *rand.Rand) *Env {
 	r := &Env{
-		guzzle:   guzzle,
-		filter:   filter.NewFilter(),
-		gojoin:   NewGoJoin("Env"),
-		timeZero: now,
-		timeLast: now,
+		guzzle: guzzle,
+		filter: filter.NewFilter(),
+		rt:     rt,
+		rand:   src,
 	}
+	r.timeZero = r.Now()
+	r.timeLast = r.timeZero
+	r.gojoin = r.NewGoJoin("Env")
 	return r
 }
 
+// cryptoSource is a rand.Source that reads from crypto/rand
+type cryptoSource struct{}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		panic("crypto/rand failed")
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (x cryptoSource) Int63() int64 { return int64(x.Uint64() >> 1) }
+
+func (cryptoSource) Seed(int64) { panic("crypto/rand cannot be seeded") }
+
+// Int63n returns a pseudo-random number in [0,n) from the random source of the Env
+func (t *Env) Int63n(n int64) int64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.rand.Int63n(n)
+}
+
+// Float64 returns a pseudo-random number in [0,1) from the random source of the Env
+func (t *Env) Float64() float64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.rand.Float64()
+}
+
+// NormFloat64 returns a standard normally distributed number from the random source of the Env
+func (t *Env) NormFloat64() float64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.rand.NormFloat64()
+}
+
+// ExpFloat64 returns an exponentially distributed number with rate 1 from the random source
+// of the Env
+func (t *Env) ExpFloat64() float64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.rand.ExpFloat64()
+}
+
+// ChooseLabel creates a new label, whose bytes are drawn from the random source of the Env
+func (t *Env) ChooseLabel() *Label {
+	t.Lock()
+	defer t.Unlock()
+	return chooseLabel(t.rand.Int)
+}
+
 // Go runs f in a new GoRoutine. The GoRoutine is also added to the GoJoin of the Env.
 func (t *Env) Go(f func(), fmt_ string, args_ ...interface{}) {
 	t.gojoin.Go(f, fmt_, args_...)
@@ -44,8 +139,9 @@ func (t *Env) Joiner() Joiner {
 	return t.gojoin
 }
 
+// NewGoJoin creates a GoJoin, whose goroutines belong to the Env
 func (t *Env) NewGoJoin(annotation string, group ...Joiner) *GoJoin {
-	return NewGoJoin(annotation, group...)
+	return newGoJoin(t, 1, annotation, group...)
 }
 
 func (t *Env) Guzzle() Guzzle {
@@ -61,14 +157,24 @@ func (t *Env) Sync() error {
 }
 
 func (t *Env) Close() error {
+	if t.guzzle == nil {
+		return nil
+	}
 	return t.guzzle.Close()
 }
 
 func (t *Env) Now() int64 {
+	if t.rt != nil {
+		return t.rt.Now()
+	}
 	return time.Now().UnixNano()
 }
 
 func (t *Env) Sleep(ns int64) {
+	if t.rt != nil {
+		t.rt.Sleep(ns)
+		return
+	}
 	time.Sleep(time.Duration(ns))
 }
 
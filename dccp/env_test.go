@@ -0,0 +1,31 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"testing"
+)
+
+func TestEnvSeed(t *testing.T) {
+	// Replaying a seed reproduces the labels and initial sequence numbers
+	a, b := NewEnvRuntime(nil, nil, 7), NewEnvRuntime(nil, nil, 7)
+	for i := 0; i < 10; i++ {
+		if !a.ChooseLabel().Equal(b.ChooseLabel()) {
+			t.Fatalf("labels differ")
+		}
+		var sa, sb socket
+		if sa.ChooseISS(a) != sb.ChooseISS(b) {
+			t.Fatalf("initial sequence numbers differ")
+		}
+	}
+	if NewEnvRuntime(nil, nil, 8).Float64() == a.Float64() {
+		t.Errorf("different seeds give the same numbers")
+	}
+
+	// Without a seed, labels are not reproducible
+	if NewEnv(nil).ChooseLabel().Equal(NewEnv(nil).ChooseLabel()) {
+		t.Errorf("labels of unseeded Envs are equal")
+	}
+}
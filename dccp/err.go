@@ -42,6 +42,7 @@ var (
 	ErrTimeout = NewError("i/o timeout")
 	ErrBad     = NewError("i/o bad connection")
 	ErrIO      = NewError("i/o error")
+	ErrTooBusy = NewError("i/o too busy")
 )
 
 // Congestion Control errors/events
@@ -0,0 +1,133 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+// FeatureOption is a Change L, Confirm L, Change R or Confirm R option, Section 6.
+// A Change option carries the preference list of the sender, most preferred first. A
+// Confirm option carries the selected value followed by the preference list of the sender,
+// or no value at all if the sender does not know the feature.
+type FeatureOption struct {
+	Type    byte // One of OptionChangeL, OptionConfirmL, OptionChangeR or OptionConfirmR
+	Feature byte
+	Values  []byte
+}
+
+const (
+	// FeatureSendAckVector is the number of the Send Ack Vector feature, Section 11.5
+	FeatureSendAckVector = 2
+)
+
+func isOptionFeature(optionType byte) bool {
+	return optionType >= OptionChangeL && optionType <= OptionConfirmR
+}
+
+func (opt *FeatureOption) Encode() (*Option, error) {
+	if !isOptionFeature(opt.Type) {
+		return nil, ErrOption
+	}
+	d := make([]byte, 1+len(opt.Values))
+	d[0] = opt.Feature
+	copy(d[1:], opt.Values)
+	return &Option{
+		Type:      opt.Type,
+		Data:      d,
+		Mandatory: false,
+	}, nil
+}
+
+func DecodeFeatureOption(opt *Option) *FeatureOption {
+	if !isOptionFeature(opt.Type) || len(opt.Data) < 1 {
+		return nil
+	}
+	return &FeatureOption{Type: opt.Type, Feature: opt.Data[0], Values: opt.Data[1:]}
+}
+
+// reconcileServerPriority returns the value selected by the server-priority reconciliation
+// rule of Section 6.3.1, which is the first value in the preference list of the server that
+// also appears in that of the client. It returns false if the lists share no value.
+func reconcileServerPriority(server, client []byte) (byte, bool) {
+	for _, s := range server {
+		for _, c := range client {
+			if s == c {
+				return s, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// sendAckVectorPrefs is the preference list of Conn for the Send Ack Vector feature
+var sendAckVectorPrefs = []byte{1, 0}
+
+// ackVectorFeature negotiates the Send Ack Vector feature of both endpoints, Section 11.5.
+// Each endpoint asks the other side to send Ack Vectors with a Change R option, which it
+// places on its non-Data packets until the other side confirms it. The Send Ack Vector
+// feature of the local endpoint, which decides whether Conn places Ack Vectors on its Acks
+// and DataAcks, is off until the other side asks for it, and it takes the value in the
+// Confirm L sent in response. Peers that do not know the feature never ask, so they receive
+// no Ack Vectors.
+type ackVectorFeature struct {
+	changing bool    // True until the Change R of the local endpoint is confirmed
+	confirm  *Option // Confirm L to place on the next non-Data packet, or nil
+	enabled  bool    // The Send Ack Vector feature of the local endpoint
+}
+
+// Init resets the ackVectorFeature for new use
+func (f *ackVectorFeature) Init() {
+	*f = ackVectorFeature{changing: true}
+}
+
+// Enabled returns true if the local endpoint sends Ack Vectors
+func (f *ackVectorFeature) Enabled() bool {
+	return f.enabled
+}
+
+// OnWrite returns the feature negotiation options to place on an outgoing packet of the
+// given type
+func (f *ackVectorFeature) OnWrite(Type byte) []*Option {
+	if Type == Data {
+		return nil
+	}
+	var opts []*Option
+	if f.changing {
+		opt, _ := (&FeatureOption{Type: OptionChangeR, Feature: FeatureSendAckVector, Values: sendAckVectorPrefs}).Encode()
+		opts = append(opts, opt)
+	}
+	if f.confirm != nil {
+		opts = append(opts, f.confirm)
+		f.confirm = nil
+	}
+	return opts
+}
+
+// OnRead processes the feature negotiation options of an incoming packet. Options on Data
+// packets are ignored, since Data packets may not carry them.
+func (f *ackVectorFeature) OnRead(h *Header, server bool) {
+	if h.Type == Data {
+		return
+	}
+	for _, o := range h.Options {
+		opt := DecodeFeatureOption(o)
+		if opt == nil || opt.Feature != FeatureSendAckVector {
+			continue
+		}
+		switch opt.Type {
+		case OptionChangeR:
+			// Lists without a common value select 0, the default value of the feature
+			var v byte
+			if server {
+				v, _ = reconcileServerPriority(sendAckVectorPrefs, opt.Values)
+			} else {
+				v, _ = reconcileServerPriority(opt.Values, sendAckVectorPrefs)
+			}
+			f.enabled = v == 1
+			values := append([]byte{v}, sendAckVectorPrefs...)
+			f.confirm, _ = (&FeatureOption{Type: OptionConfirmL, Feature: FeatureSendAckVector, Values: values}).Encode()
+		case OptionConfirmL:
+			// A Confirm L without a value comes from a peer that does not know the feature
+			f.changing = false
+		}
+	}
+}
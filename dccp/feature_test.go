@@ -0,0 +1,96 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFeatureOption(t *testing.T) {
+	opt, err := (&FeatureOption{Type: OptionConfirmL, Feature: FeatureSendAckVector, Values: []byte{1, 1, 0}}).Encode()
+	if err != nil {
+		t.Fatalf("encode (%s)", err)
+	}
+	if opt.Type != OptionConfirmL || !bytes.Equal(opt.Data, []byte{FeatureSendAckVector, 1, 1, 0}) {
+		t.Errorf("encoded %v", opt)
+	}
+	f := DecodeFeatureOption(opt)
+	if f == nil || f.Feature != FeatureSendAckVector || !bytes.Equal(f.Values, []byte{1, 1, 0}) {
+		t.Errorf("decoded %v", f)
+	}
+	if _, err := (&FeatureOption{Type: OptionTimestamp}).Encode(); err == nil {
+		t.Errorf("expecting error on a non-feature option")
+	}
+
+	// The preference list of the server wins
+	if v, ok := reconcileServerPriority([]byte{1, 0}, []byte{0, 1}); !ok || v != 1 {
+		t.Errorf("server priority %d %v, expecting 1", v, ok)
+	}
+	if v, ok := reconcileServerPriority([]byte{0, 1}, []byte{1, 0}); !ok || v != 0 {
+		t.Errorf("server priority %d %v, expecting 0", v, ok)
+	}
+	if _, ok := reconcileServerPriority([]byte{1}, []byte{0}); ok {
+		t.Errorf("expecting no common value")
+	}
+}
+
+// exchangeFeature passes the feature options written by from on a packet of the given type
+// to to, and returns them
+func exchangeFeature(from, to *ackVectorFeature, Type byte, server bool) []*Option {
+	opts := from.OnWrite(Type)
+	to.OnRead(&Header{Type: Type, Options: opts}, server)
+	return opts
+}
+
+func TestAckVectorFeature(t *testing.T) {
+	var client, server ackVectorFeature
+	client.Init()
+	server.Init()
+	if client.Enabled() || server.Enabled() {
+		t.Fatalf("Send Ack Vector enabled before negotiation")
+	}
+	if opts := client.OnWrite(Data); len(opts) != 0 {
+		t.Errorf("feature options %v on a Data packet", opts)
+	}
+
+	// Request: Change R
+	if opts := exchangeFeature(&client, &server, Request, true); len(opts) != 1 || opts[0].Type != OptionChangeR {
+		t.Errorf("request options %v", opts)
+	}
+	if !server.Enabled() || client.Enabled() {
+		t.Errorf("after request, server %v and client %v", server.Enabled(), client.Enabled())
+	}
+	// Response: Change R and Confirm L
+	if opts := exchangeFeature(&server, &client, Response, false); len(opts) != 2 {
+		t.Errorf("response options %v", opts)
+	}
+	if !client.Enabled() || client.changing {
+		t.Errorf("client not done after response")
+	}
+	// Ack: Confirm L
+	if opts := exchangeFeature(&client, &server, Ack, true); len(opts) != 1 || opts[0].Type != OptionConfirmL {
+		t.Errorf("ack options %v", opts)
+	}
+	if server.changing {
+		t.Errorf("server not done after ack")
+	}
+	if len(client.OnWrite(Ack)) != 0 || len(server.OnWrite(Ack)) != 0 {
+		t.Errorf("feature options after negotiation")
+	}
+
+	// A peer that does not know the feature never asks for Ack Vectors. One that answers
+	// with an empty Confirm L stops the Change R.
+	var local ackVectorFeature
+	local.Init()
+	local.OnRead(&Header{Type: Response}, false)
+	if local.Enabled() || !local.changing {
+		t.Errorf("unexpected state %v", local)
+	}
+	local.OnRead(&Header{Type: Ack, Options: []*Option{{Type: OptionConfirmL, Data: []byte{FeatureSendAckVector}}}}, false)
+	if local.Enabled() || local.changing {
+		t.Errorf("unexpected state %v after empty confirm", local)
+	}
+}
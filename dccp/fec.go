@@ -0,0 +1,326 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import "fmt"
+
+// FECConn is an optional layer on top of a SegmentConn, which adds forward error correction
+// in place of retransmission. Outgoing blocks are grouped into FEC blocks of k consecutive
+// blocks, and each FEC block is followed by an XOR parity packet. The receiving side delivers
+// blocks as soon as they arrive and, if exactly one block of an FEC block is lost, rebuilds
+// it from the parity packet. FECConn implements SegmentConn.
+//
+// If the underlying connection implements LossEventRater (as Conn does with CCID3), k is
+// adapted to the loss event rate p, so that k ≈ 1/(2p) within [FECMinBlockLen, maxBlockLen].
+// Otherwise k equals maxBlockLen.
+//
+// Both endpoints of a connection must use FECConn with the same maxBlockLen, since every
+// block carries a small FEC header on the wire, and the receiving side drops packets of FEC
+// blocks longer than its own maxBlockLen.
+type FECConn struct {
+	env         *Env
+	amb         *Amb
+	sc          SegmentConn
+	maxBlockLen int
+
+	writeLk  Mutex
+	blockID  uint32 // ID of the FEC block being written
+	blockLen int    // Number of data packets in the FEC block being written
+	written  int    // Number of data packets written so far in the current FEC block
+	parity   []byte // Running XOR of the data packets in the current FEC block
+	lenXOR   uint16 // Running XOR of the lengths of the data packets in the current FEC block
+
+	readLk    Mutex
+	blocks    map[uint32]*fecBlock // FEC blocks under reception, keyed by block ID
+	order     []uint32             // IDs of blocks under reception, in order of arrival
+	recovered []byte               // A rebuilt block waiting to be returned by Read
+	stats     FECStats
+}
+
+// FECStats holds the receive-side counters of an FECConn
+type FECStats struct {
+	Received  int64 // Data packets received
+	Recovered int64 // Data packets rebuilt from parity
+	Parity    int64 // Parity packets received
+}
+
+// fecBlock holds the data packets of an FEC block that have been received so far
+type fecBlock struct {
+	data   map[byte][]byte
+	parity []byte // Parity payload, if the parity packet has arrived
+	count  int    // Number of data packets covered by the parity packet
+	done   bool   // Whether the block is complete or has been rebuilt
+}
+
+const (
+	// FECMinBlockLen is the smallest number of data packets protected by one parity packet
+	FECMinBlockLen = 2
+
+	// FECMaxBlockLen is the default and largest number of data packets protected by one parity packet
+	FECMaxBlockLen = 32
+
+	// fecMaxPending is the number of FEC blocks that can be under reception at once.
+	// When exceeded, the oldest block is forgotten.
+	fecMaxPending = 16
+
+	// fecFootprint is the size of the FEC header: a 32-bit block ID, followed by 8-bit packet
+	// index and 8-bit count. Parity packets have index fecParityIndex, and count equals
+	// the number of data packets they cover. Data packets have count zero.
+	fecFootprint = 6
+
+	fecParityIndex = 0xff
+)
+
+// NewFECConn creates an FECConn on top of sc, which emits a parity packet after at most
+// maxBlockLen data packets
+func NewFECConn(env *Env, amb *Amb, sc SegmentConn, maxBlockLen int) *FECConn {
+	if maxBlockLen < FECMinBlockLen || maxBlockLen > FECMaxBlockLen {
+		panic("FEC block length out of range")
+	}
+	return &FECConn{
+		env:         env,
+		amb:         amb.Refine("fec"),
+		sc:          sc,
+		maxBlockLen: maxBlockLen,
+		blocks:      make(map[uint32]*fecBlock),
+	}
+}
+
+// GetMTU implements SegmentConn.GetMTU. Besides the FEC header, room is reserved for the
+// length field which precedes the parity payload.
+func (f *FECConn) GetMTU() int {
+	return f.sc.GetMTU() - fecFootprint - 2
+}
+
+// Stats returns the receive-side FEC counters
+func (f *FECConn) Stats() FECStats {
+	f.readLk.Lock()
+	defer f.readLk.Unlock()
+	return f.stats
+}
+
+// chooseBlockLen returns the number of data packets to be covered by the next parity packet
+func (f *FECConn) chooseBlockLen() int {
+	ler, ok := f.sc.(LossEventRater)
+	if !ok {
+		return f.maxBlockLen
+	}
+	rateInv := ler.LossEventRateInv()
+	if rateInv == 0 || rateInv == UnknownLossEventRateInv {
+		return f.maxBlockLen
+	}
+	k := int(rateInv / 2)
+	if k < FECMinBlockLen {
+		k = FECMinBlockLen
+	}
+	if k > f.maxBlockLen {
+		k = f.maxBlockLen
+	}
+	return k
+}
+
+// Write implements SegmentConn.Write. The parity packet is sent right after the last data
+// packet of an FEC block.
+func (f *FECConn) Write(block []byte) error {
+	if len(block) > f.GetMTU() {
+		return ErrTooBig
+	}
+	f.writeLk.Lock()
+	defer f.writeLk.Unlock()
+
+	if f.written == 0 {
+		f.blockLen = f.chooseBlockLen()
+	}
+	p := make([]byte, fecFootprint+len(block))
+	EncodeUint32(f.blockID, p[0:4])
+	EncodeUint8(byte(f.written), p[4:5])
+	EncodeUint8(0, p[5:6])
+	copy(p[fecFootprint:], block)
+	if err := f.sc.Write(p); err != nil {
+		return err
+	}
+	f.parity = xorInto(f.parity, block)
+	f.lenXOR ^= uint16(len(block))
+	f.written++
+	if f.written < f.blockLen {
+		return nil
+	}
+	return f.flush()
+}
+
+// Flush sends the parity packet of the current FEC block early. Applications call it when
+// they pause writing, so that the last few packets written are protected as well.
+func (f *FECConn) Flush() error {
+	f.writeLk.Lock()
+	defer f.writeLk.Unlock()
+	if f.written == 0 {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *FECConn) flush() error {
+	f.writeLk.AssertLocked()
+	p := make([]byte, fecFootprint+2+len(f.parity))
+	EncodeUint32(f.blockID, p[0:4])
+	EncodeUint8(fecParityIndex, p[4:5])
+	EncodeUint8(byte(f.written), p[5:6])
+	EncodeUint16(f.lenXOR, p[6:8])
+	copy(p[fecFootprint+2:], f.parity)
+
+	f.blockID++
+	f.written = 0
+	f.parity = f.parity[:0]
+	f.lenXOR = 0
+	return f.sc.Write(p)
+}
+
+// xorInto XORs q into p, extending p with zeros if q is longer, and returns the result
+func xorInto(p, q []byte) []byte {
+	for len(p) < len(q) {
+		p = append(p, 0)
+	}
+	for i, b := range q {
+		p[i] ^= b
+	}
+	return p
+}
+
+// Read implements SegmentConn.Read. Data packets are returned in order of arrival. Rebuilt
+// packets are returned when the parity packet of their FEC block arrives.
+func (f *FECConn) Read() (block []byte, err error) {
+	f.readLk.Lock()
+	defer f.readLk.Unlock()
+	if f.recovered != nil {
+		block, f.recovered = f.recovered, nil
+		return block, nil
+	}
+	for {
+		p, err := f.sc.Read()
+		if err != nil {
+			return nil, err
+		}
+		if len(p) < fecFootprint {
+			f.amb.E(EventDrop, "Short FEC packet")
+			continue
+		}
+		id := DecodeUint32(p[0:4])
+		i, count := DecodeUint8(p[4:5]), int(DecodeUint8(p[5:6]))
+		b := f.getBlock(id)
+		if i == fecParityIndex {
+			if len(p) < fecFootprint+2 || count == 0 || count > f.maxBlockLen || b.parity != nil || !b.fits(count) {
+				f.amb.E(EventDrop, fmt.Sprintf("Bad parity packet for FEC block %d", id))
+				continue
+			}
+			f.stats.Parity++
+			b.parity, b.count = p[fecFootprint:], count
+			if block = f.rebuild(id, b); block != nil {
+				return block, nil
+			}
+			continue
+		}
+		if count != 0 || int(i) >= f.maxBlockLen || b.parity != nil && int(i) >= b.count {
+			f.amb.E(EventDrop, fmt.Sprintf("Bad packet %d of FEC block %d", i, id))
+			continue
+		}
+		if b.done || b.data[i] != nil {
+			f.amb.E(EventDrop, fmt.Sprintf("Duplicate packet %d of FEC block %d", i, id))
+			continue
+		}
+		f.stats.Received++
+		block = p[fecFootprint:]
+		b.data[i] = block
+		if r := f.rebuild(id, b); r != nil {
+			f.recovered = r
+		}
+		return block, nil
+	}
+	panic("unreach")
+}
+
+// getBlock returns the reception state of FEC block id, creating it if necessary
+func (f *FECConn) getBlock(id uint32) *fecBlock {
+	b, ok := f.blocks[id]
+	if ok {
+		return b
+	}
+	if len(f.order) >= fecMaxPending {
+		old := f.order[0]
+		f.order = f.order[1:]
+		if ob := f.blocks[old]; ob != nil && !ob.done && ob.parity != nil {
+			f.amb.E(EventDrop, fmt.Sprintf("FEC block %d unrecoverable", old))
+		}
+		delete(f.blocks, old)
+	}
+	b = &fecBlock{data: make(map[byte][]byte)}
+	f.blocks[id] = b
+	f.order = append(f.order, id)
+	return b
+}
+
+// fits returns true if the data packets of b received so far are among the first count
+// packets of the FEC block
+func (b *fecBlock) fits(count int) bool {
+	for i := range b.data {
+		if int(i) >= count {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuild returns the missing data packet of b, if exactly one is missing and the parity
+// packet has arrived. Otherwise it returns nil.
+func (f *FECConn) rebuild(id uint32, b *fecBlock) []byte {
+	if b.done || b.parity == nil {
+		return nil
+	}
+	if len(b.data) == b.count {
+		b.done = true
+		return nil
+	}
+	if len(b.data) != b.count-1 {
+		return nil
+	}
+	b.done = true
+	n := DecodeUint16(b.parity[0:2])
+	r := make([]byte, len(b.parity)-2)
+	copy(r, b.parity[2:])
+	missing := -1
+	for i := 0; i < b.count; i++ {
+		d, ok := b.data[byte(i)]
+		if !ok {
+			missing = i
+			continue
+		}
+		if len(d) > len(r) {
+			f.amb.E(EventDrop, fmt.Sprintf("Inconsistent parity for FEC block %d", id))
+			return nil
+		}
+		n ^= uint16(len(d))
+		for j, x := range d {
+			r[j] ^= x
+		}
+	}
+	if int(n) > len(r) {
+		f.amb.E(EventDrop, fmt.Sprintf("Inconsistent parity for FEC block %d", id))
+		return nil
+	}
+	f.stats.Recovered++
+	f.amb.E(EventInfo, fmt.Sprintf("Rebuilt packet %d of FEC block %d", missing, id))
+	return r[:n]
+}
+
+// LocalLabel implements SegmentConn.LocalLabel
+func (f *FECConn) LocalLabel() Bytes { return f.sc.LocalLabel() }
+
+// RemoteLabel implements SegmentConn.RemoteLabel
+func (f *FECConn) RemoteLabel() Bytes { return f.sc.RemoteLabel() }
+
+// SetReadExpire implements SegmentConn.SetReadExpire
+func (f *FECConn) SetReadExpire(nsec int64) error { return f.sc.SetReadExpire(nsec) }
+
+// Close implements SegmentConn.Close
+func (f *FECConn) Close() error { return f.sc.Close() }
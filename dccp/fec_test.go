@@ -0,0 +1,128 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ratedQueueConn is a queueConn that reports a fixed loss event rate
+type ratedQueueConn struct {
+	queueConn
+	rateInv uint32
+}
+
+func (x *ratedQueueConn) LossEventRateInv() uint32 { return x.rateInv }
+
+func TestFECRecovery(t *testing.T) {
+	// With blocks of 4 data packets, every block is followed by a parity packet. Drop the
+	// second packet of the first block and the fourth packet of the second block.
+	qc := &queueConn{drop: func(k int) bool { return k == 2 || k == 9 }}
+	fc := NewFECConn(NewEnv(nil), NoLogging, qc, 4)
+
+	var sent [][]byte
+	for i := 0; i < 8; i++ {
+		msg := makeMessage(100+i*10, byte(i))
+		sent = append(sent, msg)
+		if err := fc.Write(msg); err != nil {
+			t.Fatalf("write (%s)", err)
+		}
+	}
+	if len(qc.q) != 8 {
+		t.Fatalf("expecting 8 packets on the wire, got %d", len(qc.q))
+	}
+
+	var recv [][]byte
+	for {
+		p, err := fc.Read()
+		if err != nil {
+			break
+		}
+		recv = append(recv, p)
+	}
+	if len(recv) != len(sent) {
+		t.Fatalf("expecting %d messages, got %d", len(sent), len(recv))
+	}
+	for _, s := range sent {
+		found := false
+		for _, r := range recv {
+			if bytes.Equal(s, r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("message of length %d not received", len(s))
+		}
+	}
+	if st := fc.Stats(); st.Recovered != 2 || st.Received != 6 || st.Parity != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestFECBlockLen(t *testing.T) {
+	qc := &ratedQueueConn{rateInv: UnknownLossEventRateInv}
+	fc := NewFECConn(NewEnv(nil), NoLogging, qc, 16)
+	for _, c := range []struct {
+		rateInv uint32
+		k       int
+	}{
+		{UnknownLossEventRateInv, 16},
+		{1000, 16},
+		{20, 10},
+		{3, FECMinBlockLen},
+	} {
+		qc.rateInv = c.rateInv
+		if k := fc.chooseBlockLen(); k != c.k {
+			t.Errorf("rate inverse %d: expecting block length %d, got %d", c.rateInv, c.k, k)
+		}
+	}
+}
+
+// fecPacket returns a packet with an FEC header and the given payload
+func fecPacket(id uint32, i byte, count int, payload []byte) []byte {
+	p := make([]byte, fecFootprint+len(payload))
+	EncodeUint32(id, p[0:4])
+	EncodeUint8(i, p[4:5])
+	EncodeUint8(byte(count), p[5:6])
+	copy(p[fecFootprint:], payload)
+	return p
+}
+
+// TestFECBadIndex checks that packets whose index or count do not fit the FEC block are
+// dropped, rather than used to rebuild a packet
+func TestFECBadIndex(t *testing.T) {
+	a, b := []byte{1, 2, 3}, []byte{4, 5}
+	parity := []byte{0, 0}
+	EncodeUint16(uint16(len(a)^len(b)), parity)
+	parity = append(parity, xorInto(append([]byte{}, a...), b)...)
+
+	qc := &queueConn{q: [][]byte{
+		fecPacket(0, 4, 0, a),                   // Index beyond maxBlockLen
+		fecPacket(0, fecParityIndex, 5, parity), // Count beyond maxBlockLen
+		fecPacket(1, fecParityIndex, 2, parity),
+		fecPacket(1, 2, 0, a), // Index beyond the count of the parity
+		fecPacket(1, 0, 0, a), // Rebuilds packet 1 of block 1
+		fecPacket(2, 3, 0, a),
+		fecPacket(2, fecParityIndex, 2, parity), // Count below the index of a received packet
+		fecPacket(2, 0, 0, a),
+	}}
+	fc := NewFECConn(NewEnv(nil), NoLogging, qc, 4)
+	var recv [][]byte
+	for {
+		p, err := fc.Read()
+		if err != nil {
+			break
+		}
+		recv = append(recv, p)
+	}
+	if len(recv) != 4 || !bytes.Equal(recv[1], b) {
+		t.Errorf("unexpected packets %v", recv)
+	}
+	if st := fc.Stats(); st.Recovered != 1 || st.Received != 3 || st.Parity != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+)
+
+// Any packet with an unknown Source label creates a new flow. To keep a flood of packets with
+// random labels from exhausting a server, the Mux limits the rate of flow creation, both per
+// source host and globally, using token buckets.
+//
+// In addition, if MuxConfig.Challenge is set, the Mux allocates no state for a new remote
+// until the remote proves that it can receive packets at its source address. The first packet
+// of a new remote is answered with a cookie control packet, and dropped. The cookie is a
+// keyed hash of the remote label, the remote address and the current time epoch, so the Mux
+// need not remember it. The remote echoes the cookie in the Sink label of its packets, until
+// it learns the actual label of the flow, and resends the dropped packet right away.
+//
+// The per-source buckets are kept for at most muxMaxSources hosts. When the table is full,
+// a few sampled buckets that have refilled are forgotten. If none has, a new source is
+// challenged with a cookie, as if MuxConfig.Challenge were set, and once it echoes the cookie
+// it is subject to the global limit only. Cookies themselves are rate-limited, so that the
+// Mux cannot be used to reflect a flood.
+//
+//	Cookie: type (1 byte), cookie (16 bytes)
+
+// floodGuard holds the flow-creation rate limiters and the cookie secret of a Mux.
+// It is used only from process() and so needs no lock.
+type floodGuard struct {
+	secret  []byte
+	global  tokenBucket
+	cookies tokenBucket // Limits the rate of cookies sent
+	rate    float64
+	burst   float64
+	sources map[string]*tokenBucket // Per-source buckets keyed by source host
+}
+
+// tokenBucket admits events at an average rate, allowing bursts
+type tokenBucket struct {
+	tokens float64
+	last   int64
+}
+
+const (
+	muxControlCookie = 3
+
+	DefaultMuxFlowRate        = 500 // New flows per second, across all sources
+	DefaultMuxFlowBurst       = 100
+	DefaultMuxSourceFlowRate  = 50 // New flows per second, from a single source host
+	DefaultMuxSourceFlowBurst = 20
+
+	// MuxCookieEpoch is the time period during which a cookie remains valid
+	MuxCookieEpoch = 10e9 // 10 sec in nanoseconds
+
+	muxMaxSources  = 4096 // Max number of per-source buckets remembered
+	muxSweepSample = 16   // Number of buckets examined when the table of sources is full
+	muxCookieRate  = 1000 // Cookies per second
+	muxCookieBurst = 100
+)
+
+// Decisions of floodGuard.Allow
+const (
+	guardAdmit = iota
+	guardRefuse
+	guardChallenge
+)
+
+func (t *floodGuard) Init(config *MuxConfig, now int64) {
+	t.secret = make([]byte, 32)
+	if _, err := rand.Read(t.secret); err != nil {
+		panic("cookie secret")
+	}
+	t.rate, t.burst = config.SourceFlowRate, float64(config.SourceFlowBurst)
+	t.global.Init(float64(config.FlowBurst), now)
+	t.cookies.Init(muxCookieBurst, now)
+	t.sources = make(map[string]*tokenBucket)
+}
+
+func (t *tokenBucket) Init(burst float64, now int64) {
+	t.tokens = burst
+	t.last = now
+}
+
+// Take refills the bucket and takes a token from it, if there is one
+func (t *tokenBucket) Take(now int64, rate, burst float64) bool {
+	t.tokens += rate * float64(now-t.last) / 1e9
+	if t.tokens > burst {
+		t.tokens = burst
+	}
+	t.last = now
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// sourceKey identifies the source host of addr. Ports are ignored, since they cost an
+// attacker nothing to vary.
+func sourceKey(addr net.Addr) string {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	return addrKey(addr)
+}
+
+// Allow decides whether a new flow from addr is within the rate limits. It returns guardAdmit
+// or guardRefuse, or guardChallenge if the source cannot be tracked because the table of
+// sources is full, and the remote has not proven its address by echoing a cookie.
+func (t *floodGuard) Allow(addr net.Addr, config *MuxConfig, now int64, cookie bool) int {
+	key := sourceKey(addr)
+	b, ok := t.sources[key]
+	if !ok {
+		if len(t.sources) >= muxMaxSources {
+			t.sweep(now)
+		}
+		if len(t.sources) < muxMaxSources {
+			b = &tokenBucket{}
+			b.Init(t.burst, now)
+			t.sources[key] = b
+		} else if !cookie {
+			return guardChallenge
+		}
+		// Otherwise, the cookie shows that the source is not spoofed, and the global
+		// limit suffices
+	}
+	if b != nil && !b.Take(now, t.rate, t.burst) {
+		return guardRefuse
+	}
+	if !t.global.Take(now, config.FlowRate, float64(config.FlowBurst)) {
+		return guardRefuse
+	}
+	return guardAdmit
+}
+
+// sweep forgets those among muxSweepSample buckets that have refilled, as they are
+// indistinguishable from new ones. Map iteration order is random, so the sample is too.
+func (t *floodGuard) sweep(now int64) {
+	n := 0
+	for k, s := range t.sources {
+		s.Take(now, t.rate, t.burst)
+		if s.tokens+1 >= t.burst {
+			delete(t.sources, k)
+		}
+		if n++; n == muxSweepSample {
+			break
+		}
+	}
+}
+
+// AllowCookie returns true if a cookie can be sent within the rate limit of cookies
+func (t *floodGuard) AllowCookie(now int64) bool {
+	return t.cookies.Take(now, muxCookieRate, muxCookieBurst)
+}
+
+func (t *floodGuard) cookie(remote *Label, addr net.Addr, epoch int64) *Label {
+	h := hmac.New(sha256.New, t.secret)
+	h.Write(remote.Bytes())
+	h.Write([]byte(addrKey(addr)))
+	e := make([]byte, 6)
+	EncodeUint48(uint64(epoch), e)
+	h.Write(e)
+	label, _, _ := ReadLabel(h.Sum(nil)[:LabelLen])
+	return label
+}
+
+// MakeCookie returns the cookie that the remote with label remote at addr must echo
+func (t *floodGuard) MakeCookie(remote *Label, addr net.Addr, now int64) *Label {
+	return t.cookie(remote, addr, now/MuxCookieEpoch)
+}
+
+// CheckCookie returns true if c is a cookie for the remote at addr from the current or the
+// previous epoch
+func (t *floodGuard) CheckCookie(c, remote *Label, addr net.Addr, now int64) bool {
+	epoch := now / MuxCookieEpoch
+	for _, e := range []int64{epoch, epoch - 1} {
+		if k := t.cookie(remote, addr, e); k != nil && hmac.Equal(k.Bytes(), c.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit decides whether a packet from a new remote creates a flow. cookie is true if the
+// packet echoed a valid cookie.
+func (m *Mux) admit(remote *Label, addr net.Addr, ml *muxLink, cargo []byte, cookie bool) *flow {
+	now := m.env.Now()
+	if m.config.Challenge && !cookie {
+		m.challenge(remote, addr, ml, now)
+		return nil
+	}
+	switch m.guard.Allow(addr, &m.config, now, cookie) {
+	case guardRefuse:
+		m.Lock()
+		m.stats.RateLimited++
+		m.Unlock()
+		return nil
+	case guardChallenge:
+		m.challenge(remote, addr, ml, now)
+		return nil
+	}
+	return m.accept(remote, addr, ml, cargo)
+}
+
+// challenge sends a cookie to the remote with label remote at addr, unless cookies are over
+// their rate limit
+func (m *Mux) challenge(remote *Label, addr net.Addr, ml *muxLink, now int64) {
+	if !m.guard.AllowCookie(now) {
+		m.Lock()
+		m.stats.RateLimited++
+		m.Unlock()
+		return
+	}
+	c := m.guard.MakeCookie(remote, addr, now)
+	p := make([]byte, 1+labelFootprint)
+	p[0] = muxControlCookie
+	c.Write(p[1:])
+	m.reply(ml, &muxMsg{nil, remote}, p, addr)
+	m.Lock()
+	m.stats.Challenged++
+	m.Unlock()
+}
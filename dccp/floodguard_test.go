@@ -0,0 +1,133 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxCookie(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	slink, clink := n.Attach(saddr), n.Attach(caddr)
+	sm, cm := NewMuxConfig(MuxConfig{Challenge: true}, slink), NewMux(clink)
+
+	cc, _ := cm.Dial(saddr)
+	cc.Write([]byte("a"))
+	sc, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	if s := readString(t, sc); s != "a" {
+		t.Fatalf("expecting a, got %s", s)
+	}
+	sc.Write([]byte("b"))
+	if s := readString(t, cc); s != "b" {
+		t.Fatalf("expecting b, got %s", s)
+	}
+	if st := sm.Stats(); st.Challenged != 1 {
+		t.Errorf("expecting 1 challenge, got %d", st.Challenged)
+	}
+
+	// A packet whose Sink is neither a flow nor a cookie is dropped
+	eaddr := &Addr{ChooseLabel(), 3}
+	elink := n.Attach(eaddr)
+	forged := make([]byte, muxMsgFootprint+1)
+	(&muxMsg{ChooseLabel(), ChooseLabel()}).Write(forged)
+	elink.WriteTo(forged, saddr)
+	for i := 0; i < 100 && sm.Stats().BadCookie == 0; i++ {
+		time.Sleep(10e6)
+	}
+	if st := sm.Stats(); st.BadCookie != 1 {
+		t.Errorf("expecting 1 bad cookie, got %d", st.BadCookie)
+	}
+	sm.Close()
+	cm.Close()
+	elink.Close()
+}
+
+func TestMuxFlowRate(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	slink, clink := n.Attach(saddr), n.Attach(caddr)
+	sm := NewMuxConfig(MuxConfig{SourceFlowRate: 1e-3, SourceFlowBurst: 2}, slink)
+	cm := NewMux(clink)
+
+	const dials = 5
+	for i := 0; i < dials; i++ {
+		cc, _ := cm.Dial(saddr)
+		cc.Write([]byte("a"))
+	}
+	for i := 0; i < 100 && sm.Stats().RateLimited < dials-2; i++ {
+		time.Sleep(10e6)
+	}
+	if st := sm.Stats(); st.RateLimited != dials-2 {
+		t.Errorf("expecting %d rate-limited flows, got %d", dials-2, st.RateLimited)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sm.Accept(); err != nil {
+			t.Fatalf("accept (%s)", err)
+		}
+	}
+	sm.Close()
+	cm.Close()
+}
+
+// TestFloodGuardFull fills the table of sources with drained buckets, and checks that new
+// sources are challenged rather than refused, until the buckets refill
+func TestFloodGuardFull(t *testing.T) {
+	config := MuxConfig{FlowRate: 1e9, FlowBurst: 1e6, SourceFlowRate: 1e-3, SourceFlowBurst: 2}
+	var g floodGuard
+	g.Init(&config, 0)
+	source := func(i int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))}
+	}
+	for i := 0; i < muxMaxSources; i++ {
+		for j := 0; j < 2; j++ {
+			if v := g.Allow(source(i), &config, 0, false); v != guardAdmit {
+				t.Fatalf("source %d: decision %d", i, v)
+			}
+		}
+	}
+	if v := g.Allow(source(0), &config, 0, false); v != guardRefuse {
+		t.Errorf("drained source: decision %d, expecting refuse", v)
+	}
+	fresh := source(muxMaxSources)
+	if v := g.Allow(fresh, &config, 0, false); v != guardChallenge {
+		t.Errorf("new source: decision %d, expecting challenge", v)
+	}
+	if v := g.Allow(fresh, &config, 0, true); v != guardAdmit {
+		t.Errorf("new source with cookie: decision %d, expecting admit", v)
+	}
+	if len(g.sources) != muxMaxSources {
+		t.Errorf("%d sources, expecting %d", len(g.sources), muxMaxSources)
+	}
+
+	// Once the buckets have refilled, the sampled ones are forgotten
+	if v := g.Allow(fresh, &config, 3000e9, false); v != guardAdmit {
+		t.Errorf("new source after refill: decision %d, expecting admit", v)
+	}
+	if _, ok := g.sources[sourceKey(fresh)]; !ok || len(g.sources) > muxMaxSources {
+		t.Errorf("new source not tracked")
+	}
+}
+
+func TestFloodGuardCookieRate(t *testing.T) {
+	var g floodGuard
+	g.Init(&MuxConfig{}, 0)
+	for i := 0; i < muxCookieBurst; i++ {
+		if !g.AllowCookie(0) {
+			t.Fatalf("cookie %d refused", i)
+		}
+	}
+	if g.AllowCookie(0) {
+		t.Errorf("cookie over the burst allowed")
+	}
+	if !g.AllowCookie(1e9 / muxCookieRate) {
+		t.Errorf("cookie refused after refill")
+	}
+}
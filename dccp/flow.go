@@ -4,41 +4,49 @@
 
 package dccp
 
-import (
-	"net"
-	"time"
-)
+import "net"
 
 // flow is an implementation of SegmentConn
 type flow struct {
-	addr net.Addr
-	m    *Mux
-	ch   chan muxHeader
-	mtu  int
+	env *Env
+	m   *Mux
+	ch  chan muxHeader // Queue of received packets
+	mtu int
 
 	Mutex        // protects the variables below
+	addr         net.Addr
+	challenge    *pathChallenge // Outstanding validation of a new remote address, if any
+	link         *muxLink       // The link this flow sends over
+	linkSince    int64          // Time when the flow switched to its current link
+	lastHeard    int64          // Time when the last packet was received from the remote
+	dropped      int64          // Number of received packets dropped due to a full queue
+	cookie       *Label         // Cookie to echo in place of the unknown remote label
+	first        []byte         // Last block written while the remote label is unknown
 	local        *Label
 	remote       *Label
-	lastRead     time.Time
-	lastWrite    time.Time
-	readDeadline time.Time
-
-	rlk Mutex // synchronizes calls to Read()
+	lastRead     int64
+	lastWrite    int64
+	readDeadline int64
 }
 
-// addr is the Link-level address of the remote.
+// addr is the Link-level address of the remote. It changes when the remote migrates to a
+// new address, after the new address is validated (see pathChallenge).
 // local and remote are logical labels that are associated with each endpoint 
 // of the connection. The remote label is not known until a packet is received
 // from the other side.
-func newFlow(addr net.Addr, m *Mux, ch chan muxHeader, mtu int, local, remote *Label) *flow {
-	now := time.Now()
+func newFlow(addr net.Addr, m *Mux, ch chan muxHeader, mtu int, local, remote *Label, link *muxLink) *flow {
+	now := m.env.Now()
 	return &flow{
+		env:          m.env,
 		addr:         addr,
+		link:         link,
+		linkSince:    now,
+		lastHeard:    now,
 		local:        local,
 		remote:       remote,
 		lastRead:     now,
 		lastWrite:    now,
-		readDeadline: time.Now().Add(-time.Second),	// time in the past
+		readDeadline: now - 1e9,	// time in the past
 		m:            m,
 		ch:           ch,
 		mtu:          mtu,
@@ -55,24 +63,68 @@ func (f *flow) SetReadExpire(nsec int64) error {
 	}
 	f.Lock()
 	defer f.Unlock()
-	f.readDeadline = time.Now().Add(time.Duration(nsec))
+	f.readDeadline = f.env.Now() + nsec
 	return nil
 }
 
-// LastRead() returns the timestamp of the last successful read operation
-func (f *flow) LastReadTime() time.Time {
+// LastRead() returns the timestamp of the last successful read operation, in nanoseconds
+func (f *flow) LastReadTime() int64 {
 	f.Lock()
 	defer f.Unlock()
 	return f.lastRead
 }
 
-// LastWrite() returns the timestamp of the last successful write operation
-func (f *flow) LastWriteTime() time.Time {
+// LastWrite() returns the timestamp of the last successful write operation, in nanoseconds
+func (f *flow) LastWriteTime() int64 {
 	f.Lock()
 	defer f.Unlock()
 	return f.lastWrite
 }
 
+func (f *flow) getAddr() net.Addr {
+	f.Lock()
+	defer f.Unlock()
+	return f.addr
+}
+
+func (f *flow) getLink() *muxLink {
+	f.Lock()
+	defer f.Unlock()
+	return f.link
+}
+
+// heard records that a packet from the remote has just arrived
+func (f *flow) heard() {
+	f.Lock()
+	defer f.Unlock()
+	f.lastHeard = f.env.Now()
+}
+
+// deliver queues a received packet for the reader of the flow. It returns false if the
+// packet was dropped, because the flow is closed or its queue is full.
+func (f *flow) deliver(h muxHeader) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.ch == nil {
+		return false
+	}
+	select {
+	case f.ch <- h:
+		return true
+	default:
+	}
+	f.dropped++
+	return false
+}
+
+// Dropped returns the number of received packets that were dropped, because the reader of
+// the flow did not keep up
+func (f *flow) Dropped() int64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.dropped
+}
+
 func (f *flow) setRemote(remote *Label) {
 	f.Lock()
 	defer f.Unlock()
@@ -80,6 +132,20 @@ func (f *flow) setRemote(remote *Label) {
 		panic("setting remote label twice")
 	}
 	f.remote = remote
+	f.cookie = nil
+	f.first = nil
+}
+
+// setCookie saves the cookie that the remote asked us to echo, and returns the block that
+// the remote dropped when it sent the cookie, if the remote label is still unknown
+func (f *flow) setCookie(cookie *Label) []byte {
+	f.Lock()
+	defer f.Unlock()
+	if f.remote != nil {
+		return nil
+	}
+	f.cookie = cookie
+	return f.first
 }
 
 func (f *flow) getRemote() *Label {
@@ -112,10 +178,18 @@ func (f *flow) Write(block []byte) error {
 	if m == nil {
 		return ErrBad
 	}
-	err := m.write(&muxMsg{f.getLocal(), f.getRemote()}, block, f.addr)
-	if err != nil {
+	f.Lock()
+	sink := f.remote
+	if sink == nil {
+		// Remember the block, in case the remote challenges us and drops it
+		sink = f.cookie
+		f.first = append(f.first[:0], block...)
+	}
+	f.Unlock()
+	err := m.write(m.sendLink(f), &muxMsg{f.getLocal(), sink}, block, f.getAddr())
+	if err == nil {
 		f.Lock()
-		f.lastWrite = time.Now()
+		f.lastWrite = f.env.Now()
 		f.Unlock()
 	}
 	return err
@@ -123,39 +197,29 @@ func (f *flow) Write(block []byte) error {
 
 // Read implements SegmentConn.Read
 func (f *flow) Read() (block []byte, err error) {
-	f.rlk.Lock()
-	defer f.rlk.Unlock()
-
 	f.Lock()
 	ch := f.ch
 	readDeadline := f.readDeadline
 	f.Unlock()
-	readTimeout := readDeadline.Sub(time.Now())
 	if ch == nil {
 		return nil, ErrBad
 	}
 
-	var timer *time.Timer
-	var tmoch <-chan time.Time
-	if readTimeout > 0 {
-		timer = time.NewTimer(readTimeout)
-		defer timer.Stop()
-		tmoch = timer.C
+	// A read deadline in the past means that reads do not time out
+	readTimeout := readDeadline - f.env.Now()
+	if readTimeout <= 0 {
+		readTimeout = -1
 	}
-
-	var header muxHeader
-	var ok bool
-	select {
-	case header, ok = <-ch:
-		if !ok {
-			return nil, ErrIO
-		}
-	case <-tmoch:
+	header, ok, expired := RecvTimeout(f.env, ch, readTimeout)
+	if expired {
 		return nil, ErrTimeout
 	}
+	if !ok {
+		return nil, ErrIO
+	}
 
 	f.Lock()
-	f.lastRead = time.Now()
+	f.lastRead = f.env.Now()
 	f.Unlock()
 
 	return header.Cargo, nil
@@ -184,6 +248,6 @@ func (f *flow) Close() error {
 	if m == nil {
 		return ErrBad
 	}
-	m.del(f.getLocal(), f.getRemote())
+	m.del(f.getLocal(), f.getRemote(), f.getLink())
 	return nil
 }
@@ -0,0 +1,200 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import "fmt"
+
+// FragmentConn is an optional layer on top of a SegmentConn, which allows sending application
+// messages that are larger than the MTU of the underlying connection. Each message is split
+// into numbered fragments. The receiving side reassembles a message once all of its fragments
+// have arrived. If any fragment is lost, the whole message is dropped once its reassembly
+// timeout expires. FragmentConn implements SegmentConn.
+//
+// Both endpoints of a connection must use FragmentConn, since every block carries a small
+// fragment header on the wire.
+type FragmentConn struct {
+	env     *Env
+	amb     *Amb
+	sc      SegmentConn
+	timeout int64
+
+	writeLk Mutex
+	lastID  uint32
+
+	readLk  Mutex
+	partial map[uint32]*fragmentedMsg // Messages under reassembly, keyed by message ID
+}
+
+// fragmentedMsg holds the fragments of a message that is being reassembled
+type fragmentedMsg struct {
+	start   int64    // Time when the first fragment was received
+	frags   [][]byte // Fragments received so far, indexed by fragment number
+	missing int      // Number of fragments not received yet
+}
+
+const (
+	// FragmentMaxCount is the maximum number of fragments in a message
+	FragmentMaxCount = 64
+
+	// FragmentTimeout is the default time allowed for the reassembly of a message
+	FragmentTimeout = 2e9 // 2 sec in nanoseconds
+
+	// fragmentMaxPartial is the number of messages that can be under reassembly at once.
+	// When exceeded, the oldest partial message is dropped.
+	fragmentMaxPartial = 16
+
+	// fragmentFootprint is the size of the fragment header: a 32-bit message ID, followed by
+	// 8-bit fragment number and 8-bit fragment count
+	fragmentFootprint = 6
+)
+
+// NewFragmentConn creates a FragmentConn on top of sc. Messages whose fragments do not all
+// arrive within timeout nanoseconds of the first one are dropped.
+func NewFragmentConn(env *Env, amb *Amb, sc SegmentConn, timeout int64) *FragmentConn {
+	return &FragmentConn{
+		env:     env,
+		amb:     amb.Refine("fragment"),
+		sc:      sc,
+		timeout: timeout,
+		partial: make(map[uint32]*fragmentedMsg),
+	}
+}
+
+// fragmentLen returns the maximum length of application data carried in one fragment
+func (f *FragmentConn) fragmentLen() int {
+	return f.sc.GetMTU() - fragmentFootprint
+}
+
+// GetMTU implements SegmentConn.GetMTU. It returns the largest message that can be written.
+func (f *FragmentConn) GetMTU() int {
+	return FragmentMaxCount * f.fragmentLen()
+}
+
+// Write implements SegmentConn.Write. It blocks until all fragments of block are sent.
+func (f *FragmentConn) Write(block []byte) error {
+	flen := f.fragmentLen()
+	if flen <= 0 {
+		return ErrTooBig
+	}
+	count := (len(block) + flen - 1) / flen
+	if count == 0 {
+		count = 1
+	}
+	if count > FragmentMaxCount {
+		return ErrTooBig
+	}
+
+	f.writeLk.Lock()
+	defer f.writeLk.Unlock()
+	f.lastID++
+	id := f.lastID
+	for i := 0; i < count; i++ {
+		chunk := block[i*flen : min((i+1)*flen, len(block))]
+		p := make([]byte, fragmentFootprint+len(chunk))
+		EncodeUint32(id, p[0:4])
+		EncodeUint8(byte(i), p[4:5])
+		EncodeUint8(byte(count), p[5:6])
+		copy(p[fragmentFootprint:], chunk)
+		if err := f.sc.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read implements SegmentConn.Read. It blocks until a whole message has been reassembled.
+func (f *FragmentConn) Read() (block []byte, err error) {
+	f.readLk.Lock()
+	defer f.readLk.Unlock()
+	for {
+		p, err := f.sc.Read()
+		if err != nil {
+			return nil, err
+		}
+		f.expire()
+		if len(p) < fragmentFootprint {
+			f.amb.E(EventDrop, "Short fragment")
+			continue
+		}
+		id := DecodeUint32(p[0:4])
+		i, count := int(DecodeUint8(p[4:5])), int(DecodeUint8(p[5:6]))
+		if count == 0 || count > FragmentMaxCount || i >= count {
+			f.amb.E(EventDrop, fmt.Sprintf("Bad fragment %d/%d of message %d", i, count, id))
+			continue
+		}
+		if count == 1 {
+			return p[fragmentFootprint:], nil
+		}
+		msg, ok := f.partial[id]
+		if !ok {
+			f.makeRoom()
+			msg = &fragmentedMsg{start: f.env.Now(), frags: make([][]byte, count), missing: count}
+			f.partial[id] = msg
+		}
+		if len(msg.frags) != count || msg.frags[i] != nil {
+			f.amb.E(EventDrop, fmt.Sprintf("Inconsistent fragment %d/%d of message %d", i, count, id))
+			continue
+		}
+		msg.frags[i] = p[fragmentFootprint:]
+		msg.missing--
+		if msg.missing > 0 {
+			continue
+		}
+		delete(f.partial, id)
+		return joinFragments(msg.frags), nil
+	}
+	panic("unreach")
+}
+
+func joinFragments(frags [][]byte) []byte {
+	n := 0
+	for _, frag := range frags {
+		n += len(frag)
+	}
+	r := make([]byte, 0, n)
+	for _, frag := range frags {
+		r = append(r, frag...)
+	}
+	return r
+}
+
+// expire drops partial messages whose reassembly timeout has passed
+func (f *FragmentConn) expire() {
+	now := f.env.Now()
+	for id, msg := range f.partial {
+		if now-msg.start > f.timeout {
+			f.amb.E(EventDrop, fmt.Sprintf("Message %d expired with %d missing fragments", id, msg.missing))
+			delete(f.partial, id)
+		}
+	}
+}
+
+// makeRoom drops the oldest partial message, if the maximum number of partial messages is reached
+func (f *FragmentConn) makeRoom() {
+	if len(f.partial) < fragmentMaxPartial {
+		return
+	}
+	var oldestID uint32
+	var oldest *fragmentedMsg
+	for id, msg := range f.partial {
+		if oldest == nil || msg.start < oldest.start {
+			oldestID, oldest = id, msg
+		}
+	}
+	f.amb.E(EventDrop, fmt.Sprintf("Message %d evicted with %d missing fragments", oldestID, oldest.missing))
+	delete(f.partial, oldestID)
+}
+
+// LocalLabel implements SegmentConn.LocalLabel
+func (f *FragmentConn) LocalLabel() Bytes { return f.sc.LocalLabel() }
+
+// RemoteLabel implements SegmentConn.RemoteLabel
+func (f *FragmentConn) RemoteLabel() Bytes { return f.sc.RemoteLabel() }
+
+// SetReadExpire implements SegmentConn.SetReadExpire
+func (f *FragmentConn) SetReadExpire(nsec int64) error { return f.sc.SetReadExpire(nsec) }
+
+// Close implements SegmentConn.Close
+func (f *FragmentConn) Close() error { return f.sc.Close() }
@@ -0,0 +1,77 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// queueConn is a SegmentConn whose writes are queued and returned by its reads
+type queueConn struct {
+	q    [][]byte
+	drop func(k int) bool
+	k    int
+}
+
+func (x *queueConn) GetMTU() int { return 1000 }
+
+func (x *queueConn) Write(block []byte) error {
+	x.k++
+	if x.drop == nil || !x.drop(x.k) {
+		x.q = append(x.q, block)
+	}
+	return nil
+}
+
+func (x *queueConn) Read() ([]byte, error) {
+	if len(x.q) == 0 {
+		return nil, ErrEOF
+	}
+	p := x.q[0]
+	x.q = x.q[1:]
+	return p, nil
+}
+
+func (x *queueConn) LocalLabel() Bytes              { return &LabelZero }
+func (x *queueConn) RemoteLabel() Bytes             { return &LabelZero }
+func (x *queueConn) SetReadExpire(nsec int64) error { return nil }
+func (x *queueConn) Close() error                   { return nil }
+
+func makeMessage(n int, seed byte) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i) + seed
+	}
+	return p
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	// Drop the second fragment of the first message
+	qc := &queueConn{drop: func(k int) bool { return k == 2 }}
+	fc := NewFragmentConn(NewEnv(nil), NoLogging, qc, FragmentTimeout)
+
+	if err := fc.Write(makeMessage(fc.GetMTU()+1, 0)); err != ErrTooBig {
+		t.Errorf("expecting ErrTooBig, got %v", err)
+	}
+	lost, whole, small := makeMessage(15000, 1), makeMessage(20000, 2), makeMessage(10, 3)
+	for _, msg := range [][]byte{lost, whole, small} {
+		if err := fc.Write(msg); err != nil {
+			t.Fatalf("write (%s)", err)
+		}
+	}
+	for _, want := range [][]byte{whole, small} {
+		have, err := fc.Read()
+		if err != nil {
+			t.Fatalf("read (%s)", err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("reassembled message of len %d differs from original of len %d", len(have), len(want))
+		}
+	}
+	if _, err := fc.Read(); err != ErrEOF {
+		t.Errorf("message with missing fragment was delivered")
+	}
+}
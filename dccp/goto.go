@@ -51,7 +51,7 @@ func (c *Conn) gotoRESPOND(hServiceCode uint32, hSeqNo int64) {
 	c.AssertLocked()
 	c.socket.SetState(RESPOND)
 	c.emitSetState()
-	iss := c.socket.ChooseISS()
+	iss := c.socket.ChooseISS(c.env)
 	c.socket.SetGAR(iss)
 	c.socket.SetISR(hSeqNo)
 	c.socket.SetGSR(hSeqNo)
@@ -78,7 +78,7 @@ func (c *Conn) gotoREQUEST(serviceCode uint32) {
 	c.socket.SetState(REQUEST)
 	c.emitSetState()
 	c.socket.SetServiceCode(serviceCode)
-	iss := c.socket.ChooseISS()
+	iss := c.socket.ChooseISS(c.env)
 	c.socket.SetGAR(iss)
 	c.inject(c.generateRequest(serviceCode))
 
@@ -37,6 +37,24 @@ const (
 	SEQNOMAX = (2 << 48) - 1
 )
 
+// seqNoMask masks a sequence number to the 48 bits of the circular sequence space
+const seqNoMask = (1 << 48) - 1
+
+// SeqNoDiff returns the distance from b to a in circular sequence space (modulo 2^48),
+// which is positive if a is after b and negative if a is before b.
+func SeqNoDiff(a, b int64) int64 {
+	d := (a - b) & seqNoMask
+	if d >= 1<<47 {
+		d -= 1 << 48
+	}
+	return d
+}
+
+// SeqNoAdd returns the sequence number that is d after seqno in circular sequence space
+func SeqNoAdd(seqno, d int64) int64 {
+	return (seqno + d) & seqNoMask
+}
+
 // Packet types. Stored in the Type field of the generic header.
 // Receivers MUST ignore any packets with reserved type.  That is,
 // packets with reserved type MUST NOT be processed, and they MUST
@@ -14,6 +14,13 @@ type writeHeader struct {
 	Header
 	SeqAckType   int
 	InResponseTo *Header
+	DeliveryID   int64 // Message ID of tracked application data, or zero
+}
+
+// appData is the application data of a user call to Write, which is sent to the writeLoop
+type appData struct {
+	Data       []byte
+	DeliveryID int64
 }
 
 // inject adds the packet h to the outgoing non-Data pipeline, without blocking.  The
@@ -33,9 +40,9 @@ func (c *Conn) inject(h *writeHeader) {
 	// c.emitCatchSeqNo(h, 161019, 161020, 161021)
 
 	// Dropping a nil is OK, since it happens only if there are other packets in the queue
-	if len(c.writeNonData) < cap(c.writeNonData) {
-		c.writeNonData <- h
-	} else {
+	select {
+	case c.writeNonData <- h:
+	default:
 		// This first emit is a workaround. The inspector does not recognize drop events,
 		// unless they have been preceeded by a write event.
 		// TODO: It may help to introduce an inject event to distinguish between write queue
@@ -74,7 +81,18 @@ func (c *Conn) write(h *writeHeader) error {
 	// before the CCID gets to see it?
 	c.Lock()
 	c.WriteSeqAck(h)
+	h.Options = append(h.Options, c.ackVectorFeat.OnWrite(h.Type)...)
+	if (h.Type == Ack || h.Type == DataAck) && c.ackVectorFeat.Enabled() {
+		if av := c.ackVector.Option(h.AckNo); av != nil {
+			if opt, err := av.Encode(); err == nil {
+				h.Options = append(h.Options, opt)
+			}
+		}
+	}
 	c.WriteCC(&h.Header, c.writeTime.Now())
+	if h.DeliveryID != 0 {
+		c.delivery.OnWrite(h.SeqNo, h.DeliveryID)
+	}
 	c.Unlock()
 
 	c.amb.E(EventWrite, "Write to header link", h)
@@ -82,11 +100,11 @@ func (c *Conn) write(h *writeHeader) error {
 }
 
 // writeLoop() sends headers incoming on the writeData and writeNonData channels, while
-// giving priority to writeNonData. It continues to do so until writeNonData is closed.
-func (c *Conn) writeLoop(writeNonData chan *writeHeader, writeData chan []byte) {
+// giving priority to the latter. It continues to do so until writeNonData is closed.
+func (c *Conn) writeLoop(writeNonData chan *writeHeader, writeData chan *appData, writeDone chan int) {
 
 	// The presence of multiple loops below allows user calls to Write to
-	// block in "writeNonData <-" while the connection moves into a state where
+	// block in "writeData <-" while the connection moves into a state where
 	// it accepts app data (in _Loop_II)
 
 	// This loop is active until state OPEN or PARTOPEN is observed, when a
@@ -95,7 +113,7 @@ func (c *Conn) writeLoop(writeNonData chan *writeHeader, writeData chan []byte)
 _Loop_I:
 
 	for {
-		h, ok := <-writeNonData
+		h, ok := Recv(c.env, writeNonData)
 		if !ok {
 			// Closing writeNonData means that the Conn is done and dead
 			goto _Exit
@@ -121,27 +139,45 @@ _Loop_I:
 		continue _Loop_I
 	}
 
-	// This loop is active until writeData is not closed
+	// This loop is active until writeDone is not closed
 	c.amb.E(EventInfo, "Write Loop II")
 _Loop_II:
 
 	for {
+		// When writeDone is closed, we transition to the 3rd loop,
+		// which accepts only non-Data packets
+		select {
+		case <-writeDone:
+			goto _Loop_III
+		default:
+		}
 		var h *writeHeader
+		var ad *appData
 		var ok bool
-		var appData []byte
+		// Note that non-Data packets take precedence. Only when none are queued does
+		// writeLoop wait for either kind.
+		i := 0
 		select {
-		// Note that non-Data packets take precedence
 		case h, ok = <-writeNonData:
+			// An Ack is not sent ahead of waiting app data. Instead, the data goes out
+			// in a DataAck, which acknowledges the same packets. Otherwise, Acks that
+			// are queued faster than the send rate would keep app data from going out.
+			if ok && h != nil && h.Type == Ack {
+				var received bool
+				if ad, _, received = TryRecv(c.env, writeData); received {
+					i = 1
+				}
+			}
+		default:
+			i, h, ad, ok = Select(c.env, -1, writeNonData, writeData)
+		}
+		switch i {
+		case 0:
 			if !ok {
 				// Closing writeNonData means that the Conn is done and dead
 				goto _Exit
 			}
-		case appData, ok = <-writeData:
-			if !ok {
-				// When writeData is closed, we transition to the 3rd loop,
-				// which accepts only non-Data packets
-				goto _Loop_III
-			}
+		case 1:
 			// By virtue of being in _Loop_II (which implies we have been or are in OPEN
 			// or PARTOPEN), we know that some packets of the other side have been
 			// received, and so AckNo can be filled in meaningfully (below) in the
@@ -152,7 +188,8 @@ _Loop_II:
 			// Header.Data = []byte{}) would cause a problem in Header.Write
 			// It should be that it doesn't. Must verify this.
 			c.Lock()
-			h = c.generateDataAck(appData)
+			h = c.generateDataAck(ad.Data)
+			h.DeliveryID = ad.DeliveryID
 			c.Unlock()
 		}
 		if h != nil {
@@ -169,7 +206,7 @@ _Loop_II:
 _Loop_III:
 
 	for {
-		h, ok := <-writeNonData
+		h, ok := Recv(c.env, writeNonData)
 		if !ok {
 			// Closing writeNonData means that the Conn is done and dead
 			goto _Exit
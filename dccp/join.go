@@ -23,6 +23,7 @@ type Joiner interface {
 
 // GoRoutine represents a running goroutine.
 type GoRoutine struct {
+	env  *Env // The Env of the goroutine, if any
 	ch   chan int
 	file string
 	line int
@@ -32,18 +33,29 @@ type GoRoutine struct {
 // Go runs f in a new goroutine and returns a handle object, which can
 // then be used for various synchronization mechanisms.
 func GoCaller(f func(), skip int, fmt_ string, args_ ...interface{}) *GoRoutine {
+	return goCaller(nil, f, 1+skip, fmt_, args_...)
+}
+
+// goCaller runs f in a new goroutine, which belongs to env if env is not nil
+func goCaller(env *Env, f func(), skip int, fmt_ string, args_ ...interface{}) *GoRoutine {
 	sfile, sline := FetchCaller(1 + skip)
 	ch := make(chan int)
 	g := &GoRoutine{ 
+		env:  env,
 		ch:   ch,
 		file: sfile,
 		line: sline,
 		anno: fmt.Sprintf(fmt_, args_...),
 	}
-	go func() {
+	run := func() {
 		f()
 		close(ch)
-	}()
+	}
+	if env != nil && env.rt != nil {
+		env.rt.Go(run)
+	} else {
+		go run()
+	}
 	return g
 }
 
@@ -55,7 +67,7 @@ func Go(f func(), fmt_ string, args_ ...interface{}) *GoRoutine {
 // if the goroutine has completed, it returns immediately.
 // Join can be called concurrently.
 func (g *GoRoutine) Join() {
-	_, _ = <-g.ch
+	Recv(g.env, g.ch)
 }
 
 // Source returns the file and line where the goroutine was forked.
@@ -107,26 +119,28 @@ func TrimFuncName(fname string) (trimmed string, isDCCP bool) {
 // GoJoin waits until a set of GoRoutines all complete. It also allows
 // new routines to be added dynamically before the completion event.
 type GoJoin struct {
+	env        *Env		// Runs the goroutines started with Go, if not nil
 	srcFile    string
 	srcLine    int
 	annotation string
 
 	lk      sync.Mutex	// Locks the fields below
 	group   []Joiner	// Slice of joiners included in this conjunction sync
-	kdone   int		// Counts the number of Joiners that have already completed
-	ch      chan Joiner
-	slk     sync.Mutex	// Only one Join can be called at a time
+	done    bool		// Set once all joiners have completed during a Join
 }
 
 // NewGoJoinCaller creates an object capable of waiting until all supplied GoRoutines complete.
 func NewGoJoinCaller(skip int, annotation string, group ...Joiner) *GoJoin {
+	return newGoJoin(nil, 1+skip, annotation, group...)
+}
+
+func newGoJoin(env *Env, skip int, annotation string, group ...Joiner) *GoJoin {
 	sfile, sline := FetchCaller(1 + skip)
 	var w *GoJoin = &GoJoin{ 
+		env:        env,
 		srcFile:    sfile,
 		srcLine:    sline,
 		annotation: annotation,
-		kdone:      0, 
-		ch:         make(chan Joiner, 10),
 	}
 	for _, u := range group {
 		w.Add(u)
@@ -140,7 +154,7 @@ func NewGoJoin(annotation string, group ...Joiner) *GoJoin {
 
 // String returns a unique, readable string representation of this instance.
 func (t *GoJoin) String() string {
-	return fmt.Sprintf("%s:%d %s (%x)", t.srcFile, t.srcLine, t.annotation, t)
+	return fmt.Sprintf("%s:%d %s (%p)", t.srcFile, t.srcLine, t.annotation, t)
 }
 
 // Add adds a Joiner to the group. It can be called at any time
@@ -150,61 +164,41 @@ func (t *GoJoin) String() string {
 func (t *GoJoin) Add(u Joiner) {
 	t.lk.Lock()
 	defer t.lk.Unlock()
-	if t.kdone < 0 {
+	if t.done {
 		panic("adding joiners after conjunction event")
 	}
 	t.group = append(t.group, u)
-	ch := t.ch
-	go func(){
-		u.Join()
-		ch <- u
-	}()
 }
 
 // Go is a convenience method which forks f into a new GoRoutine and
 // adds the latter to the waiting queue. fmt is a formatted annotation
-// with arguments args.
+// with arguments args. The goroutines of a GoJoin created by an Env belong to the Env.
 func (t *GoJoin) Go(f func(), fmt_ string, args_ ...interface{}) {
-	t.Add(GoCaller(f, 1, fmt_, args_...))
+	t.Add(goCaller(t.env, f, 1, fmt_, args_...))
 }
 
 // Join blocks until all goroutines in the group have completed.
 // Join can be called concurrently. If called post-completion of the
 // goroutine group, Join returns immediately.
+//
+// Join waits for the joiners one at a time, in the order in which they were added, so
+// that it needs no goroutines of its own.
 func (t *GoJoin) Join() {
-	t.slk.Lock()
-	defer t.slk.Unlock()
-
-	// Prevent calling Join before any waitees have been added
-	t.lk.Lock()
-	n := len(t.group)
-	ch := t.ch
-	t.lk.Unlock()
-	if n == 0 {
-		panic("waiting on 0 goroutines")
-	}
-
-	for t.stillRemain() {
-		_, ok := <-ch
-		if !ok {
-			return
-		}
+	for i := 0; ; i++ {
 		t.lk.Lock()
-		if t.kdone < 0 {
-			panic("no joiners should complete past junction event")
+		// Prevent calling Join before any waitees have been added
+		if len(t.group) == 0 {
+			t.lk.Unlock()
+			panic("waiting on 0 goroutines")
 		}
-		t.kdone++
-		if t.kdone == len(t.group) {
+		if t.done || i == len(t.group) {
 			// Ensure future calls to Join return immediately
-			t.kdone = -1
-			close(ch)
+			t.done = true
+			t.lk.Unlock()
+			return
 		}
+		u := t.group[i]
 		t.lk.Unlock()
+		u.Join()
 	}
 }
-
-func (t* GoJoin) stillRemain() bool {
-	t.lk.Lock()
-	defer t.lk.Unlock()
-	return t.kdone >= 0 && t.kdone < len(t.group)
-}
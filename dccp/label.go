@@ -48,11 +48,16 @@ func isZero(bb []byte) bool {
 	return true
 }
 
-// ChooseLabel() creates a new label by choosing its bytes randomly
+// ChooseLabel() creates a new label by choosing its bytes randomly. Code that runs in an Env
+// should use Env.ChooseLabel instead, so that its runs can be reproduced.
 func ChooseLabel() *Label {
+	return chooseLabel(rand.Int)
+}
+
+func chooseLabel(randInt func() int) *Label {
 	label := &Label{}
 	for i := 0; i < LabelLen/2; i++ {
-		q := rand.Int()
+		q := randInt()
 		label.data[2*i] = byte(q & 0xff)
 		q >>= 8
 		label.data[2*i+1] = byte(q & 0xff)
@@ -0,0 +1,136 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+)
+
+// Flows are identified by their labels, not by the link address of the remote, so a flow
+// can follow its remote to a new address (e.g. when a mobile client switches networks, or a
+// NAT rebinds). The new address is adopted only after it passes a path validation: the Mux
+// sends a challenge carrying an unpredictable nonce to the new address, and switches the flow
+// over when the remote echoes the nonce back from that address. Packets arriving from the new
+// address are still delivered in the meantime.
+//
+// The validation only proves that whoever knows the labels of the flow can receive at the new
+// address. It keeps packets with a spoofed source address from turning the flow against a
+// third party that never asked for it. It does not keep anyone who has observed the labels,
+// such as an on-path attacker, from moving the flow to an address of their own; that takes
+// securing the link (see SecureLink).
+//
+// Path validation uses mux control packets, which carry a zero Source label, the local
+// label of the receiving flow as the Sink label, and a control message as cargo:
+//
+//	Challenge: type (1 byte), nonce (8 bytes), local label of the sender (16 bytes)
+//	Response:  type (1 byte), nonce (8 bytes)
+
+// pathChallenge is an outstanding validation of a new remote address of a flow
+type pathChallenge struct {
+	addr  net.Addr
+	nonce [muxNonceLen]byte
+	sent  int64
+}
+
+const (
+	muxControlChallenge = 1
+	muxControlResponse  = 2
+
+	muxNonceLen = 8
+
+	// MuxChallengeResend is the minimum time between path challenges of a flow
+	MuxChallengeResend = 1e9 // 1 sec in nanoseconds
+)
+
+func sameAddr(a, b net.Addr) bool {
+	return addrKey(a) == addrKey(b)
+}
+
+// validatePath starts (or repeats) a path challenge, if a packet of flow f arrived from an
+// address other than the current remote address of f
+func (m *Mux) validatePath(f *flow, addr net.Addr) {
+	f.Lock()
+	if sameAddr(f.addr, addr) {
+		// A packet from the current address makes any pending challenge moot
+		f.challenge = nil
+		f.Unlock()
+		return
+	}
+	now := m.env.Now()
+	ch := f.challenge
+	if ch != nil && sameAddr(ch.addr, addr) && now-ch.sent < MuxChallengeResend {
+		f.Unlock()
+		return
+	}
+	if ch == nil || !sameAddr(ch.addr, addr) {
+		ch = &pathChallenge{addr: addr}
+		if _, err := rand.Read(ch.nonce[:]); err != nil {
+			panic("nonce generation")
+		}
+		f.challenge = ch
+	}
+	ch.sent = now
+	local, remote, ml := f.local, f.remote, f.link
+	f.Unlock()
+
+	if remote == nil {
+		return
+	}
+	p := make([]byte, 1+muxNonceLen+labelFootprint)
+	p[0] = muxControlChallenge
+	copy(p[1:], ch.nonce[:])
+	local.Write(p[1+muxNonceLen:])
+	m.reply(ml, &muxMsg{nil, remote}, p, addr)
+}
+
+// processControl handles a mux control packet addressed to the flow with local label sink,
+// which arrived over link ml from addr
+func (m *Mux) processControl(sink *Label, cargo []byte, addr net.Addr, ml *muxLink) {
+	f := m.findLocal(sink)
+	if f == nil || len(cargo) < 1+muxNonceLen {
+		return
+	}
+	nonce := cargo[1 : 1+muxNonceLen]
+	switch cargo[0] {
+	case muxControlChallenge:
+		// Respond only on behalf of the flow whose remote sent the challenge
+		label, _, err := ReadLabel(cargo[1+muxNonceLen:])
+		if err != nil || label == nil {
+			return
+		}
+		remote := f.getRemote()
+		if remote == nil || !remote.Equal(label) {
+			return
+		}
+		p := make([]byte, 1+muxNonceLen)
+		p[0] = muxControlResponse
+		copy(p[1:], nonce)
+		// The response goes to the address the challenge came from, and it leaves over the
+		// link the challenge arrived on, since that is the path being validated
+		m.reply(ml, &muxMsg{nil, remote}, p, addr)
+
+	case muxControlCookie:
+		cookie, _, err := ReadLabel(cargo[1:])
+		if err != nil || cookie == nil {
+			return
+		}
+		if first := f.setCookie(cookie); first != nil {
+			// The resend may block, so it must not hold up the read loop
+			m.env.Go(func() { f.Write(first) }, "Mux cookie resend")
+		}
+
+	case muxControlResponse:
+		f.Lock()
+		defer f.Unlock()
+		ch := f.challenge
+		if ch == nil || !sameAddr(ch.addr, addr) || !bytes.Equal(ch.nonce[:], nonce) {
+			return
+		}
+		f.addr = addr
+		f.challenge = nil
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// memNet is an in-memory packet network, where links are reachable by address. The links
+// wait for packets through env.
+type memNet struct {
+	env *Env
+	Mutex
+	links map[string]*memLink
+}
+
+type memPacket struct {
+	p    []byte
+	from net.Addr
+}
+
+// memLink is a Link attached to a memNet. Its address can be changed with Rebind.
+type memLink struct {
+	net  *memNet
+	in   chan memPacket
+	done chan int
+	Mutex
+	addr   net.Addr
+	closed bool
+}
+
+func newMemNet(env *Env) *memNet {
+	return &memNet{env: env, links: make(map[string]*memLink)}
+}
+
+func (n *memNet) Attach(addr net.Addr) *memLink {
+	l := &memLink{net: n, in: make(chan memPacket, 100), done: make(chan int), addr: addr}
+	n.Lock()
+	n.links[addrKey(addr)] = l
+	n.Unlock()
+	return l
+}
+
+// Rebind moves the link to a new address, as if its host switched networks
+func (l *memLink) Rebind(addr net.Addr) {
+	l.net.Lock()
+	defer l.net.Unlock()
+	l.Lock()
+	defer l.Unlock()
+	delete(l.net.links, addrKey(l.addr))
+	l.net.links[addrKey(addr)] = l
+	l.addr = addr
+}
+
+func (l *memLink) GetMTU() int                       { return 1500 }
+func (l *memLink) SetReadDeadline(t time.Time) error { return nil }
+
+func (l *memLink) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
+	if i, pkt, _, _ := Select(l.net.env, -1, l.in, l.done); i == 0 {
+		return copy(buf, pkt.p), pkt.from, nil
+	}
+	return 0, nil, ErrIO
+}
+
+func (l *memLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
+	l.net.Lock()
+	dst := l.net.links[addrKey(addr)]
+	l.net.Unlock()
+	l.Lock()
+	from := l.addr
+	l.Unlock()
+	if dst != nil {
+		p := make([]byte, len(buf))
+		copy(p, buf)
+		select {
+		case dst.in <- memPacket{p, from}:
+		default:
+		}
+	}
+	return len(buf), nil
+}
+
+// Close detaches the link from the network
+func (l *memLink) Close() error {
+	l.net.Lock()
+	defer l.net.Unlock()
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return ErrBad
+	}
+	l.closed = true
+	delete(l.net.links, addrKey(l.addr))
+	close(l.done)
+	return nil
+}
+
+func readString(t *testing.T, c SegmentConn) string {
+	p, err := c.Read()
+	if err != nil {
+		t.Fatalf("read (%s)", err)
+	}
+	return string(p)
+}
+
+func waitAddr(f *flow, addr net.Addr) bool {
+	for i := 0; i < 100; i++ {
+		if sameAddr(f.getAddr(), addr) {
+			return true
+		}
+		time.Sleep(10e6)
+	}
+	return false
+}
+
+func TestMuxMigration(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	slink, clink := n.Attach(saddr), n.Attach(caddr)
+	sm, cm := NewMux(slink), NewMux(clink)
+
+	cc, _ := cm.Dial(saddr)
+	cc.Write([]byte("a"))
+	sc, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	if s := readString(t, sc); s != "a" {
+		t.Fatalf("expecting a, got %s", s)
+	}
+	sc.Write([]byte("b"))
+	if s := readString(t, cc); s != "b" {
+		t.Fatalf("expecting b, got %s", s)
+	}
+
+	// A forged packet with the right labels from an address that does not respond to the
+	// challenge must not divert the flow
+	eaddr := &Addr{ChooseLabel(), 3}
+	elink := n.Attach(eaddr)
+	forged := make([]byte, muxMsgFootprint+1)
+	(&muxMsg{cc.LocalLabel().(*Label), sc.LocalLabel().(*Label)}).Write(forged)
+	forged[muxMsgFootprint] = 'x'
+	elink.WriteTo(forged, saddr)
+	if s := readString(t, sc); s != "x" {
+		t.Fatalf("expecting x, got %s", s)
+	}
+	if waitAddr(sc.(*flow), eaddr) {
+		t.Fatalf("flow diverted to unvalidated address")
+	}
+
+	// The client moves to a new address
+	naddr := &Addr{ChooseLabel(), 4}
+	clink.Rebind(naddr)
+	cc.Write([]byte("c"))
+	if s := readString(t, sc); s != "c" {
+		t.Fatalf("expecting c, got %s", s)
+	}
+	if !waitAddr(sc.(*flow), naddr) {
+		t.Fatalf("flow did not migrate")
+	}
+	sc.Write([]byte("d"))
+	if s := readString(t, cc); s != "d" {
+		t.Fatalf("expecting d, got %s", s)
+	}
+	sm.Close()
+	cm.Close()
+	elink.Close()
+}
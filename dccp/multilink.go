@@ -0,0 +1,66 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+// A Mux may own several links, e.g. UDP links bound to different interfaces of a host with
+// redundant uplinks. Each flow sends over one link at a time. Dialed flows are assigned to
+// the live link with the fewest flows, and accepted flows to the link their first packet
+// arrived on. A flow fails over to another link when its link dies (its read loop fails),
+// or when nothing has been heard from the remote for MuxFailoverTime while the flow keeps
+// writing. The failover decision is made when the flow writes. The remote sees the flow
+// arrive from a new address and follows it after a path validation (see migrate.go).
+
+// muxLink is a Link owned by a Mux. Its fields are protected by the Mux lock.
+type muxLink struct {
+	Link
+	dead  bool // Set when the read loop of the link exits
+	flows int  // Number of flows sending over this link
+}
+
+// MuxFailoverTime is the time a flow waits to hear from its remote before it moves
+// to another link
+const MuxFailoverTime = 3e9 // 3 sec in nanoseconds
+
+// pickLink returns the live link, other than exclude, with the fewest flows, or nil if
+// there is none
+func (m *Mux) pickLink(exclude *muxLink) *muxLink {
+	m.AssertLocked()
+	var best *muxLink
+	for _, ml := range m.links {
+		if ml.dead || ml == exclude {
+			continue
+		}
+		if best == nil || ml.flows < best.flows {
+			best = ml
+		}
+	}
+	return best
+}
+
+// sendLink returns the link that flow f should send over, failing f over to another link if
+// its current path appears to be down
+func (m *Mux) sendLink(f *flow) *muxLink {
+	now := m.env.Now()
+	f.Lock()
+	ml, since, heard := f.link, f.linkSince, f.lastHeard
+	f.Unlock()
+
+	m.Lock()
+	defer m.Unlock()
+	if !ml.dead && (now-heard < MuxFailoverTime || now-since < MuxFailoverTime) {
+		return ml
+	}
+	next := m.pickLink(ml)
+	if next == nil {
+		return ml
+	}
+	ml.flows--
+	next.flows++
+	f.Lock()
+	f.link = next
+	f.linkSince = now
+	f.Unlock()
+	return next
+}
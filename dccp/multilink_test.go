@@ -0,0 +1,62 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"testing"
+	"time"
+)
+
+func isDead(m *Mux, ml *muxLink) bool {
+	m.Lock()
+	defer m.Unlock()
+	return ml.dead
+}
+
+func TestMuxFailover(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, c1addr, c2addr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}, &Addr{ChooseLabel(), 3}
+	slink, c1link, c2link := n.Attach(saddr), n.Attach(c1addr), n.Attach(c2addr)
+	sm, cm := NewMux(slink), NewMux(c1link, c2link)
+
+	cc, err := cm.Dial(saddr)
+	if err != nil {
+		t.Fatalf("dial (%s)", err)
+	}
+	cc.Write([]byte("a"))
+	sc, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	if s := readString(t, sc); s != "a" {
+		t.Fatalf("expecting a, got %s", s)
+	}
+	sc.Write([]byte("b"))
+	if s := readString(t, cc); s != "b" {
+		t.Fatalf("expecting b, got %s", s)
+	}
+	if !sameAddr(sc.(*flow).getAddr(), c1addr) {
+		t.Fatalf("expecting flow on the first link")
+	}
+
+	// The first uplink goes down. The flow moves to the second one, and the server follows.
+	c1link.Close()
+	for i := 0; i < 100 && !isDead(cm, cc.(*flow).getLink()); i++ {
+		time.Sleep(10e6)
+	}
+	cc.Write([]byte("c"))
+	if s := readString(t, sc); s != "c" {
+		t.Fatalf("expecting c, got %s", s)
+	}
+	if !waitAddr(sc.(*flow), c2addr) {
+		t.Fatalf("server did not follow the failover")
+	}
+	sc.Write([]byte("d"))
+	if s := readString(t, cc); s != "d" {
+		t.Fatalf("expecting d, got %s", s)
+	}
+	sm.Close()
+	cm.Close()
+}
@@ -4,10 +4,7 @@
 
 package dccp
 
-import (
-	"net"
-	"time"
-)
+import "net"
 
 // Mux is a thin protocol layer that works on top of a connection-less packet layer, like UDP.
 // Mux multiplexes packets into flows. A flow is a point-to-point connection, which has no
@@ -17,22 +14,110 @@ import (
 // one minute after their respective flow has been closed.
 //
 // Mux force-closes flows that have experienced no activity for 10 mins
+//
+// Mux takes its notion of time from its Env, so that the linger and expiry mechanisms can
+// be exercised in synthetic time.
+//
+// Flows follow their remote to a new link address, once the new address passes a path
+// validation (see migrate.go).
+//
+// Incoming flows wait in a bounded accept backlog until the application calls Accept. New
+// flows are turned away when the backlog is full or the number of flows is at its limit.
+// Received packets wait in a bounded queue per flow, and are dropped when the queue is full,
+// so that a flow whose reader stalls does not hold up the other flows on the same link.
+//
+// Replies that the Mux sends on its own (cookies, path challenges and responses, and rejects)
+// are queued and written by a separate goroutine, so that a link whose writes block does not
+// stall the read loops. Replies arriving at a full queue are dropped.
 type Mux struct {
+	env *Env
 	Mutex
-	link         Link
+	links        []*muxLink // Links in the order they were passed to NewMux
+	closed       bool
+	nreaders     int // Number of link read loops still running
 	flowsLocal   map[uint64]*flow // Active flows hashed by local label
 	flowsRemote  map[uint64]*flow
-	lingerLocal  map[uint64]time.Time // Local labels of recently-closed flows mapped to time of closure
-	lingerRemote map[uint64]time.Time
-	acceptChan   chan *flow
+	lingerLocal  map[uint64]int64 // Local labels of recently-closed flows mapped to time of closure
+	lingerRemote map[uint64]int64
+	acceptChan   chan *flow    // Queue of incoming flows waiting for Accept
+	replies      chan muxReply // Queue of replies written by replyLoop
+	procLk       Mutex         // Ensures that only one copy of process() runs at a time
+	config       MuxConfig
+	stats        MuxStats
+	guard        floodGuard
+}
+
+// MuxConfig holds the admission limits of a Mux
+type MuxConfig struct {
+
+	// AcceptBacklog is the number of incoming flows that can wait for Accept.
+	// If zero, DefaultMuxAcceptBacklog is used.
+	AcceptBacklog int
+
+	// MaxFlows is the maximum number of concurrent flows, both dialed and accepted.
+	// If zero, DefaultMuxMaxFlows is used.
+	MaxFlows int
+
+	// FlowQueueLen is the number of received packets that can wait for the reader of a flow.
+	// Packets arriving at a full queue are dropped. If zero, DefaultMuxFlowQueueLen is used.
+	FlowQueueLen int
+
+	// FlowRate and FlowBurst limit the rate of new incoming flows across all sources, in flows
+	// per second. SourceFlowRate and SourceFlowBurst limit it per source host. Zero values
+	// are replaced by the respective defaults.
+	FlowRate        float64
+	FlowBurst       int
+	SourceFlowRate  float64
+	SourceFlowBurst int
+
+	// Challenge, if set, requires new remotes to echo a cookie before a flow is created
+	// for them (see floodguard.go)
+	Challenge bool
+
+	// LingerTime is the time, in nanoseconds, for which packets of a closed flow are dropped.
+	// ExpireTime is the time, in nanoseconds, after which a flow that has not written is
+	// force-closed. If zero, MuxLingerTime and MuxExpireTime are used, respectively.
+	LingerTime int64
+	ExpireTime int64
+
+	// Reject, if not nil, is called with the cargo of the first packet of an incoming flow
+	// that is turned away. If it returns a non-nil reply, the reply is sent back to the remote.
+	Reject func(cargo []byte) []byte
+}
+
+// MuxStats holds the counters of a Mux
+type MuxStats struct {
+	Rejected  int64 // Incoming flows turned away due to the admission limits
+	Delivered int64 // Packets queued for the reader of their flow
+	Dropped   int64 // Packets dropped because the receive queue of their flow was full
+
+	RateLimited int64 // New flows refused by the flow-creation rate limits
+	Challenged  int64 // Cookies sent to new remotes
+	BadCookie   int64 // Packets whose Sink label is neither a known flow nor a valid cookie
+
+	RepliesDropped int64 // Replies dropped because the reply queue was full
 }
 
 const (
 	MuxLingerTime = 60e9  // 1 min in nanoseconds
 	MuxExpireTime = 600e9 // 10 min in nanoseconds
 	MuxReadSafety = 5
+
+	DefaultMuxAcceptBacklog = 16
+	DefaultMuxMaxFlows      = 1024
+	DefaultMuxFlowQueueLen  = 64
+
+	muxReplyQueueLen = 64
 )
 
+// muxReply is a packet that the Mux sends on its own, waiting in the reply queue
+type muxReply struct {
+	ml    *muxLink
+	msg   *muxMsg
+	block []byte
+	addr  net.Addr
+}
+
 // muxHeader is an internal data structure that carries a parsed switch packet,
 // which contains a flow ID and a DCCP header
 type muxHeader struct {
@@ -40,25 +125,87 @@ type muxHeader struct {
 	Cargo []byte
 }
 
-// NewMux creates a new Mux object, using the connection-less packet interface link
-func NewMux(link Link) *Mux {
+// NewMux creates a new Mux object, using the connection-less packet interfaces links.
+// If more than one link is given (e.g. UDP links bound to different interfaces), each flow
+// sends over one link at a time, and fails over to another link when its path stops
+// responding (see multilink.go). Packets are accepted on all links.
+func NewMux(links ...Link) *Mux {
+	return NewMuxConfig(MuxConfig{}, links...)
+}
+
+// NewMuxConfig creates a new Mux object, like NewMux, with the admission limits in config
+func NewMuxConfig(config MuxConfig, links ...Link) *Mux {
+	return NewMuxEnv(NewEnv(nil), config, links...)
+}
+
+// NewMuxEnv creates a new Mux object, like NewMuxConfig, whose time and goroutines are those
+// of env
+func NewMuxEnv(env *Env, config MuxConfig, links ...Link) *Mux {
+	if len(links) == 0 {
+		panic("mux without links")
+	}
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = DefaultMuxAcceptBacklog
+	}
+	if config.MaxFlows <= 0 {
+		config.MaxFlows = DefaultMuxMaxFlows
+	}
+	if config.FlowQueueLen <= 0 {
+		config.FlowQueueLen = DefaultMuxFlowQueueLen
+	}
+	if config.LingerTime <= 0 {
+		config.LingerTime = MuxLingerTime
+	}
+	if config.ExpireTime <= 0 {
+		config.ExpireTime = MuxExpireTime
+	}
+	if config.FlowRate <= 0 {
+		config.FlowRate = DefaultMuxFlowRate
+	}
+	if config.FlowBurst <= 0 {
+		config.FlowBurst = DefaultMuxFlowBurst
+	}
+	if config.SourceFlowRate <= 0 {
+		config.SourceFlowRate = DefaultMuxSourceFlowRate
+	}
+	if config.SourceFlowBurst <= 0 {
+		config.SourceFlowBurst = DefaultMuxSourceFlowBurst
+	}
 	m := &Mux{
-		link:         link,
+		env:          env,
 		flowsLocal:   make(map[uint64]*flow),
 		flowsRemote:  make(map[uint64]*flow),
-		lingerLocal:  make(map[uint64]time.Time),
-		lingerRemote: make(map[uint64]time.Time),
-		acceptChan:   make(chan *flow),
+		lingerLocal:  make(map[uint64]int64),
+		lingerRemote: make(map[uint64]int64),
+		acceptChan:   make(chan *flow, config.AcceptBacklog),
+		replies:      make(chan muxReply, muxReplyQueueLen),
+		config:       config,
+	}
+	m.guard.Init(&m.config, env.Now())
+	for _, link := range links {
+		m.links = append(m.links, &muxLink{Link: link})
+	}
+	m.nreaders = len(m.links)
+	for _, ml := range m.links {
+		ml := ml
+		env.Go(func() { m.readLoop(ml) }, "Mux read loop")
 	}
-	go m.readLoop()
-	go m.expireLingeringLoop()
-	go m.expireLoop()
+	env.Go(m.replyLoop, "Mux reply loop")
+	env.Go(m.expireLingeringLoop, "Mux linger loop")
+	env.Go(m.expireLoop, "Mux expire loop")
 	return m
 }
 
+// Stats returns the counters of the mux
+func (m *Mux) Stats() MuxStats {
+	m.Lock()
+	defer m.Unlock()
+	return m.stats
+}
+
 // Accept() returns the first incoming flow request
 func (m *Mux) Accept() (c SegmentConn, err error) {
-	f, ok := <-m.acceptChan
+	f, ok := Recv(m.env, m.acceptChan)
 	if !ok {
 		return nil, ErrBad
 	}
@@ -67,13 +214,21 @@ func (m *Mux) Accept() (c SegmentConn, err error) {
 
 // Dial opens a packet-based connection to the Link-layer addr
 func (m *Mux) Dial(addr net.Addr) (c SegmentConn, err error) {
-	ch := make(chan muxHeader)
-	local := ChooseLabel()
-	f := newFlow(addr, m, ch, m.cargoMaxLen(), local, nil)
+	ch := make(chan muxHeader, m.config.FlowQueueLen)
+	local := m.env.ChooseLabel()
 
 	m.Lock()
+	defer m.Unlock()
+	ml := m.pickLink(nil)
+	if m.closed || ml == nil {
+		return nil, ErrBad
+	}
+	if len(m.flowsLocal) >= m.config.MaxFlows {
+		return nil, ErrTooBusy
+	}
+	ml.flows++
+	f := newFlow(addr, m, ch, m.cargoMaxLen(), local, nil, ml)
 	m.flowsLocal[local.Hash()] = f
-	m.Unlock()
 
 	return f, nil
 }
@@ -82,34 +237,41 @@ func (m *Mux) Dial(addr net.Addr) (c SegmentConn, err error) {
 // that it is time to terminate
 func (m *Mux) Close() error {
 	m.Lock()
-	link := m.link
-	m.link = nil
+	if m.closed {
+		m.Unlock()
+		return ErrBad
+	}
+	m.closed = true
 	for _, f := range m.flowsLocal {
 		f.foreclose()
 	}
 	for _, f := range m.flowsRemote {
 		f.foreclose()
 	}
+	links := m.links
 	m.Unlock()
-	if link == nil {
-		return ErrBad
+	var err error
+	for _, ml := range links {
+		if e := ml.Close(); e != nil {
+			err = e
+		}
 	}
-	return link.Close()
+	return err
 }
 
-func (m *Mux) readLoop() {
+func (m *Mux) readLoop(ml *muxLink) {
 	for {
 		// Check that mux is still open
 		m.Lock()
-		link := m.link
+		closed := m.closed
 		m.Unlock()
-		if link == nil {
+		if closed {
 			break
 		}
 
 		// Read incoming packet
-		buf := make([]byte, m.link.GetMTU()+MuxReadSafety)
-		n, addr, err := link.ReadFrom(buf)
+		buf := make([]byte, ml.GetMTU()+MuxReadSafety)
+		n, addr, err := ml.ReadFrom(buf)
 		if err != nil {
 			break
 		}
@@ -125,9 +287,23 @@ func (m *Mux) readLoop() {
 			continue
 		}
 
-		m.process(msg, cargo, addr)
+		m.procLk.Lock()
+		m.process(msg, cargo, addr, ml)
+		m.procLk.Unlock()
+	}
+
+	// Flows sending over a dead link fail over to a live one on their next write
+	m.Lock()
+	ml.dead = true
+	m.nreaders--
+	last := m.nreaders == 0
+	m.Unlock()
+	if !last {
+		return
 	}
 	close(m.acceptChan)
+	// Only the read loops queue replies
+	close(m.replies)
 	m.Lock()
 	for _, f := range m.flowsLocal {
 		f.foreclose()
@@ -138,11 +314,15 @@ func (m *Mux) readLoop() {
 	m.Unlock()
 }
 
-func (m *Mux) process(msg *muxMsg, cargo []byte, addr net.Addr) {
+func (m *Mux) process(msg *muxMsg, cargo []byte, addr net.Addr, ml *muxLink) {
 	// REMARK: By design, only one copy of process() can run at a time (*)
+	m.procLk.AssertLocked()
 
-	// Every packet must have a source (remote) label
+	// Every packet must have a source (remote) label, except for control packets
 	if msg.Source == nil {
+		if msg.Sink != nil {
+			m.processControl(msg.Sink, cargo, addr, ml)
+		}
 		return
 	}
 
@@ -152,15 +332,20 @@ func (m *Mux) process(msg *muxMsg, cargo []byte, addr net.Addr) {
 	}
 
 	var f *flow
+	var cookie bool
 	// Does the packet have a sink label?
 	if msg.Sink != nil {
-		// If yes, then we must have a matching flow
+		// If yes, then we must have a matching flow, unless the sink is an echoed cookie
 		f = m.findLocal(msg.Sink)
 		if f == nil {
-			return
-		}
-		// Check if this is the first time we hear about the remote label on this flow
-		if f.getRemote() == nil {
+			if cookie = m.guard.CheckCookie(msg.Sink, msg.Source, addr, m.env.Now()); !cookie {
+				m.Lock()
+				m.stats.BadCookie++
+				m.Unlock()
+				return
+			}
+		} else if f.getRemote() == nil {
+			// Check if this is the first time we hear about the remote label on this flow
 			// If yes, then we just discovered the remote label. Save it.
 			// Remark (*), above, ensures that the next 4 lines are executed atomically
 			f.setRemote(msg.Source)
@@ -170,30 +355,68 @@ func (m *Mux) process(msg *muxMsg, cargo []byte, addr net.Addr) {
 		} else if !f.getRemote().Equal(msg.Source) {
 			return
 		}
-	} else {
+	}
+	if f == nil {
 		f = m.findRemote(msg.Source)
 		if f == nil {
-			f = m.accept(msg.Source, addr)
+			f = m.admit(msg.Source, addr, ml, cargo, cookie)
+			if f == nil {
+				return
+			}
 		}
 	}
+	f.heard()
 
-	f.ch <- muxHeader{msg, cargo}
+	// Follow the remote, if it has moved to a new address
+	m.validatePath(f, addr)
+
+	// Delivery never blocks, so a flow whose reader stalls does not hold up the other flows
+	ok := f.deliver(muxHeader{msg, cargo})
+	m.Lock()
+	if ok {
+		m.stats.Delivered++
+	} else {
+		m.stats.Dropped++
+	}
+	m.Unlock()
 }
 
-func (m *Mux) accept(remote *Label, addr net.Addr) *flow {
+// accept creates a flow for an incoming packet from a new remote, or turns the remote away
+// and returns nil, if the admission limits have been reached
+func (m *Mux) accept(remote *Label, addr net.Addr, ml *muxLink, cargo []byte) *flow {
 	if remote == nil {
 		panic("remote == nil")
 	}
 
-	ch := make(chan muxHeader)
-	local := ChooseLabel()
-	f := newFlow(addr, m, ch, m.cargoMaxLen(), local, remote)
+	ch := make(chan muxHeader, m.config.FlowQueueLen)
+	local := m.env.ChooseLabel()
 
 	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return nil
+	}
+	if len(m.flowsLocal) >= m.config.MaxFlows || len(m.acceptChan) == cap(m.acceptChan) {
+		m.stats.Rejected++
+		reject := m.config.Reject
+		m.Unlock()
+		if reject != nil {
+			if reply := reject(cargo); reply != nil {
+				// The reply comes from a throw-away label, so any further packets that the
+				// remote sends in response are dropped
+				m.reply(ml, &muxMsg{local, remote}, reply, addr)
+			}
+		}
+		return nil
+	}
+	// Replies to an incoming flow go out over the link that the flow came in on
+	ml.flows++
+	f := newFlow(addr, m, ch, m.cargoMaxLen(), local, remote, ml)
 	m.flowsLocal[local.Hash()] = f
 	m.flowsRemote[remote.Hash()] = f
 	m.Unlock()
 
+	// The backlog has room, since only process() sends on acceptChan (Remark (*))
 	m.acceptChan <- f
 
 	return f
@@ -231,24 +454,24 @@ func (m *Mux) findRemote(remote *Label) *flow {
 	return m.flowsRemote[remote.Hash()]
 }
 
-// expireLoop() force-closes flows that have been inactive for more than 10 min
+// expireLoop() force-closes flows that have been inactive for more than ExpireTime
 func (m *Mux) expireLoop() {
 	for {
-		time.Sleep(MuxExpireTime)
+		m.env.Sleep(m.config.ExpireTime)
 
 		// Check if mux has been closed
 		m.Lock()
-		link := m.link
+		closed := m.closed
 		m.Unlock()
-		if link == nil {
+		if closed {
 			break
 		}
 
-		now := time.Now()
+		now := m.env.Now()
 		m.Lock()
 		// All active flows have local labels, so it's enough to iterate just flowsLocal[]
 		for _, f := range m.flowsLocal {
-			if now.Sub(f.LastWriteTime()) > MuxExpireTime {
+			if now-f.LastWriteTime() > m.config.ExpireTime {
 				f.foreclose()
 			}
 		}
@@ -257,7 +480,7 @@ func (m *Mux) expireLoop() {
 }
 
 // isLingering() returns true if the labels of this packet pertain to a flow
-// that has been closed in the past minute.
+// that has been closed in the past LingerTime.
 func (m *Mux) isLingering(local, remote *Label) bool {
 	m.Lock()
 	defer m.Unlock()
@@ -276,28 +499,28 @@ func (m *Mux) isLingering(local, remote *Label) bool {
 }
 
 // expireLingeringLoop() removes the labels of connections that have been closed for more than
-// a minute from the data structure that remembers them
+// LingerTime from the data structure that remembers them
 func (m *Mux) expireLingeringLoop() {
 	for {
-		time.Sleep(MuxLingerTime)
+		m.env.Sleep(m.config.LingerTime)
 
 		// Check if mux has been closed
 		m.Lock()
-		link := m.link
+		closed := m.closed
 		m.Unlock()
-		if link == nil {
+		if closed {
 			break
 		}
 
-		now := time.Now()
+		now := m.env.Now()
 		m.Lock()
 		for h, t := range m.lingerLocal {
-			if now.Sub(t) >= MuxLingerTime {
+			if now-t >= m.config.LingerTime {
 				delete(m.lingerLocal, h)
 			}
 		}
 		for h, t := range m.lingerRemote {
-			if now.Sub(t) >= MuxLingerTime {
+			if now-t >= m.config.LingerTime {
 				delete(m.lingerRemote, h)
 			}
 		}
@@ -306,11 +529,14 @@ func (m *Mux) expireLingeringLoop() {
 }
 
 // del() removes the flow with the specified labels from the data structure, if it still exists
-func (m *Mux) del(local *Label, remote *Label) {
+func (m *Mux) del(local *Label, remote *Label, ml *muxLink) {
 	m.Lock()
 	defer m.Unlock()
 
-	now := time.Now()
+	if ml != nil {
+		ml.flows--
+	}
+	now := m.env.Now()
 	if local != nil {
 		delete(m.flowsLocal, local.Hash())
 		if _, alreadyClosed := m.lingerLocal[local.Hash()]; !alreadyClosed {
@@ -325,13 +551,44 @@ func (m *Mux) del(local *Label, remote *Label) {
 	}
 }
 
-func (m *Mux) cargoMaxLen() int { return m.link.GetMTU() - muxMsgFootprint }
+// cargoMaxLen returns the largest block that fits in the MTU of every link, so that flows can
+// fail over between links
+func (m *Mux) cargoMaxLen() int {
+	mtu := m.links[0].GetMTU()
+	for _, ml := range m.links[1:] {
+		mtu = min(mtu, ml.GetMTU())
+	}
+	return mtu - muxMsgFootprint
+}
 
-func (m *Mux) write(msg *muxMsg, block []byte, addr net.Addr) error {
+// reply queues a packet that the Mux sends on its own, or drops it if the queue is full.
+// It never blocks, so it can be called from the read loops.
+func (m *Mux) reply(ml *muxLink, msg *muxMsg, block []byte, addr net.Addr) {
+	select {
+	case m.replies <- muxReply{ml, msg, block, addr}:
+	default:
+		m.Lock()
+		m.stats.RepliesDropped++
+		m.Unlock()
+	}
+}
+
+// replyLoop writes the queued replies, until the read loops exit
+func (m *Mux) replyLoop() {
+	for {
+		r, ok := Recv(m.env, m.replies)
+		if !ok {
+			return
+		}
+		m.write(r.ml, r.msg, r.block, r.addr)
+	}
+}
+
+func (m *Mux) write(ml *muxLink, msg *muxMsg, block []byte, addr net.Addr) error {
 	m.Lock()
-	link := m.link
+	closed := m.closed
 	m.Unlock()
-	if link == nil {
+	if closed {
 		return ErrBad
 	}
 
@@ -339,7 +596,10 @@ func (m *Mux) write(msg *muxMsg, block []byte, addr net.Addr) error {
 	msg.Write(buf)
 	copy(buf[muxMsgFootprint:], block)
 
-	n, err := link.WriteTo(buf, addr)
+	n, err := ml.WriteTo(buf, addr)
+	if err != nil {
+		return err
+	}
 	if n != muxMsgFootprint+len(block) {
 		panic("block divided")
 	}
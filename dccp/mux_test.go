@@ -7,6 +7,8 @@ package dccp
 import (
 	"net"
 	"testing"
+	"time"
+	"github.com/petar/GoDCCP/dccp/sandbox/synthetic"
 )
 
 type endToEnd struct {
@@ -166,3 +168,191 @@ func _TestMuxOverUDP(t *testing.T) {
 	ee := newEndToEnd(t, alink, dlink, addr, 10)
 	ee.Run()
 }
+
+func TestMuxAdmission(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	busy := func(cargo []byte) []byte { return []byte("busy") }
+	sm := NewMuxConfig(MuxConfig{MaxFlows: 1, Reject: busy}, n.Attach(saddr))
+	cm := NewMux(n.Attach(caddr))
+
+	c1, _ := cm.Dial(saddr)
+	c1.Write([]byte("1"))
+	s1, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	if s := readString(t, s1); s != "1" {
+		t.Fatalf("expecting 1, got %s", s)
+	}
+
+	// The second flow exceeds MaxFlows
+	c2, _ := cm.Dial(saddr)
+	c2.Write([]byte("2"))
+	if s := readString(t, c2); s != "busy" {
+		t.Fatalf("expecting busy, got %s", s)
+	}
+	if st := sm.Stats(); st.Rejected != 1 {
+		t.Errorf("expecting 1 rejected flow, got %d", st.Rejected)
+	}
+	sm.Close()
+	cm.Close()
+}
+
+// TestMuxReplyQueue checks that cookies for new remotes do not stall the read loop when
+// nobody reads the link on the other side
+func TestMuxReplyQueue(t *testing.T) {
+	p, q := NewChanPipe()
+	m := NewMuxConfig(MuxConfig{Challenge: true}, p)
+
+	// More cookies than fit in the reply queue, but within the rate limit of cookies
+	const n = muxCookieBurst
+	if n <= muxReplyQueueLen {
+		t.Fatalf("cookie burst fits in the reply queue")
+	}
+	pkt := make([]byte, muxMsgFootprint+1)
+	for i := 0; i < n; i++ {
+		(&muxMsg{ChooseLabel(), nil}).Write(pkt)
+		if _, err := q.WriteTo(pkt, nil); err != nil {
+			t.Fatalf("write (%s)", err)
+		}
+	}
+	for i := 0; i < 100 && m.Stats().Challenged < n; i++ {
+		time.Sleep(10e6)
+	}
+	if st := m.Stats(); st.Challenged != n || st.RepliesDropped == 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	m.Close()
+	q.Close()
+}
+
+func TestRejectTooBusy(t *testing.T) {
+	req := &Header{SeqNo: 1234}
+	req.InitRequestHeader(7)
+	p, err := req.Write(LabelZero.Bytes(), LabelZero.Bytes(), AnyProto, false)
+	if err != nil {
+		t.Fatalf("request write (%s)", err)
+	}
+	q := rejectTooBusy(p)
+	if q == nil {
+		t.Fatalf("no reset")
+	}
+	h, err := ReadHeader(q, LabelZero.Bytes(), LabelZero.Bytes(), AnyProto, false)
+	if err != nil {
+		t.Fatalf("reset read (%s)", err)
+	}
+	if h.Type != Reset || h.ResetCode != ResetTooBusy || h.AckNo != 1234 || h.SeqNo != 0 {
+		t.Errorf("unexpected reset %v", h)
+	}
+	if rejectTooBusy(q) != nil {
+		t.Errorf("reset in response to a non-Request")
+	}
+}
+
+func TestMuxSlowFlow(t *testing.T) {
+	n := newMemNet(NewEnv(nil))
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	sm := NewMuxConfig(MuxConfig{AcceptBacklog: 2, FlowQueueLen: 2}, n.Attach(saddr))
+	cm := NewMux(n.Attach(caddr))
+
+	// Nobody reads the first flow, which overflows its queue
+	slow, _ := cm.Dial(saddr)
+	for i := 0; i < 5; i++ {
+		slow.Write([]byte("s"))
+	}
+	fast, _ := cm.Dial(saddr)
+	fast.Write([]byte("f"))
+
+	// The first flow waits in the accept backlog, and the third one does not fit in it
+	extra, _ := cm.Dial(saddr)
+	extra.Write([]byte("x"))
+
+	for i := 0; i < 100 && sm.Stats().Rejected == 0; i++ {
+		time.Sleep(10e6)
+	}
+
+	sslow, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	sfast, err := sm.Accept()
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	if s := readString(t, sfast); s != "f" {
+		t.Fatalf("expecting f, got %s", s)
+	}
+	st := sm.Stats()
+	if st.Dropped != 3 || st.Delivered != 3 || st.Rejected != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	if d := sslow.(*flow).Dropped(); d != 3 {
+		t.Errorf("expecting 3 drops on the slow flow, got %d", d)
+	}
+	sm.Close()
+	cm.Close()
+}
+
+// TestMuxExpire runs in synthetic time, which stands still while the test goroutines run
+func TestMuxExpire(t *testing.T) {
+	env := NewEnvRuntime(nil, synthetic.New(), 1)
+	n := newMemNet(env)
+	saddr, caddr := &Addr{ChooseLabel(), 1}, &Addr{ChooseLabel(), 2}
+	config := MuxConfig{LingerTime: 100e6, ExpireTime: 100e6}
+	sm := NewMuxEnv(env, config, n.Attach(saddr))
+	cm := NewMuxEnv(env, config, n.Attach(caddr))
+
+	test := env.NewGoJoin("test")
+	test.Go(func() {
+		cc, _ := cm.Dial(saddr)
+		cc.Write([]byte("a"))
+		sc, err := sm.Accept()
+		if err != nil {
+			t.Errorf("accept (%s)", err)
+			return
+		}
+		if p, err := sc.Read(); err != nil || string(p) != "a" {
+			t.Errorf("expecting a, got %q (%v)", p, err)
+			return
+		}
+
+		// A read that outlives its deadline times out
+		t0 := env.Now()
+		sc.SetReadExpire(10e6)
+		if _, err := sc.Read(); err != ErrTimeout {
+			t.Errorf("expecting timeout, got %v", err)
+			return
+		}
+		if d := env.Now() - t0; d != 10e6 {
+			t.Errorf("read timed out after %d", d)
+		}
+
+		// Idle flows are force-closed within two expiry periods
+		t0 = env.Now()
+		sc.SetReadExpire(1e9)
+		if _, err := sc.Read(); err != ErrIO {
+			t.Errorf("expecting idle flow to be force-closed, got %v", err)
+			return
+		}
+		if d := env.Now() - t0; d > 2*config.ExpireTime {
+			t.Errorf("idle flow force-closed after %d", d)
+		}
+
+		// The labels of a closed flow linger for one to two linger periods
+		local := cc.LocalLabel().(*Label)
+		cc.Close()
+		env.Sleep(config.LingerTime / 2)
+		if !cm.isLingering(local, nil) {
+			t.Errorf("closed flow not lingering")
+		}
+		env.Sleep(2 * config.LingerTime)
+		if cm.isLingering(local, nil) {
+			t.Errorf("closed flow still lingering")
+		}
+	}, "test")
+	test.Join()
+	sm.Close()
+	cm.Close()
+	env.Close()
+}
@@ -0,0 +1,143 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// Bottleneck is a link of fixed capacity that is shared by several pipes, so that the
+// connections over them compete for capacity and queue space. Packets wait in a single queue,
+// which is served in order of arrival, and the QueueDiscipline of the bottleneck decides
+// which of them are dropped. Every pipe that routes through the bottleneck is a flow, and
+// the bottleneck keeps statistics for each flow.
+type Bottleneck struct {
+	env        *dccp.Env
+	amb        *dccp.Amb
+	rate       int64 // Bytes per second
+	queueBytes int64
+	disc       QueueDiscipline
+
+	sync.Mutex
+	free       int64 // Time when the bottleneck finishes transmitting the queued packets
+	queue      []tracePacket
+	flows      map[string]*FlowStats
+}
+
+// FlowStats are the statistics of one flow through a Bottleneck
+type FlowStats struct {
+	Packets int64  // Packets that reached the bottleneck
+	Bytes   int64  // Bytes accepted for transmission
+	Dropped int64  // Packets dropped
+	Delay   Moment // Queueing delay of accepted packets, in ns
+}
+
+// NewBottleneck creates a bottleneck which transmits bytesPerSecond bytes per second, queues
+// up to queueBytes bytes and drops packets according to disc. A non-positive queueBytes
+// selects DefaultQueueBytes, and a nil disc selects DropTail.
+func NewBottleneck(env *dccp.Env, amb *dccp.Amb, bytesPerSecond int64, queueBytes int, disc QueueDiscipline) *Bottleneck {
+	if queueBytes <= 0 {
+		queueBytes = DefaultQueueBytes
+	}
+	if disc == nil {
+		disc = DropTail{}
+	}
+	return &Bottleneck{
+		env:        env,
+		amb:        amb.Refine("bottleneck"),
+		rate:       bytesPerSecond,
+		queueBytes: int64(queueBytes),
+		disc:       disc,
+		flows:      make(map[string]*FlowStats),
+	}
+}
+
+// Send returns the time when a packet of n bytes of the given flow, arriving at time now,
+// finishes transmission. It returns false if the packet is dropped. Packets must arrive in
+// order of time.
+func (b *Bottleneck) Send(flow string, now, n int64) (sent int64, ok bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	st := b.stats(flow)
+	st.Packets++
+
+	for len(b.queue) > 0 && b.queue[0].depart <= now {
+		b.queue = b.queue[1:]
+	}
+	var queued int64
+	for _, p := range b.queue {
+		queued += p.n
+	}
+	head := max64(now, b.free)
+	if queued+n > b.queueBytes {
+		st.Dropped++
+		b.amb.E(dccp.EventInfo, fmt.Sprintf("Queue full, flow=%s", flow))
+		return 0, false
+	}
+	if b.disc.Drop(b.env, now, head, queued, n) {
+		st.Dropped++
+		b.amb.E(dccp.EventInfo, fmt.Sprintf("%s drop, flow=%s", b.disc, flow))
+		return 0, false
+	}
+	b.free = head + (n*1e9)/b.rate
+	b.queue = append(b.queue, tracePacket{b.free, n})
+	st.Bytes += n
+	st.Delay.Add(float64(head - now))
+	return b.free, true
+}
+
+func (b *Bottleneck) stats(flow string) *FlowStats {
+	st, ok := b.flows[flow]
+	if !ok {
+		st = &FlowStats{}
+		st.Delay.Init()
+		b.flows[flow] = st
+	}
+	return st
+}
+
+// Stats returns a copy of the statistics of each flow
+func (b *Bottleneck) Stats() map[string]FlowStats {
+	b.Lock()
+	defer b.Unlock()
+	r := make(map[string]FlowStats)
+	for flow, st := range b.flows {
+		r[flow] = *st
+	}
+	return r
+}
+
+// Report returns a table of the throughput, drops and queueing delay of each flow, where
+// throughput is averaged over elapsed nanoseconds
+func (b *Bottleneck) Report(elapsed int64) string {
+	st := b.Stats()
+	var flows []string
+	for flow, _ := range st {
+		flows = append(flows, flow)
+	}
+	sort.Strings(flows)
+	var w bytes.Buffer
+	fmt.Fprintf(&w, "%-12s %12s %8s %12s\n", "Flow", "Rate (B/s)", "Drop", "Delay (ms)")
+	for _, flow := range flows {
+		f := st[flow]
+		var drop float64
+		if f.Packets > 0 {
+			drop = float64(f.Dropped) / float64(f.Packets)
+		}
+		fmt.Fprintf(&w, "%-12s %12.0f %7.1f%% %12.1f\n", flow, float64(f.Bytes)*1e9/float64(elapsed),
+			100*drop, f.Delay.Average()/1e6)
+	}
+	return string(w.Bytes())
+}
+
+// Rate returns the capacity of the bottleneck in bytes per second
+func (b *Bottleneck) Rate() int64 {
+	return b.rate
+}
@@ -0,0 +1,142 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// TestSharedBottleneck checks that flows share the queue and the capacity of a bottleneck
+func TestSharedBottleneck(t *testing.T) {
+	env := dccp.NewEnv(nil)
+	b := NewBottleneck(env, dccp.NewAmb("line", env), 1e6, 3000, nil)
+	steps := []struct {
+		flow string
+		sent int64
+		ok   bool
+	}{
+		{"a", 1e6, true},
+		{"b", 2e6, true},
+		{"a", 3e6, true},
+		{"b", 0, false},
+	}
+	for i, s := range steps {
+		sent, ok := b.Send(s.flow, 0, 1000)
+		if sent != s.sent || ok != s.ok {
+			t.Errorf("step %d: sent %d %v, expecting %d %v", i, sent, ok, s.sent, s.ok)
+		}
+	}
+	st := b.Stats()
+	if a := st["a"]; a.Packets != 2 || a.Bytes != 2000 || a.Dropped != 0 || a.Delay.Average() != 1e6 {
+		t.Errorf("unexpected stats of a %+v", a)
+	}
+	if b := st["b"]; b.Packets != 2 || b.Bytes != 1000 || b.Dropped != 1 || b.Delay.Average() != 1e6 {
+		t.Errorf("unexpected stats of b %+v", b)
+	}
+}
+
+// TestQueueDisciplines checks the queueing delay of the disciplines under a 10% overload by a
+// flow that does not respond to drops
+func TestQueueDisciplines(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	const (
+		rate     = 1e6     // Bytes per second, or a 1000-byte packet per ms
+		duration = 10e9
+	)
+	tests := []struct {
+		disc               QueueDiscipline
+		minDelay, maxDelay float64
+	}{
+		{DropTail{}, 90e6, 100e6},
+		{NewRED(10e3, 30e3), 5e6, 35e6},
+		{NewCoDel(), 1e6, 40e6},
+	}
+	for _, test := range tests {
+		b := NewBottleneck(env, dccp.NewAmb("line", env), rate, 100e3, test.disc)
+		// Packets are counted as flow b once the queue has settled
+		for now := int64(0); now < 2*duration; now += 909e3 {
+			flow := "a"
+			if now >= duration {
+				flow = "b"
+			}
+			b.Send(flow, now, 1000)
+		}
+		st := b.Stats()["b"]
+		if d := st.Delay.Average(); d < test.minDelay || d > test.maxDelay {
+			t.Errorf("%s: average delay %0.1f ms", test.disc, d/1e6)
+		}
+		if tput := float64(st.Bytes) * 1e9 / duration; tput < 0.95*rate {
+			t.Errorf("%s: throughput %0.0f B/s", test.disc, tput)
+		}
+	}
+}
+
+const (
+	fairnessDuration = 60e9  // Duration of the experiment in ns
+	fairnessRate     = 50e3  // Capacity of the bottleneck in bytes per second
+	fairnessQueue    = 30e3  // Queue of the bottleneck in bytes, or 600 ms at its capacity
+	fairnessMinJain  = 0.9   // Minimum Jain fairness index of the two connections
+	fairnessMinUsage = 0.7   // Minimum fraction of the capacity used by the two connections
+)
+
+// TestFairness runs two connections through a shared bottleneck under each queue discipline,
+// and checks that they share it fairly and, except under CoDel, use most of its capacity.
+// The experiment is seeded, so every run gives the same shares. Longer queues let one
+// connection lock the other out for long stretches under DropTail.
+//
+// CCID3 converts its allowed rate into packets of FixedSegmentSize bytes, so connections
+// writing smaller packets send a fraction of it. Once there is loss, the rate is capped at
+// twice the receive rate, which is that same fraction, so the regular early drops of CoDel
+// hold both connections near their initial rate. See the segment size entry in TODO.
+func TestFairness(t *testing.T) {
+	testFairness(t, DropTail{}, fairnessMinUsage)
+	testFairness(t, NewRED(8e3, 24e3), fairnessMinUsage)
+	testFairness(t, NewCoDel(), 0)
+}
+
+func testFairness(t *testing.T, disc QueueDiscipline, minUsage float64) {
+	flows := []string{"1", "2"}
+	x := &Experiment{
+		Name:       "fairness",
+		Seed:       1,
+		Duration:   fairnessDuration,
+		Bottleneck: &BottleneckSpec{Rate: fairnessRate, QueueBytes: fairnessQueue, Discipline: disc},
+		Check: func(r *Run) {
+			st := r.Bottleneck.Stats()
+			var total, sumSq float64
+			for _, flow := range flows {
+				f := st[flow]
+				if f.Bytes == 0 {
+					t.Errorf("%s: flow %s starved", disc, flow)
+				}
+				total += float64(f.Bytes)
+				sumSq += float64(f.Bytes) * float64(f.Bytes)
+			}
+			jain := total*total/(float64(len(flows))*sumSq)
+			usage := total/(fairnessRate*fairnessDuration/1e9)
+			t.Logf("%s: Jain fairness index %0.2f, usage %0.2f", disc, jain, usage)
+			if jain < fairnessMinJain {
+				t.Errorf("%s: Jain fairness index %0.2f below %g", disc, jain, fairnessMinJain)
+			}
+			if usage > 1 {
+				t.Errorf("%s: flows exceed the capacity of the bottleneck", disc)
+			}
+			if usage < minUsage {
+				t.Errorf("%s: flows use %0.2f of the capacity, below %g", disc, usage, minUsage)
+			}
+		},
+	}
+	for _, flow := range flows {
+		x.Pairs = append(x.Pairs, &Pair{
+			Client:        "client" + flow,
+			Server:        "server" + flow,
+			Shared:        true,
+			Flow:          flow,
+			ClientTraffic: Pattern{Payload: 1000},
+		})
+	}
+	x.Run(t)
+}
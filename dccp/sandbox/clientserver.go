@@ -5,34 +5,94 @@
 package sandbox
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"path"
+	"strconv"
+	"time"
 	"github.com/petar/GoDCCP/dccp"
 	"github.com/petar/GoDCCP/dccp/ccid3"
+	"github.com/petar/GoDCCP/dccp/sandbox/synthetic"
 )
 
-// NewEnv creates a dccp.Env for test purposes, whose dccp.Guzzle writes to a file
-// and duplicates all emits to any number of additional guzzles, which are usually used to check
-// test conditions. The GuzzlePlex is returned to facilitate adding further guzzles.
+// NewEnv creates a dccp.Env for test purposes, which runs in synthetic time and whose dccp.Guzzle
+// writes to a file and duplicates all emits to any number of additional guzzles, which are usually
+// used to check test conditions. The GuzzlePlex is returned to facilitate adding further guzzles.
+// If the environment variable DCCPSEED is set, it seeds the random source of the dccp.Env, so that
+// a run whose seed was logged can be replayed. The calling goroutine is a goroutine of the Env, which
+// must wait only through the Env (see synthetic.Runtime).
 func NewEnv(guzzleFilename string, guzzles ...dccp.Guzzle) (env *dccp.Env, plex *GuzzlePlex) {
+	seed := time.Now().UnixNano()
+	if s := os.Getenv("DCCPSEED"); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			panic("DCCPSEED is not an integer")
+		}
+	}
+	return NewEnvSeed(guzzleFilename, seed, guzzles...)
+}
+
+// NewEnvSeed is like NewEnv, but it seeds the random source of the dccp.Env with seed
+func NewEnvSeed(guzzleFilename string, seed int64, guzzles ...dccp.Guzzle) (env *dccp.Env, plex *GuzzlePlex) {
 	fileGuzzle := dccp.NewFileGuzzle(path.Join(os.Getenv("DCCPLOG"), guzzleFilename + ".emit"))
 	plex = NewGuzzlePlex(append(guzzles, fileGuzzle)...)
-	return dccp.NewEnv(plex), plex
+	return NewSyntheticEnv(plex, seed), plex
+}
+
+// NewSyntheticEnv creates a dccp.Env that runs in synthetic time (see synthetic.Runtime), whose
+// random source is seeded with seed. The seed is logged, so that the run can be replayed. The
+// calling goroutine is a goroutine of the Env.
+func NewSyntheticEnv(guzzle dccp.Guzzle, seed int64) *dccp.Env {
+	env := dccp.NewEnvRuntime(guzzle, synthetic.New(), seed)
+	dccp.NewAmb("env", env).E(dccp.EventInfo, fmt.Sprintf("Seed=%d", seed))
+	return env
 }
 
 // NewClientServerPipe creates a sandbox communication pipe and attaches a DCCP client and a DCCP
 // server to its endpoints. In addition to sending all emits to a standard DCCP log file, it sends a
 // copy of all emits to the dup Guzzle.
 func NewClientServerPipe(env *dccp.Env) (clientConn, serverConn *dccp.Conn, clientToServer, serverToClient *headerHalfPipe) {
+	return NewClientServerPipeNamed(env, "client", "server")
+}
+
+// NewClientServerPipeNamed is like NewClientServerPipe, but labels the emits of the client and
+// the server with the given names, so that several pairs can run in one dccp.Env.
+func NewClientServerPipeNamed(env *dccp.Env, client, server string) (clientConn, serverConn *dccp.Conn, clientToServer, serverToClient *headerHalfPipe) {
 	llog := dccp.NewAmb("line", env)
-	hca, hcb, _ := NewPipe(env, llog, "client", "server")
+	hca, hcb, _ := NewPipe(env, llog, client, server)
 	ccid := ccid3.CCID3{}
 
-	clog := dccp.NewAmb("client", env)
+	clog := dccp.NewAmb(client, env)
 	clientConn = dccp.NewConnClient(env, clog, hca, ccid.NewSender(env, clog), ccid.NewReceiver(env, clog), 0)
 
-	slog := dccp.NewAmb("server", env)
+	slog := dccp.NewAmb(server, env)
 	serverConn = dccp.NewConnServer(env, slog, hcb, ccid.NewSender(env, slog), ccid.NewReceiver(env, slog))
 
 	return clientConn, serverConn, hca, hcb
 }
+
+// DialConn dials addr through the Mux m and attaches a DCCP client, labeled name, to the new
+// flow. Unlike a pipe, a Mux carries the wire format of packets over a dccp.Link (see
+// ImpairedLink).
+func DialConn(env *dccp.Env, name string, m *dccp.Mux, addr net.Addr) (*dccp.Conn, error) {
+	bc, err := m.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	ccid := ccid3.CCID3{}
+	amb := dccp.NewAmb(name, env)
+	return dccp.NewConnClient(env, amb, dccp.NewHeaderConn(bc), ccid.NewSender(env, amb), ccid.NewReceiver(env, amb), 0), nil
+}
+
+// AcceptConn waits for the next flow of the Mux m and attaches a DCCP server, labeled name,
+// to it
+func AcceptConn(env *dccp.Env, name string, m *dccp.Mux) (*dccp.Conn, error) {
+	bc, err := m.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ccid := ccid3.CCID3{}
+	amb := dccp.NewAmb(name, env)
+	return dccp.NewConnServer(env, amb, dccp.NewHeaderConn(bc), ccid.NewSender(env, amb), ccid.NewReceiver(env, amb)), nil
+}
@@ -5,6 +5,9 @@
 package sandbox
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 	"github.com/petar/GoDCCP/dccp"
 )
@@ -14,8 +17,14 @@ func TestNop(t *testing.T) {
 	// dccp.InstallCtrlCPanic()
 	// dccp.InstallTimeout(10e9)
 	env, _ := NewEnv("nop")
-	NewClientServerPipe(env)
+	clientConn, serverConn, _, _ := NewClientServerPipe(env)
 	env.Sleep(5e9)
+	clientConn.Abort()
+	serverConn.Abort()
+	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
+	if err := env.Close(); err != nil {
+		t.Errorf("Error closing runtime (%s)", err)
+	}
 }
 
 // TestOpenClose verifies that connect and close handshakes function correctly
@@ -23,29 +32,23 @@ func TestOpenClose(t *testing.T) {
 	env, _ := NewEnv("openclose")
 	clientConn, serverConn, _, _ := NewClientServerPipe(env)
 
-	cchan := make(chan int, 1)
-	env.Go(func() {
+	test := env.NewGoJoin("test")
+	test.Go(func() {
 		env.Sleep(2e9)
 		_, err := clientConn.Read()
 		if err != dccp.ErrEOF {
 			t.Errorf("client read error (%s), expected EBADF", err)
 		}
-		cchan <- 1
-		close(cchan)
 	}, "test client")
 
-	schan := make(chan int, 1)
-	env.Go(func() {
+	test.Go(func() {
 		env.Sleep(1e9)
 		if err := serverConn.Close(); err != nil {
 			t.Errorf("server close error (%s)", err)
 		}
-		schan <- 1
-		close(schan)
 	}, "test server")
 
-	<-cchan
-	<-schan
+	test.Join()
 
 	// Abort casuses both connection to wrap up the connection quickly
 	clientConn.Abort()
@@ -60,49 +63,114 @@ func TestOpenClose(t *testing.T) {
 	}
 }
 
+// TestAckVectorNegotiation checks that the client and the server ask each other for Ack
+// Vectors during the handshake, and make room for them in the MTU once they agree
+func TestAckVectorNegotiation(t *testing.T) {
+	env, _ := NewEnv("ackvector")
+	clientConn, serverConn, _, _ := NewClientServerPipe(env)
+	mtu := clientConn.GetMTU()
+	env.Sleep(2e9)
+	// The Ack Vectors of Conn have a 2-byte option header and up to 16 cells
+	for _, c := range []*dccp.Conn{clientConn, serverConn} {
+		if m := c.GetMTU(); m != mtu-2-16 {
+			t.Errorf("MTU %d after the handshake, expecting %d", m, mtu-2-16)
+		}
+	}
+	clientConn.Abort()
+	serverConn.Abort()
+	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
+	if err := env.Close(); err != nil {
+		t.Errorf("Error closing runtime (%s)", err)
+	}
+}
+
 // Idle keeps the connection between a client and server idle for a few seconds and makes sure that
 // no unusual behavior occurs.
 func TestIdle(t *testing.T) {
+	x := &Experiment{
+		Name:     "idle",
+		Duration: 10e9, // Stay idle for 10 sec
+		Pairs: []*Pair{
+			&Pair{
+				ClientTraffic: Pattern{Payload: 3, Count: 1},
+				ServerTraffic: Pattern{Payload: 3, Count: 1},
+			},
+		},
+	}
+	x.Run(t)
+}
 
-	env, _ := NewEnv("idle")
-	clientConn, serverConn, _, _ := NewClientServerPipe(env)
-	payload := []byte{1, 2, 3}
+// eventRecorder is a dccp.Guzzle that records the emits of a run
+type eventRecorder struct {
+	sync.Mutex
+	events []string
+}
 
-	cchan := make(chan int, 1)
-	env.Go(func() {
-		if err := clientConn.Write(payload); err != nil {
-			t.Errorf("client write (%s)", err)
-		}
-		env.Sleep(10e9) // Stay idle for 10 sec
-		if err := clientConn.Close(); err != nil && err != dccp.ErrEOF {
-			t.Errorf("client close (%s)", err)
-		}
-		cchan <- 1
-		close(cchan)
-	}, "test client")
+func (x *eventRecorder) Write(r *dccp.LogRecord) {
+	x.Lock()
+	defer x.Unlock()
+	x.events = append(x.events, fmt.Sprintf("%d %v %d %s %s %s %d %d",
+		r.Time, r.Labels, r.Event, r.State, r.Comment, r.Type, r.SeqNo, r.AckNo))
+}
 
-	schan := make(chan int, 1)
-	env.Go(func() {
-		if err := serverConn.Write(payload); err != nil {
-			t.Errorf("server write (%s)", err)
-		}
-		env.Sleep(10e9) // Stay idle for 10 sec
-		if err := serverConn.Close(); err != nil && err != dccp.ErrEOF {
-			// XXX why not EOF
-			t.Logf("server close (%s)", err)
+func (x *eventRecorder) Sync() error  { return nil }
+func (x *eventRecorder) Close() error { return nil }
+
+// TestDeterminism checks that two runs with the same seed emit the same events at the same
+// times, even though their goroutines race for the same channels (see runprocs.sh)
+func TestDeterminism(t *testing.T) {
+	a, b := runSeeded(7), runSeeded(7)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			t.Fatalf("runs diverge at event %d:\n%s\n%s", i, a[i], b[i])
 		}
-		schan <- 1
-		close(schan)
-	}, "test server")
+	}
+	if len(a) != len(b) {
+		t.Fatalf("runs emit %d and %d events", len(a), len(b))
+	}
+	if !strings.Contains(a[0], "Seed=7") {
+		t.Errorf("seed not logged first, got %s", a[0])
+	}
+	if c := runSeeded(8); fmt.Sprint(c) == fmt.Sprint(a) {
+		t.Errorf("runs with different seeds emit the same events")
+	}
+}
 
-	<-cchan
-	<-schan
+// runSeeded runs a connection with random losses and jitter in both directions for 10
+// seconds, and returns its emits
+func runSeeded(seed int64) []string {
+	rec := &eventRecorder{}
+	env := NewSyntheticEnv(rec, seed)
+	clientConn, serverConn, clientToServer, serverToClient := NewClientServerPipe(env)
+	for _, p := range []*headerHalfPipe{clientToServer, serverToClient} {
+		p.SetWriteLatency(20e6)
+		p.SetWriteJitter(&UniformJitter{Max: 10e6})
+		p.SetLossModel(&BernoulliLoss{P: 0.05})
+	}
+	test := env.NewGoJoin("test")
+	for _, c := range []*dccp.Conn{clientConn, serverConn} {
+		c := c
+		test.Go(func() {
+			t0 := env.Now()
+			for env.Now()-t0 < 10e9 {
+				if c.Write(make([]byte, 100)) != nil {
+					break
+				}
+			}
+			c.Close()
+		}, "writer")
+		test.Go(func() {
+			for {
+				if _, err := c.Read(); err != nil {
+					break
+				}
+			}
+		}, "reader")
+	}
+	test.Join()
 	clientConn.Abort()
 	serverConn.Abort()
 	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
-
-	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
-	if err := env.Close(); err != nil {
-		t.Errorf("Error closing runtime (%s)", err)
-	}
+	env.Close()
+	return rec.events
 }
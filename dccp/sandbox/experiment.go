@@ -0,0 +1,371 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"sync"
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// Experiment describes a sandbox test declaratively. Run creates the environment and the
+// connections, drives the traffic for Duration, shuts the connections down and writes the
+// inspector log to Name.emit. A Measure observes the pair of endpoints named client and
+// server, and its results are logged at the end.
+type Experiment struct {
+	Name     string
+	Duration int64
+
+	// Seed, if not zero, seeds the random source of the environment, so that every run of
+	// the experiment is the same. Otherwise, the seed is chosen as by NewEnv.
+	Seed     int64
+
+	// Pairs are the DCCP connections of the experiment. If Pairs is empty, the experiment
+	// runs one pair with default parameters.
+	Pairs []*Pair
+
+	// If Bottleneck is not nil, the client-to-server side of pairs marked Shared and the cross
+	// traffic compete for it. Shared pairs and cross traffic require a Bottleneck.
+	Bottleneck *BottleneckSpec
+	Traffic    []*CrossTraffic
+
+	// Highlight lists the sample series to highlight in the inspector
+	Highlight []string
+
+	// Setup, if not nil, is called once the connections exist and before traffic starts. It is
+	// the place to add guzzles and to set flags of the connections.
+	Setup func(r *Run)
+
+	// Actions are performed at given times during the experiment. Actions at or after Duration
+	// are not performed. The connections are shut down only once all actions have returned.
+	Actions []*Action
+
+	// Check, if not nil, is called after the traffic has ended and the connections are down,
+	// before the environment is closed
+	Check func(r *Run)
+}
+
+// Pair is a DCCP client and server connected by a pipe
+type Pair struct {
+	Client, Server string // Names of the endpoints, client and server by default
+
+	ClientToServer Link
+	ServerToClient Link
+	Shared         bool   // Route the client-to-server side through the experiment bottleneck
+	Flow           string // Name of the flow in the bottleneck, the client name by default
+
+	ClientTraffic  Pattern
+	ServerTraffic  Pattern
+
+	// If FixRate is positive, both endpoints send at FixRate packets per second (see the
+	// FixRate flag of CCID3)
+	FixRate        uint32
+}
+
+// Link holds the parameters of one direction of a pipe. Zero fields leave the defaults of
+// the pipe in place.
+type Link struct {
+	Latency      int64
+	Jitter       Jitter
+	Loss         LossModel
+	Reorder      float64
+	ReorderDelay int64
+	Duplicate    float64
+
+	// Rate limits in packets per interval (see SetWriteRate)
+	RateInterval int64
+	RatePackets  uint32
+
+	// Rate limit in bytes per second through a queue (see SetWriteByteRate)
+	ByteRate     int64
+	QueueBytes   int
+
+	Trace        *Trace
+	Schedule     *Schedule
+}
+
+// Pattern describes the data that an endpoint writes. Every endpoint reads until its
+// connection closes.
+type Pattern struct {
+	Payload  int   // Size of each write in bytes, or PayloadMTU; the endpoint does not write if zero
+	Interval int64 // Time between writes; writes follow each other immediately if zero
+	Count    int   // Number of writes; unlimited if zero
+}
+
+// PayloadMTU is a Pattern payload of the size of the connection MTU
+const PayloadMTU = -1
+
+// BottleneckSpec holds the parameters of the shared bottleneck of an experiment (see
+// NewBottleneck)
+type BottleneckSpec struct {
+	Rate       int64
+	QueueBytes int
+	Discipline QueueDiscipline
+}
+
+// CrossTraffic is a source of traffic on the experiment bottleneck
+type CrossTraffic struct {
+	Flow   string
+	Source Source
+}
+
+// Action is performed at time At, relative to the start of the experiment
+type Action struct {
+	At int64
+	Do func(r *Run)
+}
+
+// Run is the state of a running experiment
+type Run struct {
+	T          *testing.T
+	Env        *dccp.Env
+	Plex       *GuzzlePlex
+	Measure    *Measure
+	Bottleneck *Bottleneck
+	Pairs      []*PairRun
+}
+
+// PairRun is the state of a running pair
+type PairRun struct {
+	*Pair
+	ClientConn, ServerConn         *dccp.Conn
+	ClientToServer, ServerToClient *headerHalfPipe
+
+	sync.Mutex
+	clientRead, serverRead         int64
+}
+
+// ClientRead returns the number of bytes read by the client
+func (p *PairRun) ClientRead() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.clientRead
+}
+
+// ServerRead returns the number of bytes read by the server
+func (p *PairRun) ServerRead() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.serverRead
+}
+
+// Run performs the experiment
+func (x *Experiment) Run(t *testing.T) *Run {
+	if x.Bottleneck == nil {
+		if len(x.Traffic) > 0 {
+			t.Fatalf("experiment %s has cross traffic but no bottleneck", x.Name)
+		}
+		for _, pair := range x.Pairs {
+			if pair.Shared {
+				t.Fatalf("experiment %s has shared pairs but no bottleneck", x.Name)
+			}
+		}
+	}
+	var env *dccp.Env
+	var plex *GuzzlePlex
+	if x.Seed != 0 {
+		env, plex = NewEnvSeed(x.Name, x.Seed)
+	} else {
+		env, plex = NewEnv(x.Name)
+	}
+	r := &Run{T: t, Env: env, Plex: plex, Measure: NewMeasure(env, t)}
+	plex.Add(r.Measure)
+	plex.HighlightSamples(x.Highlight...)
+
+	if x.Bottleneck != nil {
+		r.Bottleneck = NewBottleneck(env, dccp.NewAmb("line", env), x.Bottleneck.Rate,
+			x.Bottleneck.QueueBytes, x.Bottleneck.Discipline)
+	}
+	pairs := x.Pairs
+	if len(pairs) == 0 {
+		pairs = []*Pair{&Pair{}}
+	}
+	for _, pair := range pairs {
+		r.Pairs = append(r.Pairs, r.newPair(pair))
+	}
+	if x.Setup != nil {
+		x.Setup(r)
+	}
+
+	actions, nactions := env.NewGoJoin("experiment actions"), 0
+	for _, a := range x.Actions {
+		if a.At >= x.Duration {
+			t.Logf("action at %d ns is past the end of the experiment", a.At)
+			continue
+		}
+		a := a
+		actions.Go(func() {
+			env.Sleep(a.At)
+			a.Do(r)
+		}, "experiment action")
+		nactions++
+	}
+	var traffic []dccp.Joiner
+	for _, c := range x.Traffic {
+		traffic = append(traffic, StartTraffic(env, r.Bottleneck, c.Flow, c.Source, x.Duration))
+	}
+	var drives []dccp.Joiner
+	for _, p := range r.Pairs {
+		drives = append(drives, r.drive(p, x.Duration))
+	}
+	env.NewGoJoin("experiment pairs", drives...).Join()
+	if nactions > 0 {
+		actions.Join()
+	}
+	if len(traffic) > 0 {
+		env.NewGoJoin("cross traffic", traffic...).Join()
+	}
+
+	// Shutdown the connections properly
+	var joiners []dccp.Joiner
+	for _, p := range r.Pairs {
+		p.ClientConn.Abort()
+		p.ServerConn.Abort()
+		joiners = append(joiners, p.ClientConn.Joiner(), p.ServerConn.Joiner())
+	}
+	env.NewGoJoin("end-of-test", joiners...).Join()
+	t.Logf("\n%s", r.Measure.String())
+	if r.Bottleneck != nil {
+		t.Logf("\n%s", r.Bottleneck.Report(x.Duration))
+	}
+
+	if x.Check != nil {
+		x.Check(r)
+	}
+	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
+	if err := env.Close(); err != nil {
+		t.Errorf("error closing runtime (%s)", err)
+	}
+	return r
+}
+
+func (r *Run) newPair(pair *Pair) *PairRun {
+	client, server := pair.Client, pair.Server
+	if client == "" {
+		client = "client"
+	}
+	if server == "" {
+		server = "server"
+	}
+	p := &PairRun{Pair: pair}
+	p.ClientConn, p.ServerConn, p.ClientToServer, p.ServerToClient = NewClientServerPipeNamed(r.Env, client, server)
+	pair.ClientToServer.apply(p.ClientToServer)
+	pair.ServerToClient.apply(p.ServerToClient)
+	if pair.Shared {
+		flow := pair.Flow
+		if flow == "" {
+			flow = client
+		}
+		p.ClientToServer.SetWriteBottleneck(r.Bottleneck, flow)
+	}
+	if pair.FixRate > 0 {
+		p.ClientConn.Amb().Flags().SetUint32("FixRate", pair.FixRate)
+		p.ServerConn.Amb().Flags().SetUint32("FixRate", pair.FixRate)
+	}
+	return p
+}
+
+func (l *Link) apply(h *headerHalfPipe) {
+	if l.Latency > 0 {
+		h.SetWriteLatency(l.Latency)
+	}
+	if l.Jitter != nil {
+		h.SetWriteJitter(l.Jitter)
+	}
+	if l.Loss != nil {
+		h.SetLossModel(l.Loss)
+	}
+	if l.Reorder > 0 {
+		h.SetWriteReorder(l.Reorder, l.ReorderDelay)
+	}
+	if l.Duplicate > 0 {
+		h.SetWriteDuplicate(l.Duplicate)
+	}
+	if l.RateInterval > 0 {
+		h.SetWriteRate(l.RateInterval, l.RatePackets)
+	}
+	if l.ByteRate > 0 {
+		h.SetWriteByteRate(l.ByteRate, l.QueueBytes)
+	}
+	if l.Trace != nil {
+		h.SetWriteTrace(l.Trace, l.QueueBytes)
+	}
+	if l.Schedule != nil {
+		h.SetWriteSchedule(l.Schedule)
+	}
+}
+
+// drive runs the writers and the readers of a pair. When the writers are done, the
+// endpoints that wrote close their connections; the client always closes, so that the
+// server reader sees the end of the connection. The returned Joiner waits for both readers.
+func (r *Run) drive(p *PairRun, duration int64) dccp.Joiner {
+	env, t := r.Env, r.T
+	env.Go(func() {
+		r.write(p.ClientConn, p.ClientTraffic, duration)
+		if err := p.ClientConn.Close(); err != nil && err != dccp.ErrEOF {
+			t.Errorf("client close (%s)", err)
+		}
+	}, "experiment client writer")
+	env.Go(func() {
+		r.write(p.ServerConn, p.ServerTraffic, duration)
+		if p.ServerTraffic.Payload == 0 {
+			return
+		}
+		if err := p.ServerConn.Close(); err != nil && err != dccp.ErrEOF {
+			t.Logf("server close (%s)", err)
+		}
+	}, "experiment server writer")
+	readers := env.NewGoJoin("experiment pair")
+	readers.Go(func() {
+		r.read(p.ClientConn, func(n int) { p.Lock(); p.clientRead += int64(n); p.Unlock() })
+	}, "experiment client reader")
+	readers.Go(func() {
+		r.read(p.ServerConn, func(n int) { p.Lock(); p.serverRead += int64(n); p.Unlock() })
+	}, "experiment server reader")
+	return readers
+}
+
+// write writes according to pattern for duration nanoseconds, and waits out the rest of the
+// duration if the pattern ends earlier
+func (r *Run) write(c *dccp.Conn, pattern Pattern, duration int64) {
+	env := r.Env
+	t0 := env.Now()
+	if pattern.Payload != 0 {
+		size := pattern.Payload
+		if size == PayloadMTU {
+			size = c.GetMTU()
+		}
+		buf := make([]byte, size)
+		for i := 0; pattern.Count == 0 || i < pattern.Count; i++ {
+			if env.Now() - t0 >= duration {
+				break
+			}
+			if err := c.Write(buf); err != nil {
+				r.T.Errorf("write (%s)", err)
+				return
+			}
+			if pattern.Interval > 0 {
+				env.Sleep(pattern.Interval)
+			}
+		}
+	}
+	if rest := duration - (env.Now() - t0); rest > 0 {
+		env.Sleep(rest)
+	}
+}
+
+// read reads from c until the connection ends, reporting the size of every read block
+func (r *Run) read(c *dccp.Conn, count func(int)) {
+	for {
+		p, err := c.Read()
+		if err == dccp.ErrEOF {
+			return
+		} else if err != nil {
+			r.T.Errorf("read (%s)", err)
+			return
+		}
+		count(len(p))
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// ImpairedLink is a dccp.Link that impairs the packets written to an underlying Link, such as
+// a ChanLink or a UDPLink. Unlike a Pipe, which carries DCCP headers between two Conns, an
+// ImpairedLink carries the wire format of packets, so a Stack (or a Mux) on top of it
+// exercises the mux framing, labels, the header codec and checksums under adverse conditions.
+//
+// Packets written to the link can be lost (see LossModel), delayed by a fixed latency plus
+// jitter (see Jitter), held back so that later packets overtake them, duplicated, queued
+// behind a rate limit and corrupted by bit errors. Impairments apply on the write side only;
+// to impair both directions of a connection, wrap the links of both endpoints. Reads are
+// passed through unchanged.
+type ImpairedLink struct {
+	env  *dccp.Env
+	amb  *dccp.Amb
+	link dccp.Link
+
+	sync.Mutex
+	latency      int64
+	jitter       Jitter
+	loss         LossModel
+	reorderProb  float64
+	reorderDelay int64
+	dupProb      float64
+	corruptRate  float64 // Probability that a bit is flipped
+	bottleneck   *Bottleneck
+	flow         string
+
+	queue        []*impairedPacket // Packets waiting for delivery, in order of delivery time
+	wake         chan int
+	closed       bool
+}
+
+// impairedPacket is a packet waiting for delivery through the underlying link
+type impairedPacket struct {
+	p           []byte
+	addr        net.Addr
+	DeliverTime int64
+}
+
+// NewImpairedLink creates an ImpairedLink on top of link, with no impairments
+func NewImpairedLink(env *dccp.Env, amb *dccp.Amb, link dccp.Link) *ImpairedLink {
+	l := &ImpairedLink{
+		env:  env,
+		amb:  amb.Refine("impaired"),
+		link: link,
+		wake: make(chan int, 1),
+	}
+	env.Go(l.deliverLoop, "impaired link")
+	return l
+}
+
+// SetLatency sets the fixed delay of every packet, in nanoseconds
+func (l *ImpairedLink) SetLatency(latency int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.latency = latency
+}
+
+// SetJitter adds a random delay, drawn from jitter, to the latency of every packet. A nil
+// jitter removes it.
+func (l *ImpairedLink) SetJitter(jitter Jitter) {
+	l.Lock()
+	defer l.Unlock()
+	l.jitter = jitter
+}
+
+// SetLossModel sets the model that decides which packets are lost. A nil model loses no
+// packets.
+func (l *ImpairedLink) SetLossModel(model LossModel) {
+	l.Lock()
+	defer l.Unlock()
+	l.loss = model
+}
+
+// SetReorder holds back packets, with probability prob, by an additional delay nanoseconds,
+// so that packets written after them overtake them
+func (l *ImpairedLink) SetReorder(prob float64, delay int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.reorderProb, l.reorderDelay = prob, delay
+}
+
+// SetDuplicate delivers packets twice with probability prob
+func (l *ImpairedLink) SetDuplicate(prob float64) {
+	l.Lock()
+	defer l.Unlock()
+	l.dupProb = prob
+}
+
+// SetCorrupt flips every bit of every delivered packet independently with probability
+// bitErrorRate
+func (l *ImpairedLink) SetCorrupt(bitErrorRate float64) {
+	l.Lock()
+	defer l.Unlock()
+	l.corruptRate = bitErrorRate
+}
+
+// SetRate limits the link to bytesPerSecond bytes per second, through a drop-tail queue of
+// queueBytes bytes. A non-positive queueBytes selects DefaultQueueBytes. A non-positive
+// bytesPerSecond removes the rate limit.
+func (l *ImpairedLink) SetRate(bytesPerSecond int64, queueBytes int) {
+	var b *Bottleneck
+	if bytesPerSecond > 0 {
+		b = NewBottleneck(l.env, l.amb, bytesPerSecond, queueBytes, nil)
+	}
+	l.SetBottleneck(b, "link")
+}
+
+// SetBottleneck routes the packets of the link through b, possibly shared with other links
+// and pipes, as flow. A nil b removes the rate limit.
+func (l *ImpairedLink) SetBottleneck(b *Bottleneck, flow string) {
+	l.Lock()
+	defer l.Unlock()
+	l.bottleneck, l.flow = b, flow
+}
+
+// GetMTU implements dccp.Link.GetMTU
+func (l *ImpairedLink) GetMTU() int {
+	return l.link.GetMTU()
+}
+
+// SetReadDeadline implements dccp.Link.SetReadDeadline
+func (l *ImpairedLink) SetReadDeadline(t time.Time) error {
+	return l.link.SetReadDeadline(t)
+}
+
+// ReadFrom implements dccp.Link.ReadFrom
+func (l *ImpairedLink) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
+	return l.link.ReadFrom(buf)
+}
+
+// WriteTo implements dccp.Link.WriteTo. Packets that are lost or dropped by the rate limit
+// are reported as written, as they would be by a lossy network.
+func (l *ImpairedLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
+	l.Lock()
+	defer l.Unlock()
+	if l.closed {
+		return 0, dccp.ErrBad
+	}
+	now := l.env.Now()
+	sent := now
+	if l.bottleneck != nil {
+		var ok bool
+		if sent, ok = l.bottleneck.Send(l.flow, now, int64(len(buf))); !ok {
+			l.amb.E(dccp.EventDrop, "Bottleneck drop")
+			return len(buf), nil
+		}
+	}
+	if l.loss != nil && l.loss.Lose(l.env) {
+		l.amb.E(dccp.EventDrop, "Lost in transit")
+		return len(buf), nil
+	}
+	copies := 1
+	if l.dupProb > 0 && l.env.Float64() < l.dupProb {
+		l.amb.E(dccp.EventInfo, "Duplicate")
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		p := make([]byte, len(buf))
+		copy(p, buf)
+		l.corrupt(p)
+		l.enqueue(&impairedPacket{p: p, addr: addr, DeliverTime: sent + l.delay()})
+	}
+	return len(buf), nil
+}
+
+// delay returns the latency of a packet, made of the fixed latency, the jitter and the
+// reordering delay
+func (l *ImpairedLink) delay() int64 {
+	d := l.latency
+	if l.jitter != nil {
+		d += l.jitter.Sample(l.env)
+	}
+	if l.reorderProb > 0 && l.env.Float64() < l.reorderProb {
+		l.amb.E(dccp.EventInfo, "Held back")
+		d += l.reorderDelay
+	}
+	return d
+}
+
+// corrupt flips the bits of p independently with probability corruptRate. The gaps between
+// flipped bits are geometrically distributed, so the cost is proportional to the number of
+// flips rather than the number of bits.
+func (l *ImpairedLink) corrupt(p []byte) {
+	if l.corruptRate <= 0 {
+		return
+	}
+	var flips int
+	nbits := int64(len(p)) * 8
+	for i := int64(-1); ; {
+		if l.corruptRate < 1 {
+			i += 1 + int64(math.Log(1-l.env.Float64())/math.Log(1-l.corruptRate))
+		} else {
+			i++
+		}
+		if i >= nbits {
+			break
+		}
+		p[i/8] ^= 1 << uint(i%8)
+		flips++
+	}
+	if flips > 0 {
+		l.amb.E(dccp.EventInfo, fmt.Sprintf("Corrupted %d bits", flips))
+	}
+}
+
+// enqueue adds pkt to the delivery queue after all packets due no later than it, so that
+// packets with equal delivery times keep their order
+func (l *ImpairedLink) enqueue(pkt *impairedPacket) {
+	k := sort.Search(len(l.queue), func(i int) bool { return l.queue[i].DeliverTime > pkt.DeliverTime })
+	l.queue = append(l.queue, nil)
+	copy(l.queue[k+1:], l.queue[k:])
+	l.queue[k] = pkt
+	if k == 0 {
+		l.signal()
+	}
+}
+
+// deliverLoop writes the queued packets to the underlying link when they are due
+func (l *ImpairedLink) deliverLoop() {
+	for {
+		l.Lock()
+		if l.closed {
+			l.Unlock()
+			return
+		}
+		if len(l.queue) == 0 {
+			l.Unlock()
+			dccp.Recv(l.env, l.wake)
+			continue
+		}
+		pkt := l.queue[0]
+		wait := pkt.DeliverTime - l.env.Now()
+		if wait > 0 {
+			l.Unlock()
+			// Wait until the packet is due, or until a packet due earlier is queued
+			dccp.RecvTimeout(l.env, l.wake, wait)
+			continue
+		}
+		l.queue = l.queue[1:]
+		l.Unlock()
+		_, err := l.link.WriteTo(pkt.p, pkt.addr)
+		if err != nil {
+			l.amb.E(dccp.EventWarn, fmt.Sprintf("Write (%s)", err))
+		}
+	}
+}
+
+// Close implements dccp.Link.Close. Packets still waiting for delivery are discarded.
+func (l *ImpairedLink) Close() error {
+	l.Lock()
+	if l.closed {
+		l.Unlock()
+		return dccp.ErrBad
+	}
+	l.closed = true
+	l.queue = nil
+	l.Unlock()
+	l.signal()
+	return l.link.Close()
+}
+
+// signal wakes deliverLoop, without blocking
+func (l *ImpairedLink) signal() {
+	select {
+	case l.wake <- 1:
+	default:
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+func readLink(env *dccp.Env, l dccp.Link) <-chan []byte {
+	ch := make(chan []byte, 100)
+	env.Go(func() {
+		for {
+			buf := make([]byte, l.GetMTU())
+			n, _, err := l.ReadFrom(buf)
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- buf[:n]
+		}
+	}, "readLink")
+	return ch
+}
+
+func expectPacket(t *testing.T, ch <-chan []byte, p string) {
+	select {
+	case q := <-ch:
+		if string(q) != p {
+			t.Errorf("expecting %q, got %q", p, q)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expecting %q, got nothing", p)
+	}
+}
+
+// TestImpairedLink checks each impairment of an ImpairedLink in isolation
+func TestImpairedLink(t *testing.T) {
+	env := dccp.NewEnvRuntime(nil, nil, 1)
+	p, q := dccp.NewChanPipe()
+	l := NewImpairedLink(env, dccp.NoLogging, p)
+	ch := readLink(env, q)
+
+	l.WriteTo([]byte("a"), nil)
+	expectPacket(t, ch, "a")
+
+	l.SetDuplicate(1)
+	l.WriteTo([]byte("b"), nil)
+	expectPacket(t, ch, "b")
+	expectPacket(t, ch, "b")
+	l.SetDuplicate(0)
+
+	l.SetReorder(1, 50e6)
+	l.WriteTo([]byte("c"), nil)
+	l.SetReorder(0, 0)
+	l.WriteTo([]byte("d"), nil)
+	expectPacket(t, ch, "d")
+	expectPacket(t, ch, "c")
+
+	l.SetLossModel(&BernoulliLoss{P: 1})
+	l.WriteTo([]byte("e"), nil)
+	l.SetLossModel(nil)
+	l.WriteTo([]byte("f"), nil)
+	expectPacket(t, ch, "f")
+
+	l.SetCorrupt(1)
+	l.WriteTo([]byte{0x0f}, nil)
+	expectPacket(t, ch, "\xf0")
+	l.SetCorrupt(0)
+
+	// Only one packet fits in the queue of the rate limit
+	l.SetRate(1e6, 1500)
+	for i := 0; i < 3; i++ {
+		l.WriteTo(make([]byte, 1000), nil)
+	}
+	expectPacket(t, ch, string(make([]byte, 1000)))
+	env.Sleep(5e6)
+	l.WriteTo([]byte("g"), nil)
+	expectPacket(t, ch, "g")
+	l.SetRate(0, 0)
+
+	l.SetLatency(20e6)
+	t0 := env.Now()
+	l.WriteTo([]byte("h"), nil)
+	expectPacket(t, ch, "h")
+	if d := env.Now() - t0; d < 20e6 {
+		t.Errorf("packet delivered after %d ns, expecting latency of 20 ms", d)
+	}
+	l.SetLatency(0)
+
+	// A bit error rate of 1e-3 flips one bit in 1000 on average
+	l.SetCorrupt(1e-3)
+	var flips int
+	zero := make([]byte, 125)
+	for i := 0; i < 1000; i++ {
+		l.WriteTo(zero, nil)
+		for _, b := range <-ch {
+			for ; b != 0; b &= b - 1 {
+				flips++
+			}
+		}
+	}
+	if flips < 800 || flips > 1200 {
+		t.Errorf("%d bits flipped, expecting 1000", flips)
+	}
+
+	l.Close()
+	q.Close()
+	<-ch
+}
+
+// TestImpairedLinkClose checks that packets which wake the delivery loop early leave no
+// sleepers behind, so that the goroutines of a closed link end without the clock advancing
+func TestImpairedLinkClose(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	defer env.Close()
+	p, q := dccp.NewChanPipeEnv(env)
+	l := NewImpairedLink(env, dccp.NoLogging, p)
+	env.Go(func() {
+		buf := make([]byte, q.GetMTU())
+		for {
+			if _, _, err := q.ReadFrom(buf); err != nil {
+				return
+			}
+			t.Errorf("packet delivered after close")
+		}
+	}, "reader")
+
+	// Every packet is due earlier than the one before it
+	t0 := env.Now()
+	for i := 0; i < 10; i++ {
+		l.SetLatency(int64(10-i) * 1e9)
+		l.WriteTo([]byte{byte(i)}, nil)
+	}
+	l.Close()
+	env.Joiner().Join()
+	if d := env.Now() - t0; d != 0 {
+		t.Errorf("goroutines of the link ended after %d ns", d)
+	}
+}
+
+// Fixed sender rate in pps, so that the checks do not depend on how CCID3 reacts to the impairments
+const impairedSendRate = 20
+
+// TestImpairedMux runs a connection between two Muxes over impaired links, and checks that
+// corrupted packets are caught by the checksums, so that only intact data is received
+func TestImpairedMux(t *testing.T) {
+	env, _ := NewEnv("impaired")
+	p, q := dccp.NewChanPipeEnv(env)
+	var links []*ImpairedLink
+	for _, link := range []dccp.Link{p, q} {
+		l := NewImpairedLink(env, dccp.NewAmb("line", env), link)
+		l.SetLatency(10e6)
+		l.SetJitter(&UniformJitter{Max: 5e6})
+		l.SetLossModel(&BernoulliLoss{P: 0.05})
+		l.SetDuplicate(0.05)
+		l.SetCorrupt(1e-5)
+		links = append(links, l)
+	}
+	cm, sm := dccp.NewMuxEnv(env, dccp.MuxConfig{}, links[0]), dccp.NewMuxEnv(env, dccp.MuxConfig{}, links[1])
+
+	clientConn, err := DialConn(env, "client", cm, nil)
+	if err != nil {
+		t.Fatalf("dial (%s)", err)
+	}
+	clientConn.Amb().Flags().SetUint32("FixRate", impairedSendRate)
+	client := env.NewGoJoin("test client")
+	client.Go(func() {
+		t0 := env.Now()
+		for i := 0; env.Now()-t0 < 10e9; i++ {
+			if err := clientConn.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+				t.Errorf("write (%s)", err)
+				break
+			}
+		}
+		clientConn.Close()
+	}, "test client")
+
+	serverConn, err := AcceptConn(env, "server", sm)
+	if err != nil {
+		t.Fatalf("accept (%s)", err)
+	}
+	serverConn.Amb().Flags().SetUint32("FixRate", impairedSendRate)
+	var received int
+	for {
+		p, err := serverConn.Read()
+		if err != nil {
+			break
+		}
+		if len(p) != 1000 || !bytes.Equal(p, bytes.Repeat(p[:1], 1000)) {
+			t.Errorf("received corrupted data")
+		}
+		received++
+	}
+	client.Join()
+	t.Logf("received %d blocks", received)
+	if received == 0 {
+		t.Errorf("received no data")
+	}
+
+	// The joiner of a Conn waits for all goroutines of the Env, including those of the
+	// Muxes and the links, which end when the Muxes are closed
+	clientConn.Abort()
+	serverConn.Abort()
+	cm.Close()
+	sm.Close()
+	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
+	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
+	if err := env.Close(); err != nil {
+		t.Errorf("error closing runtime (%s)", err)
+	}
+}
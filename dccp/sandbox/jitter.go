@@ -0,0 +1,78 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"math"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// Jitter is a distribution of the variable part of the latency of a Pipe. Every packet is
+// delayed by the fixed write latency of the pipe plus an independent sample of the jitter.
+// Since the pipe delivers packets in order of their delivery times, jitter which is large
+// compared to the spacing between packets reorders them. Samples are drawn from the random
+// source of the Env, so that they can be reproduced by fixing the seed of the Env.
+type Jitter interface {
+	// Sample returns a non-negative delay in nanoseconds
+	Sample(env *dccp.Env) int64
+
+	String() string
+}
+
+// UniformJitter delays packets by a duration distributed uniformly in [0,Max) nanoseconds
+type UniformJitter struct {
+	Max int64
+}
+
+// Sample implements Jitter.Sample
+func (x *UniformJitter) Sample(env *dccp.Env) int64 {
+	if x.Max <= 0 {
+		return 0
+	}
+	return env.Int63n(x.Max)
+}
+
+func (x *UniformJitter) String() string {
+	return fmt.Sprintf("Uniform(Max=%d)", x.Max)
+}
+
+// NormalJitter delays packets by a normally distributed duration with mean Mean and standard
+// deviation StdDev nanoseconds. Negative samples are truncated to zero.
+type NormalJitter struct {
+	Mean   int64
+	StdDev int64
+}
+
+// Sample implements Jitter.Sample
+func (x *NormalJitter) Sample(env *dccp.Env) int64 {
+	return max64(0, x.Mean + int64(env.NormFloat64() * float64(x.StdDev)))
+}
+
+func (x *NormalJitter) String() string {
+	return fmt.Sprintf("Normal(Mean=%d, StdDev=%d)", x.Mean, x.StdDev)
+}
+
+// ParetoJitter delays packets by a heavy-tailed duration, distributed according to a Pareto
+// distribution with scale Scale nanoseconds and shape Shape, shifted so that it starts at
+// zero. The mean delay is Scale/(Shape-1) for Shape > 1. Smaller shapes give heavier tails.
+type ParetoJitter struct {
+	Scale int64
+	Shape float64
+}
+
+// Sample implements Jitter.Sample
+func (x *ParetoJitter) Sample(env *dccp.Env) int64 {
+	u := 1 - env.Float64() // In (0,1]
+	d := float64(x.Scale) * (math.Pow(u, -1/x.Shape) - 1)
+	if d > math.MaxInt64/2 {
+		return math.MaxInt64/2
+	}
+	return int64(d)
+}
+
+func (x *ParetoJitter) String() string {
+	return fmt.Sprintf("Pareto(Scale=%d, Shape=%g)", x.Scale, x.Shape)
+}
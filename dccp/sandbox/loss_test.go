@@ -5,7 +5,6 @@
 package sandbox
 
 import (
-	"fmt"
 	"testing"
 	"github.com/petar/GoDCCP/dccp"
 	"github.com/petar/GoDCCP/dccp/ccid3"
@@ -19,58 +18,159 @@ const (
 
 // TestLoss checks that loss estimation matches actual
 func TestLoss(t *testing.T) {
+	x := &Experiment{
+		Name:      "loss",
+		Duration:  lossDuration,
+		Highlight: []string{ccid3.LossReceiverEstimateSample},
+		Pairs: []*Pair{
+			&Pair{
+				// In order to force packet loss, we fix the send rate slightly above the
+				// the pipeline rate.
+				FixRate:        lossSendRate,
+				ClientToServer: Link{RateInterval: 1e9, RatePackets: lossTransmitRate},
+				ClientTraffic:  Pattern{Payload: 3},
+			},
+		},
+	}
+	x.Run(t)
+}
 
-	env, plex := NewEnv("loss")
-	reducer := NewMeasure(env, t)
-	plex.Add(reducer)
-	plex.HighlightSamples(ccid3.LossReceiverEstimateSample)
-
-	clientConn, serverConn, clientToServer, _ := NewClientServerPipe(env)
-
-	payload := []byte{1, 2, 3}
-	buf := make([]byte, len(payload))
+// TestLossModels checks the long-run loss rate and burst length of the loss models
+func TestLossModels(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	const n = 100000
 
-	// In order to force packet loss, we fix the send rate slightly above the
-	// the pipeline rate.
-	clientConn.Amb().Flags().SetUint32("FixRate", lossSendRate)
-	serverConn.Amb().Flags().SetUint32("FixRate", lossSendRate)
-	clientToServer.SetWriteRate(1e9, lossTransmitRate)
+	var lost int
+	bernoulli := &BernoulliLoss{P: 0.1}
+	for i := 0; i < n; i++ {
+		if bernoulli.Lose(env) {
+			lost++
+		}
+	}
+	if r := float64(lost) / n; r < 0.09 || r > 0.11 {
+		t.Errorf("Bernoulli loss rate %g, expecting 0.1", r)
+	}
 
-	cchan := make(chan int, 1)
-	env.Go(func() {
-		t0 := env.Now()
-		for env.Now() - t0 < lossDuration {
-			err := clientConn.Write(buf)
-			if err != nil {
-				break
+	// The bad state lasts 4 packets on average, and takes 1/26 of the time
+	lost = 0
+	var bursts int
+	var prev bool
+	gilbert := NewGilbertLoss(0.01, 0.25)
+	for i := 0; i < n; i++ {
+		l := gilbert.Lose(env)
+		if l {
+			lost++
+			if !prev {
+				bursts++
 			}
 		}
-		clientConn.Close()
-		close(cchan)
-	}, "test client")
+		prev = l
+	}
+	if r := float64(lost) / n; r < 0.8/26 || r > 1.2/26 {
+		t.Errorf("Gilbert loss rate %g, expecting %g", r, 1.0/26)
+	}
+	if b := float64(lost) / float64(bursts); b < 3.2 || b > 4.8 {
+		t.Errorf("Gilbert mean burst length %g, expecting 4", b)
+	}
+}
+
+const (
+	burstyLossDuration  = 20e9  // Duration of the experiment in ns
+	burstyLossSendRate  = 40    // Fixed sender rate in pps
+	burstyLossGoodToBad = 0.05
+	burstyLossBadToGood = 0.5
+)
 
-	schan := make(chan int, 1)
-	env.Go(func() {
-		for {
-			_, err := serverConn.Read()
-			if err != nil {
-				break
+// TestBurstyLoss checks that the loss observed on a line with bursty Gilbert-Elliott loss
+// matches the model
+func TestBurstyLoss(t *testing.T) {
+	x := &Experiment{
+		Name:      "burstyloss",
+		Duration:  burstyLossDuration,
+		Highlight: []string{ccid3.LossReceiverEstimateSample},
+		Pairs: []*Pair{
+			&Pair{
+				FixRate:        burstyLossSendRate,
+				ClientToServer: Link{Loss: NewGilbertLoss(burstyLossGoodToBad, burstyLossBadToGood)},
+				ClientTraffic:  Pattern{Payload: 3},
+			},
+		},
+		Check: func(r *Run) {
+			expected := burstyLossGoodToBad / (burstyLossGoodToBad + burstyLossBadToGood)
+			cs, _, _, sc, _, _ := r.Measure.Loss()
+			if cs < expected/2 || cs > expected*2 {
+				t.Errorf("client to server loss %0.1f%%, expecting %0.1f%%", 100*cs, 100*expected)
 			}
-		}
-		close(schan)
-	}, "test server")
+			if sc != 0 {
+				t.Errorf("server to client loss %0.1f%%, expecting none", 100*sc)
+			}
+		},
+	}
+	x.Run(t)
+}
 
-	_, _ = <-cchan
-	_, _ = <-schan
+const (
+	reorderDuration = 10e9  // Duration of the experiment in ns
+	reorderSendRate = 40    // Fixed sender rate in pps
+)
 
-	fmt.Println(reducer.String())
+// TestReorder checks that jitter, reordering and duplication on a lossless line are not
+// mistaken for loss by the receiver
+func TestReorder(t *testing.T) {
+	checker := &lossEstimateChecker{}
+	x := &Experiment{
+		Name:      "reorder",
+		Duration:  reorderDuration,
+		Highlight: []string{ccid3.LossReceiverEstimateSample},
+		Pairs: []*Pair{
+			&Pair{
+				FixRate: reorderSendRate,
+				ClientToServer: Link{
+					Latency:      20e6,
+					Jitter:       &NormalJitter{Mean: 0, StdDev: 2e6},
+					Reorder:      0.1,
+					ReorderDelay: 1e9 / reorderSendRate / 2,
+					Duplicate:    0.05,
+				},
+				ClientTraffic: Pattern{Payload: 3},
+			},
+		},
+		Setup: func(r *Run) {
+			r.Plex.Add(checker)
+		},
+		Check: func(r *Run) {
+			// Duplicates occasionally overflow the receive buffer of the pipe, otherwise the line is
+			// lossless
+			if cs, _, _, _, _, _ := r.Measure.Loss(); cs > 0.01 {
+				t.Errorf("client to server loss %0.1f%%, expecting none", 100*cs)
+			}
+			if checker.max > 1 {
+				t.Errorf("receiver estimated loss event rate %0.3f%% on a nearly lossless line", checker.max)
+			}
+		},
+	}
+	x.Run(t)
+}
 
-	// Shutdown the connections properly
-	clientConn.Abort()
-	serverConn.Abort()
-	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
-	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
-	if err := env.Close(); err != nil {
-		t.Errorf("error closing runtime (%s)", err)
+// lossEstimateChecker records the largest loss event rate estimated by the server receiver
+type lossEstimateChecker struct {
+	max float64
+}
+
+func (x *lossEstimateChecker) Write(r *dccp.LogRecord) {
+	s, ok := r.Sample()
+	if !ok || s.Series != ccid3.LossReceiverEstimateSample || r.Labels[0] != "server" {
+		return
 	}
+	if s.Value > x.max {
+		x.max = s.Value
+	}
+}
+
+func (x *lossEstimateChecker) Sync() error { 
+	return nil 
+}
+
+func (x *lossEstimateChecker) Close() error { 
+	return nil 
 }
@@ -0,0 +1,86 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"sync"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// LossModel decides which packets are lost in transit through one direction of a Pipe.
+// Random decisions are drawn from the random source of the Env, so that a loss pattern can
+// be reproduced by fixing the seed of the Env.
+type LossModel interface {
+	// Lose is called once for every packet that enters the line, in order of entry. It
+	// returns true if the packet is to be lost.
+	Lose(env *dccp.Env) bool
+
+	String() string
+}
+
+// BernoulliLoss loses every packet independently with probability P
+type BernoulliLoss struct {
+	P float64
+}
+
+// Lose implements LossModel.Lose
+func (x *BernoulliLoss) Lose(env *dccp.Env) bool {
+	return env.Float64() < x.P
+}
+
+func (x *BernoulliLoss) String() string {
+	return fmt.Sprintf("Bernoulli(P=%g)", x.P)
+}
+
+// GilbertElliottLoss is a two-state Markov loss model, which produces bursts of loss. In the
+// good state packets are lost with probability LossGood, and in the bad state with probability
+// LossBad. After every packet, the model moves from the good to the bad state with probability
+// GoodToBad, and from the bad to the good state with probability BadToGood.
+//
+// The long-run fraction of time spent in the bad state is GoodToBad/(GoodToBad+BadToGood),
+// and the mean length of a stay in the bad state is 1/BadToGood packets.
+type GilbertElliottLoss struct {
+	GoodToBad float64
+	BadToGood float64
+	LossGood  float64
+	LossBad   float64
+
+	sync.Mutex
+	bad bool
+}
+
+// NewGilbertLoss creates a Gilbert-Elliott model, which loses all packets in the bad state
+// and none in the good state
+func NewGilbertLoss(goodToBad, badToGood float64) *GilbertElliottLoss {
+	return &GilbertElliottLoss{
+		GoodToBad: goodToBad,
+		BadToGood: badToGood,
+		LossGood:  0,
+		LossBad:   1,
+	}
+}
+
+// Lose implements LossModel.Lose
+func (x *GilbertElliottLoss) Lose(env *dccp.Env) bool {
+	x.Lock()
+	defer x.Unlock()
+	p := x.LossGood
+	if x.bad {
+		p = x.LossBad
+	}
+	lost := env.Float64() < p
+	if x.bad {
+		x.bad = env.Float64() >= x.BadToGood
+	} else {
+		x.bad = env.Float64() < x.GoodToBad
+	}
+	return lost
+}
+
+func (x *GilbertElliottLoss) String() string {
+	return fmt.Sprintf("GilbertElliott(GoodToBad=%g, BadToGood=%g, LossGood=%g, LossBad=%g)",
+		x.GoodToBad, x.BadToGood, x.LossGood, x.LossBad)
+}
@@ -11,8 +11,11 @@ import (
 )
 
 // Pipe is an in-process commincation channel, whose two ends implement dccp.HeaderConn.
-// It supports rate limiting, latency emulation and receive buffer emulation (in order to
-// capture slow readers).
+// It supports rate limiting (in packets per interval, or in bytes per second through a
+// bottleneck with a finite queue, possibly shared with other pipes, or following a recorded
+// Trace), random loss (see LossModel), latency emulation with jitter (see Jitter) or
+// following a Schedule, reordering and duplication, and receive buffer emulation (in order
+// to capture slow readers).
 type Pipe struct {
 	amb *dccp.Amb
 	ha, hb headerHalfPipe
@@ -32,6 +35,7 @@ func NewPipe(env *dccp.Env, amb *dccp.Amb, namea, nameb string) (a, b *headerHal
 const (
 	DefaultRateInterval           = 1e9
 	DefaultRatePacketsPerInterval = 100
+	DefaultQueueBytes             = 64 * 1500
 )
 
 const pipeBufferLen = 2
@@ -42,9 +46,9 @@ type headerHalfPipe struct {
 	amb                    *dccp.Amb
 
 	// read, writeLk and write pertain to the communication mechanism of the pipe
-	read                   <-chan *pipeHeader
+	read                   chan *pipeHeader
 	writeLk                sync.Mutex
-	write                  chan<- *pipeHeader
+	write                  chan *pipeHeader
 
 	// rateLk is used to lock on all rate* variables below as well as readDeadline
 	rateLk                 sync.Mutex
@@ -61,6 +65,25 @@ type headerHalfPipe struct {
 	// rateIntervalCounter-th time interval
 	rateIntervalFill       uint32
 
+	// If rateBytesPerSecond is positive, packets pass through a bottleneck which transmits
+	// rateBytesPerSecond bytes per second. A packet is delayed by the time it takes to transmit
+	// the packets queued ahead of it, plus its own serialization delay. Packets that do not
+	// fit in the queue of queueBytes bytes are dropped.
+	rateBytesPerSecond     int64
+	queueBytes             int64
+
+	// bottleneckFree is the time when the bottleneck finishes transmitting the queued packets
+	bottleneckFree         int64
+
+	// If traceLink is not nil, packets are delivered at the opportunities of a recorded trace,
+	// in place of the bottleneck above
+	traceLink              *traceLink
+
+	// If shared is not nil, packets pass through a Bottleneck shared with other pipes, as
+	// flow sharedFlow, in place of the bottleneck and the trace above
+	shared                 *Bottleneck
+	sharedFlow             string
+
 	// readDeadline is the absolute time deadline for the reads on this side of the connection
 	readDeadlineLk         sync.Mutex
 	readDeadline           int64
@@ -69,6 +92,27 @@ type headerHalfPipe struct {
 	writeLatencyLk         sync.Mutex
 	writeLatency           int64
 
+	// writeJitter, if not nil, adds a random delay to writeLatency. The variables below are
+	// also protected by writeLatencyLk.
+	writeJitter            Jitter
+
+	// If scheduleLink is not nil, its latency takes the place of writeLatency and its loss is
+	// applied in addition to lossModel
+	scheduleLink           *scheduleLink
+
+	// With probability reorderProb, a packet is held back for an additional reorderDelay
+	// nanoseconds, so that packets written after it overtake it
+	reorderProb            float64
+	reorderDelay           int64
+
+	// With probability dupProb, a packet is delivered twice
+	dupProb                float64
+
+	// lossModel, if not nil, decides which of the packets written from this endpoint are lost
+	// in transit
+	lossLk                 sync.Mutex
+	lossModel              LossModel
+
 	latencyQueueLk         sync.Mutex
 	latencyQueue
 }
@@ -79,7 +123,7 @@ type pipeHeader struct {
 }
 
 // Init resets a half pipe for initial use, using amb (without making a copy of it)
-func (x *headerHalfPipe) Init(env *dccp.Env, amb *dccp.Amb, r <-chan *pipeHeader, w chan<- *pipeHeader) {
+func (x *headerHalfPipe) Init(env *dccp.Env, amb *dccp.Amb, r, w chan *pipeHeader) {
 	x.env = env
 	x.amb = amb
 	x.read = r
@@ -97,6 +141,30 @@ func (x *headerHalfPipe) SetWriteLatency(latency int64) {
 	x.writeLatency = latency
 }
 
+// SetWriteJitter sets the distribution of the random delay which is added to the write latency
+// of every packet. A nil jitter removes the random delay.
+func (x *headerHalfPipe) SetWriteJitter(jitter Jitter) {
+	x.writeLatencyLk.Lock()
+	defer x.writeLatencyLk.Unlock()
+	x.writeJitter = jitter
+}
+
+// SetWriteReorder makes this side of the pipe hold back packets with probability prob for an
+// additional delay nanoseconds, so that packets written after them are delivered first
+func (x *headerHalfPipe) SetWriteReorder(prob float64, delay int64) {
+	x.writeLatencyLk.Lock()
+	defer x.writeLatencyLk.Unlock()
+	x.reorderProb = prob
+	x.reorderDelay = delay
+}
+
+// SetWriteDuplicate makes this side of the pipe deliver packets twice with probability prob
+func (x *headerHalfPipe) SetWriteDuplicate(prob float64) {
+	x.writeLatencyLk.Lock()
+	defer x.writeLatencyLk.Unlock()
+	x.dupProb = prob
+}
+
 // SetWriteRate sets the transmission rate of this side of the pipe to ratePacketsPerInterval packets for each
 // interval of rateInterval nanoseconds
 func (x *headerHalfPipe) SetWriteRate(rateInterval int64, ratePacketsPerInterval uint32) {
@@ -108,6 +176,68 @@ func (x *headerHalfPipe) SetWriteRate(rateInterval int64, ratePacketsPerInterval
 	x.rateIntervalFill = 0
 }
 
+// SetWriteByteRate limits the transmission rate of this side of the pipe to bytesPerSecond
+// bytes per second, queueing up to queueBytes bytes of packets waiting to be transmitted. A
+// non-positive queueBytes selects DefaultQueueBytes. The byte rate takes the place of the
+// rate set by SetWriteRate. A non-positive bytesPerSecond removes the limit.
+func (x *headerHalfPipe) SetWriteByteRate(bytesPerSecond int64, queueBytes int) {
+	x.rateLk.Lock()
+	defer x.rateLk.Unlock()
+	if queueBytes <= 0 {
+		queueBytes = DefaultQueueBytes
+	}
+	x.rateBytesPerSecond = bytesPerSecond
+	x.queueBytes = int64(queueBytes)
+	x.bottleneckFree = 0
+}
+
+// SetLossModel sets the model which decides which packets written from this side of the pipe
+// are lost in transit. A nil model removes random loss.
+func (x *headerHalfPipe) SetLossModel(model LossModel) {
+	x.lossLk.Lock()
+	defer x.lossLk.Unlock()
+	x.lossModel = model
+}
+
+// SetWriteTrace makes this side of the pipe deliver packets at the delivery opportunities of
+// trace, which starts now. Packets wait for delivery in a queue of queueBytes bytes. A
+// non-positive queueBytes selects DefaultQueueBytes. A nil trace returns to the rate limit
+// set by SetWriteByteRate or SetWriteRate.
+func (x *headerHalfPipe) SetWriteTrace(trace *Trace, queueBytes int) {
+	x.rateLk.Lock()
+	defer x.rateLk.Unlock()
+	if trace == nil {
+		x.traceLink = nil
+		return
+	}
+	if queueBytes <= 0 {
+		queueBytes = DefaultQueueBytes
+	}
+	x.traceLink = newTraceLink(trace, x.env.Now(), int64(queueBytes))
+}
+
+// SetWriteBottleneck routes the packets written from this side of the pipe through b, where
+// they compete with the packets of other pipes. The statistics of this side of the pipe are
+// kept under the name flow. A nil b returns to the private limits of the pipe.
+func (x *headerHalfPipe) SetWriteBottleneck(b *Bottleneck, flow string) {
+	x.rateLk.Lock()
+	defer x.rateLk.Unlock()
+	x.shared = b
+	x.sharedFlow = flow
+}
+
+// SetWriteSchedule makes the latency and the loss of this side of the pipe follow schedule,
+// which starts now. A nil schedule returns to the latency set by SetWriteLatency.
+func (x *headerHalfPipe) SetWriteSchedule(schedule *Schedule) {
+	x.writeLatencyLk.Lock()
+	defer x.writeLatencyLk.Unlock()
+	if schedule == nil {
+		x.scheduleLink = nil
+		return
+	}
+	x.scheduleLink = &scheduleLink{schedule: schedule, zero: x.env.Now()}
+}
+
 // GetMTU implements dccp.HeaderConn.GetMTU
 func (x *headerHalfPipe) GetMTU() int {
 	return 1500
@@ -132,51 +262,38 @@ func (x *headerHalfPipe) Read() (h *dccp.Header, err error) {
 			return ph.Header, nil
 		}
 		
-		// Calculate time to wait until either queued packet is available or read timeout is reached
+		// Calculate time to wait until either queued packet is available or read timeout is
+		// reached. A read deadline in the past means that reads do not time out.
 		timeout := readDeadline - x.env.Now()
-		if existQueued {
-			if timeout == 0 {
-				timeout = timeToQueued
-			} else {
-				timeout = min64(timeout, timeToQueued)
-			}
+		wait := timeout
+		if existQueued && (wait <= 0 || timeToQueued < wait) {
+			wait = timeToQueued
 		}
 
-		timeoutChan := x.makeTimeoutChan(timeout)
+		if wait <= 0 {
+			wait = -1
+		}
 
 		// Either timeout or receive a new packet which goes to the latency queue
-		select {
-		case ph, ok := <-x.read:
-			if !ok {
-				x.amb.E(dccp.EventWarn, "Read EOF", ph.Header)
-				return nil, dccp.ErrEOF
+		ph, ok, expired := dccp.RecvTimeout(x.env, x.read, wait)
+		if expired {
+			// The wait may have ended because a queued packet is due
+			if timeout <= 0 || x.env.Now() < readDeadline {
+				continue
 			}
-			x.latencyQueueLk.Lock()
-			x.latencyQueue.Add(ph)
-			x.latencyQueueLk.Unlock()
-		case <-timeoutChan:
 			return nil, dccp.ErrTimeout
 		}
+		if !ok {
+			x.amb.E(dccp.EventWarn, "Read EOF")
+			return nil, dccp.ErrEOF
+		}
+		x.latencyQueueLk.Lock()
+		x.latencyQueue.Add(ph)
+		x.latencyQueueLk.Unlock()
 	}
 	panic("un")
 }
 
-var sleepingChan = make(chan int64)
-
-func (x *headerHalfPipe) makeTimeoutChan(timeout int64) (<-chan int64) {
-	var ch chan int64
-	if timeout > 0 {
-		ch = make(chan int64)
-		x.env.Go(func() {
-			x.env.Sleep(timeout)
-			close(ch)
-		}, "pipe timeout")
-	} else {
-		ch = sleepingChan
-	}
-	return ch
-}
-
 // Write implements dccp.HeaderConn.Write
 func (x *headerHalfPipe) Write(h *dccp.Header) (err error) {
 	x.writeLk.Lock()
@@ -187,29 +304,124 @@ func (x *headerHalfPipe) Write(h *dccp.Header) (err error) {
 		return dccp.ErrBad
 	}
 
-	if x.rateFilter() {
-		if len(x.write) >= cap(x.write) {
-			x.amb.E(dccp.EventDrop, "Slow reader", h)
-		} else {
-			x.amb.E(dccp.EventWrite, "", h)
-			x.writeLatencyLk.Lock()
-			latency := x.writeLatency
-			x.writeLatencyLk.Unlock()
-			now := x.env.Now()
-			x.write <- &pipeHeader{ Header: h, DeliverTime: now + latency }
-		}
-	} else {
+	if !x.rateFilter() {
 		x.amb.E(dccp.EventDrop, "Fast writer", h)
+		return nil
+	}
+	if len(x.write) >= cap(x.write) {
+		x.amb.E(dccp.EventDrop, "Slow reader", h)
+		return nil
+	}
+	sent, ok := x.bottleneck(wireLen(h))
+	if !ok {
+		x.amb.E(dccp.EventDrop, "Bottleneck drop", h)
+		return nil
+	}
+	x.amb.E(dccp.EventWrite, "", h)
+	if x.lose() {
+		x.amb.E(dccp.EventDrop, "Lost in transit", h)
+		return nil
+	}
+	// The writer holds writeLk and found room in the buffer above, so the send does not block
+	x.write <- &pipeHeader{ Header: h, DeliverTime: sent + x.delay(h) }
+
+	x.writeLatencyLk.Lock()
+	dup := x.dupProb > 0 && x.env.Float64() < x.dupProb
+	x.writeLatencyLk.Unlock()
+	if dup {
+		hh := *h
+		select {
+		case x.write <- &pipeHeader{ Header: &hh, DeliverTime: sent + x.delay(h) }:
+		default:
+			x.amb.E(dccp.EventInfo, "Duplicate dropped, slow reader", h)
+			return nil
+		}
+		x.amb.E(dccp.EventInfo, "Duplicate", h)
 	}
 	return nil
 }
 
+// delay returns the time it takes a packet to travel from the bottleneck to the reader, which
+// is made of the write latency, the jitter and the reordering delay
+func (x *headerHalfPipe) delay(h *dccp.Header) int64 {
+	x.writeLatencyLk.Lock()
+	defer x.writeLatencyLk.Unlock()
+	d := x.writeLatency
+	if x.scheduleLink != nil {
+		d = x.scheduleLink.Latency(x.env.Now())
+	}
+	if x.writeJitter != nil {
+		d += x.writeJitter.Sample(x.env)
+	}
+	if x.reorderProb > 0 && x.env.Float64() < x.reorderProb {
+		x.amb.E(dccp.EventInfo, "Held back", h)
+		d += x.reorderDelay
+	}
+	return d
+}
+
+// lose returns true if the schedule or the loss model decides that the next packet is lost
+func (x *headerHalfPipe) lose() bool {
+	x.writeLatencyLk.Lock()
+	schedule := x.scheduleLink
+	x.writeLatencyLk.Unlock()
+	if schedule != nil && schedule.Lose(x.env, x.env.Now()) {
+		return true
+	}
+
+	x.lossLk.Lock()
+	defer x.lossLk.Unlock()
+	if x.lossModel == nil {
+		return false
+	}
+	return x.lossModel.Lose(x.env)
+}
+
+// wireLen returns the size of the wire format of h
+func wireLen(h *dccp.Header) int64 {
+	p, err := h.Write(dccp.LabelZero.Bytes(), dccp.LabelZero.Bytes(), dccp.AnyProto, false)
+	if err != nil {
+		return int64(len(h.Data))
+	}
+	return int64(len(p))
+}
+
+// bottleneck returns the time when a packet of n bytes, written now, finishes transmission
+// through the bottleneck set by SetWriteByteRate, SetWriteTrace or SetWriteBottleneck. It
+// returns false if the packet is dropped by the bottleneck.
+func (x *headerHalfPipe) bottleneck(n int64) (sent int64, ok bool) {
+	x.rateLk.Lock()
+	defer x.rateLk.Unlock()
+
+	now := x.env.Now()
+	if x.shared != nil {
+		return x.shared.Send(x.sharedFlow, now, n)
+	}
+	if x.traceLink != nil {
+		return x.traceLink.Send(now, n)
+	}
+	if x.rateBytesPerSecond <= 0 {
+		return now, true
+	}
+	start := max64(now, x.bottleneckFree)
+	queued := ((start - now) * x.rateBytesPerSecond) / 1e9
+	if queued+n > x.queueBytes {
+		return 0, false
+	}
+	x.bottleneckFree = start + (n*1e9)/x.rateBytesPerSecond
+	return x.bottleneckFree, true
+}
+
 // rateFilter returns true if another packet can be sent now without violating the rate
-// limit set by SetWriteRate
+// limit set by SetWriteRate, or if a byte rate, a trace or a shared bottleneck is in use
 func (x *headerHalfPipe) rateFilter() bool {
 	x.rateLk.Lock()
 	defer x.rateLk.Unlock()
 
+	// A byte rate, a trace or a shared bottleneck takes the place of the rate limit
+	if x.rateBytesPerSecond > 0 || x.traceLink != nil || x.shared != nil {
+		return true
+	}
 	now := x.env.Now()
 	gctr := now / x.rateInterval
 	if gctr != x.rateIntervalCounter {
@@ -0,0 +1,173 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// TestBottleneck checks that packets written through a byte-rate bottleneck are spaced by
+// their serialization delay, and that packets which overflow its queue are dropped
+func TestBottleneck(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	defer env.Close()
+	a, b, _ := NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+
+	const rate = 1e5 // Bytes per second
+	h := &dccp.Header{}
+	h.InitDataHeader(make([]byte, 500))
+	n := wireLen(h)
+	a.SetWriteByteRate(rate, int(2*n))
+
+	// The reader records delivery times until its deadline expires
+	b.SetReadExpire(1e9)
+	var r []int64
+	reader := env.NewGoJoin("reader")
+	reader.Go(func() {
+		for {
+			if _, err := b.Read(); err != nil {
+				break
+			}
+			r = append(r, env.Now())
+		}
+	}, "reader")
+
+	// Three packets are written back to back, and only two fit in the queue
+	t0 := env.Now()
+	for i := 0; i < 3; i++ {
+		if err := a.Write(h); err != nil {
+			t.Fatalf("write (%s)", err)
+		}
+		env.Sleep(1)
+	}
+
+	reader.Join()
+	if len(r) != 2 {
+		t.Fatalf("expecting 2 delivered packets, got %d", len(r))
+	}
+	for i, got := range r {
+		want := t0 + int64(i+1)*n*1e9/rate
+		if got < want || got > want+10 {
+			t.Errorf("packet %d delivered at %d, expecting %d", i, got-t0, want-t0)
+		}
+	}
+
+	// The byte rate replaces the default limit of DefaultRatePacketsPerInterval packets
+	a, b, _ = NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+	a.SetWriteByteRate(1e7, 0)
+	const m = 4 * DefaultRatePacketsPerInterval
+	b.SetReadExpire(1e9)
+	var k int
+	reader = env.NewGoJoin("reader")
+	reader.Go(func() {
+		for {
+			if _, err := b.Read(); err != nil {
+				break
+			}
+			k++
+		}
+	}, "reader")
+	for i := 0; i < m; i++ {
+		a.Write(h)
+		env.Sleep(DefaultRateInterval / m)
+	}
+	reader.Join()
+	if k != m {
+		t.Errorf("expecting %d delivered packets, got %d", m, k)
+	}
+}
+
+// pipeTrial writes n packets, one every interval nanoseconds, from a to b and returns the
+// sequence numbers of the packets read on b, in order of delivery, and their travel times
+func pipeTrial(env *dccp.Env, a, b *headerHalfPipe, n int, interval int64) (seqno []int64, travel []int64) {
+	a.SetWriteRate(1e9, 1e6)
+	b.SetReadExpire(int64(n)*interval + 1e9)
+	sent := make(map[int64]int64)
+	reader := env.NewGoJoin("reader")
+	reader.Go(func() {
+		for {
+			h, err := b.Read()
+			if err != nil {
+				break
+			}
+			seqno = append(seqno, h.SeqNo)
+			travel = append(travel, env.Now() - sent[h.SeqNo])
+		}
+	}, "reader")
+	for i := 0; i < n; i++ {
+		h := &dccp.Header{SeqNo: int64(i)}
+		h.InitDataHeader([]byte{1, 2, 3})
+		sent[h.SeqNo] = env.Now()
+		a.Write(h)
+		env.Sleep(interval)
+	}
+	reader.Join()
+	return seqno, travel
+}
+
+// TestJitter checks the delays, reordering and duplication introduced by the pipe
+func TestJitter(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	defer env.Close()
+	const n = 500
+
+	// Uniform jitter larger than the spacing of packets reorders them
+	a, b, _ := NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+	a.SetWriteLatency(10e6)
+	a.SetWriteJitter(&UniformJitter{Max: 5e6})
+	seqno, travel := pipeTrial(env, a, b, n, 1e6)
+	if len(seqno) != n {
+		t.Fatalf("expecting %d packets, got %d", n, len(seqno))
+	}
+	var late int
+	for i, d := range travel {
+		if d < 10e6 || d >= 15e6 {
+			t.Errorf("travel time %d out of range", d)
+		}
+		if i > 0 && seqno[i] < seqno[i-1] {
+			late++
+		}
+	}
+	if late == 0 {
+		t.Errorf("no reordering")
+	}
+
+	// The mean of the normal and Pareto jitter
+	for _, jitter := range []Jitter{&NormalJitter{Mean: 5e6, StdDev: 1e6}, &ParetoJitter{Scale: 10e6, Shape: 3}} {
+		a, b, _ = NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+		a.SetWriteJitter(jitter)
+		_, travel = pipeTrial(env, a, b, n, 1e6)
+		var sum float64
+		for _, d := range travel {
+			sum += float64(d)
+		}
+		if mean := sum / float64(len(travel)); mean < 4e6 || mean > 6e6 {
+			t.Errorf("%s mean delay %g, expecting 5e6", jitter, mean)
+		}
+	}
+
+	// Held back packets arrive after the next one
+	a, b, _ = NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+	a.SetWriteReorder(0.1, 1500e3)
+	seqno, _ = pipeTrial(env, a, b, n, 1e6)
+	late = 0
+	for i := 1; i < len(seqno); i++ {
+		if seqno[i] < seqno[i-1] {
+			late++
+		}
+	}
+	if r := float64(late) / n; r < 0.06 || r > 0.14 {
+		t.Errorf("reordered fraction %g, expecting 0.1", r)
+	}
+
+	// Duplicates
+	a, b, _ = NewPipe(env, dccp.NewAmb("line", env), "a", "b")
+	a.SetWriteDuplicate(0.1)
+	seqno, _ = pipeTrial(env, a, b, n, 1e6)
+	if r := float64(len(seqno) - n) / n; r < 0.06 || r > 0.14 {
+		t.Errorf("duplicated fraction %g, expecting 0.1", r)
+	}
+}
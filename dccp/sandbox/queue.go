@@ -0,0 +1,182 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// QueueDiscipline decides which packets are dropped by the queue of a Bottleneck. Packets
+// that do not fit in the queue are dropped regardless of the discipline.
+type QueueDiscipline interface {
+	// Drop is called for every packet that fits in the queue, in order of arrival. arrival is
+	// the time when the packet enters the queue, and head is the time when it reaches the
+	// head of the queue and would start transmission. queued is the number of bytes in the
+	// queue ahead of the packet, and n is the size of the packet.
+	Drop(env *dccp.Env, arrival, head, queued, n int64) bool
+
+	String() string
+}
+
+// DropTail drops only the packets that do not fit in the queue
+type DropTail struct{}
+
+// Drop implements QueueDiscipline.Drop
+func (DropTail) Drop(env *dccp.Env, arrival, head, queued, n int64) bool {
+	return false
+}
+
+func (DropTail) String() string {
+	return "DropTail"
+}
+
+// RED is the Random Early Detection discipline of Floyd and Jacobson. It keeps an
+// exponentially weighted moving average of the queue size, with weight Weight. Arriving
+// packets are never dropped while the average is below MinThreshold bytes, and are always
+// dropped while it is above MaxThreshold bytes. In between, the drop probability grows
+// linearly up to MaxP, and is spread evenly across arrivals.
+type RED struct {
+	MinThreshold int64
+	MaxThreshold int64
+	MaxP         float64
+	Weight       float64
+
+	sync.Mutex
+	avg          float64
+	count        int // Packets since the last drop
+}
+
+// NewRED creates a RED discipline with the given thresholds in bytes, and the customary
+// maximum drop probability of 0.1 and weight of 0.002
+func NewRED(minThreshold, maxThreshold int64) *RED {
+	return &RED{
+		MinThreshold: minThreshold,
+		MaxThreshold: maxThreshold,
+		MaxP:         0.1,
+		Weight:       0.002,
+	}
+}
+
+// Drop implements QueueDiscipline.Drop
+func (x *RED) Drop(env *dccp.Env, arrival, head, queued, n int64) bool {
+	x.Lock()
+	defer x.Unlock()
+	x.avg = (1-x.Weight)*x.avg + x.Weight*float64(queued)
+	switch {
+	case x.avg < float64(x.MinThreshold):
+		x.count = 0
+		return false
+	case x.avg >= float64(x.MaxThreshold):
+		x.count = 0
+		return true
+	}
+	x.count++
+	pb := x.MaxP * (x.avg - float64(x.MinThreshold)) / float64(x.MaxThreshold-x.MinThreshold)
+	pa := 1.0
+	if d := 1 - float64(x.count)*pb; d > 0 {
+		pa = pb / d
+	}
+	if env.Float64() < pa {
+		x.count = 0
+		return true
+	}
+	return false
+}
+
+// Average returns the average queue size in bytes
+func (x *RED) Average() float64 {
+	x.Lock()
+	defer x.Unlock()
+	return x.avg
+}
+
+func (x *RED) String() string {
+	return fmt.Sprintf("RED(Min=%d, Max=%d, MaxP=%g, Weight=%g)",
+		x.MinThreshold, x.MaxThreshold, x.MaxP, x.Weight)
+}
+
+// CoDel is the Controlled Delay discipline of Nichols and Jacobson (RFC 8289). It drops
+// packets once the time they spend in the queue has stayed above Target for at least
+// Interval nanoseconds, at a rate which increases with the square root of the number of
+// drops, until the queueing delay falls below Target.
+//
+// CoDel decides at the head of the queue. The queue of a Bottleneck is served in order at a
+// constant rate, so the time when a packet reaches the head is known on arrival, and the
+// decision is taken then, for that time.
+type CoDel struct {
+	Target   int64
+	Interval int64
+
+	sync.Mutex
+	firstAbove int64 // Time when the delay will have been above target for an interval
+	dropNext   int64 // Time of the next drop in the dropping state
+	count      int   // Drops since entering the dropping state
+	lastCount  int
+	dropping   bool
+}
+
+// NewCoDel creates a CoDel discipline with the customary target of 5 ms and interval of 100 ms
+func NewCoDel() *CoDel {
+	return &CoDel{
+		Target:   5e6,
+		Interval: 100e6,
+	}
+}
+
+// Drop implements QueueDiscipline.Drop
+func (x *CoDel) Drop(env *dccp.Env, arrival, head, queued, n int64) bool {
+	x.Lock()
+	defer x.Unlock()
+	now := head
+	ok := x.okToDrop(now, head-arrival, queued)
+	if x.dropping {
+		if !ok {
+			x.dropping = false
+			return false
+		}
+		if now >= x.dropNext {
+			x.count++
+			x.dropNext = x.controlLaw(x.dropNext)
+			return true
+		}
+		return false
+	}
+	if !ok {
+		return false
+	}
+	x.dropping = true
+	// Resume the drop rate of the last dropping state if it ended recently
+	delta := x.count - x.lastCount
+	x.count = 1
+	if delta > 1 && now-x.dropNext < 16*x.Interval {
+		x.count = delta
+	}
+	x.dropNext = x.controlLaw(now)
+	x.lastCount = x.count
+	return true
+}
+
+func (x *CoDel) okToDrop(now, sojourn, queued int64) bool {
+	if sojourn < x.Target || queued <= TraceMTU {
+		x.firstAbove = 0
+		return false
+	}
+	if x.firstAbove == 0 {
+		x.firstAbove = now + x.Interval
+		return false
+	}
+	return now >= x.firstAbove
+}
+
+func (x *CoDel) controlLaw(t int64) int64 {
+	return t + int64(float64(x.Interval)/math.Sqrt(float64(x.count)))
+}
+
+func (x *CoDel) String() string {
+	return fmt.Sprintf("CoDel(Target=%d, Interval=%d)", x.Target, x.Interval)
+}
@@ -5,9 +5,7 @@
 package sandbox
 
 import (
-	//"fmt"
 	"testing"
-	"github.com/petar/GoDCCP/dccp"
 )
 
 const (
@@ -24,58 +22,19 @@ const (
 //		(2.b) or be closely above the connection limit (and maintain a drop rate below some threshold)
 // A two-way test is not necessary as the congestion mechanisms in either direction are completely independent.
 //
-// NOTE: Pipe currently supports rate simulation in packets per time interval. If we want to test behavior
-// under variable packet sizes, we need to implement rate simulation in bytes per interval.
+// The limit here is in packets per time interval. Limits in bytes per second, which matter under variable
+// packet sizes, are set with Link.ByteRate (see SetWriteByteRate).
 func TestRate(t *testing.T) {
-
-	env, _ := NewEnv("rate")
-	clientConn, serverConn, clientToServer, _ := NewClientServerPipe(env)
-
-	// Set rate limit on client-to-server connection
-	clientToServer.SetWriteRate(rateInterval, ratePacketsPerInterval)
-
-	cchan := make(chan int, 1)
-	mtu := clientConn.GetMTU()
-	buf := make([]byte, mtu)
-	env.Go(func() {
-		t0 := env.Now()
-		for env.Now() - t0 < rateDuration {
-			err := clientConn.Write(buf)
-			if err != nil {
-				t.Errorf("error writing (%s)", err)
-				break
-			}
-		}
-		// Close is necessary because otherwise, if no read timeout is in place, the
-		// server sides hangs forever on Read
-		clientConn.Close()
-		close(cchan)
-	}, "test client")
-
-	schan := make(chan int, 1)
-	env.Go(func() {
-		for {
-			_, err := serverConn.Read()
-			if err == dccp.ErrEOF {
-				break 
-			} else if err != nil {
-				t.Errorf("error reading (%s)", err)
-				break
-			}
-		}
-		serverConn.Close()
-		close(schan)
-	}, "test server")
-
-	_, _ = <-cchan
-	_, _ = <-schan
-
-	clientConn.Abort()
-	serverConn.Abort()
-
-	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
-	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
-	if err := env.Close(); err != nil {
-		t.Errorf("error closing runtime (%s)", err)
+	x := &Experiment{
+		Name:     "rate",
+		Duration: rateDuration,
+		Pairs: []*Pair{
+			&Pair{
+				// Set rate limit on client-to-server connection
+				ClientToServer: Link{RateInterval: rateInterval, RatePackets: ratePacketsPerInterval},
+				ClientTraffic:  Pattern{Payload: PayloadMTU},
+			},
+		},
 	}
+	x.Run(t)
 }
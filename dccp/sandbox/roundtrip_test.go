@@ -25,72 +25,42 @@ const (
 func TestRoundtripEstimation(t *testing.T) {
 	dccp.InstallCtrlCPanic()
 
-	env, plex := NewEnv("rtt")
-	reducer := NewMeasure(env, t)
-	plex.Add(reducer)
-	plex.Add(newRoundtripCheckpoint(env, t))
-	plex.HighlightSamples(ccid3.RoundtripElapsedSample, ccid3.RoundtripReportSample)
-
-	clientConn, serverConn, clientToServer, _ := NewClientServerPipe(env)
-
-	// Roundtrip estimates might be imprecise during long idle periods,
-	// as a product of the CCID3 design, since during such period precise
-	// estimates are not necessary. Therefore, to focus on roundtrip time
-	// estimation without saturating the link, we generate sufficiently 
-	// regular transmissions.
-
-	payload := []byte{1, 2, 3}
-	buf := make([]byte, len(payload))
-
-	// In order to isolate roundtrip measurement testing from the complexities
-	// of the send rate calculation mechanism, we fix the send rate of both
-	// endpoints using the debug flag FixRate.
-	clientConn.Amb().Flags().SetUint32("FixRate", roundtripRate)
-	serverConn.Amb().Flags().SetUint32("FixRate", roundtripRate)
-
-	// Increase the client—>server latency from 0 to latency at half time
-	env.Go(func() {
-		env.Sleep(roundtripDuration / 2)
-		clientToServer.SetWriteLatency(roundtripLatency)
-	}, "test controller")
-
-	cchan := make(chan int, 1)
-	env.Go(func() {
-		t0 := env.Now()
-		for env.Now() - t0 < roundtripDuration {
-			err := clientConn.Write(buf)
-			if err != nil {
-				break
-			}
-		}
-		// Close is necessary because otherwise, if no read timeout is in place, the
-		// server sides hangs forever on Read
-		clientConn.Close()
-		close(cchan)
-	}, "test client")
-
-	schan := make(chan int, 1)
-	env.Go(func() {
-		for {
-			_, err := serverConn.Read()
-			if err != nil {
-				break
-			}
-		}
-		close(schan)
-	}, "test server")
-
-	_, _ = <-cchan
-	_, _ = <-schan
-
-	// Shutdown the connections properly
-	clientConn.Abort()
-	serverConn.Abort()
-	env.NewGoJoin("end-of-test", clientConn.Joiner(), serverConn.Joiner()).Join()
-	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and client done.")
-	if err := env.Close(); err != nil {
-		t.Errorf("error closing runtime (%s)", err)
+	x := &Experiment{
+		Name:      "rtt",
+		Duration:  roundtripDuration,
+		Highlight: []string{ccid3.RoundtripElapsedSample, ccid3.RoundtripReportSample},
+		Pairs: []*Pair{
+			&Pair{
+				// In order to isolate roundtrip measurement testing from the complexities
+				// of the send rate calculation mechanism, we fix the send rate of both
+				// endpoints using the debug flag FixRate.
+				FixRate: roundtripRate,
+
+				// Under synthetic time, computation takes no time, so its latency is injected explicitly
+				ClientToServer: Link{Latency: roundtripComputationalLatency},
+
+				// Roundtrip estimates might be imprecise during long idle periods,
+				// as a product of the CCID3 design, since during such period precise
+				// estimates are not necessary. Therefore, to focus on roundtrip time
+				// estimation without saturating the link, we generate sufficiently 
+				// regular transmissions.
+				ClientTraffic: Pattern{Payload: 3},
+			},
+		},
+		Setup: func(r *Run) {
+			r.Plex.Add(newRoundtripCheckpoint(r.Env, t))
+		},
+		Actions: []*Action{
+			// Increase the client—>server latency to latency at half time
+			&Action{
+				At: roundtripDuration / 2,
+				Do: func(r *Run) {
+					r.Pairs[0].ClientToServer.SetWriteLatency(roundtripLatency)
+				},
+			},
+		},
 	}
+	x.Run(t)
 }
 
 // roundtripCheckpoint verifies that roundtrip estimates are within expected at
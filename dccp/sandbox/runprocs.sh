@@ -0,0 +1,3 @@
+#!/bin/sh
+# The virtual clock must not depend on the number of processors
+go test -test.cpu=1,4,8
@@ -0,0 +1,207 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+// Package synthetic provides the virtual time of the sandbox. Its Runtime implements
+// dccp.Runtime (see sandbox.NewSyntheticEnv).
+package synthetic
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Runtime is the dccp.Runtime of the Envs of the sandbox. It runs on a virtual clock, and it
+// lets the goroutines of the Env run one at a time, each until it waits. Time stands still
+// while a goroutine is running. When a goroutine waits, the turn goes to
+//
+//	(1) the goroutine that has been ready to run for longest, such as a new goroutine;
+//	(2) otherwise, the goroutine that has been waiting for longest among those whose
+//	    channel operation can now succeed;
+//	(3) otherwise, the earliest sleeper, or the earliest waiter whose timeout expires,
+//	    after the clock moves to its wake-up time. Ties go to the first to arrive.
+//
+// Since the order of turns depends only on what the goroutines do, and not on the Go
+// scheduler, the number of processors, or the load of the machine, a run is determined by
+// the seed of the random source of the Env, and a multi-minute scenario runs as fast as the
+// CPU permits.
+//
+// The goroutines of the Env are the goroutine that creates the Runtime and those started
+// with dccp.Env.Go. They must wait only through the Env: Sleep, the channel operations of
+// dccp.Recv, dccp.Select and dccp.Send, and the Joiners of the Env. Any other wait, such as
+// a plain channel operation, or a mutex that is held across a wait of the Env, blocks the
+// goroutine while it holds the turn, and so stops the whole Env.
+type Runtime struct {
+	sync.Mutex
+	now      int64
+	seq      int64     // Order of arrival of the next sleeper
+	runq     []*turn   // Goroutines ready to run, in order of arrival
+	waitq    []*turn   // Goroutines waiting in Wait, in order of arrival
+	sleepers turnHeap  // Goroutines waiting with a timeout
+}
+
+// turn is a goroutine of the Env waiting for its turn to run
+type turn struct {
+	next    chan int    // Receives when the goroutine gets its turn
+	try     func() bool // Operation of a goroutine in Wait
+	expired bool        // Set if Wait timed out
+	at      int64       // Wake-up time of a sleeper
+	seq     int64
+	index   int         // Position in the sleeper heap, or -1
+}
+
+func newTurn(try func() bool) *turn {
+	return &turn{next: make(chan int, 1), try: try, index: -1}
+}
+
+// TimeZero is the time at which the virtual clock starts
+var TimeZero = time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+
+// New creates a Runtime. The calling goroutine is its first goroutine, which holds the turn.
+func New() *Runtime {
+	return &Runtime{now: TimeZero}
+}
+
+// Now implements dccp.Runtime.Now
+func (r *Runtime) Now() int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.now
+}
+
+// Go implements dccp.Runtime.Go. The new goroutine runs once the calling goroutine waits.
+func (r *Runtime) Go(f func()) {
+	t := newTurn(nil)
+	r.Lock()
+	r.runq = append(r.runq, t)
+	r.Unlock()
+	go func() {
+		<-t.next
+		f()
+		r.pass()
+	}()
+}
+
+// Sleep implements dccp.Runtime.Sleep
+func (r *Runtime) Sleep(ns int64) {
+	if ns < 0 {
+		ns = 0
+	}
+	t := newTurn(nil)
+	r.Lock()
+	r.sleep(t, ns)
+	r.Unlock()
+	r.pass()
+	<-t.next
+}
+
+// Wait implements dccp.Runtime.Wait
+func (r *Runtime) Wait(try func() bool, timeout int64) bool {
+	if try() {
+		return true
+	}
+	if timeout == 0 {
+		return false
+	}
+	t := newTurn(try)
+	r.Lock()
+	r.waitq = append(r.waitq, t)
+	if timeout > 0 {
+		r.sleep(t, timeout)
+	}
+	r.Unlock()
+	r.pass()
+	<-t.next
+	return !t.expired
+}
+
+// sleep schedules t to wake up after ns nanoseconds. It must be called with r locked.
+func (r *Runtime) sleep(t *turn, ns int64) {
+	t.at = r.now + ns
+	t.seq = r.seq
+	r.seq++
+	heap.Push(&r.sleepers, t)
+}
+
+// pass gives the turn of the calling goroutine, which is about to wait or to return, to the
+// next goroutine (see Runtime)
+func (r *Runtime) pass() {
+	r.Lock()
+	t := r.choose()
+	r.Unlock()
+	if t == nil {
+		panic("sandbox: all goroutines of the env wait, and none of them can wake")
+	}
+	t.next <- 1
+}
+
+// choose picks the goroutine whose turn is next. It must be called with r locked.
+func (r *Runtime) choose() *turn {
+	if len(r.runq) > 0 {
+		t := r.runq[0]
+		r.runq[0] = nil
+		r.runq = r.runq[1:]
+		return t
+	}
+	for i, t := range r.waitq {
+		if t.try() {
+			r.unwait(i)
+			return t
+		}
+	}
+	if len(r.sleepers) > 0 {
+		t := heap.Pop(&r.sleepers).(*turn)
+		if t.at > r.now {
+			r.now = t.at
+		}
+		if t.try != nil {
+			t.expired = true
+			for i, u := range r.waitq {
+				if u == t {
+					r.unwait(i)
+					break
+				}
+			}
+		}
+		return t
+	}
+	return nil
+}
+
+// unwait removes the turn at index i from the wait queue, along with its timeout
+func (r *Runtime) unwait(i int) {
+	t := r.waitq[i]
+	r.waitq = append(r.waitq[:i], r.waitq[i+1:]...)
+	if t.index >= 0 {
+		heap.Remove(&r.sleepers, t.index)
+	}
+}
+
+// turnHeap orders sleepers by wake-up time, breaking ties in order of arrival
+type turnHeap []*turn
+
+func (h turnHeap) Len() int { return len(h) }
+func (h turnHeap) Less(i, j int) bool {
+	if h[i].at != h[j].at {
+		return h[i].at < h[j].at
+	}
+	return h[i].seq < h[j].seq
+}
+func (h turnHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *turnHeap) Push(x interface{}) {
+	t := x.(*turn)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *turnHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
@@ -0,0 +1,223 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package synthetic
+
+import (
+	"runtime"
+	"testing"
+	"time"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+func newEnv() (*dccp.Env, *Runtime) {
+	r := New()
+	return dccp.NewEnvRuntime(nil, r, 1), r
+}
+
+func TestSleep(t *testing.T) {
+	env, _ := newEnv()
+	t0 := env.Now()
+	c := make(chan int64)
+	gojoin := env.NewGoJoin("sleep")
+	gojoin.Go(func() {
+		env.Sleep(2 * 3600e9)
+		dccp.Send(env, c, env.Now(), (chan int)(nil))
+	}, "late")
+	gojoin.Go(func() {
+		env.Sleep(3600e9)
+		dccp.Send(env, c, env.Now(), (chan int)(nil))
+	}, "early")
+	var dur int64
+	gojoin.Go(func() {
+		u0, _ := dccp.Recv(env, c)
+		u1, _ := dccp.Recv(env, c)
+		dur = u1 - u0
+	}, "measure")
+	real0 := time.Now()
+	gojoin.Join()
+	if dur != 3600e9 {
+		t.Errorf("expecting 1 hour between wake-ups, got %d", dur)
+	}
+	if e := env.Now() - t0; e != 2*3600e9 {
+		t.Errorf("expecting 2 hours of synthetic time, got %d", e)
+	}
+	if time.Since(real0) > 5*time.Second {
+		t.Errorf("synthetic time too slow")
+	}
+}
+
+// TestBusy checks that time stands still while a goroutine is running
+func TestBusy(t *testing.T) {
+	env, _ := newEnv()
+	t0 := env.Now()
+	gojoin := env.NewGoJoin("busy")
+	gojoin.Go(func() {
+		env.Sleep(1e9)
+	}, "sleeper")
+	gojoin.Go(func() {
+		u0 := env.Now()
+		k := 0
+		for i := 0; i < 1e8; i++ {
+			k += i
+		}
+		if env.Now() != u0 {
+			t.Errorf("time advanced while a goroutine was running")
+		}
+	}, "busy")
+	gojoin.Join()
+	if env.Now()-t0 != 1e9 {
+		t.Errorf("expecting 1 sec of synthetic time, got %d", env.Now()-t0)
+	}
+}
+
+// TestChan checks that a goroutine waiting on a channel does not hold the clock back, and
+// that no sleepers are left behind by a wait that ends before its timeout
+func TestChan(t *testing.T) {
+	env, r := newEnv()
+	t0 := env.Now()
+	c, d := make(chan int64), make(chan int64)
+	env.Go(func() {
+		u, _ := dccp.Recv(env, c)
+		dccp.Send(env, d, u, (chan int)(nil))
+	}, "waiter")
+	env.Go(func() {
+		env.Sleep(1e9)
+		dccp.Send(env, c, env.Now(), (chan int)(nil))
+	}, "sleeper")
+	if u, _ := dccp.Recv(env, d); u-t0 != 1e9 {
+		t.Errorf("expecting wake-up after 1 sec, got %d", u-t0)
+	}
+
+	// A value that arrives early cancels the timeout of the wait
+	env.Go(func() {
+		env.Sleep(1e9)
+		dccp.Send(env, c, 1, (chan int)(nil))
+	}, "sender")
+	if _, _, expired := dccp.RecvTimeout(env, c, 5e9); expired {
+		t.Errorf("expecting a value, got a timeout")
+	}
+	if _, _, expired := dccp.RecvTimeout(env, c, 1e9); !expired {
+		t.Errorf("expecting a timeout")
+	}
+	if e := env.Now() - t0; e != 3e9 {
+		t.Errorf("expecting 3 sec of synthetic time, got %d", e)
+	}
+	r.Lock()
+	sleepers, waiters := len(r.sleepers), len(r.waitq)
+	r.Unlock()
+	if sleepers != 0 || waiters != 0 {
+		t.Errorf("expecting no sleepers and waiters, got %d and %d", sleepers, waiters)
+	}
+}
+
+// TestWakeOrder checks that sleepers due at the same time are woken in the order in which
+// they went to sleep, and that goroutines take turns in the order in which their channel
+// operations became possible
+func TestWakeOrder(t *testing.T) {
+	env, _ := newEnv()
+	const n = 10
+	var order []int
+	gojoin := env.NewGoJoin("wake order")
+	for i := 0; i < n; i++ {
+		i := i
+		gojoin.Go(func() {
+			// Goroutine i goes to sleep at time i+1, and all wake up at 1 sec
+			env.Sleep(int64(i) + 1)
+			env.Sleep(1e9 - int64(i) - 1)
+			order = append(order, i)
+		}, "sleeper %d", i)
+	}
+	gojoin.Join()
+	for i, j := range order {
+		if i != j {
+			t.Fatalf("wake-up order %v", order)
+		}
+	}
+
+	// Receivers are released in the order in which they started to wait
+	c := make(chan int)
+	order = nil
+	gojoin = env.NewGoJoin("receive order")
+	for i := 0; i < n; i++ {
+		i := i
+		gojoin.Go(func() {
+			env.Sleep(int64(n - i))
+			dccp.Recv(env, c)
+			order = append(order, i)
+		}, "receiver %d", i)
+	}
+	env.Sleep(1e9)
+	close(c)
+	gojoin.Join()
+	for i, j := range order {
+		if j != n-1-i {
+			t.Fatalf("receive order %v", order)
+		}
+	}
+}
+
+// TestProcs checks that the turns of a computation, in which goroutines exchange values over
+// channels, race for them and sleep, do not depend on the number of processors
+func TestProcs(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	var want []int64
+	for _, procs := range []int{1, 4, 8, 1, 4, 8} {
+		runtime.GOMAXPROCS(procs)
+		got := pingPong()
+		if want == nil {
+			want = got
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("with %d procs, expecting %v, got %v", procs, want, got)
+			}
+		}
+	}
+}
+
+// pingPong bounces a value between two goroutines that sleep between the bounces, while
+// other goroutines race to send on the same channel, and returns the virtual times at which
+// the bounces arrive, along with the order in which the racers got through
+func pingPong() []int64 {
+	env, _ := newEnv()
+	ping, pong := make(chan int64), make(chan int64, 1)
+	var times []int64
+	env.Go(func() {
+		for {
+			v, ok := dccp.Recv(env, ping)
+			if !ok {
+				close(pong)
+				return
+			}
+			if v < 0 {
+				times = append(times, v)
+				continue
+			}
+			env.Sleep(v)
+			dccp.Send(env, pong, v, (chan int)(nil))
+		}
+	}, "pong")
+	for i := int64(1); i <= 10; i++ {
+		i := i
+		env.Go(func() {
+			dccp.Send(env, ping, -i, (chan int)(nil))
+		}, "racer")
+	}
+	t0 := env.Now()
+	for i := int64(1); i <= 100; i++ {
+		dccp.Send(env, ping, i*1e6, (chan int)(nil))
+		// Poll with a timeout shorter than the sleep of the other side
+		for {
+			if _, _, expired := dccp.RecvTimeout(env, pong, i*1e5); !expired {
+				break
+			}
+		}
+		times = append(times, env.Now()-t0)
+	}
+	close(ping)
+	dccp.Recv(env, pong)
+	return times
+}
@@ -0,0 +1,259 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// TraceMTU is the number of bytes that a link can deliver at one delivery opportunity of a Trace
+const TraceMTU = 1500
+
+// Trace is a recorded link capacity in the format of the Mahimahi link emulator. A trace file
+// lists one timestamp per line, in milliseconds. Every line is an opportunity to deliver
+// TraceMTU bytes at the given time, so that a timestamp repeated k times allows k*TraceMTU bytes
+// through in that millisecond. Opportunities that find no packets waiting are wasted. When the
+// trace ends, it repeats from the beginning with a period equal to its last timestamp.
+type Trace struct {
+	opportunities []int64 // Times of delivery opportunities within a period, in ns, ascending
+	period        int64   // Period of the trace in ns
+}
+
+// ReadTrace parses a trace in Mahimahi format from r
+func ReadTrace(r io.Reader) (*Trace, error) {
+	t := &Trace{}
+	err := scanLines(r, func(fields []string) error {
+		if len(fields) != 1 {
+			return errors.New("expecting one timestamp")
+		}
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || ms < 0 {
+			return errors.New("bad timestamp")
+		}
+		ns := ms * 1e6
+		if n := len(t.opportunities); n > 0 && ns < t.opportunities[n-1] {
+			return errors.New("timestamps not ascending")
+		}
+		t.opportunities = append(t.opportunities, ns)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(t.opportunities) == 0 {
+		return nil, errors.New("empty trace")
+	}
+	t.period = t.opportunities[len(t.opportunities)-1]
+	if t.period <= 0 {
+		return nil, errors.New("trace period is zero")
+	}
+	return t, nil
+}
+
+// LoadTrace reads a trace in Mahimahi format from the named file
+func LoadTrace(filename string) (*Trace, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTrace(f)
+}
+
+// Period returns the duration of the trace in nanoseconds
+func (t *Trace) Period() int64 {
+	return t.period
+}
+
+// Rate returns the average capacity of the trace in bytes per second
+func (t *Trace) Rate() float64 {
+	return float64(len(t.opportunities)) * TraceMTU * 1e9 / float64(t.period)
+}
+
+// opportunity returns the time of the k-th delivery opportunity, relative to the start of
+// the trace
+func (t *Trace) opportunity(k int64) int64 {
+	n := int64(len(t.opportunities))
+	return (k/n)*t.period + t.opportunities[k%n]
+}
+
+// next returns the index of the first delivery opportunity at or after time at, relative to
+// the start of the trace
+func (t *Trace) next(at int64) int64 {
+	n := int64(len(t.opportunities))
+	cycle := at / t.period
+	off := at - cycle*t.period
+	i := int64(sort.Search(len(t.opportunities), func(i int) bool { return t.opportunities[i] >= off }))
+	return cycle*n + i
+}
+
+// traceLink tracks the delivery of packets over a Trace. Packets wait in a drop-tail queue
+// of queueBytes bytes for delivery opportunities.
+type traceLink struct {
+	trace      *Trace
+	zero       int64 // Time when the trace started
+	queueBytes int64
+
+	// The last delivery opportunity in use and the number of bytes left in it
+	cursor     int64
+	left       int64
+
+	// Departure times and sizes of the packets in the queue
+	queue      []tracePacket
+}
+
+type tracePacket struct {
+	depart int64
+	n      int64
+}
+
+func newTraceLink(trace *Trace, now int64, queueBytes int64) *traceLink {
+	return &traceLink{
+		trace:      trace,
+		zero:       now,
+		queueBytes: queueBytes,
+		cursor:     -1,
+	}
+}
+
+// Send returns the time when a packet of n bytes, written at time now, is delivered. It
+// returns false if the packet does not fit in the queue.
+func (x *traceLink) Send(now, n int64) (sent int64, ok bool) {
+	var queued int64
+	for len(x.queue) > 0 && x.queue[0].depart <= now {
+		x.queue = x.queue[1:]
+	}
+	for _, p := range x.queue {
+		queued += p.n
+	}
+	if queued+n > x.queueBytes {
+		return 0, false
+	}
+	// Bytes left in opportunities that have passed are wasted
+	if x.cursor < 0 || x.zero+x.trace.opportunity(x.cursor) < now || x.left == 0 {
+		x.cursor = max64(x.cursor+1, x.trace.next(now-x.zero))
+		x.left = TraceMTU
+	}
+	m := n
+	for m > x.left {
+		m -= x.left
+		x.cursor++
+		x.left = TraceMTU
+	}
+	x.left -= m
+	sent = x.zero + x.trace.opportunity(x.cursor)
+	x.queue = append(x.queue, tracePacket{sent, n})
+	return sent, true
+}
+
+// Schedule changes the latency and the loss rate of a pipe over time. A schedule file lists
+// one change per line, made of three fields: the time of the change in milliseconds since the
+// start of the schedule, the latency in milliseconds and the loss probability. The last line
+// remains in effect after the end of the schedule. Lines starting with # are comments.
+type Schedule struct {
+	steps []scheduleStep
+}
+
+type scheduleStep struct {
+	at      int64   // Time of the change, relative to the start of the schedule
+	latency int64
+	loss    float64
+}
+
+// ReadSchedule parses a latency and loss schedule from r
+func ReadSchedule(r io.Reader) (*Schedule, error) {
+	s := &Schedule{}
+	err := scanLines(r, func(fields []string) error {
+		if len(fields) != 3 {
+			return errors.New("expecting time, latency and loss")
+		}
+		at, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || at < 0 {
+			return errors.New("bad time")
+		}
+		if n := len(s.steps); n > 0 && at*1e6 < s.steps[n-1].at {
+			return errors.New("times not ascending")
+		}
+		latency, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || latency < 0 {
+			return errors.New("bad latency")
+		}
+		loss, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || loss < 0 || loss > 1 {
+			return errors.New("bad loss probability")
+		}
+		s.steps = append(s.steps, scheduleStep{at * 1e6, int64(latency * 1e6), loss})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(s.steps) == 0 {
+		return nil, errors.New("empty schedule")
+	}
+	return s, nil
+}
+
+// LoadSchedule reads a latency and loss schedule from the named file
+func LoadSchedule(filename string) (*Schedule, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSchedule(f)
+}
+
+// At returns the latency and loss probability in effect at time at, relative to the start
+// of the schedule. Before the first change, there is no latency and no loss.
+func (s *Schedule) At(at int64) (latency int64, loss float64) {
+	i := sort.Search(len(s.steps), func(i int) bool { return s.steps[i].at > at })
+	if i == 0 {
+		return 0, 0
+	}
+	return s.steps[i-1].latency, s.steps[i-1].loss
+}
+
+// scheduleLink applies a Schedule to a pipe
+type scheduleLink struct {
+	schedule *Schedule
+	zero     int64
+}
+
+// Latency returns the latency in effect at time now
+func (x *scheduleLink) Latency(now int64) int64 {
+	latency, _ := x.schedule.At(now - x.zero)
+	return latency
+}
+
+// Lose returns true if a packet written at time now is to be lost
+func (x *scheduleLink) Lose(env *dccp.Env, now int64) bool {
+	_, loss := x.schedule.At(now - x.zero)
+	return loss > 0 && env.Float64() < loss
+}
+
+// scanLines calls parse with the fields of every line of r that is neither blank nor a
+// comment, and annotates errors with line numbers
+func scanLines(r io.Reader, parse func(fields []string) error) error {
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := parse(strings.Fields(text)); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	return s.Err()
+}
@@ -0,0 +1,140 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+func TestReadTrace(t *testing.T) {
+	trace, err := ReadTrace(strings.NewReader("# comment\n1\n1\n\n3\n4\n"))
+	if err != nil {
+		t.Fatalf("read trace (%s)", err)
+	}
+	if trace.Period() != 4e6 || len(trace.opportunities) != 4 {
+		t.Errorf("unexpected trace %v", trace)
+	}
+	if trace.Rate() != 4*TraceMTU*1e9/4e6 {
+		t.Errorf("unexpected rate %g", trace.Rate())
+	}
+	if trace.opportunity(5) != 5e6 || trace.next(5e6) != 4 || trace.next(6e6) != 6 {
+		t.Errorf("unexpected opportunities")
+	}
+	for _, bad := range []string{"", "0\n", "2\n1\n", "x\n", "1 2\n"} {
+		if _, err := ReadTrace(strings.NewReader(bad)); err == nil {
+			t.Errorf("expecting error on %q", bad)
+		}
+	}
+
+	s, err := ReadSchedule(strings.NewReader("0 10 0\n# comment\n1000 50.5 0.1\n"))
+	if err != nil {
+		t.Fatalf("read schedule (%s)", err)
+	}
+	if l, p := s.At(999e6); l != 10e6 || p != 0 {
+		t.Errorf("unexpected schedule step %d %g", l, p)
+	}
+	if l, p := s.At(5e9); l != 50.5e6 || p != 0.1 {
+		t.Errorf("unexpected schedule step %d %g", l, p)
+	}
+	for _, bad := range []string{"", "0 10\n", "10 1 0\n5 1 0\n", "0 1 2\n"} {
+		if _, err := ReadSchedule(strings.NewReader(bad)); err == nil {
+			t.Errorf("expecting error on %q", bad)
+		}
+	}
+}
+
+// TestTraceLink checks that packets are delivered at the opportunities of a trace
+func TestTraceLink(t *testing.T) {
+	trace, _ := ReadTrace(strings.NewReader("2\n2\n5\n10\n"))
+	x := newTraceLink(trace, 1e9, 2*TraceMTU)
+	steps := []struct {
+		now, n, sent int64
+		ok           bool
+	}{
+		{1e9, 1000, 1e9 + 2e6, true},        // First opportunity at 2 ms
+		{1e9, 1000, 1e9 + 2e6, true},        // Spans both opportunities at 2 ms
+		{1e9, 1000, 1e9 + 2e6, true},        // Fills the second opportunity at 2 ms
+		{1e9, 1500, 0, false},               // The queue is full
+		{1e9 + 3e6, 100, 1e9 + 5e6, true},   // The queue has drained
+		{1e9 + 6e6, 100, 1e9 + 10e6, true},  // The rest of the opportunity at 5 ms is wasted
+		{1e9 + 11e6, 100, 1e9 + 12e6, true}, // The trace repeats
+	}
+	for i, s := range steps {
+		sent, ok := x.Send(s.now, s.n)
+		if sent != s.sent || ok != s.ok {
+			t.Errorf("step %d: sent %d %v, expecting %d %v", i, sent-1e9, ok, s.sent-1e9, s.ok)
+		}
+	}
+}
+
+const (
+	traceDuration = 10e9 // Duration of the experiment in ns
+	tracePeriod   = 1000 // Period of the trace in ms
+)
+
+// TestTraceRate checks that a sender above the capacity of a recorded trace, with a latency
+// and loss schedule, delivers data at the capacity of the trace less the scheduled losses.
+// The sender sends at a fixed rate, so that the result does not depend on congestion
+// control, and the seed is fixed, so that the losses are the same in every run.
+func TestTraceRate(t *testing.T) {
+
+	// The trace alternates between 400 ms of 1 and 600 ms of 2 delivery opportunities per 10 ms,
+	// an average of 240 KB/s
+	var w bytes.Buffer
+	for ms := 10; ms <= tracePeriod; ms += 10 {
+		fmt.Fprintf(&w, "%d\n", ms)
+		if ms > 400 {
+			fmt.Fprintf(&w, "%d\n", ms)
+		}
+	}
+	trace, err := ReadTrace(&w)
+	if err != nil {
+		t.Fatalf("read trace (%s)", err)
+	}
+	// No loss until 5 sec, and 1% loss after
+	schedule, err := ReadSchedule(strings.NewReader("0 20 0\n5000 60 0.01\n"))
+	if err != nil {
+		t.Fatalf("read schedule (%s)", err)
+	}
+
+	// The rate is measured over whole periods of the trace, once the sender has left the
+	// initial rate of CCID3
+	const from, to = 4e9, 9e9
+	const loss = 0.01 * (to - 5e9) / (to - from)
+	var received [2]int64
+	record := func(i int) func(r *Run) {
+		return func(r *Run) { received[i] = r.Pairs[0].ServerRead() }
+	}
+	x := &Experiment{
+		Name:     "trace",
+		Duration: traceDuration,
+		Seed:     1,
+		Pairs: []*Pair{
+			&Pair{
+				ClientToServer: Link{Trace: trace, Schedule: schedule},
+				ClientTraffic:  Pattern{Payload: 1000},
+				FixRate:        400, // Packets per second, well above the capacity of the trace
+			},
+		},
+		Actions: []*Action{&Action{At: from, Do: record(0)}, &Action{At: to, Do: record(1)}},
+		Check: func(r *Run) {
+			// The trace carries the headers of the packets as well as their data
+			h := &dccp.Header{}
+			h.InitDataHeader(make([]byte, 1000))
+			want := trace.Rate() * 1000 / float64(wireLen(h)) * (1 - loss)
+			rate := float64(received[1]-received[0]) * 1e9 / (to - from)
+			t.Logf("receive rate %0.0f B/s, expecting %0.0f B/s", rate, want)
+			// The options of the packets take up a few percent of the capacity
+			if rate > want || rate < 0.95*want {
+				t.Errorf("receive rate %0.0f B/s, expecting %0.0f B/s", rate, want)
+			}
+		},
+	}
+	x.Run(t)
+}
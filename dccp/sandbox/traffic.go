@@ -0,0 +1,172 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// Source is a model of cross traffic, which competes with DCCP connections for the capacity
+// of a Bottleneck. A source is driven by StartTraffic.
+type Source interface {
+	// Next returns the time to wait before sending the next packet, and the size of the
+	// packet in bytes
+	Next(env *dccp.Env) (wait int64, size int64)
+
+	// Result reports the fate of the last packet, which entered the bottleneck at time
+	// arrival. If ok, the packet finished transmission at time sent; otherwise it was dropped.
+	Result(arrival, sent int64, ok bool)
+
+	String() string
+}
+
+// CBR is a constant bit rate source, which sends packets of Size bytes at Rate bytes per second
+type CBR struct {
+	Rate int64
+	Size int64
+}
+
+// Next implements Source.Next
+func (x *CBR) Next(env *dccp.Env) (wait int64, size int64) {
+	return x.Size * 1e9 / x.Rate, x.Size
+}
+
+// Result implements Source.Result
+func (x *CBR) Result(arrival, sent int64, ok bool) {}
+
+func (x *CBR) String() string {
+	return fmt.Sprintf("CBR(Rate=%d, Size=%d)", x.Rate, x.Size)
+}
+
+// Poisson is a source whose packets of Size bytes arrive as a Poisson process, at an average
+// of Rate bytes per second
+type Poisson struct {
+	Rate int64
+	Size int64
+}
+
+// Next implements Source.Next
+func (x *Poisson) Next(env *dccp.Env) (wait int64, size int64) {
+	return int64(env.ExpFloat64() * float64(x.Size*1e9/x.Rate)), x.Size
+}
+
+// Result implements Source.Result
+func (x *Poisson) Result(arrival, sent int64, ok bool) {}
+
+func (x *Poisson) String() string {
+	return fmt.Sprintf("Poisson(Rate=%d, Size=%d)", x.Rate, x.Size)
+}
+
+// OnOff is a source which alternates between periods of sending packets of Size bytes at Rate
+// bytes per second, and periods of silence. The lengths of the periods are exponentially
+// distributed, with means On and Off nanoseconds. The average rate of the source is
+// Rate*On/(On+Off).
+type OnOff struct {
+	Rate int64
+	Size int64
+	On   int64
+	Off  int64
+
+	sync.Mutex
+	left int64 // Time left in the current on period
+}
+
+// Next implements Source.Next
+func (x *OnOff) Next(env *dccp.Env) (wait int64, size int64) {
+	x.Lock()
+	defer x.Unlock()
+	interval := x.Size * 1e9 / x.Rate
+	for x.left < interval {
+		// The on period ends, and is followed by a period of silence and a new on period
+		wait += x.left + int64(env.ExpFloat64() * float64(x.Off))
+		x.left = int64(env.ExpFloat64() * float64(x.On))
+	}
+	x.left -= interval
+	return wait + interval, x.Size
+}
+
+// Result implements Source.Result
+func (x *OnOff) Result(arrival, sent int64, ok bool) {}
+
+func (x *OnOff) String() string {
+	return fmt.Sprintf("OnOff(Rate=%d, Size=%d, On=%d, Off=%d)", x.Rate, x.Size, x.On, x.Off)
+}
+
+// AIMD is a simple model of a TCP Reno flow in congestion avoidance. It paces packets of Size
+// bytes at a window of packets per round-trip time. The round-trip time is BaseRTT plus
+// the queueing delay of the last packet. The window grows by one packet per window of
+// delivered packets, and is halved on a drop, at most once per round trip. Unlike TCP, the
+// model learns the fate of each packet immediately, rather than one round trip later.
+type AIMD struct {
+	Size    int64
+	BaseRTT int64
+
+	sync.Mutex
+	window       float64
+	rtt          int64
+	lastDecrease int64
+}
+
+// NewAIMD creates an AIMD source with an initial window of one packet
+func NewAIMD(size, baseRTT int64) *AIMD {
+	return &AIMD{Size: size, BaseRTT: baseRTT, window: 1, rtt: baseRTT}
+}
+
+// Next implements Source.Next
+func (x *AIMD) Next(env *dccp.Env) (wait int64, size int64) {
+	x.Lock()
+	defer x.Unlock()
+	return int64(float64(x.rtt) / x.window), x.Size
+}
+
+// Result implements Source.Result
+func (x *AIMD) Result(arrival, sent int64, ok bool) {
+	x.Lock()
+	defer x.Unlock()
+	if ok {
+		x.rtt = x.BaseRTT + sent - arrival
+		x.window += 1 / x.window
+		return
+	}
+	if arrival-x.lastDecrease >= x.rtt {
+		x.window = math.Max(1, x.window/2)
+		x.lastDecrease = arrival
+	}
+}
+
+// Window returns the current window in packets
+func (x *AIMD) Window() float64 {
+	x.Lock()
+	defer x.Unlock()
+	return x.window
+}
+
+func (x *AIMD) String() string {
+	return fmt.Sprintf("AIMD(Size=%d, BaseRTT=%d)", x.Size, x.BaseRTT)
+}
+
+// StartTraffic sends the packets of src through b, under the name flow, for duration
+// nanoseconds, in a new goroutine. The throughput of the flow is reported by b along with
+// that of the DCCP connections through it. The returned Joiner waits for the traffic to end.
+func StartTraffic(env *dccp.Env, b *Bottleneck, flow string, src Source, duration int64) dccp.Joiner {
+	j := env.NewGoJoin("traffic")
+	j.Go(func() {
+		t0 := env.Now()
+		for {
+			wait, size := src.Next(env)
+			env.Sleep(wait)
+			now := env.Now()
+			if now-t0 >= duration {
+				break
+			}
+			sent, ok := b.Send(flow, now, size)
+			src.Result(now, sent, ok)
+		}
+	}, "traffic %s", flow)
+	return j
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"testing"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// TestSources checks the average rate of the open-loop sources
+func TestSources(t *testing.T) {
+	env := NewSyntheticEnv(nil, 1)
+	const rate = 1e5
+	sources := []Source{
+		&CBR{Rate: rate, Size: 1000},
+		&Poisson{Rate: rate, Size: 1000},
+		&OnOff{Rate: 2 * rate, Size: 1000, On: 1e8, Off: 1e8},
+	}
+	for _, src := range sources {
+		var elapsed, sent int64
+		for elapsed < 1000e9 {
+			wait, size := src.Next(env)
+			elapsed += wait
+			sent += size
+		}
+		if r := float64(sent) * 1e9 / float64(elapsed); r < 0.95*rate || r > 1.05*rate {
+			t.Errorf("%s: rate %0.0f B/s, expecting %0.0f", src, r, rate)
+		}
+	}
+}
+
+// TestAIMD checks that an AIMD source fills a bottleneck and backs off on drops
+func TestAIMD(t *testing.T) {
+	env := dccp.NewEnv(nil)
+	const rate = 1e6
+	b := NewBottleneck(env, dccp.NewAmb("line", env), rate, 30e3, nil)
+	src := NewAIMD(1000, 50e6)
+	var now int64
+	for now < 60e9 {
+		wait, size := src.Next(env)
+		now += wait
+		sent, ok := b.Send("aimd", now, size)
+		src.Result(now, sent, ok)
+	}
+	st := b.Stats()["aimd"]
+	if r := float64(st.Bytes) * 1e9 / float64(now); r < 0.8*rate {
+		t.Errorf("rate %0.0f B/s, expecting close to %0.0f", r, rate)
+	}
+	if st.Dropped == 0 {
+		t.Errorf("no drops")
+	}
+}
+
+const (
+	crossDuration = 10e9  // Duration of the experiment in ns
+	crossRate     = 100e3 // Capacity of the bottleneck in bytes per second
+	crossQueue    = 30e3  // Size of the queue of the bottleneck in bytes
+)
+
+// TestCrossTraffic runs a DCCP connection through a bottleneck along with constant bit rate
+// and AIMD cross traffic, and reports the throughput of each
+func TestCrossTraffic(t *testing.T) {
+
+	x := &Experiment{
+		Name:       "cross",
+		Duration:   crossDuration,
+		Bottleneck: &BottleneckSpec{Rate: crossRate, QueueBytes: crossQueue},
+		Traffic: []*CrossTraffic{
+			&CrossTraffic{Flow: "cbr", Source: &CBR{Rate: crossRate / 5, Size: 1000}},
+			&CrossTraffic{Flow: "aimd", Source: NewAIMD(1000, 50e6)},
+		},
+		Pairs: []*Pair{
+			&Pair{
+				Shared:        true,
+				Flow:          "dccp",
+				ClientTraffic: Pattern{Payload: 1000},
+			},
+		},
+		Check: func(r *Run) {
+			var total int64
+			for flow, f := range r.Bottleneck.Stats() {
+				if f.Bytes == 0 {
+					t.Errorf("flow %s starved", flow)
+				}
+				total += f.Bytes
+			}
+			// Packets still in the queue at the end have been counted
+			if total > crossRate*crossDuration/1e9 + crossQueue {
+				t.Errorf("flows exceed the capacity of the bottleneck")
+			}
+		},
+	}
+	x.Run(t)
+}
@@ -0,0 +1,112 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+// VirtualNet is an in-memory packet network, which connects any number of nodes, each with
+// its own address, so that one server Mux can serve many client Muxes in a single process.
+// Every node is attached to a router by a dccp.ChanLink pair. The router forwards the packets
+// sent by a node to the node whose address matches the destination, and delivers them with
+// the address of the sender. Packets to unknown addresses are dropped.
+//
+// The access link of every node is impaired in both directions (see ImpairedLink): Up
+// impairs the packets that the node sends, and Down the packets that it receives.
+type VirtualNet struct {
+	env *dccp.Env
+	amb *dccp.Amb
+
+	sync.Mutex
+	nodes map[string]*NetNode
+}
+
+// NetNode is a node of a VirtualNet
+type NetNode struct {
+	Addr net.Addr
+
+	// Up is the link of the node, which is to be passed to its Mux. It impairs the packets
+	// that the node sends.
+	Up *ImpairedLink
+
+	// Down impairs the packets that the router delivers to the node
+	Down *ImpairedLink
+}
+
+// NewVirtualNet creates an empty network
+func NewVirtualNet(env *dccp.Env, amb *dccp.Amb) *VirtualNet {
+	return &VirtualNet{
+		env:   env,
+		amb:   amb.Refine("vnet"),
+		nodes: make(map[string]*NetNode),
+	}
+}
+
+// netKey returns a string that identifies addr in a VirtualNet
+func netKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+// Attach adds a node with address addr to the network. The node is detached when its Up link
+// is closed.
+func (n *VirtualNet) Attach(addr net.Addr) (*NetNode, error) {
+	p, q := dccp.NewChanPipeEnv(n.env)
+	node := &NetNode{
+		Addr: addr,
+		Up:   NewImpairedLink(n.env, n.amb.Refine(addr.String()), p),
+		Down: NewImpairedLink(n.env, n.amb.Refine(addr.String()), q),
+	}
+	n.Lock()
+	defer n.Unlock()
+	k := netKey(addr)
+	if _, ok := n.nodes[k]; ok {
+		node.Up.Close()
+		node.Down.Close()
+		return nil, dccp.ErrInvalid
+	}
+	n.nodes[k] = node
+	n.env.Go(func() { n.route(node, q) }, "vnet route %s", addr)
+	return node, nil
+}
+
+// Node returns the node with address addr, or nil if there is none
+func (n *VirtualNet) Node(addr net.Addr) *NetNode {
+	n.Lock()
+	defer n.Unlock()
+	return n.nodes[netKey(addr)]
+}
+
+// route forwards the packets sent by node, which the router reads from the far end q of its
+// access link, until the node detaches
+func (n *VirtualNet) route(node *NetNode, q *dccp.ChanLink) {
+	buf := make([]byte, q.GetMTU())
+	for {
+		m, addr, err := q.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		dst := n.Node(addr)
+		if dst == nil {
+			n.amb.E(dccp.EventDrop, fmt.Sprintf("No route from %s to %s", node.Addr, addr))
+			continue
+		}
+		if _, err := dst.Down.WriteTo(buf[:m], node.Addr); err != nil {
+			n.amb.E(dccp.EventDrop, fmt.Sprintf("Forward from %s to %s (%s)", node.Addr, addr, err))
+		}
+	}
+	n.Lock()
+	if k := netKey(node.Addr); n.nodes[k] == node {
+		delete(n.nodes, k)
+	}
+	n.Unlock()
+	node.Down.Close()
+}
@@ -0,0 +1,168 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"github.com/petar/GoDCCP/dccp"
+)
+
+func vnetAddr(i int) net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 5000}
+}
+
+func expectFrom(t *testing.T, l dccp.Link, p string, from net.Addr) {
+	buf := make([]byte, l.GetMTU())
+	n, addr, err := l.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read (%s)", err)
+	}
+	if string(buf[:n]) != p || addr.String() != from.String() {
+		t.Errorf("expecting %q from %s, got %q from %s", p, from, buf[:n], addr)
+	}
+}
+
+// TestVirtualNet checks that packets are routed by address, and that impairments apply
+func TestVirtualNet(t *testing.T) {
+	env := dccp.NewEnv(nil)
+	n := NewVirtualNet(env, dccp.NoLogging)
+	var nodes []*NetNode
+	for i := 1; i <= 3; i++ {
+		node, err := n.Attach(vnetAddr(i))
+		if err != nil {
+			t.Fatalf("attach (%s)", err)
+		}
+		nodes = append(nodes, node)
+	}
+	if _, err := n.Attach(vnetAddr(1)); err == nil {
+		t.Errorf("expecting error on attaching an address twice")
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+
+	a.Up.WriteTo([]byte("ab"), b.Addr)
+	expectFrom(t, b.Up, "ab", a.Addr)
+	c.Up.WriteTo([]byte("ca"), a.Addr)
+	expectFrom(t, a.Up, "ca", c.Addr)
+
+	// Packets to unknown addresses and packets lost on the way down are dropped
+	a.Up.WriteTo([]byte("a?"), vnetAddr(4))
+	b.Down.SetLossModel(&BernoulliLoss{P: 1})
+	a.Up.WriteTo([]byte("ab"), b.Addr)
+	c.Up.WriteTo([]byte("cb"), b.Addr)
+	// The router forwards the packets of each node in order, so once the next packets of a
+	// and c arrive, their packets to b have met the loss
+	a.Up.WriteTo([]byte("ac"), c.Addr)
+	expectFrom(t, c.Up, "ac", a.Addr)
+	c.Up.WriteTo([]byte("ca"), a.Addr)
+	expectFrom(t, a.Up, "ca", c.Addr)
+	b.Down.SetLossModel(nil)
+	a.Up.WriteTo([]byte("ab"), b.Addr)
+	expectFrom(t, b.Up, "ab", a.Addr)
+
+	// Closing the link of a node detaches it
+	a.Up.Close()
+	for i := 0; n.Node(a.Addr) != nil; i++ {
+		if i == 100 {
+			t.Fatalf("node not detached")
+		}
+		time.Sleep(1e6)
+	}
+	b.Up.Close()
+	c.Up.Close()
+}
+
+const (
+	vnetClients  = 4
+	vnetDuration = 5e9
+	vnetSendRate = 20 // Fixed sender rate in pps, since the access links have no capacity limit
+)
+
+// TestVirtualNetMux runs a server Mux with several client Muxes, over access links of
+// different latency and loss, and checks that the data of every client reaches the server
+// over a connection of its own
+func TestVirtualNetMux(t *testing.T) {
+	env, _ := NewEnv("vnet")
+	n := NewVirtualNet(env, dccp.NewAmb("line", env))
+	snode, _ := n.Attach(vnetAddr(1))
+	sm := dccp.NewMuxEnv(env, dccp.MuxConfig{}, snode.Up)
+	muxes := []*dccp.Mux{sm}
+
+	var lk sync.Mutex
+	var conns []*dccp.Conn
+	received := make(map[byte]int)
+	tests := env.NewGoJoin("test")
+	for i := 0; i < vnetClients; i++ {
+		cnode, _ := n.Attach(vnetAddr(2 + i))
+		cnode.Up.SetLatency(10e6 + int64(i)*20e6)
+		cnode.Up.SetLossModel(&BernoulliLoss{P: float64(i) * 0.02})
+		cm := dccp.NewMuxEnv(env, dccp.MuxConfig{}, cnode.Up)
+		muxes = append(muxes, cm)
+		conn, err := DialConn(env, fmt.Sprintf("client%d", i), cm, snode.Addr)
+		if err != nil {
+			t.Fatalf("dial (%s)", err)
+		}
+		conn.Amb().Flags().SetUint32("FixRate", vnetSendRate)
+		conns = append(conns, conn)
+		id := byte(i)
+		tests.Go(func() {
+			t0 := env.Now()
+			for env.Now()-t0 < vnetDuration {
+				if err := conn.Write([]byte{id}); err != nil {
+					break
+				}
+			}
+			conn.Close()
+		}, "test client")
+	}
+	for i := 0; i < vnetClients; i++ {
+		conn, err := AcceptConn(env, fmt.Sprintf("server%d", i), sm)
+		if err != nil {
+			t.Fatalf("accept (%s)", err)
+		}
+		conn.Amb().Flags().SetUint32("FixRate", vnetSendRate)
+		conns = append(conns, conn)
+		tests.Go(func() {
+			from := -1
+			for {
+				p, err := conn.Read()
+				if err != nil {
+					break
+				}
+				if from >= 0 && int(p[0]) != from {
+					t.Errorf("connection carries data of clients %d and %d", from, p[0])
+				}
+				from = int(p[0])
+				lk.Lock()
+				received[p[0]]++
+				lk.Unlock()
+			}
+		}, "test server")
+	}
+	tests.Join()
+	for i := 0; i < vnetClients; i++ {
+		t.Logf("client %d: %d blocks", i, received[byte(i)])
+		if received[byte(i)] == 0 {
+			t.Errorf("no data from client %d", i)
+		}
+	}
+
+	var joiners []dccp.Joiner
+	for _, conn := range conns {
+		conn.Abort()
+		joiners = append(joiners, conn.Joiner())
+	}
+	for _, m := range muxes {
+		m.Close()
+	}
+	env.NewGoJoin("end-of-test", joiners...).Join()
+	dccp.NewAmb("line", env).E(dccp.EventMatch, "Server and clients done.")
+	if err := env.Close(); err != nil {
+		t.Errorf("error closing runtime (%s)", err)
+	}
+}
@@ -0,0 +1,649 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SecureLink is a Link that encrypts and authenticates all traffic of an underlying Link, so
+// that a Mux (and everything above it, including labels and DCCP headers) can run over
+// untrusted networks. SecureLink implements Link.
+//
+// Each pair of endpoints agrees on session keys with a Hello exchange. The initiator sends a
+// Hello carrying its static X25519 public key and a fresh ephemeral X25519 public key. The
+// responder answers with a Hello of its own, which also echoes the ephemeral key of the
+// initiator, and the initiator confirms with a third Hello, which echoes the ephemeral key
+// of the responder. The Reply and the Confirm are authenticated with a key derived from the
+// static-static shared secret, so only holders of a trusted static private key can complete
+// a handshake, and echoing the ephemeral key of the other side proves that they are fresh.
+// The Init cannot be authenticated, since the initiator may not know the static key of the
+// responder yet, but a forged or replayed Init only starts a session that is never confirmed.
+//
+// The session keys are derived from the ephemeral-ephemeral and the static-static shared
+// secrets. Every session uses new ephemeral keys on both sides, whose private halves are
+// discarded as soon as the session keys are derived, so traffic recorded in the past cannot
+// be decrypted later with the static keys alone. The session keys themselves are kept in
+// memory for as long as the session is in use. Packets are sealed with AES-GCM and carry a
+// 48-bit sequence number, which the receiver checks against a sliding replay window.
+//
+// A session is used for sending only once the peer has proven that it holds its keys, and
+// a replayed Hello can neither revive an old session nor displace the current one. A forged
+// Init can displace a session that is still waiting for confirmation, but at most once every
+// secureNextHold.
+//
+// Packets written to a peer before its session is established are queued (up to
+// secureMaxPending) and sent as soon as the Hello exchange completes; excess packets are
+// dropped, as a lossy link would. State is kept for at most secureMaxPeers peers.
+type SecureLink struct {
+	env     *Env
+	amb     *Amb
+	link    Link
+	static  *ecdh.PrivateKey
+	trusted []*ecdh.PublicKey
+
+	Mutex
+	peers map[string]*securePeer // Peer state keyed by the string form of the peer address
+}
+
+// securePeer holds the handshake state and sessions of one remote endpoint
+type securePeer struct {
+	addr       net.Addr
+	eph        *ecdh.PrivateKey // Local ephemeral key offered in a Hello, not yet used by a session
+	seen       [][]byte         // Ephemeral public keys of the peer used by recent sessions
+	lastHello  int64            // Time when the last Hello was sent
+	lastActive int64            // Time of the last write or authenticated read
+	pending    [][]byte         // Plaintext packets waiting for a session
+	cur        *secureSession   // The confirmed session used for sending, nil before the handshake
+	next       *secureSession   // A new session that the peer has not confirmed yet
+	prev       *secureSession   // The previous session, still accepted for receiving
+}
+
+// secureSession holds the keys and counters of an established session
+type secureSession struct {
+	peerStatic []byte // Static public key of the peer
+	helloKey   []byte // Key authenticating the Hellos that refer to the session
+	localEph   []byte // Public key of the local ephemeral key of the session
+	peerEph    []byte // Public key of the ephemeral key of the peer
+	started    int64  // Time when the session was started by an Init of the peer
+	seal, open cipher.AEAD
+	sendSeqNo  uint64
+	recvHigh   uint64 // Highest sequence number received
+	recvMask   uint64 // Bit i is set if recvHigh-i has been received
+}
+
+const (
+	securePacketHello = 1
+	securePacketData  = 2
+
+	// Stages of the Hello exchange
+	secureHelloInit    = 1 // Offers an ephemeral key
+	secureHelloReply   = 2 // Offers an ephemeral key and echoes the key of the initiator
+	secureHelloConfirm = 3 // Echoes the key of the responder, confirming the session
+
+	secureKeyLen = 32
+	secureMACLen = 16
+
+	// A Hello packet consists of the type byte, the stage byte, the static public key and
+	// the ephemeral public key of the sender, the echoed ephemeral public key of the
+	// receiver, and a MAC of all preceding bytes. The echo and the MAC of an Init are zero.
+	secureHelloLen = 2 + 3*secureKeyLen + secureMACLen
+
+	// A Data packet consists of the type byte and a 48-bit sequence number, followed by the
+	// sealed payload
+	secureDataHeaderLen = 1 + 6
+	secureOverhead      = secureDataHeaderLen + 16 // AES-GCM tag is 16 bytes
+
+	secureMaxPending  = 8
+	secureHelloResend = 250e6 // Min time between Hello retransmissions, in ns
+	secureNextHold    = 1e9   // Min time before an Init can replace an unconfirmed session, in ns
+	secureReplayWidth = 64
+	secureSeenLen     = 16   // Number of past ephemeral keys remembered for each peer
+	secureMaxPeers    = 1024 // Max number of peers whose state is kept
+	secureEvictSample = 8    // Number of peers sampled when choosing one to evict
+)
+
+// NewSecureLink creates a SecureLink on top of link, which identifies itself with the
+// static X25519 key static. If trusted is not empty, only peers whose static public key is
+// in trusted are accepted. Otherwise any peer is accepted, which protects against passive
+// eavesdropping but not against active impersonation.
+func NewSecureLink(env *Env, amb *Amb, link Link, static *ecdh.PrivateKey, trusted []*ecdh.PublicKey) *SecureLink {
+	if static.Curve() != ecdh.X25519() {
+		panic("SecureLink requires an X25519 key")
+	}
+	return &SecureLink{
+		env:     env,
+		amb:     amb.Refine("secure"),
+		link:    link,
+		static:  static,
+		trusted: trusted,
+		peers:   make(map[string]*securePeer),
+	}
+}
+
+// GetMTU implements Link.GetMTU
+func (l *SecureLink) GetMTU() int {
+	return l.link.GetMTU() - secureOverhead
+}
+
+// SetReadDeadline implements Link.SetReadDeadline
+func (l *SecureLink) SetReadDeadline(t time.Time) error {
+	return l.link.SetReadDeadline(t)
+}
+
+// Close implements Link.Close
+func (l *SecureLink) Close() error {
+	return l.link.Close()
+}
+
+// getPeer returns the state of the peer at addr, creating it if necessary. If the number of
+// peers is at its limit, one of a few sampled peers is forgotten, preferring peers without an
+// established session and then the least recently active.
+func (l *SecureLink) getPeer(addr net.Addr) *securePeer {
+	l.AssertLocked()
+	k := addrKey(addr)
+	p, ok := l.peers[k]
+	if !ok {
+		if len(l.peers) >= secureMaxPeers {
+			l.evictPeer()
+		}
+		p = &securePeer{addr: addr}
+		l.peers[k] = p
+	}
+	p.lastActive = l.env.Now()
+	return p
+}
+
+// evictPeer forgets one of secureEvictSample peers. Map iteration order is random, so the
+// sample is too.
+func (l *SecureLink) evictPeer() {
+	var victim *securePeer
+	var victimKey string
+	n := 0
+	for k, p := range l.peers {
+		if victim == nil || p.evictsBefore(victim) {
+			victim, victimKey = p, k
+		}
+		if n++; n == secureEvictSample {
+			break
+		}
+	}
+	delete(l.peers, victimKey)
+	l.amb.E(EventDrop, "Secure peer evicted")
+}
+
+// evictsBefore returns true if p should be evicted before q: peers without an established
+// session go first, then the least recently active
+func (p *securePeer) evictsBefore(q *securePeer) bool {
+	if (p.cur == nil) != (q.cur == nil) {
+		return p.cur == nil
+	}
+	return p.lastActive < q.lastActive
+}
+
+// WriteTo implements Link.WriteTo
+func (l *SecureLink) WriteTo(buf []byte, addr net.Addr) (n int, err error) {
+	if len(buf) > l.GetMTU() {
+		return 0, ErrTooBig
+	}
+	l.Lock()
+	p := l.getPeer(addr)
+	if p.cur == nil {
+		if len(p.pending) < secureMaxPending {
+			q := make([]byte, len(buf))
+			copy(q, buf)
+			p.pending = append(p.pending, q)
+		} else {
+			l.amb.E(EventDrop, "Secure handshake pending")
+		}
+		var hello []byte
+		if now := l.env.Now(); now-p.lastHello >= secureHelloResend {
+			p.lastHello = now
+			if p.next != nil {
+				// Prompt the peer to confirm the session that it has started
+				hello = makeHello(l.static, p.next.helloKey, secureHelloReply, p.next.localEph, p.next.peerEph)
+			} else {
+				hello = makeHello(l.static, nil, secureHelloInit, p.offerEph(), nil)
+			}
+		}
+		l.Unlock()
+		if hello != nil {
+			if _, err = l.link.WriteTo(hello, addr); err != nil {
+				return 0, err
+			}
+		}
+		return len(buf), nil
+	}
+	pkt := p.cur.sealPacket(buf)
+	l.Unlock()
+	if _, err = l.link.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// offerEph returns the public key of the local ephemeral key offered to the peer, generating
+// a new ephemeral key if the previous one has been used by a session
+func (p *securePeer) offerEph() []byte {
+	if p.eph == nil {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			panic("ephemeral key generation")
+		}
+		p.eph = eph
+	}
+	return p.eph.PublicKey().Bytes()
+}
+
+// makeHello returns a Hello of the given stage from the holder of static, which offers the
+// local ephemeral key eph and echoes the ephemeral key echo of the peer. The Hello is
+// authenticated with key, unless key is nil.
+func makeHello(static *ecdh.PrivateKey, key []byte, stage byte, eph, echo []byte) []byte {
+	h := make([]byte, secureHelloLen)
+	h[0] = securePacketHello
+	h[1] = stage
+	copy(h[2:], static.PublicKey().Bytes())
+	copy(h[2+secureKeyLen:], eph)
+	copy(h[2+2*secureKeyLen:], echo)
+	if key != nil {
+		copy(h[secureHelloLen-secureMACLen:], secureHelloMAC(key, h))
+	}
+	return h
+}
+
+func secureHelloMAC(key, hello []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(hello[:secureHelloLen-secureMACLen])
+	return m.Sum(nil)[:secureMACLen]
+}
+
+// ReadFrom implements Link.ReadFrom. Hello packets are processed internally. Packets that
+// fail authentication or replay checks, or do not fit in buf, are dropped.
+func (l *SecureLink) ReadFrom(buf []byte) (n int, addr net.Addr, err error) {
+	raw := make([]byte, l.link.GetMTU())
+	for {
+		m, addr, err := l.link.ReadFrom(raw)
+		if err != nil {
+			return 0, addr, err
+		}
+		pkt := raw[:m]
+		if m == 0 {
+			l.amb.E(EventDrop, "Empty secure packet")
+			continue
+		}
+		switch pkt[0] {
+		case securePacketHello:
+			l.onHello(pkt, addr)
+		case securePacketData:
+			plain, ok := l.openPacket(pkt, addr)
+			if !ok {
+				continue
+			}
+			if len(plain) > len(buf) {
+				l.amb.E(EventDrop, "Secure packet exceeds read buffer")
+				continue
+			}
+			return copy(buf, plain), addr, nil
+		default:
+			l.amb.E(EventDrop, "Unknown secure packet type")
+		}
+	}
+	panic("unreach")
+}
+
+func (l *SecureLink) isTrusted(pub *ecdh.PublicKey) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	for _, t := range l.trusted {
+		if t.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// helloKey derives the key that authenticates Hellos exchanged with the peer whose static
+// public key is peerStatic
+func (l *SecureLink) helloKey(peerStatic *ecdh.PublicKey) ([]byte, error) {
+	ss, err := l.static.ECDH(peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte("GoDCCP SecureLink Hello"))
+	h.Write(ss)
+	return h.Sum(nil), nil
+}
+
+// onHello authenticates a Hello packet and advances the handshake with its sender
+func (l *SecureLink) onHello(pkt []byte, addr net.Addr) {
+	if len(pkt) != secureHelloLen {
+		l.amb.E(EventDrop, "Bad secure hello length")
+		return
+	}
+	stage := pkt[1]
+	peerStatic, err := ecdh.X25519().NewPublicKey(pkt[2 : 2+secureKeyLen])
+	if err != nil || !l.isTrusted(peerStatic) || peerStatic.Equal(l.static.PublicKey()) {
+		l.amb.E(EventDrop, "Untrusted secure peer")
+		return
+	}
+	peerEph, err := ecdh.X25519().NewPublicKey(pkt[2+secureKeyLen : 2+2*secureKeyLen])
+	if err != nil {
+		l.amb.E(EventDrop, "Bad secure ephemeral key")
+		return
+	}
+	echo := pkt[2+2*secureKeyLen : 2+3*secureKeyLen]
+	if stage != secureHelloInit && stage != secureHelloReply && stage != secureHelloConfirm {
+		l.amb.E(EventDrop, "Unknown secure hello stage")
+		return
+	}
+	if stage != secureHelloInit {
+		key, err := l.helloKey(peerStatic)
+		if err != nil {
+			l.amb.E(EventDrop, fmt.Sprintf("Secure key agreement (%s)", err))
+			return
+		}
+		if !hmac.Equal(pkt[secureHelloLen-secureMACLen:], secureHelloMAC(key, pkt)) {
+			l.amb.E(EventDrop, "Secure hello failed authentication")
+			return
+		}
+	}
+
+	l.Lock()
+	p := l.getPeer(addr)
+	var reply []byte
+	var flush [][]byte
+	switch stage {
+	case secureHelloInit:
+		reply = l.onHelloInit(p, peerStatic, peerEph)
+	case secureHelloReply:
+		reply, flush = l.onHelloReply(p, peerStatic, peerEph, echo)
+	case secureHelloConfirm:
+		flush = l.onHelloConfirm(p, peerStatic, peerEph, echo)
+	}
+	l.Unlock()
+
+	if reply != nil {
+		l.link.WriteTo(reply, addr)
+	}
+	for _, q := range flush {
+		l.link.WriteTo(q, addr)
+	}
+}
+
+// onHelloInit starts a new session with the ephemeral key peerEph of the peer, unless
+// peerEph has been used before. The session is not used for sending until the peer confirms
+// it. It returns the Reply Hello. Since anyone can send an Init, an Init replaces a session
+// that the peer has not confirmed yet only after secureNextHold, so that forged Inits cannot
+// keep a peer from completing its handshake.
+func (l *SecureLink) onHelloInit(p *securePeer, peerStatic, peerEph *ecdh.PublicKey) []byte {
+	if p.next != nil && bytes.Equal(p.next.peerEph, peerEph.Bytes()) && bytes.Equal(p.next.peerStatic, peerStatic.Bytes()) {
+		// Our Reply was lost
+		return makeHello(l.static, p.next.helloKey, secureHelloReply, p.next.localEph, p.next.peerEph)
+	}
+	if p.wasSeen(peerEph.Bytes()) {
+		l.amb.E(EventDrop, "Replayed secure hello")
+		return nil
+	}
+	now := l.env.Now()
+	if p.next != nil && now-p.next.started < secureNextHold {
+		l.amb.E(EventDrop, "Secure session pending")
+		return nil
+	}
+	s := l.startSession(p, peerStatic, peerEph)
+	if s == nil {
+		return nil
+	}
+	s.started = now
+	p.next = s
+	l.amb.E(EventInfo, "Secure session started")
+	return makeHello(l.static, s.helloKey, secureHelloReply, s.localEph, s.peerEph)
+}
+
+// onHelloReply establishes the session that the peer has started in response to our Init,
+// or in response to our own Reply. It returns the Confirm Hello and the queued packets,
+// sealed with the new session.
+func (l *SecureLink) onHelloReply(p *securePeer, peerStatic, peerEph *ecdh.PublicKey, echo []byte) ([]byte, [][]byte) {
+	switch {
+	case p.cur != nil && p.cur.is(peerStatic, peerEph, echo):
+		// Our Confirm was lost
+		return makeHello(l.static, p.cur.helloKey, secureHelloConfirm, p.cur.localEph, p.cur.peerEph), nil
+	case p.next != nil && p.next.is(peerStatic, peerEph, echo):
+		// Both sides started the same session at once
+		s := p.next
+		return makeHello(l.static, s.helloKey, secureHelloConfirm, s.localEph, s.peerEph), l.promote(p, s)
+	case p.eph != nil && bytes.Equal(echo, p.eph.PublicKey().Bytes()) && !p.wasSeen(peerEph.Bytes()):
+		// The echo of our current ephemeral key shows that the Reply is fresh
+		s := l.startSession(p, peerStatic, peerEph)
+		if s == nil {
+			return nil, nil
+		}
+		return makeHello(l.static, s.helloKey, secureHelloConfirm, s.localEph, s.peerEph), l.promote(p, s)
+	}
+	l.amb.E(EventDrop, "Stale secure hello")
+	return nil, nil
+}
+
+// onHelloConfirm switches to the session that the peer confirms. It returns the queued
+// packets, sealed with the session.
+func (l *SecureLink) onHelloConfirm(p *securePeer, peerStatic, peerEph *ecdh.PublicKey, echo []byte) [][]byte {
+	switch {
+	case p.next != nil && p.next.is(peerStatic, peerEph, echo):
+		return l.promote(p, p.next)
+	case p.cur != nil && p.cur.is(peerStatic, peerEph, echo):
+		// Duplicate
+		return nil
+	}
+	l.amb.E(EventDrop, "Stale secure hello")
+	return nil
+}
+
+// startSession derives a new session from the offered local ephemeral key, or a new one,
+// and the ephemeral key peerEph of the peer. The local ephemeral key is not used again.
+func (l *SecureLink) startSession(p *securePeer, peerStatic, peerEph *ecdh.PublicKey) *secureSession {
+	p.offerEph()
+	eph := p.eph
+	p.eph = nil
+	s, err := l.newSession(eph, peerStatic, peerEph)
+	if err == nil {
+		s.helloKey, err = l.helloKey(peerStatic)
+	}
+	if err != nil {
+		l.amb.E(EventDrop, fmt.Sprintf("Secure key agreement (%s)", err))
+		return nil
+	}
+	p.seen = append(p.seen, s.peerEph)
+	if len(p.seen) > secureSeenLen {
+		p.seen = p.seen[1:]
+	}
+	return s
+}
+
+// wasSeen returns true if the ephemeral key peerEph of the peer was used by a recent session
+func (p *securePeer) wasSeen(peerEph []byte) bool {
+	for _, e := range p.seen {
+		if bytes.Equal(e, peerEph) {
+			return true
+		}
+	}
+	return false
+}
+
+// is returns true if the session was derived from the given keys of the peer and the given
+// ephemeral key of this side
+func (s *secureSession) is(peerStatic, peerEph *ecdh.PublicKey, localEph []byte) bool {
+	return bytes.Equal(s.peerStatic, peerStatic.Bytes()) && bytes.Equal(s.peerEph, peerEph.Bytes()) &&
+		bytes.Equal(s.localEph, localEph)
+}
+
+// promote makes the confirmed session s the session used for sending. It returns the queued
+// packets, sealed with s.
+func (l *SecureLink) promote(p *securePeer, s *secureSession) [][]byte {
+	l.AssertLocked()
+	if p.next == s {
+		p.next = nil
+	}
+	p.prev, p.cur = p.cur, s
+	l.amb.E(EventInfo, "Secure session established")
+	flush := make([][]byte, len(p.pending))
+	for i, q := range p.pending {
+		flush[i] = s.sealPacket(q)
+	}
+	p.pending = nil
+	return flush
+}
+
+// newSession derives the session keys from the ephemeral and static shared secrets. Both
+// sides order the ephemeral public keys, so that they agree on which key seals which direction.
+func (l *SecureLink) newSession(eph *ecdh.PrivateKey, peerStatic, peerEph *ecdh.PublicKey) (*secureSession, error) {
+	ee, err := eph.ECDH(peerEph)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := l.static.ECDH(peerStatic)
+	if err != nil {
+		return nil, err
+	}
+	mine, theirs := eph.PublicKey().Bytes(), peerEph.Bytes()
+	lo, hi := mine, theirs
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	h := sha256.New()
+	h.Write([]byte("GoDCCP SecureLink"))
+	h.Write(ee)
+	h.Write(ss)
+	h.Write(lo)
+	h.Write(hi)
+	secret := h.Sum(nil)
+
+	kLoHi, kHiLo := deriveKey(secret, 1), deriveKey(secret, 2)
+	sealKey, openKey := kLoHi, kHiLo
+	if !bytes.Equal(lo, mine) {
+		sealKey, openKey = kHiLo, kLoHi
+	}
+	s := &secureSession{peerStatic: peerStatic.Bytes(), localEph: mine, peerEph: theirs}
+	if s.seal, err = newAEAD(sealKey); err != nil {
+		return nil, err
+	}
+	if s.open, err = newAEAD(openKey); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func deriveKey(secret []byte, dir byte) []byte {
+	h := sha256.New()
+	h.Write(secret)
+	h.Write([]byte{dir})
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func secureNonce(seqno uint64) []byte {
+	nonce := make([]byte, 12)
+	EncodeUint48(seqno, nonce[6:12])
+	return nonce
+}
+
+// sealPacket encrypts buf into a Data packet with the next sequence number
+func (s *secureSession) sealPacket(buf []byte) []byte {
+	s.sendSeqNo++
+	h := make([]byte, secureDataHeaderLen, secureDataHeaderLen+len(buf)+s.seal.Overhead())
+	h[0] = securePacketData
+	EncodeUint48(s.sendSeqNo, h[1:7])
+	return s.seal.Seal(h, secureNonce(s.sendSeqNo), buf, h)
+}
+
+// openPacket authenticates and decrypts a Data packet from addr. A packet sealed with the
+// unconfirmed session confirms it, since only the peer that completed its handshake holds
+// its keys.
+func (l *SecureLink) openPacket(pkt []byte, addr net.Addr) ([]byte, bool) {
+	if len(pkt) < secureOverhead {
+		l.amb.E(EventDrop, "Short secure packet")
+		return nil, false
+	}
+	seqno := DecodeUint48(pkt[1:7])
+	var flush [][]byte
+	l.Lock()
+	p, ok := l.peers[addrKey(addr)]
+	if !ok {
+		l.Unlock()
+		l.amb.E(EventDrop, "Secure packet from unknown peer")
+		return nil, false
+	}
+	var plain []byte
+	for _, s := range []*secureSession{p.cur, p.next, p.prev} {
+		if s == nil {
+			continue
+		}
+		q, err := s.open.Open(nil, secureNonce(seqno), pkt[secureDataHeaderLen:], pkt[:secureDataHeaderLen])
+		if err != nil {
+			continue
+		}
+		if !s.checkReplay(seqno) {
+			l.Unlock()
+			l.amb.E(EventDrop, fmt.Sprintf("Secure replay %d", seqno))
+			return nil, false
+		}
+		if s == p.next {
+			flush = l.promote(p, s)
+		}
+		plain = q
+		break
+	}
+	l.Unlock()
+
+	if plain == nil {
+		l.amb.E(EventDrop, "Secure packet failed authentication")
+		return nil, false
+	}
+	for _, q := range flush {
+		l.link.WriteTo(q, addr)
+	}
+	return plain, true
+}
+
+// checkReplay updates the replay window and returns false if seqno was received before,
+// or is too old to tell
+func (s *secureSession) checkReplay(seqno uint64) bool {
+	if seqno == 0 {
+		return false
+	}
+	if seqno > s.recvHigh {
+		shift := seqno - s.recvHigh
+		if shift >= secureReplayWidth {
+			s.recvMask = 0
+		} else {
+			s.recvMask <<= shift
+		}
+		s.recvMask |= 1
+		s.recvHigh = seqno
+		return true
+	}
+	d := s.recvHigh - seqno
+	if d >= secureReplayWidth || s.recvMask&(1<<d) != 0 {
+		return false
+	}
+	s.recvMask |= 1 << d
+	return true
+}
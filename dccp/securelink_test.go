@@ -0,0 +1,293 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+)
+
+func readSecureLink(env *Env, l *SecureLink) <-chan string {
+	ch := make(chan string, 10)
+	env.Go(func() {
+		buf := make([]byte, l.GetMTU())
+		for {
+			n, _, err := l.ReadFrom(buf)
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- string(buf[:n])
+		}
+	}, "readSecureLink")
+	return ch
+}
+
+func TestSecureLink(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kb, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, q := NewChanPipe()
+	la := NewSecureLink(env, NoLogging, p, ka, []*ecdh.PublicKey{kb.PublicKey()})
+	lb := NewSecureLink(env, NoLogging, q, kb, []*ecdh.PublicKey{ka.PublicKey()})
+	ra, rb := readSecureLink(env, la), readSecureLink(env, lb)
+
+	// The first packet waits for the handshake
+	if _, err := la.WriteTo([]byte("ping"), nil); err != nil {
+		t.Fatalf("write (%s)", err)
+	}
+	if s := <-rb; s != "ping" {
+		t.Errorf("expecting ping, got %q", s)
+	}
+	if _, err := lb.WriteTo([]byte("pong"), nil); err != nil {
+		t.Fatalf("write (%s)", err)
+	}
+	if s := <-ra; s != "pong" {
+		t.Errorf("expecting pong, got %q", s)
+	}
+	la.Close()
+	lb.Close()
+	<-ra
+	<-rb
+}
+
+// tapLink records copies of the packets written to the underlying Link
+type tapLink struct {
+	Link
+	sync.Mutex
+	written [][]byte
+}
+
+func (t *tapLink) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	t.Lock()
+	t.written = append(t.written, append([]byte{}, buf...))
+	t.Unlock()
+	return t.Link.WriteTo(buf, addr)
+}
+
+func (t *tapLink) packets() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	return append([][]byte{}, t.written...)
+}
+
+func (l *SecureLink) curSession() *secureSession {
+	l.Lock()
+	defer l.Unlock()
+	if p, ok := l.peers[addrKey(nil)]; ok {
+		return p.cur
+	}
+	return nil
+}
+
+// TestSecureReplay replays every Hello and Data packet of a completed handshake, and checks
+// that the sessions stay in place and the replayed data is dropped
+func TestSecureReplay(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kb, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, q := NewChanPipe()
+	ta, tb := &tapLink{Link: p}, &tapLink{Link: q}
+	la := NewSecureLink(env, NoLogging, ta, ka, []*ecdh.PublicKey{kb.PublicKey()})
+	lb := NewSecureLink(env, NoLogging, tb, kb, []*ecdh.PublicKey{ka.PublicKey()})
+	ra, rb := readSecureLink(env, la), readSecureLink(env, lb)
+
+	la.WriteTo([]byte("ping"), nil)
+	if s := <-rb; s != "ping" {
+		t.Fatalf("expecting ping, got %q", s)
+	}
+	lb.WriteTo([]byte("pong"), nil)
+	if s := <-ra; s != "pong" {
+		t.Fatalf("expecting pong, got %q", s)
+	}
+	ca, cb := la.curSession(), lb.curSession()
+	if ca == nil || cb == nil {
+		t.Fatalf("no session")
+	}
+	for _, l := range []*SecureLink{la, lb} {
+		l.Lock()
+		if l.peers[addrKey(nil)].eph != nil {
+			t.Errorf("ephemeral key not rotated")
+		}
+		l.Unlock()
+	}
+
+	// Replay the Init, the Confirm and the data written by la, and the Reply and the data
+	// written by lb, straight into the other side
+	for _, pkt := range ta.packets() {
+		p.WriteTo(pkt, nil)
+	}
+	for _, pkt := range tb.packets() {
+		q.WriteTo(pkt, nil)
+	}
+	la.WriteTo([]byte("fresh-a"), nil)
+	if s := <-rb; s != "fresh-a" {
+		t.Errorf("expecting fresh-a, got %q", s)
+	}
+	lb.WriteTo([]byte("fresh-b"), nil)
+	if s := <-ra; s != "fresh-b" {
+		t.Errorf("expecting fresh-b, got %q", s)
+	}
+	if la.curSession() != ca || lb.curSession() != cb {
+		t.Errorf("replayed hello replaced the session")
+	}
+	la.Close()
+	lb.Close()
+	<-ra
+	<-rb
+}
+
+// TestSecureTamperedHello checks that Hellos that fail authentication, and Hellos from
+// untrusted peers, leave no state behind
+func TestSecureTamperedHello(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kb, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kc, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	eph, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, _ := NewChanPipe()
+	lb := NewSecureLink(env, NoLogging, p, kb, []*ecdh.PublicKey{ka.PublicKey()})
+
+	key, _ := lb.helloKey(ka.PublicKey())
+	for i := 2; i < secureHelloLen; i += 17 {
+		hello := makeHello(ka, key, secureHelloReply, eph.PublicKey().Bytes(), make([]byte, secureKeyLen))
+		hello[i] ^= 1
+		lb.onHello(hello, nil)
+	}
+	if len(lb.peers) != 0 {
+		t.Errorf("tampered hello accepted")
+	}
+
+	// An untrusted peer, whose key authenticates its Hellos
+	lb.onHello(makeHello(kc, nil, secureHelloInit, eph.PublicKey().Bytes(), nil), nil)
+	key, _ = lb.helloKey(kc.PublicKey())
+	lb.onHello(makeHello(kc, key, secureHelloConfirm, eph.PublicKey().Bytes(), make([]byte, secureKeyLen)), nil)
+	if len(lb.peers) != 0 {
+		t.Errorf("untrusted hello accepted")
+	}
+	lb.Close()
+}
+
+// TestSecureForgedInit checks that an Init cannot replace a session that waits for its
+// Confirm, until secureNextHold has passed
+func TestSecureForgedInit(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kb, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, q := NewChanPipe()
+	lb := NewSecureLink(env, NoLogging, p, kb, []*ecdh.PublicKey{ka.PublicKey()})
+	// Drain the Replies of lb
+	env.Go(func() {
+		buf := make([]byte, q.GetMTU())
+		for {
+			if _, _, err := q.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}, "drain")
+
+	next := func() *secureSession {
+		lb.Lock()
+		defer lb.Unlock()
+		return lb.peers[addrKey(nil)].next
+	}
+	sendInit := func() {
+		eph, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		lb.onHello(makeHello(ka, nil, secureHelloInit, eph.PublicKey().Bytes(), nil), nil)
+	}
+	sendInit()
+	s := next()
+	if s == nil {
+		t.Fatalf("no session started")
+	}
+	sendInit()
+	if next() != s {
+		t.Errorf("forged init replaced a pending session")
+	}
+	lb.Lock()
+	s.started -= secureNextHold
+	lb.Unlock()
+	sendInit()
+	if next() == s {
+		t.Errorf("init did not replace a session pending for secureNextHold")
+	}
+	lb.Close()
+	q.Close()
+}
+
+// TestSecureShortBuffer checks that a packet that does not fit in the buffer of ReadFrom is
+// dropped, and later packets still arrive
+func TestSecureShortBuffer(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	kb, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, q := NewChanPipe()
+	la := NewSecureLink(env, NoLogging, p, ka, []*ecdh.PublicKey{kb.PublicKey()})
+	lb := NewSecureLink(env, NoLogging, q, kb, []*ecdh.PublicKey{ka.PublicKey()})
+	ra := readSecureLink(env, la)
+	rb := make(chan string, 10)
+	env.Go(func() {
+		buf := make([]byte, 4)
+		for {
+			n, _, err := lb.ReadFrom(buf)
+			if err != nil {
+				close(rb)
+				return
+			}
+			rb <- string(buf[:n])
+		}
+	}, "short reader")
+
+	la.WriteTo([]byte("too long"), nil)
+	la.WriteTo([]byte("ok"), nil)
+	if s := <-rb; s != "ok" {
+		t.Errorf("expecting ok, got %q", s)
+	}
+	la.Close()
+	lb.Close()
+	<-ra
+	<-rb
+}
+
+// TestSecurePeerBound checks that the number of peers is bounded, and that peers without an
+// established session are evicted first
+func TestSecurePeerBound(t *testing.T) {
+	env := NewEnv(nil)
+	ka, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	p, _ := NewChanPipe()
+	l := NewSecureLink(env, NoLogging, p, ka, nil)
+	l.Lock()
+	established := &net.UDPAddr{Port: 1}
+	l.getPeer(established).cur = &secureSession{}
+	for i := 2; i < 2*secureMaxPeers; i++ {
+		l.getPeer(&net.UDPAddr{Port: i})
+	}
+	if len(l.peers) != secureMaxPeers {
+		t.Errorf("%d peers, expecting %d", len(l.peers), secureMaxPeers)
+	}
+	if _, ok := l.peers[addrKey(established)]; !ok {
+		t.Errorf("established peer evicted")
+	}
+	l.Unlock()
+	l.Close()
+}
+
+func TestSecureReplayWindow(t *testing.T) {
+	var s secureSession
+	for _, c := range []struct {
+		seqno uint64
+		ok    bool
+	}{
+		{0, false}, {1, true}, {3, true}, {2, true}, {3, false}, {100, true},
+		{37, true}, {37, false}, {36, false}, {200, true}, {100, false},
+	} {
+		if ok := s.checkReplay(c.seqno); ok != c.ok {
+			t.Errorf("seqno %d: expecting %v, got %v", c.seqno, c.ok, ok)
+		}
+	}
+}
@@ -7,7 +7,6 @@ package dccp
 import (
 	"bytes"
 	"fmt"
-	"math/rand"
 )
 
 // socket is a data structure, maintaining the DCCP socket variables.
@@ -145,9 +144,9 @@ func (s *socket) SetState(v int) { s.State = v }
 func (s *socket) SetServiceCode(v uint32) { s.ServiceCode = v }
 func (s *socket) GetServiceCode() uint32  { return s.ServiceCode }
 
-// ChooseISS chooses a safe Initial Sequence Number
-func (s *socket) ChooseISS() int64 {
-	iss := rand.Int63n(0xffffff-1) + 1
+// ChooseISS chooses a safe Initial Sequence Number, using the random source of env
+func (s *socket) ChooseISS(env *Env) int64 {
+	iss := env.Int63n(0xffffff-1) + 1
 	s.ISS = iss
 	return iss
 }
@@ -133,16 +133,19 @@ func (c *Conn) step7_CheckUnexpectedTypes(h *Header) error {
 func (c *Conn) step8_OptionsAndMarkAckbl(h *Header) error {
 
 	defer c.syncWithCongestionControl()
+	c.ackVector.OnRead(h.SeqNo)
+	c.ackVectorFeat.OnRead(h, c.socket.IsServer())
 	now := c.env.Now()
 	rsopts := filterCCIDReceiverToSenderOptions(h.Options)
-	if err := c.scc.OnRead(&FeedbackHeader{
+	fb := &FeedbackHeader{
 		Type:    h.Type, 
 		X:       h.X, 
 		SeqNo:   h.SeqNo, 
 		Options: rsopts, 
 		AckNo:   h.AckNo, 
 		Time:    now,
-	}); err != nil {
+	}
+	if err := c.scc.OnRead(fb); err != nil {
 		if re, ok := err.(CongestionReset); ok {
 			c.reset(re.ResetCode(), ErrAbort)
 			return ErrDrop
@@ -156,6 +159,9 @@ func (c *Conn) step8_OptionsAndMarkAckbl(h *Header) error {
 			c.amb.E(EventError, fmt.Sprintf("S·CC read error (%s)", err), h)
 		}
 	}
+	lr, _ := c.scc.(LossReporter)
+	awl, _ := c.socket.GetAWLH()
+	c.delivery.OnRead(fb, lr, awl)
 	sropts := filterCCIDSenderToReceiverOptions(h.Options)
 	if err := c.rcc.OnRead(&FeedforwardHeader{
 		Type:    h.Type, 
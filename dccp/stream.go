@@ -0,0 +1,396 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StreamMux multiplexes independent message streams over a single SegmentConn, typically a
+// congestion-controlled Conn. Every block on the wire is preceded by a small framing header
+// carrying the stream ID. Outgoing messages are sent in order of stream priority, and
+// incoming messages are sorted into per-stream read queues, so that a stream whose reader
+// is slow does not hold up the others.
+//
+// Both endpoints must open the streams they intend to use. Messages that arrive for a stream
+// that has not been opened locally are dropped.
+type StreamMux struct {
+	env *Env
+	amb *Amb
+	sc  SegmentConn
+
+	Mutex                      // Protects the fields below
+	streams map[uint16]*Stream // Open streams hashed by ID
+	order   []*Stream          // Open streams in decreasing order of priority
+	next    map[int]int        // Round-robin position within each group of equal priority
+	err     error              // Reason for StreamMux tear down
+	closed  bool               // Set once Close has closed the underlying connection
+
+	ready chan int // Signals writeLoop that a new message is queued
+	done  chan int // Closed when the StreamMux is torn down
+}
+
+// StreamConfig specifies the delivery policy of a stream
+type StreamConfig struct {
+
+	// Priority determines the order in which messages of different streams are sent.
+	// Streams with higher priority are served first. Streams of equal priority are served
+	// in round-robin fashion.
+	Priority int
+
+	// ReadQueueLen is the number of received messages that can wait for the reader of the
+	// stream. If zero, DefaultStreamReadQueueLen is used.
+	ReadQueueLen int
+
+	// DropOldest selects the policy when the read queue is full. If true, the oldest queued
+	// message is dropped to make room (useful for media, where only recent data is relevant).
+	// Otherwise, the newly arrived message is dropped.
+	DropOldest bool
+}
+
+const (
+	DefaultStreamReadQueueLen = 16
+	streamWriteQueueLen       = 8
+	streamFootprint           = 2 // The framing header is a 16-bit stream ID
+)
+
+// Stream is a single message stream of a StreamMux. It implements SegmentConn.
+type Stream struct {
+	m     *StreamMux
+	id    uint16
+	cfg   StreamConfig
+	write chan []byte // Queue of messages waiting for writeLoop
+	read  chan []byte // Queue of received messages waiting for Read
+	done  chan int    // Closed when the stream is closed or the StreamMux is torn down
+
+	Mutex              // Protects the fields below
+	dropped      int64 // Number of received messages dropped due to a full read queue
+	readDeadline int64 // Time after which blocked calls to Read return ErrTimeout
+	closed       bool
+	ended        bool  // Set once done is closed
+}
+
+// NewStreamMux creates a StreamMux on top of sc and starts its read and write loops
+func NewStreamMux(env *Env, amb *Amb, sc SegmentConn) *StreamMux {
+	m := &StreamMux{
+		env:     env,
+		amb:     amb.Refine("stream"),
+		sc:      sc,
+		streams: make(map[uint16]*Stream),
+		next:    make(map[int]int),
+		ready:   make(chan int, 1),
+		done:    make(chan int),
+	}
+	env.Go(func() { m.readLoop() }, "StreamMux·readLoop")
+	env.Go(func() { m.writeLoop() }, "StreamMux·writeLoop")
+	return m
+}
+
+// Open creates a new stream with the given ID and delivery policy
+func (m *StreamMux) Open(id uint16, cfg StreamConfig) (*Stream, error) {
+	if cfg.ReadQueueLen <= 0 {
+		cfg.ReadQueueLen = DefaultStreamReadQueueLen
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if _, ok := m.streams[id]; ok {
+		return nil, ErrInvalid
+	}
+	s := &Stream{
+		m:            m,
+		id:           id,
+		cfg:          cfg,
+		write:        make(chan []byte, streamWriteQueueLen),
+		read:         make(chan []byte, cfg.ReadQueueLen),
+		done:         make(chan int),
+		readDeadline: m.env.Now() - 1e9, // time in the past
+	}
+	m.streams[id] = s
+	m.order = append(m.order, s)
+	sort.Stable(streamsByPriority(m.order))
+	return s, nil
+}
+
+type streamsByPriority []*Stream
+
+func (t streamsByPriority) Len() int           { return len(t) }
+func (t streamsByPriority) Less(i, j int) bool { return t[i].cfg.Priority > t[j].cfg.Priority }
+func (t streamsByPriority) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// Close closes all streams as well as the underlying SegmentConn. If the StreamMux was
+// already torn down, because the underlying SegmentConn failed, Close returns the error that
+// tore it down.
+func (m *StreamMux) Close() error {
+	tore := m.teardown(ErrEOF)
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return ErrBad
+	}
+	m.closed = true
+	err := m.err
+	m.Unlock()
+	// The underlying connection is closed even if the read loop tore the StreamMux down
+	// first, in which case Close reports the reason for the tear down
+	cerr := m.sc.Close()
+	if !tore {
+		return err
+	}
+	return cerr
+}
+
+// teardown records err as the reason for closure and releases all blocked readers and
+// writers. It returns false if the StreamMux was already torn down.
+func (m *StreamMux) teardown(err error) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return false
+	}
+	m.err = err
+	close(m.done)
+	for _, s := range m.order {
+		s.end()
+	}
+	return true
+}
+
+func (m *StreamMux) getErr() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.err
+}
+
+func (m *StreamMux) readLoop() {
+	for {
+		p, err := m.sc.Read()
+		if err != nil {
+			m.teardown(err)
+			break
+		}
+		if len(p) < streamFootprint {
+			m.amb.E(EventDrop, "Short stream frame")
+			continue
+		}
+		id := DecodeUint16(p[0:2])
+		m.Lock()
+		s := m.streams[id]
+		m.Unlock()
+		if s == nil {
+			m.amb.E(EventDrop, fmt.Sprintf("Unknown stream %d", id))
+			continue
+		}
+		s.deliver(p[streamFootprint:])
+	}
+	m.amb.E(EventInfo, "Stream read loop EXIT")
+}
+
+// pick returns the next queued message in order of priority, or nil if there is none
+func (m *StreamMux) pick() (s *Stream, p []byte) {
+	m.Lock()
+	defer m.Unlock()
+	n := len(m.order)
+	for i := 0; i < n; {
+		// Find the group of streams with equal priority, starting at i
+		j := i + 1
+		for j < n && m.order[j].cfg.Priority == m.order[i].cfg.Priority {
+			j++
+		}
+		// Serve the group in round-robin order
+		prio, next := m.order[i].cfg.Priority, m.next[m.order[i].cfg.Priority]
+		for k := 0; k < j-i; k++ {
+			s = m.order[i+(next+k)%(j-i)]
+			select {
+			case p = <-s.write:
+				m.next[prio] = (next + k + 1) % (j - i)
+				return s, p
+			default:
+			}
+		}
+		i = j
+	}
+	return nil, nil
+}
+
+func (m *StreamMux) writeLoop() {
+	for {
+		s, p := m.pick()
+		if s == nil {
+			if i, _, _, _ := Select(m.env, -1, m.ready, m.done); i == 0 {
+				continue
+			}
+			break
+		}
+		frame := make([]byte, streamFootprint+len(p))
+		EncodeUint16(s.id, frame[0:2])
+		copy(frame[streamFootprint:], p)
+		if err := m.sc.Write(frame); err != nil {
+			m.teardown(err)
+			break
+		}
+	}
+	m.amb.E(EventInfo, "Stream write loop EXIT")
+}
+
+// end releases the readers and writers blocked on the stream
+func (s *Stream) end() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.ended {
+		s.ended = true
+		close(s.done)
+	}
+}
+
+// getErr returns the error that blocked calls on the stream return, once it is closed or
+// its StreamMux is torn down
+func (s *Stream) getErr() error {
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	if closed {
+		return ErrBad
+	}
+	return s.m.getErr()
+}
+
+// ID returns the ID of the stream
+func (s *Stream) ID() uint16 { return s.id }
+
+// Dropped returns the number of received messages that were dropped, because the reader
+// of the stream did not keep up
+func (s *Stream) Dropped() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.dropped
+}
+
+func (s *Stream) deliver(p []byte) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	if len(s.read) == cap(s.read) {
+		s.dropped++
+		if !s.cfg.DropOldest {
+			s.m.amb.E(EventDrop, fmt.Sprintf("Slow reader on stream %d", s.id))
+			return
+		}
+		select {
+		case <-s.read:
+			s.m.amb.E(EventDrop, fmt.Sprintf("Oldest message dropped on stream %d", s.id))
+		default:
+		}
+	}
+	// Only readLoop sends on the read queue, so there is room
+	s.read <- p
+}
+
+// GetMTU implements SegmentConn.GetMTU
+func (s *Stream) GetMTU() int {
+	return s.m.sc.GetMTU() - streamFootprint
+}
+
+// Write implements SegmentConn.Write. It blocks while the write queue of the stream is full,
+// until the stream is closed or the StreamMux is torn down.
+func (s *Stream) Write(block []byte) error {
+	if len(block) > s.GetMTU() {
+		return ErrTooBig
+	}
+	s.Lock()
+	closed := s.closed
+	s.Unlock()
+	if closed {
+		return ErrBad
+	}
+	if !Send(s.m.env, s.write, block, s.done) {
+		return s.getErr()
+	}
+	select {
+	case s.m.ready <- 1:
+	default:
+	}
+	return nil
+}
+
+// Read implements SegmentConn.Read. Messages that were received before the StreamMux was
+// torn down are still returned, after which Read returns the reason for the tear down.
+func (s *Stream) Read() (block []byte, err error) {
+	s.Lock()
+	closed := s.closed
+	readDeadline := s.readDeadline
+	s.Unlock()
+	if closed {
+		return nil, ErrBad
+	}
+
+	// A read deadline in the past means that reads do not time out
+	readTimeout := readDeadline - s.m.env.Now()
+	if readTimeout <= 0 {
+		readTimeout = -1
+	}
+	// Queued messages take precedence over the tear down
+	select {
+	case p := <-s.read:
+		return p, nil
+	default:
+	}
+	switch i, p, _, _ := Select(s.m.env, readTimeout, s.read, s.done); i {
+	case 0:
+		return p, nil
+	case -1:
+		return nil, ErrTimeout
+	}
+	return nil, s.getErr()
+}
+
+// LocalLabel implements SegmentConn.LocalLabel
+func (s *Stream) LocalLabel() Bytes { return s.m.sc.LocalLabel() }
+
+// RemoteLabel implements SegmentConn.RemoteLabel
+func (s *Stream) RemoteLabel() Bytes { return s.m.sc.RemoteLabel() }
+
+// SetReadExpire implements SegmentConn.SetReadExpire. The expiration applies to this stream
+// only, and does not affect the underlying SegmentConn.
+func (s *Stream) SetReadExpire(nsec int64) error {
+	if nsec < 0 {
+		return ErrInvalid
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.readDeadline = s.m.env.Now() + nsec
+	return nil
+}
+
+// Close implements SegmentConn.Close. It removes the stream from its StreamMux, without
+// affecting other streams. Blocked calls to Read and Write return ErrBad.
+func (s *Stream) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return ErrBad
+	}
+	s.closed = true
+	s.Unlock()
+	s.end()
+
+	m := s.m
+	m.Lock()
+	defer m.Unlock()
+	delete(m.streams, s.id)
+	for i, t := range m.order {
+		if t == s {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	delete(m.next, s.cfg.Priority)
+	return nil
+}
@@ -0,0 +1,274 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"testing"
+	"time"
+)
+
+// loopbackConn is a SegmentConn that reads back whatever is written to it
+type loopbackConn struct {
+	ch chan []byte
+}
+
+func (x *loopbackConn) GetMTU() int                    { return 1000 }
+func (x *loopbackConn) Write(block []byte) error       { x.ch <- block; return nil }
+func (x *loopbackConn) LocalLabel() Bytes              { return &LabelZero }
+func (x *loopbackConn) RemoteLabel() Bytes             { return &LabelZero }
+func (x *loopbackConn) SetReadExpire(nsec int64) error { return nil }
+func (x *loopbackConn) Close() error                   { close(x.ch); return nil }
+
+func (x *loopbackConn) Read() ([]byte, error) {
+	p, ok := <-x.ch
+	if !ok {
+		return nil, ErrEOF
+	}
+	return p, nil
+}
+
+func TestStreamMux(t *testing.T) {
+	env := NewEnv(nil)
+	m := NewStreamMux(env, NoLogging, &loopbackConn{make(chan []byte, 100)})
+	control, err := m.Open(1, StreamConfig{})
+	if err != nil {
+		t.Fatalf("open control (%s)", err)
+	}
+	video, err := m.Open(2, StreamConfig{Priority: 1, ReadQueueLen: 1, DropOldest: true})
+	if err != nil {
+		t.Fatalf("open video (%s)", err)
+	}
+	if _, err = m.Open(2, StreamConfig{}); err != ErrInvalid {
+		t.Errorf("expecting ErrInvalid on duplicate stream, got %v", err)
+	}
+
+	// The video stream has higher priority, so all frames are sent ahead of the control message
+	for i := byte(1); i <= 3; i++ {
+		if err := video.Write([]byte{i}); err != nil {
+			t.Fatalf("video write (%s)", err)
+		}
+	}
+	if err := control.Write([]byte{9}); err != nil {
+		t.Fatalf("control write (%s)", err)
+	}
+	if p, err := control.Read(); err != nil || len(p) != 1 || p[0] != 9 {
+		t.Fatalf("control read %v (%v)", p, err)
+	}
+
+	// Only the most recent frame is left in the video read queue
+	if p, err := video.Read(); err != nil || len(p) != 1 || p[0] != 3 {
+		t.Errorf("video read %v (%v)", p, err)
+	}
+	if video.Dropped() != 2 {
+		t.Errorf("expecting 2 dropped video frames, got %d", video.Dropped())
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("close (%s)", err)
+	}
+	if _, err := control.Read(); err != ErrEOF {
+		t.Errorf("expecting ErrEOF after close, got %v", err)
+	}
+	env.Joiner().Join()
+}
+
+// gatedConn is a SegmentConn whose Write blocks until the test releases it
+type gatedConn struct {
+	sent   chan []byte
+	gate   chan int
+	closed chan int
+}
+
+func (x *gatedConn) GetMTU() int                    { return 1000 }
+func (x *gatedConn) LocalLabel() Bytes              { return &LabelZero }
+func (x *gatedConn) RemoteLabel() Bytes             { return &LabelZero }
+func (x *gatedConn) SetReadExpire(nsec int64) error { return nil }
+func (x *gatedConn) Close() error                   { close(x.closed); return nil }
+
+func (x *gatedConn) Write(block []byte) error {
+	x.sent <- block
+	<-x.gate
+	return nil
+}
+
+func (x *gatedConn) Read() ([]byte, error) {
+	<-x.closed
+	return nil, ErrEOF
+}
+
+func TestStreamMuxPriority(t *testing.T) {
+	env := NewEnv(nil)
+	g := &gatedConn{make(chan []byte), make(chan int), make(chan int)}
+	m := NewStreamMux(env, NoLogging, g)
+	open := func(id uint16, priority int) *Stream {
+		s, err := m.Open(id, StreamConfig{Priority: priority})
+		if err != nil {
+			t.Fatalf("open %d (%s)", id, err)
+		}
+		return s
+	}
+	low, eqA, eqB, high := open(1, 0), open(2, 1), open(3, 1), open(4, 2)
+	write := func(s *Stream, b byte) {
+		if err := s.Write([]byte{b}); err != nil {
+			t.Fatalf("write %d (%s)", b, err)
+		}
+	}
+
+	// The write loop blocks on the first message, while the others are queued
+	write(low, 'x')
+	<-g.sent
+	write(low, 'l')
+	write(eqA, 'a')
+	write(eqA, 'A')
+	write(eqB, 'b')
+	write(eqB, 'B')
+	write(high, 'h')
+
+	// Higher priority goes first, and streams of equal priority take turns
+	var order []byte
+	for i := 0; i < 6; i++ {
+		g.gate <- 1
+		p := <-g.sent
+		order = append(order, p[streamFootprint])
+	}
+	if string(order) != "habABl" {
+		t.Errorf("sent in order %q, expecting %q", order, "habABl")
+	}
+	close(g.gate)
+	m.Close()
+	env.Joiner().Join()
+}
+
+// TestStreamCloseWrite checks that closing a stream releases a writer blocked on its full
+// write queue, while other streams keep working
+func TestStreamCloseWrite(t *testing.T) {
+	env := NewEnv(nil)
+	g := &gatedConn{make(chan []byte), make(chan int), make(chan int)}
+	m := NewStreamMux(env, NoLogging, g)
+	s, _ := m.Open(1, StreamConfig{})
+	other, _ := m.Open(2, StreamConfig{})
+
+	// The write loop blocks on the first message, and the next ones fill the write queue
+	s.Write([]byte{0})
+	<-g.sent
+	for i := 0; i < streamWriteQueueLen; i++ {
+		if err := s.Write([]byte{1}); err != nil {
+			t.Fatalf("write (%s)", err)
+		}
+	}
+	errc := make(chan error)
+	go func() { errc <- s.Write([]byte{2}) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("write to a full queue returned %v", err)
+	case <-time.After(50e6):
+	}
+
+	s.Close()
+	select {
+	case err := <-errc:
+		if err != ErrBad {
+			t.Errorf("expecting ErrBad from the blocked write, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked write not released by close")
+	}
+	if err := other.Write([]byte{3}); err != nil {
+		t.Errorf("write to other stream (%s)", err)
+	}
+	close(g.gate)
+	for {
+		if p := <-g.sent; p[streamFootprint] == 3 {
+			break
+		}
+	}
+	m.Close()
+	env.Joiner().Join()
+}
+
+func TestStreamReadExpire(t *testing.T) {
+	env := NewEnv(nil)
+	m := NewStreamMux(env, NoLogging, &loopbackConn{make(chan []byte, 100)})
+	s, err := m.Open(1, StreamConfig{})
+	if err != nil {
+		t.Fatalf("open (%s)", err)
+	}
+	if err = s.SetReadExpire(-1); err != ErrInvalid {
+		t.Errorf("expecting ErrInvalid on negative expiration, got %v", err)
+	}
+	s.SetReadExpire(50e6)
+	if _, err = s.Read(); err != ErrTimeout {
+		t.Errorf("expecting ErrTimeout, got %v", err)
+	}
+	s.Write([]byte{1})
+	if p, err := s.Read(); err != nil || len(p) != 1 {
+		t.Errorf("read %v (%v)", p, err)
+	}
+	m.Close()
+	env.Joiner().Join()
+}
+
+// TestStreamReadAfterTeardown checks that messages received before a tear down are read
+// before the tear down is reported
+func TestStreamReadAfterTeardown(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		env := NewEnv(nil)
+		m := NewStreamMux(env, NoLogging, &loopbackConn{make(chan []byte, 100)})
+		s, _ := m.Open(1, StreamConfig{})
+		s.Write([]byte{1})
+		for len(s.read) == 0 {
+			time.Sleep(1e6)
+		}
+		m.teardown(ErrIO)
+		if p, err := s.Read(); err != nil || len(p) != 1 {
+			t.Fatalf("read %v (%v), expecting the queued message", p, err)
+		}
+		if _, err := s.Read(); err != ErrIO {
+			t.Fatalf("expecting ErrIO, got %v", err)
+		}
+		m.Close()
+		env.Joiner().Join()
+	}
+}
+
+// brokenConn is a SegmentConn whose reads fail once fail is closed, as when the other side
+// aborts
+type brokenConn struct {
+	fail   chan int
+	closed int
+}
+
+func (x *brokenConn) GetMTU() int                    { return 1000 }
+func (x *brokenConn) Read() ([]byte, error)          { <-x.fail; return nil, ErrIO }
+func (x *brokenConn) Write(block []byte) error       { return ErrIO }
+func (x *brokenConn) LocalLabel() Bytes              { return &LabelZero }
+func (x *brokenConn) RemoteLabel() Bytes             { return &LabelZero }
+func (x *brokenConn) SetReadExpire(nsec int64) error { return nil }
+func (x *brokenConn) Close() error                   { x.closed++; return nil }
+
+// TestStreamMuxCloseAfterTeardown checks that Close closes the underlying connection once,
+// even after the read loop has torn the StreamMux down
+func TestStreamMuxCloseAfterTeardown(t *testing.T) {
+	env := NewEnv(nil)
+	b := &brokenConn{fail: make(chan int)}
+	m := NewStreamMux(env, NoLogging, b)
+	s, err := m.Open(1, StreamConfig{})
+	if err != nil {
+		t.Fatalf("open (%s)", err)
+	}
+	close(b.fail)
+	if _, err := s.Read(); err != ErrIO {
+		t.Fatalf("expecting ErrIO, got %v", err)
+	}
+	if err := m.Close(); err != ErrIO {
+		t.Errorf("expecting the tear down error ErrIO, got %v", err)
+	}
+	if err := m.Close(); err != ErrBad {
+		t.Errorf("expecting ErrBad on second close, got %v", err)
+	}
+	if b.closed != 1 {
+		t.Errorf("underlying connection closed %d times", b.closed)
+	}
+}
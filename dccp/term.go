@@ -55,10 +55,21 @@ func (c *Conn) teardownUser() {
 	c.readAppLk.Unlock()
 	c.writeDataLk.Lock()
 	if c.writeData != nil {
-		close(c.writeData)
+		// writeData is not closed, since Write may be sending on it. Rather, writeDone
+		// releases Write, and a nil header wakes writeLoop to notice.
+		close(c.writeDone)
 		c.writeData = nil
 	}
 	c.writeDataLk.Unlock()
+	c.writeNonDataLk.Lock()
+	if c.writeNonData != nil {
+		select {
+		case c.writeNonData <- nil:
+		default:
+		}
+	}
+	c.writeNonDataLk.Unlock()
+	c.delivery.Close()
 }
 
 // teardownWriteLoop MUST be idempotent. It may be called with or without lock on c.
@@ -12,30 +12,73 @@ import (
 // allowed on a Data or DataAck packet. See isOptionValidForType.
 const maxDataOptionSize = 24
 
+// maxAckVectorOptionSize is the size of the Ack Vectors placed on DataAck packets, once the
+// Send Ack Vector feature is negotiated
+const maxAckVectorOptionSize = 2 + ackVectorMaxCells
+
 // GetMTU() returns the maximum size of an application-level data block that can be passed
 // to Write This is an informative number. Packets are sent anyway, but they may be
-// dropped by the link layer or a router.
+// dropped by the link layer or a router. The MTU shrinks to make room for Ack Vectors when
+// the other side asks for them during the handshake.
 func (c *Conn) GetMTU() int {
 	c.Lock()
 	defer c.Unlock()
 	c.syncWithLink()
-	return int(c.socket.GetMPS()) - maxDataOptionSize - getFixedHeaderSize(DataAck, true)
+	mtu := int(c.socket.GetMPS()) - maxDataOptionSize - getFixedHeaderSize(DataAck, true)
+	if c.ackVectorFeat.Enabled() {
+		mtu -= maxAckVectorOptionSize
+	}
+	return mtu
 }
 
 // Write blocks until the slice b is sent.
 func (c *Conn) Write(data []byte) error {
+	return c.writeApp(&appData{Data: data})
+}
 
-	//?
+// WriteTracked behaves like Write, but it also returns an ID for the message. When the
+// packet carrying the message is acknowledged or deemed lost by the other side, or when
+// its fate can no longer be learned, a Delivery report with the same ID is returned by
+// ReadDelivery.
+func (c *Conn) WriteTracked(data []byte) (id int64, err error) {
+	c.Lock()
+	id = c.delivery.ChooseID()
+	c.Unlock()
+	return id, c.writeApp(&appData{Data: data, DeliveryID: id})
+}
 
+func (c *Conn) writeApp(ad *appData) error {
 	c.writeDataLk.Lock()
-	defer c.writeDataLk.Unlock()
-	if c.writeData == nil {
+	writeData := c.writeData
+	c.writeDataLk.Unlock()
+	if writeData == nil || !Send(c.env, writeData, ad, c.writeDone) {
 		return ErrBad
 	}
-	c.writeData <- data
 	return nil
 }
 
+// ReadDelivery blocks until the next delivery report for a message written with
+// WriteTracked is available. Reports that are not read promptly are dropped. Once the
+// connection is torn down and the remaining reports have been read, ReadDelivery returns
+// the error that Read returns.
+func (c *Conn) ReadDelivery() (Delivery, error) {
+	d, ok := c.delivery.Read()
+	if !ok {
+		return Delivery{}, c.Error()
+	}
+	return d, nil
+}
+
+// LossEventRateInv returns the inverse of the loss event rate, as last reported by the
+// receiver, if the sender congestion control implements LossEventRater. Otherwise, or if
+// no loss has been reported, it returns UnknownLossEventRateInv.
+func (c *Conn) LossEventRateInv() uint32 {
+	if ler, ok := c.scc.(LossEventRater); ok {
+		return ler.LossEventRateInv()
+	}
+	return UnknownLossEventRateInv
+}
+
 // Read blocks until the next packet of application data is received. Successfuly read data
 // is returned in a slice. The error returned by Read behaves according to io.Reader. If the
 // connection was never established or was aborted, Read returns ErrIO. If the connection
@@ -51,7 +94,7 @@ func (c *Conn) Read() (b []byte, err error) {
 		}
 		return nil, c.Error()
 	}
-	b, ok := <-readApp
+	b, ok := Recv(c.env, readApp)
 	if !ok {
 		if c.Error() == nil {
 			panic("torn connection missing error")
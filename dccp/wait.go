@@ -0,0 +1,235 @@
+// Copyright 2011 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package dccp
+
+import (
+	"reflect"
+	"time"
+)
+
+// The functions below perform the blocking channel operations of the goroutines of an Env.
+// In real time, they are plain channel operations. In an Env with a Runtime, the wait is
+// handed to the Runtime, which retries the operation without blocking until it succeeds
+// (see Runtime). Operations that do not block, such as a select with a default case or a
+// close, need no help from the Env and are written as usual.
+//
+// A send on an unbuffered channel cannot succeed without blocking unless a receiver is
+// blocked on the channel, which never happens in an Env with a Runtime. There, Send instead
+// offers the value to the Env, and Recv and Select take it from the Env. Consequently, an
+// unbuffered channel that is used with these functions must not be received from by other
+// means, such as a select with a default case. TryRecv is the way to receive from it
+// without waiting.
+
+// Recv receives a value from ch. ok is false if ch is closed and drained.
+func Recv[T any](env *Env, ch <-chan T) (v T, ok bool) {
+	if env == nil || env.rt == nil {
+		v, ok = <-ch
+		return v, ok
+	}
+	env.rt.Wait(func() bool {
+		if o, taken := env.takeOffer(ch); taken {
+			v, ok = o.(T), true
+			return true
+		}
+		select {
+		case v, ok = <-ch:
+			return true
+		default:
+		}
+		return false
+	}, -1)
+	return v, ok
+}
+
+// TryRecv receives a value from ch if one is ready, without waiting. received is false
+// otherwise. Unlike a select with a default case, TryRecv sees the values offered by Send.
+func TryRecv[T any](env *Env, ch <-chan T) (v T, ok, received bool) {
+	if env != nil && env.rt != nil {
+		if o, taken := env.takeOffer(ch); taken {
+			return o.(T), true, true
+		}
+	}
+	select {
+	case v, ok = <-ch:
+		return v, ok, true
+	default:
+	}
+	return v, false, false
+}
+
+// RecvTimeout is like Recv, but it gives up after timeout nanoseconds, in which case
+// expired is true. A negative timeout waits indefinitely.
+func RecvTimeout[T any](env *Env, ch <-chan T, timeout int64) (v T, ok, expired bool) {
+	i, v, _, ok := Select(env, timeout, ch, (<-chan int)(nil))
+	return v, ok, i < 0
+}
+
+// Select receives a value from whichever of a and b is ready first, like a select statement
+// with a receive case for each. A nil channel is never ready. Select returns 0 with the
+// value va, or 1 with the value vb, depending on the channel received from, or -1 if
+// timeout nanoseconds pass first. A negative timeout waits indefinitely. ok is false if the
+// channel is closed and drained.
+func Select[A, B any](env *Env, timeout int64, a <-chan A, b <-chan B) (i int, va A, vb B, ok bool) {
+	if env == nil || env.rt == nil {
+		var expire <-chan time.Time
+		if timeout >= 0 {
+			timer := time.NewTimer(time.Duration(timeout))
+			defer timer.Stop()
+			expire = timer.C
+		}
+		select {
+		case va, ok = <-a:
+			return 0, va, vb, ok
+		case vb, ok = <-b:
+			return 1, va, vb, ok
+		case <-expire:
+			return -1, va, vb, false
+		}
+	}
+	i = -1
+	env.rt.Wait(func() bool {
+		if o, taken := env.takeOffer(a); taken {
+			i, va, ok = 0, o.(A), true
+			return true
+		}
+		select {
+		case va, ok = <-a:
+			i = 0
+			return true
+		default:
+		}
+		if o, taken := env.takeOffer(b); taken {
+			i, vb, ok = 1, o.(B), true
+			return true
+		}
+		select {
+		case vb, ok = <-b:
+			i = 1
+			return true
+		default:
+		}
+		return false
+	}, timeout)
+	return i, va, vb, ok
+}
+
+// Send sends v on ch, unless done becomes ready first, in which case it returns false.
+func Send[T, D any](env *Env, ch chan<- T, v T, done <-chan D) bool {
+	if env == nil || env.rt == nil {
+		select {
+		case ch <- v:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	if cap(ch) == 0 {
+		o := env.makeOffer(ch, v)
+		var sent bool
+		env.rt.Wait(func() bool {
+			select {
+			case <-done:
+				sent = !env.withdrawOffer(ch, o)
+				return true
+			default:
+			}
+			sent = env.offerTaken(o)
+			return sent
+		}, -1)
+		return sent
+	}
+	var sent bool
+	env.rt.Wait(func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+		}
+		select {
+		case ch <- v:
+			sent = true
+			return true
+		default:
+		}
+		return false
+	}, -1)
+	return sent
+}
+
+// offer is a value sent by Send on an unbuffered channel in an Env with a Runtime
+type offer struct {
+	v     interface{}
+	taken bool
+}
+
+// chanKey identifies a channel regardless of its direction
+func chanKey(ch interface{}) uintptr {
+	return reflect.ValueOf(ch).Pointer()
+}
+
+// makeOffer queues v as the next value to be received from ch, after the values offered
+// earlier
+func (t *Env) makeOffer(ch interface{}, v interface{}) *offer {
+	t.offerLk.Lock()
+	defer t.offerLk.Unlock()
+	if t.offers == nil {
+		t.offers = make(map[uintptr][]*offer)
+	}
+	o := &offer{v: v}
+	k := chanKey(ch)
+	t.offers[k] = append(t.offers[k], o)
+	return o
+}
+
+// takeOffer receives the earliest value offered on ch, if any
+func (t *Env) takeOffer(ch interface{}) (interface{}, bool) {
+	t.offerLk.Lock()
+	defer t.offerLk.Unlock()
+	k := chanKey(ch)
+	q := t.offers[k]
+	if k == 0 || len(q) == 0 {
+		return nil, false
+	}
+	o := q[0]
+	q[0] = nil
+	if len(q) == 1 {
+		delete(t.offers, k)
+	} else {
+		t.offers[k] = q[1:]
+	}
+	o.taken = true
+	return o.v, true
+}
+
+// offerTaken reports whether o has been received
+func (t *Env) offerTaken(o *offer) bool {
+	t.offerLk.Lock()
+	defer t.offerLk.Unlock()
+	return o.taken
+}
+
+// withdrawOffer removes o from the offers of ch, unless it has been received. It reports
+// whether o was removed.
+func (t *Env) withdrawOffer(ch interface{}, o *offer) bool {
+	t.offerLk.Lock()
+	defer t.offerLk.Unlock()
+	if o.taken {
+		return false
+	}
+	k := chanKey(ch)
+	q := t.offers[k]
+	for i, p := range q {
+		if p == o {
+			q = append(q[:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(q) == 0 {
+		delete(t.offers, k)
+	} else {
+		t.offers[k] = q
+	}
+	return true
+}
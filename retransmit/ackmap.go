@@ -0,0 +1,60 @@
+// Copyright 2010 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package retransmit
+
+import "github.com/petar/GoDCCP/dccp"
+
+const maxAckMapRun = 128
+
+// encodeAckMap returns the run-length encoding of the bitmap am
+func encodeAckMap(am []byte) []byte {
+	var r []byte
+	nbits := 8 * len(am)
+	for i := 0; i < nbits; {
+		v := ackMapBit(am, i)
+		j := i + 1
+		for j < nbits && j-i < maxAckMapRun && ackMapBit(am, j) == v {
+			j++
+		}
+		b := byte(j - i - 1)
+		if v {
+			b |= 0x80
+		}
+		r = append(r, b)
+		i = j
+	}
+	return r
+}
+
+// decodeAckMap recovers a bitmap from its run-length encoding. Maps longer than the
+// retransmit window are rejected before the bitmap is allocated.
+func decodeAckMap(rle []byte) ([]byte, error) {
+	nbits := 0
+	for _, b := range rle {
+		nbits += int(b&0x7f) + 1
+		if nbits > RETRANSMIT_WIDTH {
+			return nil, dccp.ErrSize
+		}
+	}
+	if nbits%8 != 0 {
+		return nil, dccp.ErrSize
+	}
+	am := make([]byte, nbits/8)
+	k := 0
+	for _, b := range rle {
+		n := int(b&0x7f) + 1
+		if b&0x80 != 0 {
+			for i := k; i < k+n; i++ {
+				am[i/8] |= 1 << uint(i%8)
+			}
+		}
+		k += n
+	}
+	return am, nil
+}
+
+func ackMapBit(am []byte, i int) bool {
+	return am[i/8]&(1<<uint(i%8)) != 0
+}
@@ -5,73 +5,147 @@
 package retransmit
 
 import (
-	"io"
-	"os"
 	"github.com/petar/GoDCCP/dccp"
+	"io"
 )
 
-func NewRetransmit(bc dccp.BlockConn) io.ReadWriteCloser {
+// NewRetransmit creates a reliable, ordered byte stream on top of the lossy, message-based
+// connection sc (typically a dccp.Conn). Lost blocks are recovered using selective-repeat
+// retransmission within a window of RETRANSMIT_WIDTH blocks. Both endpoints of sc must use
+// NewRetransmit.
+func NewRetransmit(env *dccp.Env, amb *dccp.Amb, sc dccp.SegmentConn) io.ReadWriteCloser {
 	c := &conn{
-		bc:        bc,
-		readFirst: 0,
-		readWin:   make([][]byte, RETRANSMIT_WIDTH),
-		readChan:  make(chan []byte),
+		env:        env,
+		amb:        amb.Refine("retransmit"),
+		sc:         sc,
+		readWin:    make([][]byte, RETRANSMIT_WIDTH),
+		readReady:  make(chan int, 1),
+		writeWin:   make([]*outBlock, RETRANSMIT_WIDTH),
+		writeReady: make(chan int, 1),
+		syncTime:   make(map[uint16]int64),
+		done:       make(chan int),
 	}
-	go c.readLoop()
-	go c.writeLoop()
+	c.rtt.Init()
+	env.Go(func() { c.readLoop() }, "retransmit·readLoop")
+	env.Go(func() { c.timerLoop() }, "retransmit·timerLoop")
 	return c
 }
 
 type conn struct {
-	bc dccp.BlockConn
-
-	// Read fields
-	readLock dccp.Mutex
-	readTail []byte
-
-	// readLoop fields
-	readFirst uint32
-	readWin   [][]byte
-	readChan  chan []byte
-
-	// Write fields
-	writeLock  dccp.Mutex
-	writeFirst uint32
-	writeWin   [][]byte
-	writeChan  chan []byte
+	env *dccp.Env
+	amb *dccp.Amb
+	sc  dccp.SegmentConn
+
+	dccp.Mutex // Protects the fields below
+	err        error
+	closed     bool // Set once Close has closed sc
+
+	// Receiver state
+	readTail  []byte     // Rest of the block that Read is handing to the user
+	readFirst uint32     // DataNo of the next block to be queued for the user, in order
+	readWin   [][]byte   // Out-of-order blocks, indexed by DataNo modulo RETRANSMIT_WIDTH
+	readQueue [][]byte   // In-order blocks waiting to be read by the user
+	readReady chan int   // Signals Read that readQueue is not empty
+
+	// Sender state
+	writeFirst uint32           // DataNo of the oldest unacknowledged block
+	writeNext  uint32           // DataNo of the next block to be written
+	writeWin   []*outBlock      // Unacknowledged blocks, indexed by DataNo modulo RETRANSMIT_WIDTH
+	writeReady chan int         // Signals Write and Close that writeFirst has advanced
+	syncNo     uint16           // SyncNo of the last sync request sent
+	syncTime   map[uint16]int64 // Sync requests in flight mapped to their send times
+	rtt        rttEstimator
+
+	done chan int // Closed when the connection is torn down
 }
 
-const RETRANSMIT_WIDTH = 128 // The retransmit window width must be a multiple of 8
+// outBlock is a data block that has been sent but not acknowledged yet
+type outBlock struct {
+	cargo  []byte
+	sent   int64 // Time of the last (re)transmission
+	unsent bool  // True until the block is first handed to transmit
+	acked  bool
+}
 
-func (c *conn) Read(p []byte) (n int, err os.Error) {
-	c.readLock.Lock()
-	defer c.readLock.Unlock()
+const (
+	RETRANSMIT_WIDTH = 128 // The retransmit window width must be a multiple of 8
 
-	for len(p) > 0 {
-		// Read incoming data
-		if len(c.readTail) == 0 {
-			b, ok := <-c.readChan
-			if !ok {
-				return n, os.EOF
-			}
-			c.readTail = b
-		}
+	CloseTimeout = 10e9 // Time allowed for outstanding data to be acknowledged on Close, in ns
 
-		// Copy to user buffer
-		k := copy(p, c.readTail)
-		c.readTail = c.readTail[k:]
-		p = p[k:]
-		n += k
+	// maxHeaderOverhead is the footprint of a Data header with a Sync request
+	maxHeaderOverhead = 1 + 2 + 4 + 2
+)
+
+// seqDiff returns the circular difference x-y of two sequence numbers
+func seqDiff(x, y uint32) int32 { return int32(x - y) }
+
+// teardown records the reason for closure and releases blocked readers and writers.
+// It returns false if the connection was already torn down.
+func (c *conn) teardown(err error) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.err != nil {
+		return false
 	}
+	c.err = err
+	close(c.done)
+	return true
+}
 
-	return n, nil
+// Read implements io.Reader. It blocks until some data is available.
+func (c *conn) Read(p []byte) (n int, err error) {
+	for {
+		c.Lock()
+		if len(c.readTail) == 0 && len(c.readQueue) > 0 {
+			c.readTail = c.readQueue[0]
+			c.readQueue = c.readQueue[1:]
+			// Space in the queue opens the receive window for further blocks
+			c.advance()
+		}
+		if len(c.readTail) > 0 {
+			// Copy to user buffer
+			n = copy(p, c.readTail)
+			c.readTail = c.readTail[n:]
+			c.Unlock()
+			return n, nil
+		}
+		err := c.err
+		c.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		dccp.Select(c.env, -1, c.readReady, c.done)
+	}
 }
 
-func makeAckMap(win [][]byte, first uint32) []byte {
-	am := make([]byte, len(win) / 8)
-	for i, b := range win {
+// advance moves blocks that are now in order from the receive window to the read queue
+func (c *conn) advance() {
+	c.AssertLocked()
+	for len(c.readQueue) < RETRANSMIT_WIDTH {
+		i := c.readFirst % RETRANSMIT_WIDTH
+		b := c.readWin[i]
 		if b == nil {
-			am[i/8] |= (1 << uint(i % 8))
+			break
+		}
+		c.readWin[i] = nil
+		c.readQueue = append(c.readQueue, b)
+		c.readFirst++
+	}
+	if len(c.readQueue) > 0 {
+		select {
+		case c.readReady <- 1:
+		default:
+		}
+	}
+}
+
+// makeAckMap returns a bitmap of the blocks in the receive window that have not been received
+func (c *conn) makeAckMap() []byte {
+	c.AssertLocked()
+	am := make([]byte, RETRANSMIT_WIDTH/8)
+	for i := uint32(0); i < RETRANSMIT_WIDTH; i++ {
+		if c.readWin[(c.readFirst+i)%RETRANSMIT_WIDTH] == nil {
+			am[i/8] |= 1 << (i % 8)
 		}
 	}
 	return am
@@ -79,28 +153,255 @@ func makeAckMap(win [][]byte, first uint32) []byte {
 
 func (c *conn) readLoop() {
 	for {
-		b, err := c.bc.ReadBlock()
+		b, err := c.sc.Read()
 		if err != nil {
+			if err == dccp.ErrEOF {
+				err = io.EOF
+			}
+			c.teardown(err)
 			break
 		}
 		h, err := readHeader(b)
 		if err != nil {
+			c.amb.E(dccp.EventDrop, "Bad header")
+			continue
+		}
+		if h.Ack {
+			c.onAck(h)
+		}
+		if h.Data {
+			c.onData(h)
+		}
+		if h.Sync {
+			c.Lock()
+			ack := &header{
+				Ack:       true,
+				AckSyncNo: h.SyncNo,
+				AckDataNo: c.readFirst,
+				AckMap:    c.makeAckMap(),
+			}
+			c.Unlock()
+			c.send(ack)
+		}
+	}
+	c.amb.E(dccp.EventInfo, "Read loop EXIT")
+}
+
+func (c *conn) onData(h *header) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Accept only blocks that fit in the receive window, which shrinks as the read queue fills
+	d := seqDiff(h.DataNo, c.readFirst)
+	if d < 0 || int(d) >= RETRANSMIT_WIDTH-len(c.readQueue) {
+		return
+	}
+	i := h.DataNo % RETRANSMIT_WIDTH
+	if c.readWin[i] != nil {
+		return
+	}
+	// The header is parsed in place, so keep a copy of the cargo
+	b := make([]byte, len(h.DataCargo))
+	copy(b, h.DataCargo)
+	c.readWin[i] = b
+	c.advance()
+}
+
+func (c *conn) onAck(h *header) {
+	c.Lock()
+	defer c.Unlock()
+
+	// Sync numbers are unique to each transmission, so the round-trip sample is unambiguous
+	if t, ok := c.syncTime[h.AckSyncNo]; ok {
+		c.rtt.Sample(c.env.Now() - t)
+		delete(c.syncTime, h.AckSyncNo)
+	}
+
+	// All blocks before AckDataNo have been received
+	for no := c.writeFirst; seqDiff(no, c.writeNext) < 0 && seqDiff(no, h.AckDataNo) < 0; no++ {
+		if ob := c.writeWin[no%RETRANSMIT_WIDTH]; ob != nil {
+			ob.acked = true
+		}
+	}
+	// AckMap bits set to zero correspond to received blocks
+	for i := 0; i < 8*len(h.AckMap); i++ {
+		no := h.AckDataNo + uint32(i)
+		if seqDiff(no, c.writeFirst) < 0 || seqDiff(no, c.writeNext) >= 0 {
+			continue
+		}
+		if !ackMapBit(h.AckMap, i) {
+			if ob := c.writeWin[no%RETRANSMIT_WIDTH]; ob != nil {
+				ob.acked = true
+			}
+		}
+	}
+	// Slide the send window past acknowledged blocks
+	advanced := false
+	for c.writeFirst != c.writeNext {
+		i := c.writeFirst % RETRANSMIT_WIDTH
+		if !c.writeWin[i].acked {
 			break
 		}
+		c.writeWin[i] = nil
+		c.writeFirst++
+		advanced = true
+	}
+	if advanced {
+		select {
+		case c.writeReady <- 1:
+		default:
+		}
+	}
+}
+
+// Write implements io.Writer. It blocks while the send window is full.
+func (c *conn) Write(p []byte) (n int, err error) {
+	cargoLen := c.sc.GetMTU() - maxHeaderOverhead
+	if cargoLen <= 0 {
+		return 0, dccp.ErrTooBig
+	}
+	for len(p) > 0 {
+		k := len(p)
+		if k > cargoLen {
+			k = cargoLen
+		}
+		cargo := make([]byte, k)
+		copy(cargo, p[:k])
+
+		// Wait for space in the send window
+		c.Lock()
+		for c.err == nil && seqDiff(c.writeNext, c.writeFirst) >= RETRANSMIT_WIDTH {
+			c.Unlock()
+			dccp.Select(c.env, -1, c.writeReady, c.done)
+			c.Lock()
+		}
+		if c.err != nil {
+			err := c.err
+			c.Unlock()
+			return n, err
+		}
+		no := c.writeNext
+		c.writeNext++
+		// The timerLoop must not retransmit the block before it is first transmitted
+		c.writeWin[no%RETRANSMIT_WIDTH] = &outBlock{cargo: cargo, unsent: true}
+		c.Unlock()
+
+		if err := c.transmit(no); err != nil {
+			return n, err
+		}
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
 
-		?
+// transmit sends (or re-sends) the block with sequence number no, along with a sync request
+func (c *conn) transmit(no uint32) error {
+	c.Lock()
+	ob := c.writeWin[no%RETRANSMIT_WIDTH]
+	if ob == nil || ob.acked {
+		c.Unlock()
+		return nil
+	}
+	now := c.env.Now()
+	ob.sent = now
+	ob.unsent = false
+	c.syncNo++
+	c.syncTime[c.syncNo] = now
+	if len(c.syncTime) > 4*RETRANSMIT_WIDTH {
+		// Forget sync requests whose acknowledgements were lost
+		for s, t := range c.syncTime {
+			if now-t > c.rtt.RTO() {
+				delete(c.syncTime, s)
+			}
+		}
+	}
+	h := &header{
+		Sync:      true,
+		SyncNo:    c.syncNo,
+		Data:      true,
+		DataNo:    no,
+		DataCargo: ob.cargo,
 	}
-	??
+	c.Unlock()
+	return c.send(h)
 }
 
-func (c *conn) Write(p []byte) (n int, err os.Error) {
-	panic("")
+func (c *conn) send(h *header) error {
+	b, err := h.Write()
+	if err != nil {
+		panic("retransmit header write")
+	}
+	if err = c.sc.Write(b); err != nil {
+		c.teardown(err)
+	}
+	return err
 }
 
-func (c *conn) writeLoop() {
-	panic("")
+// timerLoop re-sends blocks that have not been acknowledged within the retransmission timeout
+func (c *conn) timerLoop() {
+	for {
+		c.Lock()
+		rto := c.rtt.RTO()
+		c.Unlock()
+		if _, _, expired := dccp.RecvTimeout(c.env, c.done, rto/4); !expired {
+			c.amb.E(dccp.EventInfo, "Timer loop EXIT")
+			return
+		}
+
+		var expired []uint32
+		c.Lock()
+		now := c.env.Now()
+		for no := c.writeFirst; no != c.writeNext; no++ {
+			ob := c.writeWin[no%RETRANSMIT_WIDTH]
+			if !ob.acked && !ob.unsent && now-ob.sent >= rto {
+				expired = append(expired, no)
+			}
+		}
+		if len(expired) > 0 {
+			c.rtt.Backoff()
+		}
+		c.Unlock()
+
+		for _, no := range expired {
+			c.amb.E(dccp.EventTurn, "Retransmit")
+			if c.transmit(no) != nil {
+				break
+			}
+		}
+	}
 }
 
-func (c *conn) Close() os.Error {
-	panic("")
+// Close waits until all written data has been acknowledged, or until CloseTimeout
+// expires, and then closes the underlying connection. If the connection was already torn
+// down, because the underlying connection failed or the other side closed it, Close returns
+// the error that tore it down.
+func (c *conn) Close() error {
+	deadline := c.env.Now() + CloseTimeout
+	for {
+		c.Lock()
+		drained := c.writeFirst == c.writeNext || c.err != nil
+		rtt := c.rtt.Min()
+		c.Unlock()
+		if drained || c.env.Now() >= deadline {
+			break
+		}
+		c.env.Sleep(rtt)
+	}
+	tore := c.teardown(dccp.ErrBad)
+	c.Lock()
+	if c.closed {
+		c.Unlock()
+		return dccp.ErrBad
+	}
+	c.closed = true
+	err := c.err
+	c.Unlock()
+	// The underlying connection is closed even if the read loop tore the connection down
+	// first, in which case Close reports the reason for the tear down
+	cerr := c.sc.Close()
+	if !tore {
+		return err
+	}
+	return cerr
 }
@@ -0,0 +1,156 @@
+// Copyright 2010 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package retransmit
+
+import (
+	"bytes"
+	"github.com/petar/GoDCCP/dccp"
+	"io"
+	"testing"
+)
+
+// lossyConn is one end of an in-memory SegmentConn pipe that drops every n-th packet written,
+// and delays every r-th packet past the next one
+type lossyConn struct {
+	in, out chan []byte
+	n, r, k int
+	held    []byte
+	dccp.Mutex
+	done chan int
+}
+
+func newLossyPipe(n int) (a, b *lossyConn) {
+	ab, ba := make(chan []byte, 4*RETRANSMIT_WIDTH), make(chan []byte, 4*RETRANSMIT_WIDTH)
+	a = &lossyConn{in: ba, out: ab, n: n, done: make(chan int)}
+	b = &lossyConn{in: ab, out: ba, n: n, done: make(chan int)}
+	return a, b
+}
+
+func (x *lossyConn) GetMTU() int                    { return 1000 }
+func (x *lossyConn) LocalLabel() dccp.Bytes         { return &dccp.LabelZero }
+func (x *lossyConn) RemoteLabel() dccp.Bytes        { return &dccp.LabelZero }
+func (x *lossyConn) SetReadExpire(nsec int64) error { return nil }
+
+func (x *lossyConn) Write(block []byte) error {
+	x.Lock()
+	defer x.Unlock()
+	x.k++
+	if x.n > 0 && x.k%x.n == 0 {
+		return nil
+	}
+	p := make([]byte, len(block))
+	copy(p, block)
+	if x.r > 0 && x.k%x.r == 0 && x.held == nil {
+		x.held = p
+		return nil
+	}
+	x.push(p)
+	if x.held != nil {
+		x.push(x.held)
+		x.held = nil
+	}
+	return nil
+}
+
+func (x *lossyConn) push(p []byte) {
+	select {
+	case x.out <- p:
+	default:
+	}
+}
+
+func (x *lossyConn) Read() ([]byte, error) {
+	select {
+	case p := <-x.in:
+		return p, nil
+	case <-x.done:
+	}
+	return nil, dccp.ErrEOF
+}
+
+func (x *lossyConn) Close() error {
+	close(x.done)
+	return nil
+}
+
+// testTransfer sends data from a to b through retransmit connections, and checks that it
+// arrives intact
+func testTransfer(t *testing.T, a, b *lossyConn) {
+	env := dccp.NewEnv(nil)
+	ca, cb := NewRetransmit(env, dccp.NoLogging, a), NewRetransmit(env, dccp.NoLogging, b)
+
+	want := make([]byte, 200000)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	env.Go(func() {
+		if _, err := ca.Write(want); err != nil {
+			t.Errorf("write (%s)", err)
+		}
+		ca.Close()
+	}, "writer")
+
+	have := make([]byte, len(want))
+	if _, err := io.ReadFull(cb, have); err != nil {
+		t.Fatalf("read (%s)", err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("received data differs from sent data")
+	}
+	cb.Close()
+}
+
+func TestLossyTransfer(t *testing.T) {
+	a, b := newLossyPipe(5)
+	testTransfer(t, a, b)
+}
+
+// TestReorderedTransfer delays some data blocks and some acknowledgements past later ones
+func TestReorderedTransfer(t *testing.T) {
+	a, b := newLossyPipe(0)
+	a.r, b.r = 3, 4
+	testTransfer(t, a, b)
+}
+
+// TestAckLossTransfer drops every other acknowledgement, but no data
+func TestAckLossTransfer(t *testing.T) {
+	a, b := newLossyPipe(0)
+	b.n = 2
+	testTransfer(t, a, b)
+}
+
+// eofConn is a SegmentConn whose reads end once eof is closed, as when the other side closes
+type eofConn struct {
+	eof    chan int
+	closed int
+}
+
+func (x *eofConn) GetMTU() int                    { return 1000 }
+func (x *eofConn) Read() ([]byte, error)          { <-x.eof; return nil, dccp.ErrEOF }
+func (x *eofConn) Write(block []byte) error       { return nil }
+func (x *eofConn) LocalLabel() dccp.Bytes         { return &dccp.LabelZero }
+func (x *eofConn) RemoteLabel() dccp.Bytes        { return &dccp.LabelZero }
+func (x *eofConn) SetReadExpire(nsec int64) error { return nil }
+func (x *eofConn) Close() error                   { x.closed++; return nil }
+
+// TestCloseAfterPeerClose checks that Close closes the underlying connection once, even
+// after the other side has closed it
+func TestCloseAfterPeerClose(t *testing.T) {
+	e := &eofConn{eof: make(chan int)}
+	c := NewRetransmit(dccp.NewEnv(nil), dccp.NoLogging, e)
+	close(e.eof)
+	if _, err := c.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("expecting EOF, got %v", err)
+	}
+	if err := c.Close(); err != io.EOF {
+		t.Errorf("expecting the tear down error EOF, got %v", err)
+	}
+	if err := c.Close(); err != dccp.ErrBad {
+		t.Errorf("expecting ErrBad on second close, got %v", err)
+	}
+	if e.closed != 1 {
+		t.Errorf("underlying connection closed %d times", e.closed)
+	}
+}
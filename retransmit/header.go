@@ -26,9 +26,9 @@ type header struct {
 	// than AckDataNo have already been received.
 	AckDataNo uint32
 
-	// AckMap is a bitmap where 1's correspond to blocks that HAVE NOT been received
-	// TODO: This can be made more space-efficient with something like run-length encoding
-	// or a Huffman-type (LZ?) thing that favors 0's
+	// AckMap is a bitmap where 1's correspond to blocks that HAVE NOT been received.
+	// Bit i (counting from the least significant bit of the first byte) pertains to the
+	// block with sequence number AckDataNo+i. On the wire, AckMap is run-length encoded.
 	AckMap []byte
 
 	// --> Data indicates if the header includes data, represented by DataNo and DataCargo
@@ -60,6 +60,16 @@ type header struct {
 //     | AckSyncNo 2bytes | AckDataNo 4bytes | AckMapLen 2bytes | ... AckMap ... |
 //     +------------------+------------------+------------------+----------------+
 //
+// AckMapLen is the length of the run-length encoded AckMap. Each byte of the encoding
+// describes a run of equal bits
+//
+//     MSB           LSB
+//     +-+-+-+-+-+-+-+-+
+//     |V| Run Len - 1 |
+//     +-+-+-+-+-+-+-+-+
+//
+// where V is the value of the bits in the run, and runs are between 1 and 128 bits long.
+//
 // Sync Subheader wire format
 //
 //     +----------------+
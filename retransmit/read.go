@@ -5,12 +5,11 @@
 package retransmit
 
 import (
-	"os"
 	"github.com/petar/GoDCCP/dccp"
 )
 
 // readHeader parses a header from its wire representation
-func readHeader(buf []byte) (h *header, err os.Error) {
+func readHeader(buf []byte) (h *header, err error) {
 
 	h = &header{}
 	k := 0
@@ -38,15 +37,15 @@ func readHeader(buf []byte) (h *header, err os.Error) {
 		}
 
 		// Read AckSyncNo
-		h.AckSyncNo = dccp.Decode2ByteUint(buf[k:k+2])
+		h.AckSyncNo = dccp.DecodeUint16(buf[k:k+2])
 		k += 2
 
 		// Read AckDataNo
-		h.AckDataNo = dccp.Decode4ByteUint(buf[k:k+4])
+		h.AckDataNo = dccp.DecodeUint32(buf[k:k+4])
 		k += 4
 
 		// Read AckMapLen
-		ackMapLen := dccp.Decode2ByteUint(buf[k:k+2])
+		ackMapLen := dccp.DecodeUint16(buf[k:k+2])
 		k += 2
 
 		if len(buf) - k < int(ackMapLen) {
@@ -54,7 +53,10 @@ func readHeader(buf []byte) (h *header, err os.Error) {
 		}
 
 		// Read AckMap
-		h.AckMap = buf[k:k+int(ackMapLen)]
+		h.AckMap, err = decodeAckMap(buf[k:k+int(ackMapLen)])
+		if err != nil {
+			return nil, err
+		}
 		k += int(ackMapLen)
 	}
 
@@ -65,7 +67,7 @@ func readHeader(buf []byte) (h *header, err os.Error) {
 		}
 
 		// Read SyncNo
-		h.SyncNo = dccp.Decode2ByteUint(buf[k:k+2])
+		h.SyncNo = dccp.DecodeUint16(buf[k:k+2])
 		k += 2
 	}
 
@@ -76,11 +78,11 @@ func readHeader(buf []byte) (h *header, err os.Error) {
 		}
 
 		// Read DataNo
-		h.DataNo = dccp.Decode4ByteUint(buf[k:k+4])
+		h.DataNo = dccp.DecodeUint32(buf[k:k+4])
 		k += 4
 
 		// Read DataLen
-		dataLen := dccp.Decode2ByteUint(buf[k:k+2])
+		dataLen := dccp.DecodeUint16(buf[k:k+2])
 		k += 2
 
 		if len(buf) - k < int(dataLen) {
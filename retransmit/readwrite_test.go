@@ -43,6 +43,21 @@ func TestReadWrite(t *testing.T) {
 	}
 }
 
+// TestAckMapBound checks that AckMaps longer than the retransmit window are rejected
+func TestAckMapBound(t *testing.T) {
+	am := make([]byte, RETRANSMIT_WIDTH/8)
+	am[3] = 0x10
+	if g, err := decodeAckMap(encodeAckMap(am)); err != nil || !bytes.Equal(g, am) {
+		t.Errorf("window-sized map decoded to %v (%v)", g, err)
+	}
+	if _, err := decodeAckMap([]byte{0x7f, 0x07}); err == nil {
+		t.Errorf("accepted a map of %d bits", RETRANSMIT_WIDTH+8)
+	}
+	if _, err := decodeAckMap(bytes.Repeat([]byte{0xff}, 0xffff)); err == nil {
+		t.Errorf("accepted a map of %d bits", 0xffff*0x80)
+	}
+}
+
 func dumpBytes(bb []byte) string {
 	var w bytes.Buffer
 	for _, b := range bb {
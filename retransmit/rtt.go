@@ -0,0 +1,63 @@
+// Copyright 2010 GoDCCP Authors. All rights reserved.
+// Use of this source code is governed by a 
+// license that can be found in the LICENSE file.
+
+package retransmit
+
+// rttEstimator maintains a smoothed round-trip time estimate and derives the retransmission
+// timeout from it, in the manner of RFC 2988. All times are in nanoseconds.
+type rttEstimator struct {
+	srtt   int64
+	rttvar int64
+	rto    int64
+}
+
+const (
+	rtoInit = 1e9  // Initial retransmission timeout, 1 sec
+	rtoMin  = 20e6 // Minimum retransmission timeout, 20 ms
+	rtoMax  = 10e9 // Maximum retransmission timeout, 10 sec
+)
+
+func (t *rttEstimator) Init() {
+	t.srtt, t.rttvar, t.rto = 0, 0, rtoInit
+}
+
+// Sample incorporates a new round-trip time measurement
+func (t *rttEstimator) Sample(rtt int64) {
+	if rtt < 0 {
+		return
+	}
+	if t.srtt == 0 {
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+	} else {
+		d := t.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		t.rttvar = (3*t.rttvar + d) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+	}
+	t.rto = clampRTO(t.srtt + 4*t.rttvar)
+}
+
+// Backoff doubles the retransmission timeout after a timeout has occurred
+func (t *rttEstimator) Backoff() {
+	t.rto = clampRTO(2 * t.rto)
+}
+
+// RTO returns the current retransmission timeout
+func (t *rttEstimator) RTO() int64 { return t.rto }
+
+// Min returns the smallest retransmission timeout that the estimator would produce
+func (t *rttEstimator) Min() int64 { return rtoMin }
+
+func clampRTO(rto int64) int64 {
+	if rto < rtoMin {
+		return rtoMin
+	}
+	if rto > rtoMax {
+		return rtoMax
+	}
+	return rto
+}
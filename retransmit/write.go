@@ -5,14 +5,13 @@
 package retransmit
 
 import (
-	"os"
 	"github.com/petar/GoDCCP/dccp"
 )
 
-func (h *header) getFootprintLen() int {
+func (h *header) getFootprintLen(ackMapLen int) int {
 	a := 0
 	if h.Ack {
-		a = 2 + 2 + 4 + len(h.AckMap)
+		a = 2 + 2 + 4 + ackMapLen
 	}
 	s := 0
 	if h.Sync {
@@ -32,8 +31,12 @@ const (
 )
 
 // Write returns the wire format represenatation of h
-func (h *header) Write() (buf []byte, err os.Error) {
-	buf = make([]byte, h.getFootprintLen())
+func (h *header) Write() (buf []byte, err error) {
+	var ackMap []byte
+	if h.Ack {
+		ackMap = encodeAckMap(h.AckMap)
+	}
+	buf = make([]byte, h.getFootprintLen(len(ackMap)))
 	k := 0
 
 	// Write type
@@ -53,43 +56,43 @@ func (h *header) Write() (buf []byte, err os.Error) {
 	// Write Ack section
 	if h.Ack {
 		// Write SyncAckNo
-		dccp.Encode2ByteUint(h.AckSyncNo, buf[k:k+2])
+		dccp.EncodeUint16(h.AckSyncNo, buf[k:k+2])
 		k += 2
 
 		// Write AckDataNo
-		dccp.Encode4ByteUint(h.AckDataNo, buf[k:k+4])
+		dccp.EncodeUint32(h.AckDataNo, buf[k:k+4])
 		k += 4
 
 		// Write AckMapLen
-		if !dccp.FitsIn2Bytes(uint64(len(h.AckMap))) {
+		if !dccp.FitsIn16Bits(uint64(len(ackMap))) {
 			return nil, dccp.ErrOverflow
 		}
-		dccp.Encode2ByteUint(uint16(len(h.AckMap)), buf[k:k+2])
+		dccp.EncodeUint16(uint16(len(ackMap)), buf[k:k+2])
 		k += 2
 
 		// Write AckMap
-		copy(buf[k:k+len(h.AckMap)], h.AckMap)
-		k += len(h.AckMap)
+		copy(buf[k:k+len(ackMap)], ackMap)
+		k += len(ackMap)
 	}
 
 	// Write Sync section
 	if h.Sync {
 		// Write SyncNo
-		dccp.Encode2ByteUint(h.SyncNo, buf[k:k+2])
+		dccp.EncodeUint16(h.SyncNo, buf[k:k+2])
 		k += 2
 	}
 
 	// Write Data section
 	if h.Data {
 		// Write DataNo
-		dccp.Encode4ByteUint(h.DataNo, buf[k:k+4])
+		dccp.EncodeUint32(h.DataNo, buf[k:k+4])
 		k += 4
 
 		// Write DataLen
-		if !dccp.FitsIn2Bytes(uint64(len(h.DataCargo))) {
+		if !dccp.FitsIn16Bits(uint64(len(h.DataCargo))) {
 			return nil, dccp.ErrSize
 		}
-		dccp.Encode2ByteUint(uint16(len(h.DataCargo)), buf[k:k+2])
+		dccp.EncodeUint16(uint16(len(h.DataCargo)), buf[k:k+2])
 		k += 2
 
 		// Write DataCargo